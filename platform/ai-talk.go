@@ -680,6 +680,23 @@ func (v *StageRequest) receiveInputFile(ctx context.Context, audioBase64Data str
 	return nil
 }
 
+// Use the file of resumable upload as input, move it to avoid copying. The owner is the room UUID if
+// authenticated by room token, so the room user is only allowed to use the upload of room.
+func (v *StageRequest) receiveUploadFile(ctx context.Context, uploadUUID, owner string) error {
+	target, err := QueryUploadTarget(ctx, uploadUUID, owner)
+	if err != nil {
+		return errors.Wrapf(err, "query upload %v", uploadUUID)
+	}
+
+	if err := os.Rename(target, v.inputFile); err != nil {
+		return errors.Wrapf(err, "rename %v to %v", target, v.inputFile)
+	}
+	logger.Tf(ctx, "File moved from %v to %v", target, v.inputFile)
+
+	v.lastUploadAudio = time.Now()
+	return nil
+}
+
 func (v *StageRequest) total() float64 {
 	if v.lastDownloadAudio.After(v.lastSentence) {
 		return float64(v.lastDownloadAudio.Sub(v.lastSentence)) / float64(time.Second)
@@ -1700,7 +1717,7 @@ func handleAITalkService(ctx context.Context, handler *http.ServeMux) error {
 			var sid, rid, userID string
 			var roomUUID, roomToken string
 			var userMayInput float64
-			var audioBase64Data, textMessage string
+			var audioBase64Data, textMessage, uploadUUID string
 			var mergeMessages int
 			if err := ParseBody(ctx, r.Body, &struct {
 				Token        *string  `json:"token"`
@@ -1712,12 +1729,15 @@ func handleAITalkService(ctx context.Context, handler *http.ServeMux) error {
 				UserMayInput *float64 `json:"umi"`
 				AudioData    *string  `json:"audio"`
 				TextMessage  *string  `json:"text"`
+				// The UUID of resumable upload, for large audio file.
+				UploadUUID *string `json:"upload"`
 				// Merge ASR text of conversations, which is small duration audio segment.
 				MergeMessages *int `json:"mergeMessages"`
 			}{
 				Token: &token, StageUUID: &sid, UserID: &userID, RequestUUID: &rid,
 				UserMayInput: &userMayInput, TextMessage: &textMessage, AudioData: &audioBase64Data,
 				RoomUUID: &roomUUID, RoomToken: &roomToken, MergeMessages: &mergeMessages,
+				UploadUUID: &uploadUUID,
 			}); err != nil {
 				return errors.Wrapf(err, "parse body")
 			}
@@ -1739,8 +1759,8 @@ func handleAITalkService(ctx context.Context, handler *http.ServeMux) error {
 			if userID == "" {
 				return errors.Errorf("empty userId")
 			}
-			if audioBase64Data == "" && textMessage == "" {
-				return errors.Errorf("empty audio and text")
+			if audioBase64Data == "" && textMessage == "" && uploadUUID == "" {
+				return errors.Errorf("empty audio, text and upload")
 			}
 
 			stage := talkServer.QueryStage(sid)
@@ -1781,9 +1801,17 @@ func handleAITalkService(ctx context.Context, handler *http.ServeMux) error {
 				sid, sreq.rid, userID, userMayInput, sreq.inputFile)
 
 			// Whether user input audio.
-			if audioBase64Data != "" {
+			if audioBase64Data != "" || uploadUUID != "" {
 				// Save audio input to file.
-				if err := sreq.receiveInputFile(ctx, audioBase64Data); err != nil {
+				if uploadUUID != "" {
+					var owner string
+					if roomToken != "" {
+						owner = stage.room.UUID
+					}
+					if err := sreq.receiveUploadFile(ctx, uploadUUID, owner); err != nil {
+						return errors.Wrapf(err, "save upload %v to file %v", uploadUUID, sreq.inputFile)
+					}
+				} else if err := sreq.receiveInputFile(ctx, audioBase64Data); err != nil {
 					return errors.Wrapf(err, "save %vB audio to file %v", len(audioBase64Data), sreq.inputFile)
 				}
 
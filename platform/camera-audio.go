@@ -0,0 +1,140 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/ossrs/go-oryx-lib/errors"
+)
+
+// The audio strategy of IP camera, see CameraConfigure.ExtraAudio
+const (
+	// Copy the audio stream of camera, which is the default.
+	CameraAudioCopy = ""
+	// Replace the audio with a silent stream.
+	CameraAudioSilent = "silent"
+	// Transcode the audio of camera to AAC, for example, G.711 or PCM which is not supported by FLV.
+	CameraAudioAAC = "aac"
+	// Replace the audio with background music, from media library or a stream.
+	CameraAudioBGM = "bgm"
+)
+
+// CameraBGM is the background music to replace the audio of camera.
+type CameraBGM struct {
+	// The media asset UUID of music file, which is played in loop.
+	Media string `json:"media,omitempty"`
+	// Or the music stream URL, for example, http://radio.example.com/live.mp3
+	URL string `json:"url,omitempty"`
+	// The volume in (0, 4], 0 means the default 1.0, for example, 0.3 to lower the music.
+	Volume float64 `json:"volume,omitempty"`
+}
+
+func (v *CameraBGM) String() string {
+	return fmt.Sprintf("media=%v, url=%v, volume=%v", v.Media, v.URL, v.Volume)
+}
+
+func (v *CameraBGM) Validate(ctx context.Context) error {
+	if v.Media == "" && v.URL == "" {
+		return errors.New("no media or url")
+	}
+	if v.Media != "" && v.URL != "" {
+		return errors.Errorf("both media %v and url %v", v.Media, v.URL)
+	}
+	if v.Volume < 0 || v.Volume > 4 {
+		return errors.Errorf("invalid volume %v", v.Volume)
+	}
+
+	if v.Media != "" {
+		if _, err := ResolveMediaSource(ctx, v.Media); err != nil {
+			return errors.Wrapf(err, "resolve media %v", v.Media)
+		}
+	} else if u, err := url.Parse(v.URL); err != nil {
+		return errors.Wrapf(err, "parse %v", v.URL)
+	} else if !slicesContains([]string{"http", "https", "rtmp", "rtsp", "srt"}, u.Scheme) {
+		return errors.Errorf("invalid url scheme %v", u.Scheme)
+	}
+
+	return nil
+}
+
+// Resolve the input of music, the file of media asset or the stream URL.
+func (v *CameraBGM) resolve(ctx context.Context) (string, error) {
+	if v.URL != "" {
+		return v.URL, nil
+	}
+
+	source, err := ResolveMediaSource(ctx, v.Media)
+	if err != nil {
+		return "", errors.Wrapf(err, "resolve media %v", v.Media)
+	}
+	return source.Target, nil
+}
+
+// Validate the audio strategy, and the background music if replace the audio.
+func (v *CameraConfigure) validateAudio(ctx context.Context) error {
+	allowedAudios := []string{CameraAudioCopy, CameraAudioSilent, CameraAudioAAC, CameraAudioBGM}
+	if !slicesContains(allowedAudios, v.ExtraAudio) {
+		return errors.Errorf("invalid extraAudio %v, should be %v", v.ExtraAudio, allowedAudios)
+	}
+
+	if v.ExtraAudio == CameraAudioBGM {
+		if v.BGM == nil {
+			return errors.New("no bgm")
+		}
+		if err := v.BGM.Validate(ctx); err != nil {
+			return errors.Wrapf(err, "validate bgm %v", v.BGM.String())
+		}
+	}
+
+	return nil
+}
+
+// The media assets used as background music, to reference them.
+func (v *CameraConfigure) bgmMedias() []string {
+	if v.ExtraAudio != CameraAudioBGM || v.BGM == nil || v.BGM.Media == "" {
+		return nil
+	}
+	return []string{v.BGM.Media}
+}
+
+// CameraAudioArgs build the FFmpeg arguments after the camera input, to process the audio by the
+// strategy. The bgm is the input of background music, only used when replace the audio.
+func CameraAudioArgs(strategy, bgm string, volume float64) []string {
+	switch strategy {
+	case CameraAudioSilent:
+		return []string{
+			"-f", "lavfi", "-i", "anullsrc=channel_layout=stereo:sample_rate=44100", // Silent audio stream.
+			"-map", "0:v", "-map", "1:a", // Ignore the original audio stream.
+			"-c:a", "aac", "-ac", "2", "-ar", "44100", "-b:a", "20k", // Encode audio stream.
+			"-c:v", "copy", // Copy video stream.
+		}
+	case CameraAudioAAC:
+		return []string{
+			"-map", "0:v", "-map", "0:a?", // Ignore if camera has no audio.
+			"-c:a", "aac", "-ac", "2", "-ar", "44100", "-b:a", "64k",
+			"-c:v", "copy",
+		}
+	case CameraAudioBGM:
+		var args []string
+		// Play the music file in realtime and loop it forever, while the stream is live.
+		if !strings.Contains(bgm, "://") {
+			args = append(args, "-stream_loop", "-1", "-re")
+		}
+		if volume <= 0 {
+			volume = 1
+		}
+		return append(args, "-i", bgm,
+			"-filter_complex", fmt.Sprintf("[1:a]volume=%v[bgm]", volume),
+			"-map", "0:v", "-map", "[bgm]", // Replace the original audio stream.
+			"-c:a", "aac", "-ac", "2", "-ar", "44100", "-b:a", "128k",
+			"-c:v", "copy",
+		)
+	}
+
+	return []string{"-c", "copy"}
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCamera_AudioArgs(t *testing.T) {
+	if args := strings.Join(CameraAudioArgs(CameraAudioCopy, "", 0), " "); args != "-c copy" {
+		t.Errorf("invalid args %v", args)
+	}
+	if args := strings.Join(CameraAudioArgs(CameraAudioAAC, "", 0), " "); !strings.Contains(args, "-map 0:a? -c:a aac") {
+		t.Errorf("invalid args %v", args)
+	}
+
+	args := strings.Join(CameraAudioArgs(CameraAudioBGM, "media/music.mp3", 0.3), " ")
+	if !strings.HasPrefix(args, "-stream_loop -1 -re -i media/music.mp3") || !strings.Contains(args, "[1:a]volume=0.3[bgm]") ||
+		!strings.Contains(args, "-map 0:v -map [bgm]") {
+		t.Errorf("invalid args %v", args)
+	}
+
+	args = strings.Join(CameraAudioArgs(CameraAudioBGM, "http://radio/live.mp3", 0), " ")
+	if !strings.HasPrefix(args, "-i http://radio/live.mp3") || !strings.Contains(args, "volume=1[bgm]") {
+		t.Errorf("invalid args %v", args)
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/ossrs/go-oryx-lib/errors"
+)
+
+// CameraFailover is the primary and backup semantics of IP camera streams. The first stream is the
+// primary, and the others are backups. When the active source fails or stalls, switch to the next one,
+// and finally the slate from media library. When on backup, probe the primary periodically, and
+// switch back when it recovers.
+type CameraFailover struct {
+	// Whether enable failover, or always use the primary stream.
+	Enabled bool `json:"enabled"`
+	// The media asset UUID of slate, an image or video to play when all streams fail.
+	Slate string `json:"slate,omitempty"`
+	// The interval in seconds to probe the primary when on backup, default to 30s.
+	Recover int `json:"recover,omitempty"`
+}
+
+func (v *CameraFailover) String() string {
+	return fmt.Sprintf("enabled=%v, slate=%v, recover=%v", v.Enabled, v.Slate, v.Recover)
+}
+
+func (v *CameraFailover) Validate(ctx context.Context) error {
+	if v.Recover < 0 {
+		return errors.Errorf("invalid recover %v", v.Recover)
+	}
+	if v.Slate != "" {
+		if _, err := ResolveMediaSource(ctx, v.Slate); err != nil {
+			return errors.Wrapf(err, "resolve slate %v", v.Slate)
+		}
+	}
+	return nil
+}
+
+// The interval to probe the primary stream.
+func (v *CameraFailover) recoverInterval() time.Duration {
+	if v.Recover <= 0 {
+		return 30 * time.Second
+	}
+	return time.Duration(v.Recover) * time.Second
+}
+
+// The role of source for failover.
+const (
+	CameraSourcePrimary = "primary"
+	CameraSourceBackup  = "backup"
+	CameraSourceSlate   = "slate"
+)
+
+// CameraSourceRole get the role of the index of failover candidates, which are the streams and then
+// the optional slate.
+func CameraSourceRole(index, streams int) string {
+	if index == 0 {
+		return CameraSourcePrimary
+	} else if index < streams {
+		return CameraSourceBackup
+	}
+	return CameraSourceSlate
+}
+
+// Resolve the failover candidates, the streams and then the slate. The slate is ignored if failed to
+// resolve, for example, removed from media library.
+func (v *CameraConfigure) failoverCandidates(ctx context.Context) []*FFprobeSource {
+	candidates := append([]*FFprobeSource{}, v.Streams...)
+	if v.Failover == nil || v.Failover.Slate == "" {
+		return candidates
+	}
+
+	slate, err := ResolveMediaSource(ctx, v.Failover.Slate)
+	if err != nil {
+		return candidates
+	}
+
+	// Use the media UUID as source UUID, because it's generated for each resolving.
+	slate.UUID = slate.Media
+	return append(candidates, slate)
+}
+
+func (v *CameraConfigure) failoverEnabled() bool {
+	return v.Failover != nil && v.Failover.Enabled
+}
+
+// Whether the source is a still image, for example, a slate of png or jpeg.
+func isImageSource(source *FFprobeSource) bool {
+	return source.Video != nil && slicesContains([]string{"mjpeg", "png", "bmp", "webp"}, source.Video.CodecName)
+}
+
+// CameraSlateArgs build the FFmpeg input and codec arguments for slate, loop the video forever, or
+// encode the still image to video with silent audio.
+func CameraSlateArgs(slate *FFprobeSource) []string {
+	if !isImageSource(slate) {
+		return []string{"-stream_loop", "-1", "-i", slate.Target, "-c", "copy"}
+	}
+
+	return []string{
+		"-loop", "1", "-framerate", "25", "-i", slate.Target,
+		"-f", "lavfi", "-i", "anullsrc=channel_layout=stereo:sample_rate=44100",
+		"-map", "0:v", "-map", "1:a",
+		"-c:v", "libx264", "-profile:v", "main", "-preset:v", "veryfast", "-tune", "stillimage",
+		"-pix_fmt", "yuv420p", "-vf", "scale=trunc(iw/2)*2:trunc(ih/2)*2",
+		"-r", "25", "-g", "50", "-bf", "0",
+		"-c:a", "aac", "-ac", "2", "-ar", "44100", "-b:a", "20k",
+	}
+}
+
+// Probe whether the stream is available, for example, the primary stream recovers.
+func probeCameraStream(ctx context.Context, target string) error {
+	toCtx, toCancelFunc := context.WithTimeout(ctx, 10*time.Second)
+	defer toCancelFunc()
+
+	args := []string{"-v", "quiet", "-show_format"}
+	// For RTSP stream source, always use TCP transport.
+	if strings.HasPrefix(target, "rtsp://") {
+		args = append(args, "-rtsp_transport", "tcp")
+	}
+	// Rebuild the stream url, because it may contain special characters.
+	if strings.Contains(target, "://") {
+		if u, err := RebuildStreamURL(target); err != nil {
+			return errors.Wrapf(err, "rebuild %v", target)
+		} else {
+			args = append(args, "-i", u.String())
+		}
+	} else {
+		args = append(args, "-i", target)
+	}
+
+	if err := exec.CommandContext(toCtx, "ffprobe", args...).Run(); err != nil {
+		return errors.Wrapf(err, "probe %v", target)
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCamera_FailoverRole(t *testing.T) {
+	if role := CameraSourceRole(0, 2); role != CameraSourcePrimary {
+		t.Errorf("invalid role %v", role)
+	}
+	if role := CameraSourceRole(1, 2); role != CameraSourceBackup {
+		t.Errorf("invalid role %v", role)
+	}
+	if role := CameraSourceRole(2, 2); role != CameraSourceSlate {
+		t.Errorf("invalid role %v", role)
+	}
+}
+
+func TestCamera_SlateArgs(t *testing.T) {
+	video := &FFprobeSource{Target: "media/slate.mp4", Video: &FFprobeVideo{CodecName: "h264"}}
+	if args := strings.Join(CameraSlateArgs(video), " "); args != "-stream_loop -1 -i media/slate.mp4 -c copy" {
+		t.Errorf("invalid args %v", args)
+	}
+
+	image := &FFprobeSource{Target: "media/slate.png", Video: &FFprobeVideo{CodecName: "png"}}
+	if args := strings.Join(CameraSlateArgs(image), " "); !strings.Contains(args, "-loop 1 -framerate 25 -i media/slate.png") ||
+		!strings.Contains(args, "anullsrc") || !strings.Contains(args, "-c:v libx264") {
+		t.Errorf("invalid args %v", args)
+	}
+}
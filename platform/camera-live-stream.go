@@ -93,6 +93,22 @@ func (v *CameraWorker) Handle(ctx context.Context, handler *http.ServeMux) error
 				if len(userConf.Streams) == 0 {
 					return errors.New("no files")
 				}
+
+				// Preserve the background music if not specified, because the UI never sends it.
+				if userConf.BGM == nil {
+					if config, err := rdb.HGet(ctx, SRS_CAMERA_CONFIG, userConf.Platform).Result(); err != nil && err != redis.Nil {
+						return errors.Wrapf(err, "hget %v %v", SRS_CAMERA_CONFIG, userConf.Platform)
+					} else if config != "" {
+						var targetConf CameraConfigure
+						if err = json.Unmarshal([]byte(config), &targetConf); err != nil {
+							return errors.Wrapf(err, "unmarshal %v", config)
+						}
+						userConf.BGM = targetConf.BGM
+					}
+				}
+				if err := userConf.validateAudio(ctx); err != nil {
+					return errors.Wrapf(err, "validate audio")
+				}
 			}
 
 			if action == "update" {
@@ -105,6 +121,13 @@ func (v *CameraWorker) Handle(ctx context.Context, handler *http.ServeMux) error
 							return errors.Wrapf(err, "unmarshal %v", config)
 						}
 					}
+
+					// Reference the background music, to avoid being removed.
+					owner := fmt.Sprintf("camera:%v:bgm", userConf.Platform)
+					if err = UpdateMediaRefs(ctx, owner, targetConf.bgmMedias(), userConf.bgmMedias()); err != nil {
+						return errors.Wrapf(err, "update media refs of %v", owner)
+					}
+
 					if err = targetConf.Update(&userConf); err != nil {
 						return errors.Wrapf(err, "update %v with %v", targetConf.String(), userConf.String())
 					} else if newB, err := json.Marshal(&targetConf); err != nil {
@@ -176,9 +199,11 @@ func (v *CameraWorker) Handle(ctx context.Context, handler *http.ServeMux) error
 					}
 
 					var pid int32
-					var inputUUID, frame, update, starttime, ready string
+					var inputUUID, frame, update, starttime, ready, role string
+					var index int
 					if task := cameraWorker.GetTask(config.Platform); task != nil {
 						pid, inputUUID, frame, update, starttime, ready = task.queryFrame()
+						index, role = task.queryActive()
 					}
 
 					elem := map[string]interface{}{
@@ -189,9 +214,19 @@ func (v *CameraWorker) Handle(ctx context.Context, handler *http.ServeMux) error
 						"files":      config.Streams,
 						"extraAudio": config.ExtraAudio,
 					}
+					if config.BGM != nil {
+						elem["bgm"] = config.BGM
+					}
+					if config.Failover != nil {
+						elem["failover"] = config.Failover
+					}
 
 					if pid > 0 {
 						elem["source"] = inputUUID
+						elem["active"] = map[string]interface{}{
+							"index": index,
+							"role":  role,
+						}
 						elem["start"] = starttime
 						elem["ready"] = ready
 						elem["frame"] = map[string]string{
@@ -295,12 +330,14 @@ func (v *CameraWorker) Handle(ctx context.Context, handler *http.ServeMux) error
 
 			var token, platform string
 			var streams []*CameraTempFile
+			var failover *CameraFailover
 			if err := ParseBody(ctx, r.Body, &struct {
 				Token    *string            `json:"token"`
 				Platform *string            `json:"platform"`
 				Streams  *[]*CameraTempFile `json:"files"`
+				Failover **CameraFailover   `json:"failover"`
 			}{
-				Token: &token, Platform: &platform, Streams: &streams,
+				Token: &token, Platform: &platform, Streams: &streams, Failover: &failover,
 			}); err != nil {
 				return errors.Wrapf(err, "parse body")
 			}
@@ -324,6 +361,13 @@ func (v *CameraWorker) Handle(ctx context.Context, handler *http.ServeMux) error
 				}
 			}
 
+			// Check failover, the slate should be in media library.
+			if failover != nil {
+				if err := failover.Validate(ctx); err != nil {
+					return errors.Wrapf(err, "validate failover %v", failover.String())
+				}
+			}
+
 			// Check platform.
 			if platform == "" {
 				return errors.New("no platform")
@@ -450,6 +494,23 @@ func (v *CameraWorker) Handle(ctx context.Context, handler *http.ServeMux) error
 
 			confObj.Streams = parsedStreams
 
+			// Update the failover if specified, and reference the slate to avoid being removed.
+			if failover != nil {
+				var olds, news []string
+				if confObj.Failover != nil && confObj.Failover.Slate != "" {
+					olds = []string{confObj.Failover.Slate}
+				}
+				if failover.Slate != "" {
+					news = []string{failover.Slate}
+				}
+
+				owner := fmt.Sprintf("camera:%v", platform)
+				if err := UpdateMediaRefs(ctx, owner, olds, news); err != nil {
+					return errors.Wrapf(err, "update media refs of %v", owner)
+				}
+				confObj.Failover = failover
+			}
+
 			if b, err := json.Marshal(&confObj); err != nil {
 				return errors.Wrapf(err, "marshal %v", confObj.String())
 			} else if err = rdb.HSet(ctx, SRS_CAMERA_CONFIG, platform, string(b)).Err(); err != nil && err != redis.Nil {
@@ -466,8 +527,9 @@ func (v *CameraWorker) Handle(ctx context.Context, handler *http.ServeMux) error
 			ohttp.WriteData(ctx, w, r, &struct {
 				Platform string           `json:"platform"`
 				Files    []*FFprobeSource `json:"files"`
+				Failover *CameraFailover  `json:"failover,omitempty"`
 			}{
-				Platform: platform, Files: parsedStreams,
+				Platform: platform, Files: parsedStreams, Failover: confObj.Failover,
 			})
 			logger.Tf(ctx, "Camera:: Update ok, token=%vB", len(token))
 			return nil
@@ -610,19 +672,33 @@ type CameraConfigure struct {
 	Customed bool `json:"custom"`
 	// The label for this configure.
 	Label string `json:"label"`
-	// The extra audio stream strategy.
+	// The extra audio stream strategy, empty to copy, silent, aac or bgm.
 	ExtraAudio string `json:"extraAudio"`
+	// The background music, only for bgm strategy.
+	BGM *CameraBGM `json:"bgm,omitempty"`
 
 	// The input files for IP camera.
 	Streams []*FFprobeSource `json:"files"`
+	// The failover of streams, the first stream is primary, and others are backups.
+	Failover *CameraFailover `json:"failover,omitempty"`
 }
 
 func (v CameraConfigure) String() string {
-	return fmt.Sprintf("platform=%v, server=%v, secret=%v, enabled=%v, customed=%v, label=%v, files=%v, extraAudio=%v",
-		v.Platform, v.Server, v.Secret, v.Enabled, v.Customed, v.Label, v.Streams, v.ExtraAudio,
+	return fmt.Sprintf("platform=%v, server=%v, secret=%v, enabled=%v, customed=%v, label=%v, files=%v, extraAudio=%v, bgm=<%v>, failover=<%v>",
+		v.Platform, v.Server, v.Secret, v.Enabled, v.Customed, v.Label, v.Streams, v.ExtraAudio, v.BGM, v.Failover,
 	)
 }
 
+// OutputURL build the output URL by server and secret, which is also used by mosaic to pull the stream.
+func (v *CameraConfigure) OutputURL() string {
+	host := "localhost"
+	outputServer := strings.ReplaceAll(v.Server, "localhost", host)
+	if !strings.HasSuffix(outputServer, "/") && !strings.HasPrefix(v.Secret, "/") && v.Secret != "" {
+		outputServer += "/"
+	}
+	return fmt.Sprintf("%v%v", outputServer, v.Secret)
+}
+
 func (v *CameraConfigure) Update(u *CameraConfigure) error {
 	v.Platform = u.Platform
 	v.Server = u.Server
@@ -632,6 +708,8 @@ func (v *CameraConfigure) Update(u *CameraConfigure) error {
 	v.Customed = u.Customed
 	v.Streams = append([]*FFprobeSource{}, u.Streams...)
 	v.ExtraAudio = u.ExtraAudio
+	v.BGM = u.BGM
+	// Note that the failover is updated by source API, because the slate is referenced.
 	return nil
 }
 
@@ -649,6 +727,13 @@ type CameraTask struct {
 	// The output url
 	Output string `json:"output"`
 
+	// The index of active source in failover candidates.
+	activeIndex int
+	// The role of active source, primary, backup or slate.
+	activeRole string
+	// Whether the source is switched by recovering or restarting, not by failure.
+	switched bool
+
 	// FFmpeg pid.
 	PID int32 `json:"pid"`
 	// FFmpeg last frame.
@@ -716,6 +801,9 @@ func (v *CameraTask) Restart(ctx context.Context) error {
 		v.cancel()
 	}
 
+	// Always use the primary stream for new configure.
+	v.activeIndex, v.switched = 0, true
+
 	// Reload config from redis.
 	if b, err := rdb.HGet(ctx, SRS_CAMERA_CONFIG, v.Platform).Result(); err != nil {
 		return errors.Wrapf(err, "hget %v %v", SRS_CAMERA_CONFIG, v.Platform)
@@ -758,6 +846,44 @@ func (v *CameraTask) queryFrame() (int32, string, string, string, string, string
 	return v.PID, v.inputUUID, v.frame, update, starttime, ready
 }
 
+func (v *CameraTask) queryActive() (int, string) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	return v.activeIndex, v.activeRole
+}
+
+// Probe the primary stream periodically when on backup or slate, and switch back when it recovers.
+func (v *CameraTask) watchPrimary(ctx context.Context, primary *FFprobeSource, interval time.Duration) {
+	for ctx.Err() == nil {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+
+		// Stop watching if the primary is already active, for example, restarted by new configure.
+		if index, _ := v.queryActive(); index == 0 {
+			return
+		}
+
+		if err := probeCameraStream(ctx, primary.Target); err != nil {
+			logger.Tf(ctx, "Camera: Primary %v not recovered, platform=%v, err %v", primary.UUID, v.Platform, err)
+			continue
+		}
+
+		v.lock.Lock()
+		v.activeIndex, v.switched = 0, true
+		if v.cancel != nil {
+			v.cancel()
+		}
+		v.lock.Unlock()
+
+		logger.Tf(ctx, "Camera: Primary %v recovered, switch back, platform=%v", primary.UUID, v.Platform)
+		return
+	}
+}
+
 func (v *CameraTask) Initialize(ctx context.Context, w *CameraWorker) error {
 	v.cameraWorker = w
 	logger.Tf(ctx, "Camera: Initialize uuid=%v, platform=%v", v.UUID, v.Platform)
@@ -781,11 +907,46 @@ func (v *CameraTask) Run(ctx context.Context) error {
 			return nil
 		}
 
-		file := v.config.Streams[0]
-		logger.Tf(ctx, "Camera: Use file=%v as input for platform=%v", file.UUID, v.Platform)
+		// Without failover, always use the primary stream.
+		if !v.config.failoverEnabled() {
+			v.activeIndex, v.activeRole = 0, CameraSourcePrimary
+			file := v.config.Streams[0]
+			logger.Tf(ctx, "Camera: Use file=%v as input for platform=%v", file.UUID, v.Platform)
+			return file
+		}
+
+		candidates := v.config.failoverCandidates(ctx)
+		if v.activeIndex >= len(candidates) {
+			v.activeIndex = 0
+		}
+
+		file := candidates[v.activeIndex]
+		v.activeRole = CameraSourceRole(v.activeIndex, len(v.config.Streams))
+		logger.Tf(ctx, "Camera: Use file=%v as %v input for platform=%v, index=%v, candidates=%v",
+			file.UUID, v.activeRole, v.Platform, v.activeIndex, len(candidates))
 		return file
 	}
 
+	// Switch to the next source when the active source exits abnormally or stalls, except it's switched
+	// by recovering or restarting, or exits normally.
+	failoverNext := func(failed bool) {
+		v.lock.Lock()
+		defer v.lock.Unlock()
+
+		if v.switched || !failed || !v.config.failoverEnabled() {
+			v.switched = false
+			return
+		}
+
+		candidates := len(v.config.Streams)
+		if v.config.Failover.Slate != "" {
+			candidates++
+		}
+		v.activeIndex = (v.activeIndex + 1) % candidates
+		logger.Wf(ctx, "Camera: Failover to index=%v, role=%v, platform=%v",
+			v.activeIndex, CameraSourceRole(v.activeIndex, len(v.config.Streams)), v.Platform)
+	}
+
 	pfn := func(ctx context.Context) error {
 		// Ignore when not enabled.
 		if !v.config.Enabled {
@@ -798,8 +959,19 @@ func (v *CameraTask) Run(ctx context.Context) error {
 			return nil
 		}
 
-		// Start IP camera task.
-		if err := v.doCameraStreaming(ctx, input); err != nil {
+		// When on backup or slate, watch the primary to switch back.
+		if index, _ := v.queryActive(); index > 0 {
+			watchCtx, watchCancel := context.WithCancel(ctx)
+			defer watchCancel()
+			go v.watchPrimary(watchCtx, v.config.Streams[0], v.config.Failover.recoverInterval())
+		}
+
+		// Start IP camera task, the error means FFmpeg stalls or exits abnormally.
+		err := v.doCameraStreaming(ctx, input)
+		if ctx.Err() == nil {
+			failoverNext(err != nil)
+		}
+		if err != nil {
 			return errors.Wrapf(err, "do IP camera")
 		}
 
@@ -832,15 +1004,8 @@ func (v *CameraTask) doCameraStreaming(ctx context.Context, input *FFprobeSource
 	ctx, cancel := context.WithCancel(ctx)
 	v.cancel = cancel
 
-	// Build input URL.
-	host := "localhost"
-
 	// Build output URL.
-	outputServer := strings.ReplaceAll(v.config.Server, "localhost", host)
-	if !strings.HasSuffix(outputServer, "/") && !strings.HasPrefix(v.config.Secret, "/") && v.config.Secret != "" {
-		outputServer += "/"
-	}
-	outputURL := fmt.Sprintf("%v%v", outputServer, v.config.Secret)
+	outputURL := v.config.OutputURL()
 
 	// Create a heartbeat to poll and manage the status of FFmpeg process.
 	heartbeat := NewFFmpegHeartbeat(cancel)
@@ -854,31 +1019,36 @@ func (v *CameraTask) doCameraStreaming(ctx context.Context, input *FFprobeSource
 	args = append(args, "-re",
 		"-fflags", "nobuffer", // Reduce the latency introduced by optional buffering.
 	)
-	// For RTSP stream source, always use TCP transport.
-	if strings.HasPrefix(input.Target, "rtsp://") {
-		args = append(args, "-rtsp_transport", "tcp")
-	}
-	// Rebuild the stream url, because it may contain special characters.
-	if strings.Contains(input.Target, "://") {
-		if u, err := RebuildStreamURL(input.Target); err != nil {
-			return errors.Wrapf(err, "rebuild %v", input.Target)
+	if input.Type == FFprobeSourceTypeMedia {
+		// For slate from media library, loop the file forever.
+		args = append(args, CameraSlateArgs(input)...)
+	} else {
+		// For RTSP stream source, always use TCP transport.
+		if strings.HasPrefix(input.Target, "rtsp://") {
+			args = append(args, "-rtsp_transport", "tcp")
+		}
+		// Rebuild the stream url, because it may contain special characters.
+		if strings.Contains(input.Target, "://") {
+			if u, err := RebuildStreamURL(input.Target); err != nil {
+				return errors.Wrapf(err, "rebuild %v", input.Target)
+			} else {
+				args = append(args, "-i", u.String())
+				heartbeat.Parse(u)
+			}
 		} else {
-			args = append(args, "-i", u.String())
-			heartbeat.Parse(u)
+			args = append(args, "-i", input.Target)
 		}
-	} else {
-		args = append(args, "-i", input.Target)
-	}
-	// Whether insert extra audio stream.
-	if v.config.ExtraAudio == "silent" {
-		args = append(args,
-			"-f", "lavfi", "-i", "anullsrc=channel_layout=stereo:sample_rate=44100", // Silent audio stream.
-			"-map", "0:v", "-map", "1:a", // Ignore the original audio stream.
-			"-c:a", "aac", "-ac", "2", "-ar", "44100", "-b:a", "20k", // Encode audio stream.
-			"-c:v", "copy", // Copy video stream.
-		)
-	} else {
-		args = append(args, "-c", "copy")
+		// Process the audio stream by strategy, copy, silent, transcode or replace by music.
+		var bgm string
+		var volume float64
+		if v.config.ExtraAudio == CameraAudioBGM && v.config.BGM != nil {
+			if input, err := v.config.BGM.resolve(ctx); err != nil {
+				return errors.Wrapf(err, "resolve bgm %v", v.config.BGM.String())
+			} else {
+				bgm, volume = input, v.config.BGM.Volume
+			}
+		}
+		args = append(args, CameraAudioArgs(v.config.ExtraAudio, bgm, volume)...)
 	}
 	// If RTMP use flv, if SRT use mpegts, otherwise do not set.
 	if strings.HasPrefix(outputURL, "rtmp://") || strings.HasPrefix(outputURL, "rtmps://") {
@@ -949,9 +1119,14 @@ func (v *CameraTask) doCameraStreaming(ctx context.Context, input *FFprobeSource
 	logger.Tf(ctx, "Camera: Cycle stopping, platform=%v, input=%v, pid=%v", v.Platform, input.Target, v.PID)
 
 	err = cmd.Wait()
-	logger.Tf(ctx, "Camera: Cycle done, platform=%v, input=%v, pid=%v, err=%v",
-		v.Platform, input.Target, v.PID, err,
+	logger.Tf(ctx, "Camera: Cycle done, platform=%v, input=%v, pid=%v, stalled=%v, err=%v",
+		v.Platform, input.Target, v.PID, heartbeat.stalled, err,
 	)
 
+	// The FFmpeg is killed by heartbeat, for the input stalls.
+	if heartbeat.stalled {
+		return errors.Errorf("stalled, input=%v, err %v", input.Target, err)
+	}
+
 	return err
 }
@@ -76,7 +76,7 @@ func handleDubbingService(ctx context.Context, handler *http.ServeMux) error {
 			if targetFile == nil {
 				return errors.Errorf("invalid file")
 			}
-			if targetFile.Type != FFprobeSourceTypeFile && targetFile.Type != FFprobeSourceTypeUpload && targetFile.Type != FFprobeSourceTypeYTDL {
+			if targetFile.Type != FFprobeSourceTypeFile && targetFile.Type != FFprobeSourceTypeUpload && targetFile.Type != FFprobeSourceTypeYTDL && targetFile.Type != FFprobeSourceTypeMedia {
 				return errors.Errorf("invalid file type %v", targetFile.Type)
 			}
 			if targetFile.Target == "" {
@@ -86,6 +86,7 @@ func handleDubbingService(ctx context.Context, handler *http.ServeMux) error {
 			dubbing := NewSrsDubbingProject(func(dubbing *SrsDubbingProject) {
 				dubbing.Title = title
 				dubbing.FileType, dubbing.FilePath = targetFile.Type, targetFile.Path
+				dubbing.Media = targetFile.Media
 			})
 
 			if err := dubbing.CheckSource(ctx, targetFile.Target); err != nil {
@@ -116,7 +117,17 @@ func handleDubbingService(ctx context.Context, handler *http.ServeMux) error {
 				)
 
 				absSourcePath := path.Join(conf.Pwd, aiDubbingWorkDir, dubbing.SourcePath)
-				if err := os.Rename(fileAbsPath, absSourcePath); err != nil {
+				if targetFile.Type == FFprobeSourceTypeMedia {
+					// Link to the file of media asset, and reference it to protect from deleting.
+					if err := os.Symlink(fileAbsPath, absSourcePath); err != nil {
+						return errors.Wrapf(err, "symlink %v to %v", fileAbsPath, absSourcePath)
+					}
+
+					owner := fmt.Sprintf("dubbing:%v", dubbing.UUID)
+					if err := UpdateMediaRefs(ctx, owner, nil, []string{dubbing.Media}); err != nil {
+						return errors.Wrapf(err, "update media refs of %v", owner)
+					}
+				} else if err := os.Rename(fileAbsPath, absSourcePath); err != nil {
 					return errors.Wrapf(err, "rename %v to %v", fileAbsPath, absSourcePath)
 				}
 			}
@@ -210,6 +221,14 @@ func handleDubbingService(ctx context.Context, handler *http.ServeMux) error {
 				return errors.Wrapf(err, "hdel %v %v", SRS_DUBBING_PROJECTS, dubbingUUID)
 			}
 
+			// Release the media asset.
+			if dubbing.Media != "" {
+				owner := fmt.Sprintf("dubbing:%v", dubbing.UUID)
+				if err := UpdateMediaRefs(ctx, owner, []string{dubbing.Media}, nil); err != nil {
+					return errors.Wrapf(err, "update media refs of %v", owner)
+				}
+			}
+
 			// Remove the project files.
 			if dubbing.UUID != "" {
 				projectDir := path.Join(conf.Pwd, aiDubbingWorkDir, dubbing.UUID)
@@ -978,8 +997,12 @@ func handleDubbingService(ctx context.Context, handler *http.ServeMux) error {
 				UUID string `json:"uuid"`
 				// The target file name.
 				Target string `json:"target"`
+				// The UUID of resumable upload, for large file.
+				Upload string `json:"upload"`
 				// The source type.
 				Type FFprobeSourceType `json:"type"`
+				// The media asset UUID, for media source.
+				Media string `json:"media"`
 			}
 
 			var token string
@@ -1002,10 +1025,21 @@ func handleDubbingService(ctx context.Context, handler *http.ServeMux) error {
 				return errors.New("no files")
 			}
 
+			// Use the file of resumable upload, which is completed by tus protocol.
+			for _, f := range files {
+				if f.Upload != "" {
+					if target, err := QueryUploadTarget(ctx, f.Upload, ""); err != nil {
+						return errors.Wrapf(err, "query upload %v", f.Upload)
+					} else {
+						f.Target = target
+					}
+				}
+			}
+
 			// Always cleanup the files in upload.
 			var tempFiles []string
 			for _, f := range files {
-				if f.Type != FFprobeSourceTypeStream {
+				if f.Type != FFprobeSourceTypeStream && !f.Type.IsShared() {
 					tempFiles = append(tempFiles, f.Target)
 				}
 			}
@@ -1020,10 +1054,19 @@ func handleDubbingService(ctx context.Context, handler *http.ServeMux) error {
 
 			// Check files.
 			for _, f := range files {
+				// For media asset, use the file of media library directly.
+				if f.Type == FFprobeSourceTypeMedia {
+					if source, err := ResolveMediaSource(ctx, f.Media); err != nil {
+						return errors.Wrapf(err, "resolve media %v", f.Media)
+					} else {
+						f.Target = source.Target
+					}
+				}
+
 				if f.Target == "" {
 					return errors.New("no target")
 				}
-				if f.Type != FFprobeSourceTypeStream {
+				if f.Type != FFprobeSourceTypeStream && !f.Type.IsShared() {
 					if _, err := os.Stat(f.Target); err != nil {
 						return errors.Wrapf(err, "no file %v", f.Target)
 					}
@@ -1106,10 +1149,10 @@ func handleDubbingService(ctx context.Context, handler *http.ServeMux) error {
 
 				parsedFile := &FFprobeSource{
 					Name: file.Name, Path: file.Path, Size: uint64(file.Size), UUID: file.UUID,
-					Target: file.Target, Type: file.Type,
+					Target: file.Target, Type: file.Type, Media: file.Media,
 					Format: &format.Format, Video: matchVideo, Audio: matchAudio,
 				}
-				if file.Type != FFprobeSourceTypeStream {
+				if file.Type != FFprobeSourceTypeStream && !file.Type.IsShared() {
 					parsedFile.Target = path.Join(dirDubbingPath, fmt.Sprintf("%v%v", file.UUID, path.Ext(file.Target)))
 					if err = os.Rename(file.Target, parsedFile.Target); err != nil {
 						return errors.Wrapf(err, "rename %v to %v", file.Target, parsedFile.Target)
@@ -2166,6 +2209,8 @@ type SrsDubbingProject struct {
 	FileType FFprobeSourceType `json:"filetype"`
 	// File source path.
 	FilePath string `json:"filepath"`
+	// The media asset UUID, if source is from media library.
+	Media string `json:"media,omitempty"`
 	// Create time.
 	CreatedAt string `json:"created_at"`
 
@@ -2245,7 +2290,7 @@ func (v *SrsDubbingProject) Save(ctx context.Context) error {
 }
 
 func (v *SrsDubbingProject) CheckSource(ctx context.Context, target string) error {
-	if v.FileType != FFprobeSourceTypeFile && v.FileType != FFprobeSourceTypeUpload && v.FileType != FFprobeSourceTypeYTDL {
+	if v.FileType != FFprobeSourceTypeFile && v.FileType != FFprobeSourceTypeUpload && v.FileType != FFprobeSourceTypeYTDL && v.FileType != FFprobeSourceTypeMedia {
 		return errors.Errorf("unsupported file type %v", v.FileType)
 	}
 
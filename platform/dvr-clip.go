@@ -0,0 +1,505 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ossrs/go-oryx-lib/errors"
+	ohttp "github.com/ossrs/go-oryx-lib/http"
+	"github.com/ossrs/go-oryx-lib/logger"
+	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+)
+
+// The status of clip job.
+const (
+	RecordClipPending    = "pending"
+	RecordClipProcessing = "processing"
+	RecordClipDone       = "done"
+	RecordClipFailed     = "failed"
+)
+
+// The mode to cut the clip, stream copy or re-encode.
+const (
+	RecordClipModeCopy   = "copy"
+	RecordClipModeEncode = "encode"
+)
+
+// The max number of clip jobs to keep.
+const recordClipMaxJobs = 100
+
+// RecordClip is a job to extract a clip as MP4 from an artifact or a live stream, and the clip is stored
+// as a new record artifact with the same UUID of job.
+type RecordClip struct {
+	// The UUID of job, which is also the UUID of clip artifact.
+	UUID string `json:"uuid"`
+	// The type of source, record, dvr, vod or stream.
+	Type FFprobeSourceType `json:"type"`
+	// The UUID of source artifact, or the stream URL such as /live/livestream for stream.
+	Source string `json:"source"`
+	// The time range in seconds, relative to the begin of source.
+	Start float64 `json:"start"`
+	End   float64 `json:"end"`
+	// The mode to cut the clip, copy or encode.
+	Mode string `json:"mode,omitempty"`
+	// The status of job, and the error if failed.
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	// The create and update time of job.
+	Created string `json:"created"`
+	Update  string `json:"update"`
+	// The download URL of clip MP4.
+	URL string `json:"url,omitempty"`
+}
+
+func (v *RecordClip) String() string {
+	return fmt.Sprintf("uuid=%v, type=%v, source=%v, start=%v, end=%v, mode=%v, status=%v",
+		v.UUID, v.Type, v.Source, v.Start, v.End, v.Mode, v.Status,
+	)
+}
+
+// ParseClipTime parse the time in seconds, or in format of mm:ss or hh:mm:ss, for example, 750, 12:30
+// or 00:12:30.
+func ParseClipTime(s string) (float64, error) {
+	parts := strings.Split(strings.TrimSpace(s), ":")
+	if len(parts) > 3 {
+		return 0, errors.Errorf("invalid time %v", s)
+	}
+
+	var seconds float64
+	for index, part := range parts {
+		v, err := strconv.ParseFloat(part, 64)
+		if err != nil || v < 0 || math.IsInf(v, 0) || math.IsNaN(v) {
+			return 0, errors.Errorf("invalid time %v", s)
+		}
+		// Except the first part, the minutes and seconds should be in [0, 60).
+		if index > 0 && v >= 60 {
+			return 0, errors.Errorf("invalid time %v", s)
+		}
+		seconds = seconds*60 + v
+	}
+	return seconds, nil
+}
+
+// RecordClipRange is the segments of source to extract the clip.
+type RecordClipRange struct {
+	// The ts files which cover the clip.
+	Files []*TsFile
+	// The offset in seconds of clip, relative to the first ts file.
+	Offset float64
+	// The duration in seconds of clip.
+	Duration float64
+	// Whether the clip starts at a keyframe, so we're able to stream copy.
+	Copy bool
+}
+
+// NewRecordClipRange select the ts files which cover the time range. Because each ts file starts with a
+// keyframe, we stream copy only when the start lands on the boundary of ts files. There is no need to
+// check the end, because the clip is always playable when truncated at any frame.
+func NewRecordClipRange(files []*TsFile, start, end float64) (*RecordClipRange, error) {
+	if start < 0 || end <= start {
+		return nil, errors.Errorf("invalid range [%v, %v]", start, end)
+	}
+
+	// Tolerate the error of duration of ts files, which is about a frame.
+	const tolerance = 0.1
+
+	r := &RecordClipRange{}
+	var begin, first float64
+	for _, file := range files {
+		fileEnd := begin + file.Duration
+		if fileEnd <= start+tolerance {
+			begin = fileEnd
+			continue
+		}
+		if begin >= end {
+			break
+		}
+
+		if len(r.Files) == 0 {
+			first, r.Offset = begin, math.Max(0, start-begin)
+			if r.Offset < tolerance {
+				r.Offset, r.Copy = 0, true
+			}
+		}
+		r.Files = append(r.Files, file)
+		begin = fileEnd
+	}
+
+	if len(r.Files) == 0 {
+		return nil, errors.Errorf("range [%v, %v] exceeds duration %v", start, end, begin)
+	}
+
+	// Limit the end to the duration of source.
+	r.Duration = math.Min(end, begin) - (first + r.Offset)
+	return r, nil
+}
+
+// loadClipSource load the artifact of source to extract clip. For stream, use the artifact of the
+// recording task, and the range is relative to the begin of record.
+func (v *RecordWorker) loadClipSource(ctx context.Context, sourceType FFprobeSourceType, source string) (*M3u8VoDArtifact, error) {
+	if sourceType == FFprobeSourceTypeStream {
+		app, stream, err := ParseRecordStream(source)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parse stream")
+		}
+
+		task := v.QueryStreamTask(app, stream)
+		if task == nil {
+			return nil, errors.Errorf("stream %v is not recording", source)
+		}
+
+		task.lock.Lock()
+		defer task.lock.Unlock()
+		if task.artifact == nil {
+			return nil, errors.Errorf("no artifact of stream %v", source)
+		}
+
+		artifact := *task.artifact
+		artifact.Files = append([]*TsFile{}, task.artifact.Files...)
+		return &artifact, nil
+	}
+
+	key := SRS_RECORD_M3U8_ARTIFACT
+	if sourceType == FFprobeSourceTypeDVR {
+		key = SRS_DVR_M3U8_ARTIFACT
+	} else if sourceType == FFprobeSourceTypeVoD {
+		key = SRS_VOD_M3U8_ARTIFACT
+	} else if sourceType != FFprobeSourceTypeRecord {
+		return nil, errors.Errorf("invalid type %v", sourceType)
+	}
+
+	var artifact M3u8VoDArtifact
+	if b, err := rdb.HGet(ctx, key, source).Result(); err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hget %v %v", key, source)
+	} else if b == "" {
+		return nil, errors.Errorf("no artifact %v of %v", source, sourceType)
+	} else if err = json.Unmarshal([]byte(b), &artifact); err != nil {
+		return nil, errors.Wrapf(err, "unmarshal %v", b)
+	}
+	return &artifact, nil
+}
+
+// extractClip extract the clip of job to a new record artifact.
+func (v *RecordWorker) extractClip(ctx context.Context, clip *RecordClip) error {
+	source, err := v.loadClipSource(ctx, clip.Type, clip.Source)
+	if err != nil {
+		return errors.Wrapf(err, "load source")
+	}
+
+	r, err := NewRecordClipRange(source.Files, clip.Start, clip.End)
+	if err != nil {
+		return errors.Wrapf(err, "range of %v", source.String())
+	}
+
+	clipDir := path.Join("record", clip.UUID)
+	if err := os.MkdirAll(clipDir, 0755); err != nil {
+		return errors.Wrapf(err, "mkdir %v", clipDir)
+	}
+
+	// Build the HLS of selected ts files, as input of FFmpeg. For local record, the ts file is relative
+	// to the record directory, while for DVR and VoD, it's the URL of COS.
+	var m3u8Body string
+	if clip.Type == FFprobeSourceTypeRecord || clip.Type == FFprobeSourceTypeStream {
+		_, m3u8Body, _, err = buildVodM3u8ForLocal(ctx, r.Files, true, "../../")
+	} else {
+		selected := *source
+		selected.Files = r.Files
+		_, m3u8Body, _, err = buildVodM3u8(ctx, &selected, true, "", false, "")
+	}
+	if err != nil {
+		return errors.Wrapf(err, "build hls of %v", source.String())
+	}
+
+	input := path.Join(clipDir, "source.m3u8")
+	if err := os.WriteFile(input, []byte(m3u8Body), 0644); err != nil {
+		return errors.Wrapf(err, "write %v", input)
+	}
+	defer os.Remove(input)
+
+	// Stream copy if start at keyframe, or re-encode to cut at the exact frame.
+	tsid := uuid.NewString()
+	tsFile := path.Join(clipDir, fmt.Sprintf("%v.ts", tsid))
+	args := []string{"-protocol_whitelist", "file,http,https,tcp,tls,crypto"}
+	if r.Copy {
+		clip.Mode = RecordClipModeCopy
+		args = append(args, "-i", input, "-t", fmt.Sprintf("%.3f", r.Duration), "-c", "copy")
+	} else {
+		clip.Mode = RecordClipModeEncode
+		args = append(args, "-ss", fmt.Sprintf("%.3f", r.Offset), "-i", input,
+			"-t", fmt.Sprintf("%.3f", r.Duration), "-c:v", "libx264", "-preset", "veryfast", "-c:a", "aac",
+		)
+	}
+	args = append(args, "-f", "mpegts", "-y", tsFile)
+	if b, err := exec.CommandContext(ctx, "ffmpeg", args...).CombinedOutput(); err != nil {
+		return errors.Wrapf(err, "ffmpeg %v, %v", strings.Join(args, " "), string(b))
+	}
+
+	stats, err := os.Stat(tsFile)
+	if err != nil {
+		return errors.Wrapf(err, "stat %v", tsFile)
+	}
+
+	// Save the clip as a new record artifact.
+	now := time.Now().Format(time.RFC3339)
+	artifact := &M3u8VoDArtifact{
+		UUID: clip.UUID, M3u8URL: source.M3u8URL, Vhost: source.Vhost, App: source.App, Stream: source.Stream,
+		NN: 1, Update: now, Begin: now, Done: now, Clip: path.Join(string(clip.Type), clip.Source),
+		Files: []*TsFile{{
+			Key: tsFile, TsID: tsid, URL: source.M3u8URL, Duration: r.Duration, Size: uint64(stats.Size()),
+		}},
+	}
+	if err := remuxRecordArtifact(ctx, artifact); err != nil {
+		return errors.Wrapf(err, "remux %v", artifact.String())
+	}
+
+	if b, err := json.Marshal(artifact); err != nil {
+		return errors.Wrapf(err, "marshal %v", artifact.String())
+	} else if err := rdb.HSet(ctx, SRS_RECORD_M3U8_ARTIFACT, artifact.UUID, string(b)).Err(); err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hset %v %v %v", SRS_RECORD_M3U8_ARTIFACT, artifact.UUID, string(b))
+	}
+	v.queuePreview(ctx, artifact.UUID)
+
+	clip.URL = fmt.Sprintf("/terraform/v1/hooks/record/hls/%v/index.mp4", clip.UUID)
+	logger.Tf(ctx, "record clip ok, %v, files=%v, offset=%v, duration=%v, size=%v",
+		clip.String(), len(r.Files), r.Offset, r.Duration, stats.Size())
+	return nil
+}
+
+// saveClip save the job to redis, and remove the oldest finished jobs.
+func saveClip(ctx context.Context, clip *RecordClip) error {
+	clip.Update = time.Now().Format(time.RFC3339)
+	if b, err := json.Marshal(clip); err != nil {
+		return errors.Wrapf(err, "marshal %v", clip.String())
+	} else if err := rdb.HSet(ctx, SRS_RECORD_CLIP, clip.UUID, string(b)).Err(); err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hset %v %v %v", SRS_RECORD_CLIP, clip.UUID, string(b))
+	}
+
+	clips, err := loadRecordClips(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "load clips")
+	}
+
+	for i := 0; len(clips)-i > recordClipMaxJobs; i++ {
+		if obj := clips[i]; obj.Status == RecordClipDone || obj.Status == RecordClipFailed {
+			if err := rdb.HDel(ctx, SRS_RECORD_CLIP, obj.UUID).Err(); err != nil && err != redis.Nil {
+				return errors.Wrapf(err, "hdel %v %v", SRS_RECORD_CLIP, obj.UUID)
+			}
+		}
+	}
+	return nil
+}
+
+// loadRecordClips load all clip jobs, sorted by the create time.
+func loadRecordClips(ctx context.Context) ([]*RecordClip, error) {
+	objs, err := rdb.HGetAll(ctx, SRS_RECORD_CLIP).Result()
+	if err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hgetall %v", SRS_RECORD_CLIP)
+	}
+
+	clips := []*RecordClip{}
+	for id, obj := range objs {
+		var clip RecordClip
+		if err := json.Unmarshal([]byte(obj), &clip); err != nil {
+			return nil, errors.Wrapf(err, "unmarshal %v %v", id, obj)
+		}
+		clips = append(clips, &clip)
+	}
+
+	sort.Slice(clips, func(i, j int) bool {
+		return clips[i].Created < clips[j].Created
+	})
+	return clips, nil
+}
+
+// startClip start a job to extract clips one by one, and resume the unfinished jobs.
+func (v *RecordWorker) startClip(ctx context.Context) error {
+	clips, err := loadRecordClips(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "load clips")
+	}
+
+	for _, clip := range clips {
+		if clip.Status == RecordClipPending || clip.Status == RecordClipProcessing {
+			select {
+			case v.clips <- clip:
+			default:
+				logger.Wf(ctx, "ignore clip %v for queue is full", clip.String())
+			}
+		}
+	}
+
+	v.wg.Add(1)
+	go func() {
+		defer v.wg.Done()
+
+		for ctx.Err() == nil {
+			var clip *RecordClip
+			select {
+			case <-ctx.Done():
+				return
+			case clip = <-v.clips:
+			}
+
+			clip.Status = RecordClipProcessing
+			if err := saveClip(ctx, clip); err != nil {
+				logger.Wf(ctx, "ignore save clip %v err %+v", clip.String(), err)
+			}
+
+			if err := v.extractClip(ctx, clip); err != nil {
+				clip.Status, clip.Error = RecordClipFailed, err.Error()
+				os.RemoveAll(path.Join("record", clip.UUID))
+				logger.Wf(ctx, "record clip %v err %+v", clip.String(), err)
+			} else {
+				clip.Status = RecordClipDone
+			}
+
+			if err := saveClip(ctx, clip); err != nil {
+				logger.Wf(ctx, "ignore save clip %v err %+v", clip.String(), err)
+			}
+		}
+	}()
+	return nil
+}
+
+func (v *RecordWorker) handleClip(ctx context.Context, handler *http.ServeMux) error {
+	ep := "/terraform/v1/hooks/record/clip/create"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := func() error {
+			var token, sourceType, source, streamURL, start, end string
+			if err := ParseBody(ctx, r.Body, &struct {
+				Token  *string `json:"token"`
+				Type   *string `json:"type"`
+				UUID   *string `json:"uuid"`
+				Stream *string `json:"stream"`
+				Start  *string `json:"start"`
+				End    *string `json:"end"`
+			}{
+				Token: &token, Type: &sourceType, UUID: &source, Stream: &streamURL, Start: &start, End: &end,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			// Use the recording task of stream, if specified the stream.
+			if streamURL != "" {
+				app, stream, err := ParseRecordStream(streamURL)
+				if err != nil {
+					return errors.Wrapf(err, "parse stream")
+				}
+				sourceType, source = string(FFprobeSourceTypeStream), fmt.Sprintf("/%v/%v", app, stream)
+			} else if sourceType == "" {
+				sourceType = string(FFprobeSourceTypeRecord)
+			}
+
+			clip := &RecordClip{
+				UUID: uuid.NewString(), Type: FFprobeSourceType(sourceType), Source: source,
+				Status: RecordClipPending, Created: time.Now().Format(time.RFC3339),
+			}
+			if clip.Source == "" {
+				return errors.New("no uuid or stream")
+			}
+			if clip.Type != FFprobeSourceTypeRecord && clip.Type != FFprobeSourceTypeDVR &&
+				clip.Type != FFprobeSourceTypeVoD && clip.Type != FFprobeSourceTypeStream {
+				return errors.Errorf("invalid type %v", clip.Type)
+			}
+
+			var err error
+			if clip.Start, err = ParseClipTime(start); err != nil {
+				return errors.Wrapf(err, "parse start")
+			}
+			if clip.End, err = ParseClipTime(end); err != nil {
+				return errors.Wrapf(err, "parse end")
+			}
+
+			// Check the source and range, before queue the job.
+			if obj, err := v.loadClipSource(ctx, clip.Type, clip.Source); err != nil {
+				return errors.Wrapf(err, "load source")
+			} else if _, err := NewRecordClipRange(obj.Files, clip.Start, clip.End); err != nil {
+				return errors.Wrapf(err, "range of %v", obj.String())
+			}
+
+			if err := saveClip(ctx, clip); err != nil {
+				return errors.Wrapf(err, "save clip %v", clip.String())
+			}
+
+			select {
+			case v.clips <- clip:
+			default:
+				return errors.Errorf("too many clip jobs")
+			}
+
+			ohttp.WriteData(ctx, w, r, clip)
+			logger.Tf(ctx, "record clip create ok, %v, token=%vB", clip.String(), len(token))
+			return nil
+		}(); err != nil {
+			ohttp.WriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/terraform/v1/hooks/record/clip/query"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := func() error {
+			var token, clipUUID string
+			if err := ParseBody(ctx, r.Body, &struct {
+				Token *string `json:"token"`
+				UUID  *string `json:"uuid"`
+			}{
+				Token: &token, UUID: &clipUUID,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			clips, err := loadRecordClips(ctx)
+			if err != nil {
+				return errors.Wrapf(err, "load clips")
+			}
+
+			if clipUUID != "" {
+				var matched []*RecordClip
+				for _, clip := range clips {
+					if clip.UUID == clipUUID {
+						matched = append(matched, clip)
+					}
+				}
+				if len(matched) == 0 {
+					return errors.Errorf("no clip %v", clipUUID)
+				}
+				clips = matched
+			}
+
+			ohttp.WriteData(ctx, w, r, clips)
+			logger.Tf(ctx, "record clip query ok, uuid=%v, clips=%v, token=%vB", clipUUID, len(clips), len(token))
+			return nil
+		}(); err != nil {
+			ohttp.WriteError(ctx, w, r, err)
+		}
+	})
+
+	return nil
+}
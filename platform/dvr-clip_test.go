@@ -0,0 +1,71 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestRecordClip_ParseClipTime(t *testing.T) {
+	for _, c := range []struct {
+		s string
+		v float64
+	}{
+		{"750", 750}, {"750.5", 750.5}, {"12:30", 750}, {"00:12:30", 750}, {"1:02:03.5", 3723.5},
+	} {
+		if v, err := ParseClipTime(c.s); err != nil {
+			t.Errorf("parse %v err %+v", c.s, err)
+		} else if v != c.v {
+			t.Errorf("parse %v got %v, expect %v", c.s, v, c.v)
+		}
+	}
+
+	for _, s := range []string{"", "abc", "-1", "12:60", "1:2:3:4", "12:"} {
+		if _, err := ParseClipTime(s); err == nil {
+			t.Errorf("parse %v should fail", s)
+		}
+	}
+}
+
+func TestRecordClip_NewRecordClipRange(t *testing.T) {
+	files := []*TsFile{
+		{TsID: "0", Duration: 10}, {TsID: "1", Duration: 10}, {TsID: "2", Duration: 10}, {TsID: "3", Duration: 10},
+	}
+
+	// Start at boundary of ts file, stream copy.
+	if r, err := NewRecordClipRange(files, 10, 25); err != nil {
+		t.Errorf("range err %+v", err)
+	} else if !r.Copy || r.Offset != 0 || r.Duration != 15 || len(r.Files) != 2 || r.Files[0].TsID != "1" {
+		t.Errorf("invalid range %+v", r)
+	}
+
+	// Start in the middle of ts file, re-encode.
+	if r, err := NewRecordClipRange(files, 12.5, 30); err != nil {
+		t.Errorf("range err %+v", err)
+	} else if r.Copy || r.Offset != 2.5 || r.Duration != 17.5 || len(r.Files) != 2 || r.Files[1].TsID != "2" {
+		t.Errorf("invalid range %+v", r)
+	}
+
+	// Tolerate the error of duration, as start at the next boundary.
+	if r, err := NewRecordClipRange(files, 19.95, 21); err != nil {
+		t.Errorf("range err %+v", err)
+	} else if !r.Copy || len(r.Files) != 1 || r.Files[0].TsID != "2" || math.Abs(r.Duration-1) > 0.001 {
+		t.Errorf("invalid range %+v", r)
+	}
+
+	// Limit the end to the duration of source.
+	if r, err := NewRecordClipRange(files, 30, 100); err != nil {
+		t.Errorf("range err %+v", err)
+	} else if r.Duration != 10 || len(r.Files) != 1 {
+		t.Errorf("invalid range %+v", r)
+	}
+
+	if _, err := NewRecordClipRange(files, 20, 10); err == nil {
+		t.Errorf("should fail for invalid range")
+	}
+	if _, err := NewRecordClipRange(files, 40, 50); err == nil {
+		t.Errorf("should fail for exceeds duration")
+	}
+}
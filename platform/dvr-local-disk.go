@@ -40,11 +40,31 @@ type RecordWorker struct {
 	msgs chan *SrsOnHlsObject
 	// The streams we're recording, key is m3u8 URL in string, value is m3u8 object *RecordM3u8Stream.
 	streams sync.Map
+	// To wakeup the retention job, when policy changed.
+	retentionNotify chan struct{}
+	// The clip jobs to extract.
+	clips chan *RecordClip
+	// The runs of post-processing pipeline.
+	pipelines chan *RecordPipelineRun
+	// The UUID of artifacts to generate preview.
+	previews chan string
+	// The parts of record to finish, split while the stream is still recording.
+	parts chan *RecordPart
+
+	// The split policy, cached to avoid loading from redis for each ts file.
+	split *RecordSplit
+	// To protect the fields.
+	lock sync.Mutex
 }
 
 func NewRecordWorker() *RecordWorker {
 	return &RecordWorker{
-		msgs: make(chan *SrsOnHlsObject, 1024),
+		msgs:            make(chan *SrsOnHlsObject, 1024),
+		retentionNotify: make(chan struct{}, 1),
+		clips:           make(chan *RecordClip, 1024),
+		pipelines:       make(chan *RecordPipelineRun, 1024),
+		previews:        make(chan string, 1024),
+		parts:           make(chan *RecordPart, 1024),
 	}
 }
 
@@ -73,6 +93,10 @@ func (v *RecordWorker) Handle(ctx context.Context, handler *http.ServeMux) error
 				return errors.Wrapf(err, "hget %v globs", SRS_RECORD_PATTERNS)
 			} else if processCpDir, err := rdb.HGet(ctx, SRS_RECORD_PATTERNS, string(RecordPostProcessCpFile)).Result(); err != nil && err != redis.Nil {
 				return errors.Wrapf(err, "hget %v %v", SRS_RECORD_PATTERNS, string(RecordPostProcessCpFile))
+			} else if split, err := loadRecordSplit(ctx); err != nil {
+				return errors.Wrapf(err, "load split")
+			} else if manuals, err := loadRecordManuals(ctx); err != nil {
+				return errors.Wrapf(err, "load manuals")
 			} else {
 				globFilters := []string{}
 				if globs != "" {
@@ -90,11 +114,15 @@ func (v *RecordWorker) Handle(ctx context.Context, handler *http.ServeMux) error
 					Globs []string `json:"globs"`
 					// The post process to copy file to dir for record.
 					ProcessCpDir string `json:"processCpDir"`
+					// The policy to split record to parts.
+					Split *RecordSplit `json:"split"`
+					// The streams which are recorded on demand.
+					Manuals []*RecordManual `json:"manuals"`
 				}
 
 				ohttp.WriteData(ctx, w, r, &RecordQueryResult{
 					All: all == "true", Home: "/data/record", Globs: globFilters,
-					ProcessCpDir: processCpDir,
+					ProcessCpDir: processCpDir, Split: split, Manuals: manuals,
 				})
 			}
 
@@ -253,34 +281,8 @@ func (v *RecordWorker) Handle(ctx context.Context, handler *http.ServeMux) error
 				return errors.Wrapf(err, "parse %v", M3u8VoDMetadata)
 			}
 
-			// Remove all ts files.
-			for _, file := range metadata.Files {
-				if _, err := os.Stat(file.Key); err == nil {
-					os.Remove(file.Key)
-				}
-			}
-
-			// Remove m3u8 file.
-			m3u8File := path.Join("record", uuid, "index.m3u8")
-			if _, err := os.Stat(m3u8File); err == nil {
-				os.Remove(m3u8File)
-			}
-
-			// Remove mp4 file.
-			mp4File := path.Join("record", uuid, "index.mp4")
-			if _, err := os.Stat(mp4File); err == nil {
-				os.Remove(mp4File)
-			}
-
-			// Remove ts directory.
-			m3u8Directory := path.Join("record", uuid)
-			if _, err := os.Stat(m3u8Directory); err == nil {
-				os.RemoveAll(m3u8Directory)
-			}
-
-			// Remove HLS from list.
-			if err := rdb.HDel(ctx, SRS_RECORD_M3U8_ARTIFACT, uuid).Err(); err != nil && err != redis.Nil {
-				return errors.Wrapf(err, "hdel %v %v", SRS_RECORD_M3U8_ARTIFACT, uuid)
+			if err := removeRecordArtifact(ctx, &metadata); err != nil {
+				return errors.Wrapf(err, "remove %v", metadata.String())
 			}
 
 			ohttp.WriteData(ctx, w, r, nil)
@@ -314,7 +316,7 @@ func (v *RecordWorker) Handle(ctx context.Context, handler *http.ServeMux) error
 				return errors.New("no uuid")
 			}
 
-			task := recordWorker.QueryTask(uuid)
+			task := recordWorker.QuerySessionTask(uuid)
 			if task == nil {
 				return errors.Errorf("no record task for uuid=%v", uuid)
 			}
@@ -377,6 +379,10 @@ func (v *RecordWorker) Handle(ctx context.Context, handler *http.ServeMux) error
 					"nn":       len(metadata.Files),
 					"duration": duration,
 					"size":     size,
+					"keep":     metadata.Keep,
+					"session":  metadata.Session,
+					"part":     metadata.Part,
+					"preview":  recordPreviewURLs(&metadata),
 				})
 			}
 
@@ -513,6 +519,23 @@ func (v *RecordWorker) Handle(ctx context.Context, handler *http.ServeMux) error
 		return nil
 	}
 
+	previewHandler := func(w http.ResponseWriter, r *http.Request) error {
+		// Format is :uuid/poster.jpg
+		filename := r.URL.Path[len("/terraform/v1/hooks/record/hls/"):]
+		uuid, previewFile := path.Dir(filename), path.Base(filename)
+		if len(uuid) == 0 || strings.Contains(uuid, "/") {
+			return errors.Errorf("invalid uuid %v from %v of %v", uuid, filename, r.URL.Path)
+		}
+
+		if exists, err := rdb.HExists(ctx, SRS_RECORD_M3U8_ARTIFACT, uuid).Result(); err != nil && err != redis.Nil {
+			return errors.Wrapf(err, "hexists %v %v", SRS_RECORD_M3U8_ARTIFACT, uuid)
+		} else if !exists {
+			return errors.Errorf("no m3u8 of uuid=%v", uuid)
+		}
+
+		return servePreview(ctx, w, r, uuid, previewFile)
+	}
+
 	ep = "/terraform/v1/hooks/record/hls/"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
@@ -523,6 +546,9 @@ func (v *RecordWorker) Handle(ctx context.Context, handler *http.ServeMux) error
 				return tsHandler(w, r)
 			} else if strings.HasSuffix(r.URL.Path, ".mp4") {
 				return mp4Handler(w, r)
+			} else if strings.HasSuffix(r.URL.Path, ".jpg") || strings.HasSuffix(r.URL.Path, ".vtt") ||
+				strings.HasSuffix(r.URL.Path, ".gif") {
+				return previewHandler(w, r)
 			}
 
 			return errors.Errorf("invalid handler for %v", r.URL.Path)
@@ -531,6 +557,26 @@ func (v *RecordWorker) Handle(ctx context.Context, handler *http.ServeMux) error
 		}
 	})
 
+	if err := v.handleManual(ctx, handler); err != nil {
+		return errors.Wrapf(err, "handle manual")
+	}
+
+	if err := v.handleSplit(ctx, handler); err != nil {
+		return errors.Wrapf(err, "handle split")
+	}
+
+	if err := v.handleRetention(ctx, handler); err != nil {
+		return errors.Wrapf(err, "handle retention")
+	}
+
+	if err := v.handleClip(ctx, handler); err != nil {
+		return errors.Wrapf(err, "handle clip")
+	}
+
+	if err := v.handlePipeline(ctx, handler); err != nil {
+		return errors.Wrapf(err, "handle pipeline")
+	}
+
 	return nil
 }
 
@@ -571,6 +617,42 @@ func (v *RecordWorker) OnHlsTsMessage(ctx context.Context, msg *SrsOnHlsMessage)
 	return nil
 }
 
+// removeRecordArtifact remove the files and the artifact of record.
+func removeRecordArtifact(ctx context.Context, metadata *M3u8VoDArtifact) error {
+	uuid := metadata.UUID
+
+	// Remove all ts files.
+	for _, file := range metadata.Files {
+		if _, err := os.Stat(file.Key); err == nil {
+			os.Remove(file.Key)
+		}
+	}
+
+	// Remove m3u8 file.
+	m3u8File := path.Join("record", uuid, "index.m3u8")
+	if _, err := os.Stat(m3u8File); err == nil {
+		os.Remove(m3u8File)
+	}
+
+	// Remove mp4 file.
+	mp4File := path.Join("record", uuid, "index.mp4")
+	if _, err := os.Stat(mp4File); err == nil {
+		os.Remove(mp4File)
+	}
+
+	// Remove ts directory.
+	m3u8Directory := path.Join("record", uuid)
+	if _, err := os.Stat(m3u8Directory); err == nil {
+		os.RemoveAll(m3u8Directory)
+	}
+
+	// Remove HLS from list.
+	if err := rdb.HDel(ctx, SRS_RECORD_M3U8_ARTIFACT, uuid).Err(); err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hdel %v %v", SRS_RECORD_M3U8_ARTIFACT, uuid)
+	}
+	return nil
+}
+
 func (v *RecordWorker) Close() error {
 	if v.cancel != nil {
 		v.cancel()
@@ -579,10 +661,31 @@ func (v *RecordWorker) Close() error {
 	return nil
 }
 
+// QueryTask query the recording task by UUID of current part.
 func (v *RecordWorker) QueryTask(uuid string) *RecordM3u8Stream {
+	return v.queryTask(func(task *RecordM3u8Stream) bool {
+		return task.UUID == uuid
+	})
+}
+
+// QuerySessionTask query the recording task by UUID of current part, or the session of parts. Note
+// that the UUID of the first part equals to the session, so never use it to query a finished part.
+func (v *RecordWorker) QuerySessionTask(uuid string) *RecordM3u8Stream {
+	return v.queryTask(func(task *RecordM3u8Stream) bool {
+		return task.UUID == uuid || (task.artifact != nil && task.artifact.Session == uuid)
+	})
+}
+
+func (v *RecordWorker) queryTask(match func(task *RecordM3u8Stream) bool) *RecordM3u8Stream {
 	var target *RecordM3u8Stream
 	v.streams.Range(func(key, value interface{}) bool {
-		if task := value.(*RecordM3u8Stream); task.UUID == uuid {
+		task := value.(*RecordM3u8Stream)
+
+		task.lock.Lock()
+		matched := match(task)
+		task.lock.Unlock()
+
+		if matched {
 			target = task
 			return false
 		}
@@ -644,8 +747,14 @@ func (v *RecordWorker) Start(ctx context.Context) error {
 			}
 		}
 
+		// Ignore the glob filters, if the stream is recorded on demand.
+		manual, err := v.IsManual(ctx, msg.Msg.App, msg.Msg.Stream)
+		if err != nil {
+			return errors.Wrapf(err, "query manual")
+		}
+
 		// If glob filters are empty, ignore it, and record all streams.
-		if len(globFilters) > 0 {
+		if len(globFilters) > 0 && !manual {
 			var globMatched bool
 			streamURL := fmt.Sprintf("/%v/%v", msg.Msg.App, msg.Msg.Stream)
 			for _, globFilter := range globFilters {
@@ -701,6 +810,25 @@ func (v *RecordWorker) Start(ctx context.Context) error {
 		return nil
 	}
 
+	// Remove the records by retention policy.
+	v.startRetention(ctx)
+
+	// Extract the clips of artifacts or streams.
+	if err := v.startClip(ctx); err != nil {
+		return errors.Wrapf(err, "start clip")
+	}
+
+	// Run the post-processing pipeline of records.
+	if err := v.startPipeline(ctx); err != nil {
+		return errors.Wrapf(err, "start pipeline")
+	}
+
+	// Generate the preview of records.
+	v.startPreview(ctx)
+
+	// Finish the split parts of records.
+	v.startPart(ctx)
+
 	// Process all messages about HLS ts segments.
 	wg.Add(1)
 	go func() {
@@ -784,8 +912,8 @@ func (v *RecordM3u8Stream) saveArtifact(ctx context.Context, artifact *M3u8VoDAr
 
 	if b, err := json.Marshal(artifact); err != nil {
 		return errors.Wrapf(err, "marshal %v", artifact.String())
-	} else if err = rdb.HSet(ctx, SRS_RECORD_M3U8_ARTIFACT, v.UUID, string(b)).Err(); err != nil && err != redis.Nil {
-		return errors.Wrapf(err, "hset %v %v %v", SRS_RECORD_M3U8_ARTIFACT, v.UUID, string(b))
+	} else if err = rdb.HSet(ctx, SRS_RECORD_M3U8_ARTIFACT, artifact.UUID, string(b)).Err(); err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hset %v %v %v", SRS_RECORD_M3U8_ARTIFACT, artifact.UUID, string(b))
 	}
 	return nil
 }
@@ -897,6 +1025,7 @@ func (v *RecordM3u8Stream) Initialize(ctx context.Context, r *RecordWorker) erro
 			M3u8URL:    v.M3u8URL,
 			Processing: true,
 			Update:     time.Now().Format(time.RFC3339),
+			Begin:      time.Now().Format(time.RFC3339),
 		}
 		if err := v.saveArtifact(ctx, v.artifact); err != nil {
 			return errors.Wrapf(err, "save artifact %v", v.artifact.String())
@@ -962,7 +1091,7 @@ func (v *RecordM3u8Stream) Run(ctx context.Context) error {
 		}
 
 		// Do post processing.
-		if err := v.postProcessing(ctx); err != nil {
+		if err := v.postProcessing(ctx, v.artifact); err != nil {
 			return errors.Wrapf(err, "post processing")
 		}
 
@@ -1002,6 +1131,11 @@ func (v *RecordM3u8Stream) serveMessage(ctx context.Context, msg *SrsOnHlsObject
 		return err
 	}
 
+	// Start a new part if exceed the split policy, before consuming the ts file.
+	if err := v.splitPart(ctx, msg); err != nil {
+		logger.Wf(ctx, "ignore split %v err %+v", v.String(), err)
+	}
+
 	tsDir := path.Join("record", v.UUID)
 	key := path.Join(tsDir, fmt.Sprintf("%v.ts", msg.TsFile.TsID))
 	msg.TsFile.Key = key
@@ -1024,13 +1158,14 @@ func (v *RecordM3u8Stream) serveMessage(ctx context.Context, msg *SrsOnHlsObject
 	return nil
 }
 
-func (v *RecordM3u8Stream) finishM3u8(ctx context.Context) error {
-	contentType, m3u8Body, duration, err := buildVodM3u8ForLocal(ctx, v.artifact.Files, false, "")
+// remuxRecordArtifact generate the m3u8 and mp4 file of artifact.
+func remuxRecordArtifact(ctx context.Context, artifact *M3u8VoDArtifact) error {
+	contentType, m3u8Body, duration, err := buildVodM3u8ForLocal(ctx, artifact.Files, false, "")
 	if err != nil {
 		return errors.Wrapf(err, "build vod")
 	}
 
-	hls := path.Join("record", v.UUID, "index.m3u8")
+	hls := path.Join("record", artifact.UUID, "index.m3u8")
 	if f, err := os.OpenFile(hls, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644); err != nil {
 		return errors.Wrapf(err, "open file %v", hls)
 	} else {
@@ -1041,12 +1176,35 @@ func (v *RecordM3u8Stream) finishM3u8(ctx context.Context) error {
 	}
 	logger.Tf(ctx, "record to %v ok, type=%v, duration=%v", hls, contentType, duration)
 
-	mp4 := path.Join("record", v.UUID, "index.mp4")
+	mp4 := path.Join("record", artifact.UUID, "index.mp4")
 	if b, err := exec.CommandContext(ctx, "ffmpeg", "-i", hls, "-c", "copy", "-y", mp4).Output(); err != nil {
 		return errors.Wrapf(err, "covert to mp4 %v err %v", mp4, string(b))
 	}
 	logger.Tf(ctx, "record to %v ok", mp4)
 
+	return nil
+}
+
+// finishPart finish a part of record while the stream is still recording.
+func (v *RecordM3u8Stream) finishPart(ctx context.Context, artifact *M3u8VoDArtifact) error {
+	if err := remuxRecordArtifact(ctx, artifact); err != nil {
+		return errors.Wrapf(err, "remux %v", artifact.String())
+	}
+
+	v.finishArtifact(ctx, artifact)
+	if err := v.saveArtifact(ctx, artifact); err != nil {
+		return errors.Wrapf(err, "save artifact %v", artifact.String())
+	}
+
+	v.recordWorker.queuePreview(ctx, artifact.UUID)
+	return nil
+}
+
+func (v *RecordM3u8Stream) finishM3u8(ctx context.Context) error {
+	if err := remuxRecordArtifact(ctx, v.artifact); err != nil {
+		return errors.Wrapf(err, "remux %v", v.artifact.String())
+	}
+
 	// Remove object from worker.
 	v.recordWorker.streams.Delete(v.M3u8URL)
 
@@ -1054,6 +1212,9 @@ func (v *RecordM3u8Stream) finishM3u8(ctx context.Context) error {
 	v.finishArtifact(ctx, v.artifact)
 	r0 := v.saveArtifact(ctx, v.artifact)
 	r1 := v.deleteObject(ctx)
+	if r0 == nil {
+		v.recordWorker.queuePreview(ctx, v.artifact.UUID)
+	}
 	logger.Tf(ctx, "record cleanup ok, r0=%v, r1=%v", r0, r1)
 
 	// Do final cleanup, because new messages might arrive while converting to mp4, which takes a long time.
@@ -1066,26 +1227,6 @@ func (v *RecordM3u8Stream) finishM3u8(ctx context.Context) error {
 	return nil
 }
 
-func (v *RecordM3u8Stream) postProcessing(ctx context.Context) error {
-	processCpDir, err := rdb.HGet(ctx, SRS_RECORD_PATTERNS, string(RecordPostProcessCpFile)).Result()
-	if err != nil && err != redis.Nil {
-		return errors.Wrapf(err, "hget %v %v", SRS_RECORD_PATTERNS, string(RecordPostProcessCpFile))
-	}
-
-	if processCpDir == "" {
-		return nil
-	}
-
-	artifactPath := path.Join("record", v.UUID, "index.mp4")
-	targetPath := path.Join(processCpDir, fmt.Sprintf("%v.mp4", v.artifact.UUID))
-	if err = exec.CommandContext(ctx, "cp", "-f", artifactPath, targetPath).Run(); err != nil {
-		return errors.Wrapf(err, "cp %v to %v", artifactPath, targetPath)
-	}
-	logger.Tf(ctx, "record post process, cp %v to %v ok", artifactPath, targetPath)
-
-	return nil
-}
-
 func (v *RecordM3u8Stream) callbackBegin(ctx context.Context) (*SrsOnHlsObject, error) {
 	messages := v.copyMessages()
 	if len(messages) == 0 {
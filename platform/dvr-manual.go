@@ -0,0 +1,182 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ossrs/go-oryx-lib/errors"
+	ohttp "github.com/ossrs/go-oryx-lib/http"
+	"github.com/ossrs/go-oryx-lib/logger"
+	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
+	"github.com/go-redis/redis/v8"
+)
+
+// RecordManual is a stream which is recorded on demand, no matter the record is enabled for all
+// streams or not, and the glob filters are ignored.
+type RecordManual struct {
+	// The stream URL, for example, /live/livestream
+	Stream string `json:"stream"`
+	// The time when start recording.
+	Start string `json:"start"`
+}
+
+// ParseRecordStream parse the stream URL to app and stream, for example, /live/livestream
+func ParseRecordStream(streamURL string) (app, stream string, err error) {
+	parts := strings.Split(strings.Trim(streamURL, "/"), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", errors.Errorf("invalid stream %v, should be /app/stream", streamURL)
+	}
+	return parts[0], parts[1], nil
+}
+
+// IsManual whether the stream is recorded on demand.
+func (v *RecordWorker) IsManual(ctx context.Context, app, stream string) (bool, error) {
+	streamURL := fmt.Sprintf("/%v/%v", app, stream)
+	exists, err := rdb.HExists(ctx, SRS_RECORD_MANUAL, streamURL).Result()
+	if err != nil && err != redis.Nil {
+		return false, errors.Wrapf(err, "hexists %v %v", SRS_RECORD_MANUAL, streamURL)
+	}
+	return exists, nil
+}
+
+// QueryStreamTask query the recording task of stream.
+func (v *RecordWorker) QueryStreamTask(app, stream string) *RecordM3u8Stream {
+	var target *RecordM3u8Stream
+	v.streams.Range(func(key, value interface{}) bool {
+		task := value.(*RecordM3u8Stream)
+
+		task.lock.Lock()
+		matched := task.M3u8URL == fmt.Sprintf("%v/%v.m3u8", app, stream) ||
+			(task.artifact != nil && task.artifact.App == app && task.artifact.Stream == stream)
+		task.lock.Unlock()
+
+		if matched {
+			target = task
+			return false
+		}
+		return true
+	})
+	return target
+}
+
+// loadRecordManuals load the streams which are recorded on demand.
+func loadRecordManuals(ctx context.Context) ([]*RecordManual, error) {
+	objs, err := rdb.HGetAll(ctx, SRS_RECORD_MANUAL).Result()
+	if err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hgetall %v", SRS_RECORD_MANUAL)
+	}
+
+	manuals := []*RecordManual{}
+	for stream, obj := range objs {
+		var manual RecordManual
+		if err := json.Unmarshal([]byte(obj), &manual); err != nil {
+			return nil, errors.Wrapf(err, "unmarshal %v %v", stream, obj)
+		}
+		manuals = append(manuals, &manual)
+	}
+	return manuals, nil
+}
+
+func (v *RecordWorker) handleManual(ctx context.Context, handler *http.ServeMux) error {
+	ep := "/terraform/v1/hooks/record/start"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := func() error {
+			var token, streamURL string
+			if err := ParseBody(ctx, r.Body, &struct {
+				Token  *string `json:"token"`
+				Stream *string `json:"stream"`
+			}{
+				Token: &token, Stream: &streamURL,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			app, stream, err := ParseRecordStream(streamURL)
+			if err != nil {
+				return errors.Wrapf(err, "parse stream")
+			}
+
+			// Record the stream from the next ts file.
+			manual := &RecordManual{
+				Stream: fmt.Sprintf("/%v/%v", app, stream), Start: time.Now().Format(time.RFC3339),
+			}
+			if b, err := json.Marshal(manual); err != nil {
+				return errors.Wrapf(err, "marshal %v", manual.Stream)
+			} else if err := rdb.HSet(ctx, SRS_RECORD_MANUAL, manual.Stream, string(b)).Err(); err != nil && err != redis.Nil {
+				return errors.Wrapf(err, "hset %v %v %v", SRS_RECORD_MANUAL, manual.Stream, string(b))
+			}
+
+			ohttp.WriteData(ctx, w, r, manual)
+			logger.Tf(ctx, "record start ok, stream=%v, token=%vB", manual.Stream, len(token))
+			return nil
+		}(); err != nil {
+			ohttp.WriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/terraform/v1/hooks/record/stop"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := func() error {
+			var token, streamURL string
+			if err := ParseBody(ctx, r.Body, &struct {
+				Token  *string `json:"token"`
+				Stream *string `json:"stream"`
+			}{
+				Token: &token, Stream: &streamURL,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			app, stream, err := ParseRecordStream(streamURL)
+			if err != nil {
+				return errors.Wrapf(err, "parse stream")
+			}
+
+			manualStream := fmt.Sprintf("/%v/%v", app, stream)
+			if err := rdb.HDel(ctx, SRS_RECORD_MANUAL, manualStream).Err(); err != nil && err != redis.Nil {
+				return errors.Wrapf(err, "hdel %v %v", SRS_RECORD_MANUAL, manualStream)
+			}
+
+			// Make the task to expire, to finish the artifact immediately. Note that if the stream is
+			// also matched by the auto mode, a new record will start from the next ts file.
+			var uuid string
+			if task := v.QueryStreamTask(app, stream); task != nil {
+				task.lock.Lock()
+				task.Expired, uuid = true, task.UUID
+				task.lock.Unlock()
+			}
+
+			ohttp.WriteData(ctx, w, r, &struct {
+				Stream string `json:"stream"`
+				UUID   string `json:"uuid"`
+			}{
+				Stream: manualStream, UUID: uuid,
+			})
+			logger.Tf(ctx, "record stop ok, stream=%v, uuid=%v, token=%vB", manualStream, uuid, len(token))
+			return nil
+		}(); err != nil {
+			ohttp.WriteError(ctx, w, r, err)
+		}
+	})
+
+	return nil
+}
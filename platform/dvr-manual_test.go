@@ -0,0 +1,21 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import "testing"
+
+func TestRecordManual_ParseStream(t *testing.T) {
+	if app, stream, err := ParseRecordStream("/live/livestream"); err != nil || app != "live" || stream != "livestream" {
+		t.Errorf("invalid app=%v, stream=%v, err %+v", app, stream, err)
+	}
+	if app, stream, err := ParseRecordStream("live/livestream"); err != nil || app != "live" || stream != "livestream" {
+		t.Errorf("invalid app=%v, stream=%v, err %+v", app, stream, err)
+	}
+
+	for _, s := range []string{"", "/", "/live", "/live/", "/live/a/b"} {
+		if _, _, err := ParseRecordStream(s); err == nil {
+			t.Errorf("should fail for %v", s)
+		}
+	}
+}
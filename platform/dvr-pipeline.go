@@ -0,0 +1,1066 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/ossrs/go-oryx-lib/errors"
+	ohttp "github.com/ossrs/go-oryx-lib/http"
+	"github.com/ossrs/go-oryx-lib/logger"
+	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
+	"github.com/go-redis/redis/v8"
+	"github.com/sashabaranov/go-openai"
+)
+
+// RecordPipelineStepType is the type of step in the post-processing pipeline of record.
+type RecordPipelineStepType string
+
+const (
+	// Copy the file to a local directory.
+	RecordPipelineStepCopy RecordPipelineStepType = "cp"
+	// Transcode the file by the encode profile, and the following steps use the transcoded file.
+	RecordPipelineStepTranscode RecordPipelineStepType = "transcode"
+	// Upload the file to S3 compatible storage.
+	RecordPipelineStepS3 RecordPipelineStepType = "s3"
+	// Upload the file to SFTP server.
+	RecordPipelineStepSFTP RecordPipelineStepType = "sftp"
+	// Notify the HTTP webhook.
+	RecordPipelineStepWebhook RecordPipelineStepType = "webhook"
+	// Generate the transcript by AI, as SRT file.
+	RecordPipelineStepTranscript RecordPipelineStepType = "transcript"
+	// Delete the local copy of record, must be the last step.
+	RecordPipelineStepDelete RecordPipelineStepType = "delete"
+)
+
+// The status of pipeline run and step.
+const (
+	RecordPipelinePending = "pending"
+	RecordPipelineRunning = "running"
+	RecordPipelineDone    = "done"
+	RecordPipelineFailed  = "failed"
+)
+
+const (
+	// The max number of steps in pipeline.
+	recordPipelineMaxSteps = 10
+	// The max number of log lines of each step.
+	recordPipelineMaxLogs = 50
+	// The max number of pipeline runs to keep.
+	recordPipelineMaxRuns = 500
+	// The mask of credentials in response.
+	recordPipelineSecretMask = "******"
+	// The max size of file to upload to S3 by a single PUT, please use SFTP for larger file.
+	recordPipelineS3MaxSize = 5 * 1024 * 1024 * 1024
+	// The min speed in bytes per second to upload, to limit the duration of upload.
+	recordPipelineMinSpeed = 128 * 1024
+)
+
+// The HTTP client for pipeline, with timeouts for connecting and response, never block for ever.
+var recordPipelineClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+		TLSHandshakeTimeout:   30 * time.Second,
+		ResponseHeaderTimeout: 60 * time.Second,
+		IdleConnTimeout:       90 * time.Second,
+	},
+}
+
+// RecordPipelineStep is a step of pipeline, the fields are used by the type of step.
+type RecordPipelineStep struct {
+	Type RecordPipelineStepType `json:"type"`
+	// The number of retries when failed, no retry if 0.
+	Retries int `json:"retries,omitempty"`
+
+	// For cp, the target directory.
+	Dir string `json:"dir,omitempty"`
+	// For transcode, the ID of encode profile.
+	Profile string `json:"profile,omitempty"`
+	// For webhook, the URL to POST to. For SFTP, the URL of directory, such as sftp://host:22/upload/
+	URL string `json:"url,omitempty"`
+
+	// For S3, the endpoint such as https://s3.us-east-1.amazonaws.com, the object is in path style. Note
+	// that the file is uploaded by a single PUT, so it should not exceed 5GB.
+	Endpoint  string `json:"endpoint,omitempty"`
+	Region    string `json:"region,omitempty"`
+	Bucket    string `json:"bucket,omitempty"`
+	AccessKey string `json:"accessKey,omitempty"`
+	SecretKey string `json:"secretKey,omitempty"`
+	// For S3, the prefix of object key, such as records/
+	Prefix string `json:"prefix,omitempty"`
+
+	// For SFTP, the user and password, or the private key file with optional passphrase, and the optional
+	// SHA256 of host key. Note that the SHA256 of host key requires curl 7.80+.
+	User       string `json:"user,omitempty"`
+	Password   string `json:"password,omitempty"`
+	KeyFile    string `json:"keyFile,omitempty"`
+	Passphrase string `json:"passphrase,omitempty"`
+	HostKey    string `json:"hostKey,omitempty"`
+}
+
+func (v *RecordPipelineStep) String() string {
+	return fmt.Sprintf("type=%v, retries=%v", v.Type, v.Retries)
+}
+
+// Redacted get a copy of step with the credentials masked, to store in runs or response to client.
+func (v *RecordPipelineStep) Redacted() *RecordPipelineStep {
+	step := *v
+	for _, secret := range []*string{&step.AccessKey, &step.SecretKey, &step.Password, &step.Passphrase} {
+		if *secret != "" {
+			*secret = recordPipelineSecretMask
+		}
+	}
+	return &step
+}
+
+// RestoreSecrets restore the masked credentials from the previous step, because the client only got the
+// masked credentials by query.
+func (v *RecordPipelineStep) RestoreSecrets(previous *RecordPipelineStep) {
+	if previous == nil || previous.Type != v.Type {
+		return
+	}
+	if v.AccessKey == recordPipelineSecretMask {
+		v.AccessKey = previous.AccessKey
+	}
+	if v.SecretKey == recordPipelineSecretMask {
+		v.SecretKey = previous.SecretKey
+	}
+	if v.Password == recordPipelineSecretMask {
+		v.Password = previous.Password
+	}
+	if v.Passphrase == recordPipelineSecretMask {
+		v.Passphrase = previous.Passphrase
+	}
+}
+
+func (v *RecordPipelineStep) Validate() error {
+	if v.Retries < 0 || v.Retries > 10 {
+		return errors.Errorf("invalid retries %v", v.Retries)
+	}
+
+	switch v.Type {
+	case RecordPipelineStepCopy:
+		if v.Dir == "" {
+			return errors.New("no dir")
+		}
+		if _, err := os.Stat(v.Dir); err != nil {
+			return errors.Wrapf(err, "stat dir %v", v.Dir)
+		}
+	case RecordPipelineStepTranscode:
+		if v.Profile == "" {
+			return errors.New("no profile")
+		}
+	case RecordPipelineStepS3:
+		if v.Endpoint == "" || v.Bucket == "" || v.AccessKey == "" || v.SecretKey == "" {
+			return errors.New("no endpoint, bucket, accessKey or secretKey")
+		}
+		if v.Region == "" {
+			v.Region = "us-east-1"
+		}
+	case RecordPipelineStepSFTP:
+		if !strings.HasPrefix(v.URL, "sftp://") {
+			return errors.Errorf("invalid url %v", v.URL)
+		}
+		if v.User == "" {
+			return errors.New("no user")
+		}
+		// The user, password and passphrase are written to the config of curl, so the control characters
+		// such as CR or LF should never be allowed, which might inject other options.
+		for _, value := range []string{v.User, v.Password, v.Passphrase} {
+			if strings.IndexFunc(value, unicode.IsControl) >= 0 {
+				return errors.New("control characters in user, password or passphrase")
+			}
+		}
+		if v.Passphrase != "" && v.KeyFile == "" {
+			return errors.New("no keyFile for passphrase")
+		}
+	case RecordPipelineStepWebhook:
+		if !strings.HasPrefix(v.URL, "http://") && !strings.HasPrefix(v.URL, "https://") {
+			return errors.Errorf("invalid url %v", v.URL)
+		}
+	case RecordPipelineStepTranscript, RecordPipelineStepDelete:
+	default:
+		return errors.Errorf("invalid type %v", v.Type)
+	}
+	return nil
+}
+
+// RecordPipeline is the ordered steps to process the record when finished.
+type RecordPipeline struct {
+	Steps []*RecordPipelineStep `json:"steps"`
+}
+
+func (v *RecordPipeline) String() string {
+	var steps []string
+	for _, step := range v.Steps {
+		steps = append(steps, string(step.Type))
+	}
+	return fmt.Sprintf("steps=[%v]", strings.Join(steps, ","))
+}
+
+func (v *RecordPipeline) Validate() error {
+	if len(v.Steps) > recordPipelineMaxSteps {
+		return errors.Errorf("too many steps %v", len(v.Steps))
+	}
+
+	for index, step := range v.Steps {
+		if step == nil {
+			return errors.Errorf("no step %v", index)
+		}
+		if err := step.Validate(); err != nil {
+			return errors.Wrapf(err, "step %v %v", index, step.String())
+		}
+		// The local copy is required by other steps, so delete must be the last one.
+		if step.Type == RecordPipelineStepDelete && index != len(v.Steps)-1 {
+			return errors.Errorf("step %v delete should be the last", index)
+		}
+	}
+	return nil
+}
+
+// RecordPipelineStepRun is the status of a step in a run.
+type RecordPipelineStepRun struct {
+	// The index of step in pipeline, and the redacted copy of step. The credentials are loaded from the
+	// pipeline when running, so they are never stored in runs.
+	Index int                 `json:"index"`
+	Step  *RecordPipelineStep `json:"step"`
+	// The status of step, and the error of last attempt.
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	// The number of attempts.
+	Attempts int `json:"attempts"`
+	// The logs of step.
+	Logs []string `json:"logs"`
+}
+
+func (v *RecordPipelineStepRun) logf(format string, a ...interface{}) {
+	line := fmt.Sprintf("%v %v", time.Now().Format(time.RFC3339), fmt.Sprintf(format, a...))
+	v.Logs = append(v.Logs, line)
+	if len(v.Logs) > recordPipelineMaxLogs {
+		v.Logs = v.Logs[len(v.Logs)-recordPipelineMaxLogs:]
+	}
+}
+
+// RecordPipelineRun is a run of pipeline for a record artifact.
+type RecordPipelineRun struct {
+	// The UUID of record artifact.
+	UUID string `json:"uuid"`
+	// The status of run.
+	Status string `json:"status"`
+	// The current file to process, such as record/:uuid/index.mp4, changed by transcode step.
+	File string `json:"file"`
+	// The extra files generated by steps, such as record/:uuid/transcript.srt, which are uploaded with
+	// the current file by the following steps.
+	Outputs []string `json:"outputs,omitempty"`
+	// The status of each step.
+	Steps []*RecordPipelineStepRun `json:"steps"`
+	// The create and update time of run.
+	Created string `json:"created"`
+	Update  string `json:"update"`
+}
+
+func (v *RecordPipelineRun) String() string {
+	return fmt.Sprintf("uuid=%v, status=%v, file=%v, steps=%v", v.UUID, v.Status, v.File, len(v.Steps))
+}
+
+// NewRecordPipelineRun create a run of pipeline for the artifact.
+func NewRecordPipelineRun(uuid string, pipeline *RecordPipeline) *RecordPipelineRun {
+	run := &RecordPipelineRun{
+		UUID: uuid, Status: RecordPipelinePending, File: path.Join("record", uuid, "index.mp4"),
+		Created: time.Now().Format(time.RFC3339),
+	}
+	for index, step := range pipeline.Steps {
+		run.Steps = append(run.Steps, &RecordPipelineStepRun{
+			Index: index, Step: step.Redacted(), Status: RecordPipelinePending,
+		})
+	}
+	return run
+}
+
+// AddOutput add the file generated by step, ignore if already exists for the step might be retried.
+func (v *RecordPipelineRun) AddOutput(file string) {
+	for _, output := range v.Outputs {
+		if output == file {
+			return
+		}
+	}
+	v.Outputs = append(v.Outputs, file)
+}
+
+// Reset the failed steps to retry the run, the finished steps are not run again.
+func (v *RecordPipelineRun) Reset() {
+	v.Status = RecordPipelinePending
+	for _, step := range v.Steps {
+		if step.Status != RecordPipelineDone {
+			step.Status, step.Error, step.Attempts = RecordPipelinePending, "", 0
+		}
+	}
+}
+
+// RecordPipelineTarget get the name of file to store in target, for example, :uuid.mp4 for the
+// original record, or :uuid-:base for the file generated by steps.
+func RecordPipelineTarget(uuid, file string) string {
+	if base := path.Base(file); base != "index.mp4" {
+		return fmt.Sprintf("%v-%v", uuid, base)
+	}
+	return fmt.Sprintf("%v.mp4", uuid)
+}
+
+// CurlUserConfig build the config of curl for the user and password, and the optional passphrase of
+// private key, to read by -K from stdin. The value is quoted, so the backslash and double quote should
+// be escaped.
+func CurlUserConfig(user, password, passphrase string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+	config := fmt.Sprintf("user = \"%v:%v\"\n", replacer.Replace(user), replacer.Replace(password))
+	if passphrase != "" {
+		config += fmt.Sprintf("pass = \"%v\"\n", replacer.Replace(passphrase))
+	}
+	return config
+}
+
+// ParseCurlVersion parse the major and minor version from the output of curl --version, for example:
+//
+//	curl 7.68.0 (x86_64-pc-linux-gnu) libcurl/7.68.0 OpenSSL/1.1.1f zlib/1.2.11
+func ParseCurlVersion(output string) (major, minor int, err error) {
+	fields := strings.Fields(output)
+	if len(fields) < 2 || fields[0] != "curl" {
+		return 0, 0, errors.Errorf("invalid curl version %v", output)
+	}
+
+	versions := strings.Split(fields[1], ".")
+	if len(versions) < 2 {
+		return 0, 0, errors.Errorf("invalid version %v", fields[1])
+	}
+	if major, err = strconv.Atoi(versions[0]); err != nil {
+		return 0, 0, errors.Wrapf(err, "parse major %v", versions[0])
+	}
+	if minor, err = strconv.Atoi(versions[1]); err != nil {
+		return 0, 0, errors.Wrapf(err, "parse minor %v", versions[1])
+	}
+	return
+}
+
+// SignS3Request sign the request by AWS Signature Version 4, all headers of request are signed. The
+// payload hash is from header x-amz-content-sha256, or UNSIGNED-PAYLOAD if not set.
+func SignS3Request(r *http.Request, accessKey, secretKey, region string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	r.Header.Set("x-amz-date", amzDate)
+
+	payloadHash := r.Header.Get("x-amz-content-sha256")
+	if payloadHash == "" {
+		payloadHash = "UNSIGNED-PAYLOAD"
+		r.Header.Set("x-amz-content-sha256", payloadHash)
+	}
+
+	host := r.Host
+	if host == "" {
+		host = r.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for k, values := range r.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+
+	var names []string
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(fmt.Sprintf("%v:%v\n", k, headers[k]))
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalURI := r.URL.EscapedPath()
+	if canonicalURI == "" {
+		canonicalURI = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		r.Method, canonicalURI, strings.ReplaceAll(r.URL.Query().Encode(), "+", "%20"),
+		canonicalHeaders.String(), signedHeaders, payloadHash,
+	}, "\n")
+
+	hash := func(s string) string {
+		b := sha256.Sum256([]byte(s))
+		return hex.EncodeToString(b[:])
+	}
+	hmacSHA256 := func(key []byte, s string) []byte {
+		h := hmac.New(sha256.New, key)
+		h.Write([]byte(s))
+		return h.Sum(nil)
+	}
+
+	scope := fmt.Sprintf("%v/%v/s3/aws4_request", date, region)
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, hash(canonicalRequest)}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	r.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%v/%v, SignedHeaders=%v, Signature=%v",
+		accessKey, scope, signedHeaders, signature,
+	))
+}
+
+// loadRecordPipeline load the pipeline of record. For compatibility, the post-cp-file is the first step.
+func loadRecordPipeline(ctx context.Context) (*RecordPipeline, error) {
+	pipeline, err := loadRecordPipelineSteps(ctx)
+	if err != nil {
+		return nil, errors.Wrapf(err, "load pipeline")
+	}
+
+	if processCpDir, err := rdb.HGet(ctx, SRS_RECORD_PATTERNS, string(RecordPostProcessCpFile)).Result(); err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hget %v %v", SRS_RECORD_PATTERNS, string(RecordPostProcessCpFile))
+	} else if processCpDir != "" {
+		pipeline.Steps = append([]*RecordPipelineStep{{
+			Type: RecordPipelineStepCopy, Dir: processCpDir,
+		}}, pipeline.Steps...)
+	}
+	return pipeline, nil
+}
+
+// loadRecordPipelineSteps load the steps of pipeline configured by user.
+func loadRecordPipelineSteps(ctx context.Context) (*RecordPipeline, error) {
+	pipeline := &RecordPipeline{Steps: []*RecordPipelineStep{}}
+	if value, err := rdb.HGet(ctx, SRS_RECORD_PATTERNS, "pipeline").Result(); err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hget %v pipeline", SRS_RECORD_PATTERNS)
+	} else if value != "" {
+		if err := json.Unmarshal([]byte(value), pipeline); err != nil {
+			return nil, errors.Wrapf(err, "unmarshal %v", value)
+		}
+	}
+	return pipeline, nil
+}
+
+// saveRecordPipelineRun save the run to redis, and remove the oldest finished runs.
+func saveRecordPipelineRun(ctx context.Context, run *RecordPipelineRun) error {
+	run.Update = time.Now().Format(time.RFC3339)
+	if b, err := json.Marshal(run); err != nil {
+		return errors.Wrapf(err, "marshal %v", run.String())
+	} else if err := rdb.HSet(ctx, SRS_RECORD_PIPELINE, run.UUID, string(b)).Err(); err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hset %v %v %v", SRS_RECORD_PIPELINE, run.UUID, string(b))
+	}
+
+	runs, err := loadRecordPipelineRuns(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "load runs")
+	}
+
+	for i := 0; len(runs)-i > recordPipelineMaxRuns; i++ {
+		if obj := runs[i]; obj.Status == RecordPipelineDone || obj.Status == RecordPipelineFailed {
+			if err := rdb.HDel(ctx, SRS_RECORD_PIPELINE, obj.UUID).Err(); err != nil && err != redis.Nil {
+				return errors.Wrapf(err, "hdel %v %v", SRS_RECORD_PIPELINE, obj.UUID)
+			}
+		}
+	}
+	return nil
+}
+
+// loadRecordPipelineRuns load all runs of pipeline, sorted by the create time.
+func loadRecordPipelineRuns(ctx context.Context) ([]*RecordPipelineRun, error) {
+	objs, err := rdb.HGetAll(ctx, SRS_RECORD_PIPELINE).Result()
+	if err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hgetall %v", SRS_RECORD_PIPELINE)
+	}
+
+	runs := []*RecordPipelineRun{}
+	for id, obj := range objs {
+		var run RecordPipelineRun
+		if err := json.Unmarshal([]byte(obj), &run); err != nil {
+			return nil, errors.Wrapf(err, "unmarshal %v %v", id, obj)
+		}
+		runs = append(runs, &run)
+	}
+
+	sort.Slice(runs, func(i, j int) bool {
+		return runs[i].Created < runs[j].Created
+	})
+	return runs, nil
+}
+
+// postProcessing start a run of pipeline for the finished artifact.
+func (v *RecordM3u8Stream) postProcessing(ctx context.Context, artifact *M3u8VoDArtifact) error {
+	pipeline, err := loadRecordPipeline(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "load pipeline")
+	}
+
+	if len(pipeline.Steps) == 0 {
+		return nil
+	}
+
+	run := NewRecordPipelineRun(artifact.UUID, pipeline)
+	if err := saveRecordPipelineRun(ctx, run); err != nil {
+		return errors.Wrapf(err, "save run %v", run.String())
+	}
+
+	select {
+	case v.recordWorker.pipelines <- run:
+	default:
+		return errors.Errorf("too many pipeline runs, %v", run.String())
+	}
+
+	logger.Tf(ctx, "record post process, start %v, %v", run.String(), pipeline.String())
+	return nil
+}
+
+// startPipeline start a job to execute the runs one by one, and resume the unfinished runs.
+func (v *RecordWorker) startPipeline(ctx context.Context) error {
+	runs, err := loadRecordPipelineRuns(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "load runs")
+	}
+
+	for _, run := range runs {
+		if run.Status == RecordPipelinePending || run.Status == RecordPipelineRunning {
+			select {
+			case v.pipelines <- run:
+			default:
+				logger.Wf(ctx, "ignore pipeline %v for queue is full", run.String())
+			}
+		}
+	}
+
+	v.wg.Add(1)
+	go func() {
+		defer v.wg.Done()
+
+		for ctx.Err() == nil {
+			var run *RecordPipelineRun
+			select {
+			case <-ctx.Done():
+				return
+			case run = <-v.pipelines:
+			}
+
+			if err := v.runPipeline(ctx, run); err != nil {
+				logger.Wf(ctx, "record pipeline %v err %+v", run.String(), err)
+			} else {
+				logger.Tf(ctx, "record pipeline ok, %v", run.String())
+			}
+		}
+	}()
+	return nil
+}
+
+// runPipeline execute the steps in order, retry the failed step, and stop the run if still failed.
+func (v *RecordWorker) runPipeline(ctx context.Context, run *RecordPipelineRun) error {
+	run.Status = RecordPipelineRunning
+	defer func() {
+		if err := saveRecordPipelineRun(ctx, run); err != nil {
+			logger.Wf(ctx, "ignore save pipeline %v err %+v", run.String(), err)
+		}
+	}()
+
+	for index, step := range run.Steps {
+		if step.Status == RecordPipelineDone {
+			continue
+		}
+
+		for ctx.Err() == nil {
+			step.Status, step.Attempts = RecordPipelineRunning, step.Attempts+1
+			step.logf("start attempt %v", step.Attempts)
+			if err := saveRecordPipelineRun(ctx, run); err != nil {
+				logger.Wf(ctx, "ignore save pipeline %v err %+v", run.String(), err)
+			}
+
+			err := v.runPipelineStep(ctx, run, step)
+			if err == nil {
+				step.Status, step.Error = RecordPipelineDone, ""
+				step.logf("done")
+				break
+			}
+
+			step.Error = err.Error()
+			step.logf("attempt %v failed, %v", step.Attempts, err.Error())
+			if step.Attempts > step.Step.Retries {
+				step.Status, run.Status = RecordPipelineFailed, RecordPipelineFailed
+				return errors.Wrapf(err, "step %v %v", index, step.Step.String())
+			}
+
+			select {
+			case <-ctx.Done():
+			case <-time.After(time.Duration(step.Attempts*10) * time.Second):
+			}
+		}
+	}
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	run.Status = RecordPipelineDone
+	return nil
+}
+
+func (v *RecordWorker) runPipelineStep(ctx context.Context, run *RecordPipelineRun, step *RecordPipelineStepRun) error {
+	// Load the step with credentials from pipeline, which should not be changed.
+	pipeline, err := loadRecordPipeline(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "load pipeline")
+	}
+	if step.Index < 0 || step.Index >= len(pipeline.Steps) || pipeline.Steps[step.Index].Type != step.Step.Type {
+		return errors.Errorf("step %v %v is changed, %v", step.Index, step.Step.String(), pipeline.String())
+	}
+	conf := pipeline.Steps[step.Index]
+
+	// The delete step doesn't require the file, as it might be removed by others.
+	if conf.Type == RecordPipelineStepDelete {
+		var artifact M3u8VoDArtifact
+		if b, err := rdb.HGet(ctx, SRS_RECORD_M3U8_ARTIFACT, run.UUID).Result(); err != nil && err != redis.Nil {
+			return errors.Wrapf(err, "hget %v %v", SRS_RECORD_M3U8_ARTIFACT, run.UUID)
+		} else if b == "" {
+			step.logf("artifact %v is already removed", run.UUID)
+			return nil
+		} else if err = json.Unmarshal([]byte(b), &artifact); err != nil {
+			return errors.Wrapf(err, "unmarshal %v", b)
+		}
+
+		if artifact.Keep {
+			return errors.Errorf("artifact %v is protected", run.UUID)
+		}
+		if referenced, err := loadReferencedRecords(ctx); err != nil {
+			return errors.Wrapf(err, "load referenced")
+		} else if referenced[run.UUID] {
+			return errors.Errorf("artifact %v is played by vLive", run.UUID)
+		}
+		if err := removeRecordArtifact(ctx, &artifact); err != nil {
+			return errors.Wrapf(err, "remove %v", artifact.String())
+		}
+		step.logf("remove artifact %v", run.UUID)
+		return nil
+	}
+
+	stats, err := os.Stat(run.File)
+	if err != nil {
+		return errors.Wrapf(err, "stat %v", run.File)
+	}
+
+	switch conf.Type {
+	case RecordPipelineStepCopy, RecordPipelineStepS3, RecordPipelineStepSFTP:
+		if conf.Type == RecordPipelineStepSFTP && conf.HostKey != "" {
+			if b, err := exec.CommandContext(ctx, "curl", "--version").Output(); err != nil {
+				return errors.Wrapf(err, "query curl version")
+			} else if major, minor, err := ParseCurlVersion(string(b)); err != nil {
+				return errors.Wrapf(err, "parse curl version")
+			} else if major < 7 || (major == 7 && minor < 80) {
+				return errors.Errorf("curl %v.%v does not support hostKey, requires 7.80+", major, minor)
+			}
+		}
+
+		// Upload the current file, and the outputs of previous steps such as transcript.
+		for _, file := range append([]string{run.File}, run.Outputs...) {
+			if err := uploadRecordPipelineFile(ctx, conf, step, run.UUID, file); err != nil {
+				return errors.Wrapf(err, "upload %v", file)
+			}
+		}
+	case RecordPipelineStepTranscode:
+		profile, err := LoadEncodeProfile(ctx, conf.Profile)
+		if err != nil {
+			return errors.Wrapf(err, "load profile %v", conf.Profile)
+		}
+
+		output := path.Join("record", run.UUID, fmt.Sprintf("transcode-%v.mp4", conf.Profile))
+		args := append([]string{"-i", run.File}, profile.FFmpegArgs()...)
+		args = append(args, "-movflags", "+faststart", "-y", output)
+		if b, err := exec.CommandContext(ctx, "ffmpeg", args...).CombinedOutput(); err != nil {
+			return errors.Wrapf(err, "ffmpeg %v, %v", strings.Join(args, " "), string(b))
+		}
+		step.logf("transcode %v to %v by %v", run.File, output, profile.String())
+		run.File = output
+	case RecordPipelineStepWebhook:
+		var artifact M3u8VoDArtifact
+		if b, err := rdb.HGet(ctx, SRS_RECORD_M3U8_ARTIFACT, run.UUID).Result(); err != nil && err != redis.Nil {
+			return errors.Wrapf(err, "hget %v %v", SRS_RECORD_M3U8_ARTIFACT, run.UUID)
+		} else if b != "" {
+			if err = json.Unmarshal([]byte(b), &artifact); err != nil {
+				return errors.Wrapf(err, "unmarshal %v", b)
+			}
+		}
+
+		// Only notify the status of steps, never the configuration of steps.
+		type stepStatus struct {
+			Type     RecordPipelineStepType `json:"type"`
+			Status   string                 `json:"status"`
+			Attempts int                    `json:"attempts"`
+			Logs     []string               `json:"logs"`
+		}
+		var steps []*stepStatus
+		for _, obj := range run.Steps {
+			steps = append(steps, &stepStatus{
+				Type: obj.Step.Type, Status: obj.Status, Attempts: obj.Attempts, Logs: obj.Logs,
+			})
+		}
+
+		b, err := json.Marshal(&struct {
+			Action   string           `json:"action"`
+			UUID     string           `json:"uuid"`
+			File     string           `json:"file"`
+			Outputs  []string         `json:"outputs,omitempty"`
+			Size     int64            `json:"size"`
+			Artifact *M3u8VoDArtifact `json:"artifact"`
+			Status   string           `json:"status"`
+			Steps    []*stepStatus    `json:"steps"`
+		}{
+			Action: "on_record_pipeline", UUID: run.UUID, File: run.File, Outputs: run.Outputs, Size: stats.Size(),
+			Artifact: &artifact, Status: run.Status, Steps: steps,
+		})
+		if err != nil {
+			return errors.Wrapf(err, "marshal %v", run.String())
+		}
+
+		webhookCtx, webhookCancel := context.WithTimeout(ctx, 30*time.Second)
+		defer webhookCancel()
+
+		req, err := http.NewRequestWithContext(webhookCtx, http.MethodPost, conf.URL, bytes.NewReader(b))
+		if err != nil {
+			return errors.Wrapf(err, "new request %v", conf.URL)
+		}
+		req.Header.Set("Content-Type", "application/json")
+
+		res, err := recordPipelineClient.Do(req)
+		if err != nil {
+			return errors.Wrapf(err, "post %v", conf.URL)
+		}
+		defer res.Body.Close()
+
+		if res.StatusCode < 200 || res.StatusCode >= 300 {
+			return errors.Errorf("post %v status %v", conf.URL, res.StatusCode)
+		}
+		step.logf("notify %v, status=%v", conf.URL, res.StatusCode)
+	case RecordPipelineStepTranscript:
+		config := NewTranscriptConfig()
+		if err := config.Load(ctx); err != nil {
+			return errors.Wrapf(err, "load transcript config")
+		}
+		if config.SecretKey == "" {
+			return errors.New("no secret key of transcript")
+		}
+
+		// Extract the audio in low bitrate, to reduce the size of file for ASR.
+		audioFile := path.Join("record", run.UUID, "transcript.m4a")
+		defer os.Remove(audioFile)
+		args := []string{"-i", run.File, "-vn", "-c:a", "aac", "-ac", "1", "-ar", "16000", "-b:a", "32k", "-y", audioFile}
+		if b, err := exec.CommandContext(ctx, "ffmpeg", args...).CombinedOutput(); err != nil {
+			return errors.Wrapf(err, "ffmpeg %v, %v", strings.Join(args, " "), string(b))
+		}
+
+		aiConfig := openai.DefaultConfig(config.SecretKey)
+		aiConfig.BaseURL = config.BaseURL
+		aiConfig.OrgID = config.Organization
+		client := openai.NewClientWithConfig(aiConfig)
+		resp, err := client.CreateTranscription(ctx, openai.AudioRequest{
+			Model:    openai.Whisper1,
+			FilePath: audioFile,
+			Format:   openai.AudioResponseFormatSRT,
+			Language: config.Language,
+		})
+		if err != nil {
+			return errors.Wrapf(err, "transcription %v", audioFile)
+		}
+
+		srtFile := path.Join("record", run.UUID, "transcript.srt")
+		if err := os.WriteFile(srtFile, []byte(resp.Text), 0644); err != nil {
+			return errors.Wrapf(err, "write %v", srtFile)
+		}
+		step.logf("transcript %v to %v, text=%vB", run.File, srtFile, len(resp.Text))
+		run.AddOutput(srtFile)
+	default:
+		return errors.Errorf("invalid type %v", conf.Type)
+	}
+	return nil
+}
+
+// uploadRecordPipelineFile upload the file to the target of step, by copy, S3 or SFTP.
+func uploadRecordPipelineFile(ctx context.Context, conf *RecordPipelineStep, step *RecordPipelineStepRun, uuid, file string) error {
+	stats, err := os.Stat(file)
+	if err != nil {
+		return errors.Wrapf(err, "stat %v", file)
+	}
+	target := RecordPipelineTarget(uuid, file)
+
+	switch conf.Type {
+	case RecordPipelineStepCopy:
+		targetPath := path.Join(conf.Dir, target)
+		if b, err := exec.CommandContext(ctx, "cp", "-f", file, targetPath).CombinedOutput(); err != nil {
+			return errors.Wrapf(err, "cp %v to %v, %v", file, targetPath, string(b))
+		}
+		step.logf("cp %v to %v", file, targetPath)
+	case RecordPipelineStepS3:
+		if stats.Size() > recordPipelineS3MaxSize {
+			return errors.Errorf("size %v of %v exceeds %v of single PUT", stats.Size(), file, recordPipelineS3MaxSize)
+		}
+
+		f, err := os.Open(file)
+		if err != nil {
+			return errors.Wrapf(err, "open %v", file)
+		}
+		defer f.Close()
+
+		// Limit the duration of upload by the size, for the connection might hang while sending body.
+		uploadCtx, uploadCancel := context.WithTimeout(ctx,
+			10*time.Minute+time.Duration(stats.Size()/recordPipelineMinSpeed)*time.Second,
+		)
+		defer uploadCancel()
+
+		objectURL := fmt.Sprintf("%v/%v/%v%v", strings.TrimSuffix(conf.Endpoint, "/"), conf.Bucket, conf.Prefix, target)
+		req, err := http.NewRequestWithContext(uploadCtx, http.MethodPut, objectURL, f)
+		if err != nil {
+			return errors.Wrapf(err, "new request %v", objectURL)
+		}
+		req.ContentLength = stats.Size()
+		SignS3Request(req, conf.AccessKey, conf.SecretKey, conf.Region, time.Now())
+
+		res, err := recordPipelineClient.Do(req)
+		if err != nil {
+			return errors.Wrapf(err, "put %v", objectURL)
+		}
+		defer res.Body.Close()
+
+		if res.StatusCode < 200 || res.StatusCode >= 300 {
+			var body bytes.Buffer
+			body.ReadFrom(res.Body)
+			return errors.Errorf("put %v status %v, %v", objectURL, res.StatusCode, body.String())
+		}
+		step.logf("upload %v to %v, size=%v", file, objectURL, stats.Size())
+	case RecordPipelineStepSFTP:
+		// Never pass the password or passphrase by arguments, which is visible to other processes, so we
+		// pass it by the config file from stdin.
+		targetURL := fmt.Sprintf("%v/%v", strings.TrimSuffix(conf.URL, "/"), target)
+		args := []string{"--fail", "-sS", "--ftp-create-dirs", "-T", file, "-K", "-"}
+		if conf.KeyFile != "" {
+			args = append(args, "--key", conf.KeyFile)
+		}
+		if conf.HostKey != "" {
+			args = append(args, "--hostpubsha256", conf.HostKey)
+		}
+		args = append(args, targetURL)
+
+		cmd := exec.CommandContext(ctx, "curl", args...)
+		cmd.Stdin = strings.NewReader(CurlUserConfig(conf.User, conf.Password, conf.Passphrase))
+		if b, err := cmd.CombinedOutput(); err != nil {
+			return errors.Wrapf(err, "upload %v to %v, %v", file, targetURL, string(b))
+		}
+		step.logf("upload %v to %v, size=%v", file, targetURL, stats.Size())
+	default:
+		return errors.Errorf("invalid type %v", conf.Type)
+	}
+	return nil
+}
+
+func (v *RecordWorker) handlePipeline(ctx context.Context, handler *http.ServeMux) error {
+	ep := "/terraform/v1/hooks/record/pipeline/query"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := func() error {
+			var token string
+			if err := ParseBody(ctx, r.Body, &struct {
+				Token *string `json:"token"`
+			}{
+				Token: &token,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			pipeline, err := loadRecordPipelineSteps(ctx)
+			if err != nil {
+				return errors.Wrapf(err, "load pipeline")
+			}
+
+			// Never response the credentials.
+			for index, step := range pipeline.Steps {
+				pipeline.Steps[index] = step.Redacted()
+			}
+
+			ohttp.WriteData(ctx, w, r, pipeline)
+			logger.Tf(ctx, "record pipeline query ok, %v, token=%vB", pipeline.String(), len(token))
+			return nil
+		}(); err != nil {
+			ohttp.WriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/terraform/v1/hooks/record/pipeline/apply"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := func() error {
+			var token string
+			var pipeline RecordPipeline
+			if err := ParseBody(ctx, r.Body, &struct {
+				Token *string `json:"token"`
+				*RecordPipeline
+			}{
+				Token: &token, RecordPipeline: &pipeline,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			// Restore the credentials which are masked by query.
+			previous, err := loadRecordPipelineSteps(ctx)
+			if err != nil {
+				return errors.Wrapf(err, "load pipeline")
+			}
+			for index, step := range pipeline.Steps {
+				if step != nil && index < len(previous.Steps) {
+					step.RestoreSecrets(previous.Steps[index])
+				}
+			}
+
+			if err := pipeline.Validate(); err != nil {
+				return errors.Wrapf(err, "validate %v", pipeline.String())
+			}
+
+			if b, err := json.Marshal(&pipeline); err != nil {
+				return errors.Wrapf(err, "marshal %v", pipeline.String())
+			} else if err := rdb.HSet(ctx, SRS_RECORD_PATTERNS, "pipeline", string(b)).Err(); err != nil && err != redis.Nil {
+				return errors.Wrapf(err, "hset %v pipeline %v", SRS_RECORD_PATTERNS, pipeline.String())
+			}
+
+			ohttp.WriteData(ctx, w, r, nil)
+			logger.Tf(ctx, "record pipeline apply ok, %v, token=%vB", pipeline.String(), len(token))
+			return nil
+		}(); err != nil {
+			ohttp.WriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/terraform/v1/hooks/record/pipeline/runs"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := func() error {
+			var token, runUUID string
+			if err := ParseBody(ctx, r.Body, &struct {
+				Token *string `json:"token"`
+				UUID  *string `json:"uuid"`
+			}{
+				Token: &token, UUID: &runUUID,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			runs, err := loadRecordPipelineRuns(ctx)
+			if err != nil {
+				return errors.Wrapf(err, "load runs")
+			}
+
+			if runUUID != "" {
+				var matched []*RecordPipelineRun
+				for _, run := range runs {
+					if run.UUID == runUUID {
+						matched = append(matched, run)
+					}
+				}
+				if len(matched) == 0 {
+					return errors.Errorf("no run %v", runUUID)
+				}
+				runs = matched
+			}
+
+			// Never response the credentials, even for the runs stored by previous version.
+			for _, run := range runs {
+				for _, step := range run.Steps {
+					if step.Step != nil {
+						step.Step = step.Step.Redacted()
+					}
+				}
+			}
+
+			ohttp.WriteData(ctx, w, r, runs)
+			logger.Tf(ctx, "record pipeline runs ok, uuid=%v, runs=%v, token=%vB", runUUID, len(runs), len(token))
+			return nil
+		}(); err != nil {
+			ohttp.WriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/terraform/v1/hooks/record/pipeline/retry"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := func() error {
+			var token, runUUID string
+			if err := ParseBody(ctx, r.Body, &struct {
+				Token *string `json:"token"`
+				UUID  *string `json:"uuid"`
+			}{
+				Token: &token, UUID: &runUUID,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			var run RecordPipelineRun
+			if b, err := rdb.HGet(ctx, SRS_RECORD_PIPELINE, runUUID).Result(); err != nil && err != redis.Nil {
+				return errors.Wrapf(err, "hget %v %v", SRS_RECORD_PIPELINE, runUUID)
+			} else if b == "" {
+				return errors.Errorf("no run %v", runUUID)
+			} else if err = json.Unmarshal([]byte(b), &run); err != nil {
+				return errors.Wrapf(err, "unmarshal %v", b)
+			}
+
+			if run.Status != RecordPipelineFailed {
+				return errors.Errorf("run %v is %v, not failed", runUUID, run.Status)
+			}
+
+			run.Reset()
+			if err := saveRecordPipelineRun(ctx, &run); err != nil {
+				return errors.Wrapf(err, "save run %v", run.String())
+			}
+
+			select {
+			case v.pipelines <- &run:
+			default:
+				return errors.Errorf("too many pipeline runs")
+			}
+
+			ohttp.WriteData(ctx, w, r, &run)
+			logger.Tf(ctx, "record pipeline retry ok, %v, token=%vB", run.String(), len(token))
+			return nil
+		}(); err != nil {
+			ohttp.WriteError(ctx, w, r, err)
+		}
+	})
+
+	return nil
+}
@@ -0,0 +1,277 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
+	"github.com/go-redis/redis/v8"
+)
+
+// The files of preview, generated in the directory of record, such as record/:uuid/poster.jpg
+const (
+	RecordPreviewPoster     = "poster.jpg"
+	RecordPreviewSprite     = "sprite.jpg"
+	RecordPreviewThumbnails = "thumbnails.vtt"
+	RecordPreviewAnimation  = "preview.gif"
+)
+
+// The size of each thumbnail in sprite, and the number of thumbnails per row.
+const (
+	recordThumbnailWidth   = 160
+	recordThumbnailHeight  = 90
+	recordThumbnailColumns = 10
+	// The max number of thumbnails in sprite.
+	recordThumbnailMax = 100
+)
+
+// RecordPreview is the visual preview of record, generated when the record is finished.
+type RecordPreview struct {
+	// The poster frame of record.
+	Poster string `json:"poster,omitempty"`
+	// The sprite image of thumbnails, and the WebVTT track for scrubbing.
+	Sprite     string `json:"sprite,omitempty"`
+	Thumbnails string `json:"thumbnails,omitempty"`
+	// The short animated preview.
+	Animation string `json:"animation,omitempty"`
+}
+
+func (v *RecordPreview) String() string {
+	return fmt.Sprintf("poster=%v, sprite=%v, thumbnails=%v, animation=%v",
+		v.Poster, v.Sprite, v.Thumbnails, v.Animation,
+	)
+}
+
+// RecordThumbnailInterval get the interval in seconds between thumbnails, at least 10s, and no more
+// than the max number of thumbnails.
+func RecordThumbnailInterval(duration float64) int {
+	interval := int(math.Ceil(duration / recordThumbnailMax))
+	if interval < 10 {
+		interval = 10
+	}
+	return interval
+}
+
+// BuildThumbnailsVtt build the WebVTT track for the sprite, each cue refers to a thumbnail in sprite
+// by the media fragment, for example, sprite.jpg#xywh=160,0,160,90
+func BuildThumbnailsVtt(duration float64, interval int, sprite string) string {
+	formatTime := func(t float64) string {
+		ms := int64(math.Round(t * 1000))
+		return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+	}
+
+	vtt := []string{"WEBVTT", ""}
+	for i := 0; float64(i*interval) < duration; i++ {
+		start, end := float64(i*interval), math.Min(float64((i+1)*interval), duration)
+		x := i % recordThumbnailColumns * recordThumbnailWidth
+		y := i / recordThumbnailColumns * recordThumbnailHeight
+		vtt = append(vtt,
+			fmt.Sprintf("%v --> %v", formatTime(start), formatTime(end)),
+			fmt.Sprintf("%v#xywh=%v,%v,%v,%v", sprite, x, y, recordThumbnailWidth, recordThumbnailHeight),
+			"",
+		)
+	}
+	return strings.Join(vtt, "\n")
+}
+
+// queuePreview queue the artifact to generate preview, after the artifact is saved to redis.
+func (v *RecordWorker) queuePreview(ctx context.Context, uuid string) {
+	select {
+	case v.previews <- uuid:
+	default:
+		logger.Wf(ctx, "ignore preview of %v for queue is full", uuid)
+	}
+}
+
+// startPreview generate the preview of records one by one, because it takes a long time for long
+// records, and should never block the finish of record.
+func (v *RecordWorker) startPreview(ctx context.Context) {
+	v.wg.Add(1)
+	go func() {
+		defer v.wg.Done()
+
+		for ctx.Err() == nil {
+			var uuid string
+			select {
+			case <-ctx.Done():
+				return
+			case uuid = <-v.previews:
+			}
+
+			// The preview is optional, so ignore any error.
+			if err := updateRecordPreview(ctx, uuid); err != nil {
+				logger.Wf(ctx, "ignore record preview %v err %+v", uuid, err)
+			}
+		}
+	}()
+}
+
+// updateRecordPreview generate the preview of artifact, and save to redis.
+func updateRecordPreview(ctx context.Context, uuid string) error {
+	loadArtifact := func() (*M3u8VoDArtifact, error) {
+		value, err := rdb.HGet(ctx, SRS_RECORD_M3U8_ARTIFACT, uuid).Result()
+		if err != nil {
+			return nil, err
+		}
+
+		var artifact M3u8VoDArtifact
+		if err := json.Unmarshal([]byte(value), &artifact); err != nil {
+			return nil, errors.Wrapf(err, "unmarshal %v", value)
+		}
+		return &artifact, nil
+	}
+
+	artifact, err := loadArtifact()
+	if err == redis.Nil {
+		return nil
+	} else if err != nil {
+		return errors.Wrapf(err, "load artifact %v", uuid)
+	}
+
+	preview, err := generateRecordPreview(ctx, artifact)
+	if err != nil {
+		return errors.Wrapf(err, "generate preview %v", artifact.String())
+	}
+
+	// Reload the artifact, which might be changed or removed while generating the preview.
+	if artifact, err = loadArtifact(); err == redis.Nil {
+		return nil
+	} else if err != nil {
+		return errors.Wrapf(err, "load artifact %v", uuid)
+	}
+
+	artifact.Preview = preview
+	if b, err := json.Marshal(artifact); err != nil {
+		return errors.Wrapf(err, "marshal %v", artifact.String())
+	} else if err := rdb.HSet(ctx, SRS_RECORD_M3U8_ARTIFACT, uuid, string(b)).Err(); err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hset %v %v %v", SRS_RECORD_M3U8_ARTIFACT, uuid, string(b))
+	}
+	return nil
+}
+
+// generateRecordPreview generate the poster, sprite with thumbnails and animated preview from the MP4
+// of record, which should be remuxed already.
+func generateRecordPreview(ctx context.Context, artifact *M3u8VoDArtifact) (*RecordPreview, error) {
+	var duration float64
+	for _, file := range artifact.Files {
+		duration += file.Duration
+	}
+	if duration <= 0 {
+		return nil, errors.Errorf("invalid duration %v of %v", duration, artifact.String())
+	}
+
+	dir := path.Join("record", artifact.UUID)
+	mp4 := path.Join(dir, "index.mp4")
+	if _, err := os.Stat(mp4); err != nil {
+		return nil, errors.Wrapf(err, "no mp4 file %v", mp4)
+	}
+
+	ffmpeg := func(args ...string) error {
+		if b, err := exec.CommandContext(ctx, "ffmpeg", args...).CombinedOutput(); err != nil {
+			return errors.Wrapf(err, "ffmpeg %v, %v", strings.Join(args, " "), string(b))
+		}
+		return nil
+	}
+
+	// Use the frame at 10% of record as poster, to skip the black frames at the beginning.
+	preview := &RecordPreview{}
+	position := fmt.Sprintf("%.3f", math.Min(duration*0.1, 30))
+	if err := ffmpeg("-ss", position, "-i", mp4, "-frames:v", "1", "-vf", "scale=640:-2",
+		"-y", path.Join(dir, RecordPreviewPoster),
+	); err != nil {
+		return nil, errors.Wrapf(err, "generate poster")
+	}
+	preview.Poster = RecordPreviewPoster
+
+	// Tile the thumbnails to a sprite, and generate the WebVTT track for scrubbing.
+	interval := RecordThumbnailInterval(duration)
+	count := int(math.Ceil(duration / float64(interval)))
+	rows := (count + recordThumbnailColumns - 1) / recordThumbnailColumns
+	filter := fmt.Sprintf(
+		"fps=1/%v,scale=%v:%v:force_original_aspect_ratio=decrease,pad=%v:%v:(ow-iw)/2:(oh-ih)/2,tile=%vx%v",
+		interval, recordThumbnailWidth, recordThumbnailHeight, recordThumbnailWidth, recordThumbnailHeight,
+		recordThumbnailColumns, rows,
+	)
+	// Only decode the keyframes, because the interval of thumbnails is at least 10s, or it decodes all
+	// frames of the whole record, which is very slow for long records.
+	if err := ffmpeg("-skip_frame", "nokey", "-i", mp4, "-vf", filter, "-frames:v", "1", "-an",
+		"-y", path.Join(dir, RecordPreviewSprite),
+	); err != nil {
+		return nil, errors.Wrapf(err, "generate sprite")
+	}
+
+	vtt := BuildThumbnailsVtt(duration, interval, RecordPreviewSprite)
+	if err := os.WriteFile(path.Join(dir, RecordPreviewThumbnails), []byte(vtt), 0644); err != nil {
+		return nil, errors.Wrapf(err, "write %v", RecordPreviewThumbnails)
+	}
+	preview.Sprite, preview.Thumbnails = RecordPreviewSprite, RecordPreviewThumbnails
+
+	// Generate a short animated preview from the poster position.
+	if err := ffmpeg("-ss", position, "-t", "3", "-i", mp4, "-an",
+		"-vf", "fps=10,scale=320:-2:flags=lanczos,split[a][b];[a]palettegen[p];[b][p]paletteuse",
+		"-loop", "0", "-y", path.Join(dir, RecordPreviewAnimation),
+	); err != nil {
+		return nil, errors.Wrapf(err, "generate animation")
+	}
+	preview.Animation = RecordPreviewAnimation
+
+	logger.Tf(ctx, "record preview ok, uuid=%v, duration=%v, interval=%v, thumbnails=%v, %v",
+		artifact.UUID, duration, interval, count, preview.String())
+	return preview, nil
+}
+
+// recordPreviewURLs get the URLs of preview, to list in the record files.
+func recordPreviewURLs(artifact *M3u8VoDArtifact) map[string]string {
+	urls := map[string]string{}
+	if artifact.Preview == nil {
+		return urls
+	}
+
+	prefix := fmt.Sprintf("/terraform/v1/hooks/record/hls/%v", artifact.UUID)
+	for name, file := range map[string]string{
+		"poster": artifact.Preview.Poster, "sprite": artifact.Preview.Sprite,
+		"thumbnails": artifact.Preview.Thumbnails, "animation": artifact.Preview.Animation,
+	} {
+		if file != "" {
+			urls[name] = fmt.Sprintf("%v/%v", prefix, file)
+		}
+	}
+	return urls
+}
+
+// servePreview serve the preview file of record, the format is :uuid/poster.jpg
+func servePreview(ctx context.Context, w http.ResponseWriter, r *http.Request, uuid, filename string) error {
+	contentTypes := map[string]string{
+		RecordPreviewPoster:     "image/jpeg",
+		RecordPreviewSprite:     "image/jpeg",
+		RecordPreviewThumbnails: "text/vtt",
+		RecordPreviewAnimation:  "image/gif",
+	}
+
+	contentType, ok := contentTypes[filename]
+	if !ok {
+		return errors.Errorf("invalid preview %v", filename)
+	}
+
+	previewFile := path.Join("record", uuid, filename)
+	if _, err := os.Stat(previewFile); err != nil {
+		return errors.Wrapf(err, "no preview file %v", previewFile)
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	http.ServeFile(w, r, previewFile)
+	logger.Tf(ctx, "record serve preview ok, uuid=%v, file=%v", uuid, previewFile)
+	return nil
+}
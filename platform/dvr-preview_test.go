@@ -0,0 +1,43 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRecordPreview_RecordThumbnailInterval(t *testing.T) {
+	for _, c := range []struct {
+		duration float64
+		interval int
+	}{
+		{5, 10}, {300, 10}, {1000, 10}, {1001, 11}, {3600, 36},
+	} {
+		if v := RecordThumbnailInterval(c.duration); v != c.interval {
+			t.Errorf("duration %v got %v, expect %v", c.duration, v, c.interval)
+		}
+	}
+}
+
+func TestRecordPreview_BuildThumbnailsVtt(t *testing.T) {
+	vtt := BuildThumbnailsVtt(115.5, 10, "sprite.jpg")
+	if !strings.HasPrefix(vtt, "WEBVTT\n\n") {
+		t.Errorf("invalid header of %v", vtt)
+	}
+	if n := strings.Count(vtt, " --> "); n != 12 {
+		t.Errorf("got %v cues, expect 12", n)
+	}
+	if !strings.Contains(vtt, "00:00:00.000 --> 00:00:10.000\nsprite.jpg#xywh=0,0,160,90\n") {
+		t.Errorf("invalid first cue of %v", vtt)
+	}
+	// The 11th thumbnail is at the second row of sprite.
+	if !strings.Contains(vtt, "00:01:40.000 --> 00:01:50.000\nsprite.jpg#xywh=0,90,160,90\n") {
+		t.Errorf("invalid cue of second row of %v", vtt)
+	}
+	// The last cue ends at the duration.
+	if !strings.Contains(vtt, "00:01:50.000 --> 00:01:55.500\nsprite.jpg#xywh=160,90,160,90\n") {
+		t.Errorf("invalid last cue of %v", vtt)
+	}
+}
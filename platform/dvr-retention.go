@@ -0,0 +1,587 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/ossrs/go-oryx-lib/errors"
+	ohttp "github.com/ossrs/go-oryx-lib/http"
+	"github.com/ossrs/go-oryx-lib/logger"
+	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
+	"github.com/go-redis/redis/v8"
+)
+
+// The reason to remove the record by retention policy.
+const (
+	// Older than the max age.
+	RecordRetentionReasonAge = "age"
+	// Exceed the max size of stream.
+	RecordRetentionReasonStreamSize = "stream-size"
+	// Exceed the max total size.
+	RecordRetentionReasonSize = "size"
+)
+
+// RecordRetentionStream overwrites the retention policy for the matched streams.
+type RecordRetentionStream struct {
+	// The glob to match the stream, for example, /live/* or /live/livestream
+	Match string `json:"match"`
+	// The max age in days, use the global policy if 0.
+	MaxDays int `json:"maxDays,omitempty"`
+	// The max size in MB of each matched stream, no limit if 0.
+	MaxSize int64 `json:"maxSize,omitempty"`
+}
+
+// RecordRetention is the retention policy of local records, the oldest records are removed, except
+// the records which are recording, protected by keep flag, or played by vLive.
+type RecordRetention struct {
+	// Whether enable the background job to remove records.
+	Enabled bool `json:"enabled"`
+	// The max age in days, no limit if 0.
+	MaxDays int `json:"maxDays"`
+	// The max total size in MB of all records, no limit if 0.
+	MaxSize int64 `json:"maxSize"`
+	// The overwrites for streams, the first matched is used.
+	Streams []*RecordRetentionStream `json:"streams,omitempty"`
+}
+
+func (v *RecordRetention) String() string {
+	return fmt.Sprintf("enabled=%v, maxDays=%v, maxSize=%vMB, streams=%v",
+		v.Enabled, v.MaxDays, v.MaxSize, len(v.Streams),
+	)
+}
+
+func (v *RecordRetention) Validate() error {
+	if v.MaxDays < 0 || v.MaxSize < 0 {
+		return errors.Errorf("invalid maxDays %v or maxSize %v", v.MaxDays, v.MaxSize)
+	}
+	for _, stream := range v.Streams {
+		if _, err := path.Match(stream.Match, "/live/livestream"); err != nil || stream.Match == "" {
+			return errors.Errorf("invalid match %v, err %v", stream.Match, err)
+		}
+		if stream.MaxDays < 0 || stream.MaxSize < 0 {
+			return errors.Errorf("invalid maxDays %v or maxSize %v of %v", stream.MaxDays, stream.MaxSize, stream.Match)
+		}
+	}
+	return nil
+}
+
+// policy get the max days and max size of stream, the max size is 0 if no overwrite.
+func (v *RecordRetention) policy(stream string) (maxDays int, maxSize int64) {
+	for _, s := range v.Streams {
+		if matched, err := path.Match(s.Match, stream); err == nil && matched {
+			maxDays = s.MaxDays
+			if maxDays == 0 {
+				maxDays = v.MaxDays
+			}
+			return maxDays, s.MaxSize
+		}
+	}
+	return v.MaxDays, 0
+}
+
+// RecordUsage is the disk usage of a record.
+type RecordUsage struct {
+	// The UUID of record.
+	UUID string `json:"uuid"`
+	// The stream URL, for example, /live/livestream
+	Stream string `json:"stream"`
+	// The size in bytes on disk.
+	Size int64 `json:"size"`
+	// The last update time.
+	Update string `json:"update"`
+	// Whether protected by keep flag.
+	Keep bool `json:"keep,omitempty"`
+	// Whether recording.
+	Processing bool `json:"progress,omitempty"`
+	// Whether played by the source of vLive, which is broken if removed.
+	Referenced bool `json:"referenced,omitempty"`
+	// The reason to remove, for dry-run report.
+	Reason string `json:"reason,omitempty"`
+
+	// The parsed update time.
+	update time.Time
+}
+
+// Plan the records to remove by retention policy, the oldest is the first. The records are not
+// changed, except the reason of removed ones.
+func (v *RecordRetention) Plan(records []*RecordUsage, now time.Time) []*RecordUsage {
+	for _, record := range records {
+		record.update, _ = time.Parse(time.RFC3339, record.Update)
+	}
+
+	sorted := append([]*RecordUsage{}, records...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].update.Before(sorted[j].update)
+	})
+
+	removed := make(map[*RecordUsage]bool)
+	var plan []*RecordUsage
+	remove := func(record *RecordUsage, reason string) {
+		record.Reason, removed[record] = reason, true
+		plan = append(plan, record)
+	}
+	removable := func(record *RecordUsage) bool {
+		return !record.Keep && !record.Processing && !record.Referenced && !removed[record]
+	}
+
+	// Remove the records which are too old.
+	for _, record := range sorted {
+		maxDays, _ := v.policy(record.Stream)
+		if maxDays > 0 && removable(record) && !record.update.IsZero() &&
+			record.update.Add(time.Duration(maxDays)*24*time.Hour).Before(now) {
+			remove(record, RecordRetentionReasonAge)
+		}
+	}
+
+	// Remove the oldest records of stream, if exceed the max size of stream.
+	streams := make(map[string]int64)
+	for _, record := range sorted {
+		if !removed[record] {
+			streams[record.Stream] += record.Size
+		}
+	}
+	for _, record := range sorted {
+		_, maxSize := v.policy(record.Stream)
+		if maxSize > 0 && removable(record) && streams[record.Stream] > maxSize*1024*1024 {
+			streams[record.Stream] -= record.Size
+			remove(record, RecordRetentionReasonStreamSize)
+		}
+	}
+
+	// Remove the oldest records, if exceed the max total size.
+	var total int64
+	for _, record := range sorted {
+		if !removed[record] {
+			total += record.Size
+		}
+	}
+	for _, record := range sorted {
+		if v.MaxSize > 0 && removable(record) && total > v.MaxSize*1024*1024 {
+			total -= record.Size
+			remove(record, RecordRetentionReasonSize)
+		}
+	}
+
+	return plan
+}
+
+// loadRecordRetention load the retention policy of records.
+func loadRecordRetention(ctx context.Context) (*RecordRetention, error) {
+	retention := &RecordRetention{}
+	if value, err := rdb.HGet(ctx, SRS_RECORD_PATTERNS, "retention").Result(); err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hget %v retention", SRS_RECORD_PATTERNS)
+	} else if value != "" {
+		if err := json.Unmarshal([]byte(value), retention); err != nil {
+			return nil, errors.Wrapf(err, "unmarshal %v", value)
+		}
+	}
+	return retention, nil
+}
+
+// loadReferencedRecords load the UUID of records, which are played by the sources of vLive.
+func loadReferencedRecords(ctx context.Context) (map[string]bool, error) {
+	configs, err := rdb.HGetAll(ctx, SRS_VLIVE_CONFIG).Result()
+	if err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hgetall %v", SRS_VLIVE_CONFIG)
+	}
+
+	referenced := make(map[string]bool)
+	for platform, b := range configs {
+		var config VLiveConfigure
+		if err := json.Unmarshal([]byte(b), &config); err != nil {
+			return nil, errors.Wrapf(err, "unmarshal %v %v", platform, b)
+		}
+
+		for _, file := range config.Files {
+			if file.Type == FFprobeSourceTypeRecord && file.Artifact != "" {
+				referenced[file.Artifact] = true
+			}
+		}
+	}
+	return referenced, nil
+}
+
+// loadRecordUsages load the records and the size on disk.
+func loadRecordUsages(ctx context.Context) (map[string]*M3u8VoDArtifact, []*RecordUsage, error) {
+	objs, err := rdb.HGetAll(ctx, SRS_RECORD_M3U8_ARTIFACT).Result()
+	if err != nil && err != redis.Nil {
+		return nil, nil, errors.Wrapf(err, "hgetall %v", SRS_RECORD_M3U8_ARTIFACT)
+	}
+
+	referenced, err := loadReferencedRecords(ctx)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "load referenced")
+	}
+
+	artifacts := make(map[string]*M3u8VoDArtifact)
+	var records []*RecordUsage
+	for uuid, obj := range objs {
+		var artifact M3u8VoDArtifact
+		if err := json.Unmarshal([]byte(obj), &artifact); err != nil {
+			return nil, nil, errors.Wrapf(err, "unmarshal %v %v", uuid, obj)
+		}
+		artifacts[uuid] = &artifact
+
+		// Use the size of files in artifact, if there is no directory.
+		var size int64
+		filepath.Walk(path.Join("record", uuid), func(p string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				size += info.Size()
+			}
+			return nil
+		})
+		if size == 0 {
+			for _, file := range artifact.Files {
+				size += int64(file.Size)
+			}
+		}
+
+		records = append(records, &RecordUsage{
+			UUID: uuid, Stream: fmt.Sprintf("/%v/%v", artifact.App, artifact.Stream), Size: size,
+			Update: artifact.Update, Keep: artifact.Keep, Processing: artifact.Processing,
+			Referenced: referenced[uuid],
+		})
+	}
+
+	return artifacts, records, nil
+}
+
+// applyRetention remove the records by retention policy, return the removed records.
+func (v *RecordWorker) applyRetention(ctx context.Context, retention *RecordRetention) ([]*RecordUsage, error) {
+	artifacts, records, err := loadRecordUsages(ctx)
+	if err != nil {
+		return nil, errors.Wrapf(err, "load records")
+	}
+
+	plan := retention.Plan(records, time.Now())
+	for _, record := range plan {
+		// Ignore the record which is recording again, for example, by restart.
+		if v.QueryTask(record.UUID) != nil {
+			continue
+		}
+
+		if err := removeRecordArtifact(ctx, artifacts[record.UUID]); err != nil {
+			return nil, errors.Wrapf(err, "remove %v", record.UUID)
+		}
+		logger.Tf(ctx, "record retention remove uuid=%v, stream=%v, size=%v, update=%v, reason=%v",
+			record.UUID, record.Stream, record.Size, record.Update, record.Reason)
+	}
+	return plan, nil
+}
+
+// startRetention start the background job to remove records by retention policy.
+func (v *RecordWorker) startRetention(ctx context.Context) {
+	v.wg.Add(1)
+	go func() {
+		defer v.wg.Done()
+
+		for ctx.Err() == nil {
+			if err := func() error {
+				retention, err := loadRecordRetention(ctx)
+				if err != nil {
+					return errors.Wrapf(err, "load retention")
+				}
+
+				if !retention.Enabled {
+					return nil
+				}
+
+				if plan, err := v.applyRetention(ctx, retention); err != nil {
+					return errors.Wrapf(err, "apply %v", retention.String())
+				} else if len(plan) > 0 {
+					logger.Tf(ctx, "record retention ok, %v, removed=%v", retention.String(), len(plan))
+				}
+				return nil
+			}(); err != nil {
+				logger.Wf(ctx, "ignore record retention err %+v", err)
+			}
+
+			select {
+			case <-ctx.Done():
+			case <-v.retentionNotify:
+			case <-time.After(1 * time.Hour):
+			}
+		}
+	}()
+}
+
+func (v *RecordWorker) handleRetention(ctx context.Context, handler *http.ServeMux) error {
+	ep := "/terraform/v1/hooks/record/retention/query"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := func() error {
+			var token string
+			if err := ParseBody(ctx, r.Body, &struct {
+				Token *string `json:"token"`
+			}{
+				Token: &token,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			retention, err := loadRecordRetention(ctx)
+			if err != nil {
+				return errors.Wrapf(err, "load retention")
+			}
+
+			ohttp.WriteData(ctx, w, r, retention)
+			logger.Tf(ctx, "record retention query ok, %v, token=%vB", retention.String(), len(token))
+			return nil
+		}(); err != nil {
+			ohttp.WriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/terraform/v1/hooks/record/retention/apply"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := func() error {
+			var token string
+			var retention RecordRetention
+			if err := ParseBody(ctx, r.Body, &struct {
+				Token *string `json:"token"`
+				*RecordRetention
+			}{
+				Token: &token, RecordRetention: &retention,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			if err := retention.Validate(); err != nil {
+				return errors.Wrapf(err, "validate %v", retention.String())
+			}
+
+			if b, err := json.Marshal(&retention); err != nil {
+				return errors.Wrapf(err, "marshal %v", retention.String())
+			} else if err := rdb.HSet(ctx, SRS_RECORD_PATTERNS, "retention", string(b)).Err(); err != nil && err != redis.Nil {
+				return errors.Wrapf(err, "hset %v retention %v", SRS_RECORD_PATTERNS, string(b))
+			}
+
+			// Wakeup the job to apply the policy.
+			select {
+			case v.retentionNotify <- struct{}{}:
+			default:
+			}
+
+			ohttp.WriteData(ctx, w, r, nil)
+			logger.Tf(ctx, "record retention apply ok, %v, token=%vB", retention.String(), len(token))
+			return nil
+		}(); err != nil {
+			ohttp.WriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/terraform/v1/hooks/record/retention/dry-run"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := func() error {
+			var token string
+			var retention *RecordRetention
+			if err := ParseBody(ctx, r.Body, &struct {
+				Token     *string           `json:"token"`
+				Retention **RecordRetention `json:"retention"`
+			}{
+				Token: &token, Retention: &retention,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			// Use the policy in request to preview before apply, or the current policy.
+			if retention == nil {
+				if saved, err := loadRecordRetention(ctx); err != nil {
+					return errors.Wrapf(err, "load retention")
+				} else {
+					retention = saved
+				}
+			} else if err := retention.Validate(); err != nil {
+				return errors.Wrapf(err, "validate %v", retention.String())
+			}
+
+			_, records, err := loadRecordUsages(ctx)
+			if err != nil {
+				return errors.Wrapf(err, "load records")
+			}
+
+			plan := retention.Plan(records, time.Now())
+			var size int64
+			for _, record := range plan {
+				size += record.Size
+			}
+
+			ohttp.WriteData(ctx, w, r, &struct {
+				Retention *RecordRetention `json:"retention"`
+				Records   []*RecordUsage   `json:"records"`
+				Size      int64            `json:"size"`
+			}{
+				Retention: retention, Records: plan, Size: size,
+			})
+			logger.Tf(ctx, "record retention dry-run ok, %v, records=%v, size=%v, token=%vB",
+				retention.String(), len(plan), size, len(token))
+			return nil
+		}(); err != nil {
+			ohttp.WriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/terraform/v1/hooks/record/usage"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := func() error {
+			var token string
+			if err := ParseBody(ctx, r.Body, &struct {
+				Token *string `json:"token"`
+			}{
+				Token: &token,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			_, records, err := loadRecordUsages(ctx)
+			if err != nil {
+				return errors.Wrapf(err, "load records")
+			}
+
+			type StreamUsage struct {
+				Stream string `json:"stream"`
+				Count  int    `json:"count"`
+				Size   int64  `json:"size"`
+			}
+			var total, kept int64
+			var streams []*StreamUsage
+			streamsByURL := make(map[string]*StreamUsage)
+			for _, record := range records {
+				total += record.Size
+				if record.Keep || record.Referenced {
+					kept += record.Size
+				}
+
+				stream, ok := streamsByURL[record.Stream]
+				if !ok {
+					stream = &StreamUsage{Stream: record.Stream}
+					streamsByURL[record.Stream] = stream
+					streams = append(streams, stream)
+				}
+				stream.Count, stream.Size = stream.Count+1, stream.Size+record.Size
+			}
+			sort.Slice(streams, func(i, j int) bool {
+				return streams[i].Size > streams[j].Size
+			})
+
+			// The capacity of disk, where the records are stored.
+			var disk syscall.Statfs_t
+			if err := syscall.Statfs("record", &disk); err != nil {
+				return errors.Wrapf(err, "statfs record")
+			}
+
+			ohttp.WriteData(ctx, w, r, &struct {
+				Count     int            `json:"count"`
+				Size      int64          `json:"size"`
+				Kept      int64          `json:"kept"`
+				Streams   []*StreamUsage `json:"streams"`
+				DiskTotal uint64         `json:"diskTotal"`
+				DiskFree  uint64         `json:"diskFree"`
+			}{
+				Count: len(records), Size: total, Kept: kept, Streams: streams,
+				DiskTotal: disk.Blocks * uint64(disk.Bsize), DiskFree: disk.Bavail * uint64(disk.Bsize),
+			})
+			logger.Tf(ctx, "record usage ok, count=%v, size=%v, kept=%v, token=%vB",
+				len(records), total, kept, len(token))
+			return nil
+		}(); err != nil {
+			ohttp.WriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/terraform/v1/hooks/record/keep"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := func() error {
+			var token, uuid string
+			var keep bool
+			if err := ParseBody(ctx, r.Body, &struct {
+				Token *string `json:"token"`
+				UUID  *string `json:"uuid"`
+				Keep  *bool   `json:"keep"`
+			}{
+				Token: &token, UUID: &uuid, Keep: &keep,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			if uuid == "" {
+				return errors.New("no uuid")
+			}
+
+			// For the recording task, update the artifact in memory, which is saved to redis.
+			if task := v.QueryTask(uuid); task != nil {
+				task.lock.Lock()
+				task.artifact.Keep = keep
+				task.lock.Unlock()
+
+				if err := task.saveArtifact(ctx, task.artifact); err != nil {
+					return errors.Wrapf(err, "save %v", task.String())
+				}
+			} else {
+				var metadata M3u8VoDArtifact
+				if value, err := rdb.HGet(ctx, SRS_RECORD_M3U8_ARTIFACT, uuid).Result(); err != nil && err != redis.Nil {
+					return errors.Wrapf(err, "hget %v %v", SRS_RECORD_M3U8_ARTIFACT, uuid)
+				} else if value == "" {
+					return errors.Errorf("no record for uuid=%v", uuid)
+				} else if err = json.Unmarshal([]byte(value), &metadata); err != nil {
+					return errors.Wrapf(err, "parse %v", value)
+				}
+
+				metadata.Keep = keep
+				if b, err := json.Marshal(&metadata); err != nil {
+					return errors.Wrapf(err, "marshal %v", metadata.String())
+				} else if err := rdb.HSet(ctx, SRS_RECORD_M3U8_ARTIFACT, uuid, string(b)).Err(); err != nil && err != redis.Nil {
+					return errors.Wrapf(err, "hset %v %v %v", SRS_RECORD_M3U8_ARTIFACT, uuid, string(b))
+				}
+			}
+
+			ohttp.WriteData(ctx, w, r, nil)
+			logger.Tf(ctx, "record keep ok, uuid=%v, keep=%v, token=%vB", uuid, keep, len(token))
+			return nil
+		}(); err != nil {
+			ohttp.WriteError(ctx, w, r, err)
+		}
+	})
+
+	return nil
+}
@@ -0,0 +1,58 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRecordRetention_Plan(t *testing.T) {
+	now := time.Date(2024, 1, 31, 0, 0, 0, 0, time.UTC)
+	day := func(d int) string {
+		return now.AddDate(0, 0, -d).Format(time.RFC3339)
+	}
+	const mb = 1024 * 1024
+
+	records := []*RecordUsage{
+		{UUID: "a", Stream: "/live/a", Size: 100 * mb, Update: day(20)},
+		{UUID: "b", Stream: "/live/a", Size: 100 * mb, Update: day(5)},
+		{UUID: "c", Stream: "/live/a", Size: 100 * mb, Update: day(1)},
+		{UUID: "d", Stream: "/live/b", Size: 100 * mb, Update: day(30), Keep: true},
+		{UUID: "e", Stream: "/live/b", Size: 100 * mb, Update: day(4)},
+		{UUID: "f", Stream: "/live/b", Size: 100 * mb, Update: day(0), Processing: true},
+		{UUID: "g", Stream: "/show/c", Size: 100 * mb, Update: day(40)},
+		{UUID: "h", Stream: "/show/c", Size: 100 * mb, Update: day(90), Referenced: true},
+	}
+
+	retention := &RecordRetention{MaxDays: 10, MaxSize: 350, Streams: []*RecordRetentionStream{
+		{Match: "/show/*", MaxDays: 60},
+		{Match: "/live/a", MaxSize: 150},
+	}}
+	if err := retention.Validate(); err != nil {
+		t.Errorf("validate err %+v", err)
+	}
+
+	var plan []string
+	for _, record := range retention.Plan(records, now) {
+		plan = append(plan, record.UUID+":"+record.Reason)
+	}
+
+	// The a is too old, the b exceeds the size of /live/a, the g is older than e and c. The h is played by
+	// vLive, so it's kept but counted in total size.
+	expect := []string{"a:age", "b:stream-size", "g:size", "e:size", "c:size"}
+	if len(plan) != len(expect) {
+		t.Errorf("invalid plan %v, expect %v", plan, expect)
+		return
+	}
+	for i := range plan {
+		if plan[i] != expect[i] {
+			t.Errorf("invalid plan %v, expect %v", plan, expect)
+		}
+	}
+
+	if err := (&RecordRetention{Streams: []*RecordRetentionStream{{Match: "[live"}}}).Validate(); err == nil {
+		t.Errorf("should fail for invalid match")
+	}
+}
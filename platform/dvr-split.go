@@ -0,0 +1,279 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/ossrs/go-oryx-lib/errors"
+	ohttp "github.com/ossrs/go-oryx-lib/http"
+	"github.com/ossrs/go-oryx-lib/logger"
+	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+)
+
+// RecordSplit is the policy to split the record of a stream to parts, each part is finished as an
+// artifact while the stream is still recording, and all parts are linked by the session.
+type RecordSplit struct {
+	// The max duration in seconds of each part, no limit if 0.
+	Duration int `json:"duration"`
+	// The max size in MB of each part, no limit if 0.
+	Size int64 `json:"size"`
+	// The wall clock boundary in minutes, for example, 60 to split at each hour, disabled if 0.
+	Clock int `json:"clock"`
+}
+
+func (v *RecordSplit) String() string {
+	return fmt.Sprintf("duration=%v, size=%vMB, clock=%v", v.Duration, v.Size, v.Clock)
+}
+
+func (v *RecordSplit) Validate() error {
+	if v.Duration != 0 && (v.Duration < 60 || v.Duration > 7*24*3600) {
+		return errors.Errorf("invalid duration %v", v.Duration)
+	}
+	if v.Size != 0 && (v.Size < 10 || v.Size > 1024*1024) {
+		return errors.Errorf("invalid size %v", v.Size)
+	}
+	if v.Clock != 0 && (v.Clock < 5 || v.Clock > 1440 || 1440%v.Clock != 0) {
+		return errors.Errorf("invalid clock %v, should be divisor of 1440", v.Clock)
+	}
+	return nil
+}
+
+func (v *RecordSplit) enabled() bool {
+	return v.Duration > 0 || v.Size > 0 || v.Clock > 0
+}
+
+// ShouldSplit whether start a new part for the next ts file, by the files of current part which is
+// begin at the specified time.
+func (v *RecordSplit) ShouldSplit(files []*TsFile, begin, now time.Time, next *TsFile) bool {
+	if len(files) == 0 {
+		return false
+	}
+
+	var duration float64
+	var size uint64
+	for _, file := range files {
+		duration, size = duration+file.Duration, size+file.Size
+	}
+
+	if v.Duration > 0 && duration+next.Duration > float64(v.Duration) {
+		return true
+	}
+	if v.Size > 0 && size+next.Size > uint64(v.Size)*1024*1024 {
+		return true
+	}
+
+	// Split when cross the wall clock boundary, for example, 10:00 for hourly.
+	if v.Clock > 0 && !begin.IsZero() {
+		window := func(t time.Time) string {
+			t = t.Local()
+			minutes := t.Hour()*60 + t.Minute()
+			return fmt.Sprintf("%v-%v", t.Format("2006-01-02"), minutes/v.Clock)
+		}
+		if window(begin) != window(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// loadRecordSplit load the split policy of records.
+func loadRecordSplit(ctx context.Context) (*RecordSplit, error) {
+	split := &RecordSplit{}
+	if value, err := rdb.HGet(ctx, SRS_RECORD_PATTERNS, "split").Result(); err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hget %v split", SRS_RECORD_PATTERNS)
+	} else if value != "" {
+		if err := json.Unmarshal([]byte(value), split); err != nil {
+			return nil, errors.Wrapf(err, "unmarshal %v", value)
+		}
+	}
+	return split, nil
+}
+
+// querySplit get the cached split policy, load from redis if not cached.
+func (v *RecordWorker) querySplit(ctx context.Context) (*RecordSplit, error) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if v.split == nil {
+		split, err := loadRecordSplit(ctx)
+		if err != nil {
+			return nil, errors.Wrapf(err, "load split")
+		}
+		v.split = split
+	}
+	return v.split, nil
+}
+
+// updateSplit update the cached split policy, when it's changed.
+func (v *RecordWorker) updateSplit(split *RecordSplit) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.split = split
+}
+
+// RecordPart is a part of record to finish, which is split from the stream.
+type RecordPart struct {
+	// The stream of part.
+	stream *RecordM3u8Stream
+	// The artifact of part.
+	artifact *M3u8VoDArtifact
+	// The message of ts file, which triggers the split.
+	msg *SrsOnHlsObject
+}
+
+func (v *RecordPart) String() string {
+	return fmt.Sprintf("stream=%v, artifact=%v", v.stream.M3u8URL, v.artifact.String())
+}
+
+// finish the part, remux to mp4 which takes a long time for large part, then notify the end of
+// record and start the post-processing.
+func (v *RecordPart) finish(ctx context.Context) error {
+	part := v.artifact
+	if err := v.stream.finishPart(ctx, part); err != nil {
+		return errors.Wrapf(err, "finish part %v", part.String())
+	}
+	if err := callbackWorker.OnRecordMessage(ctx, SrsActionOnRecordEnd, part.UUID, v.msg.Msg, part); err != nil {
+		logger.Wf(ctx, "ignore part %v callback end err %+v", part.String(), err)
+	}
+	if err := v.stream.postProcessing(ctx, part); err != nil {
+		logger.Wf(ctx, "ignore part %v post processing err %+v", part.String(), err)
+	}
+	return nil
+}
+
+// startPart finish the parts one by one, to never block consuming the ts files of stream.
+func (v *RecordWorker) startPart(ctx context.Context) {
+	v.wg.Add(1)
+	go func() {
+		defer v.wg.Done()
+
+		for ctx.Err() == nil {
+			var part *RecordPart
+			select {
+			case <-ctx.Done():
+				return
+			case part = <-v.parts:
+			}
+
+			if err := part.finish(ctx); err != nil {
+				logger.Wf(ctx, "record part %v err %+v", part.String(), err)
+			}
+		}
+	}()
+}
+
+// splitPart finish the current part and start a new part, if the next ts file exceeds the policy.
+func (v *RecordM3u8Stream) splitPart(ctx context.Context, msg *SrsOnHlsObject) error {
+	split, err := v.recordWorker.querySplit(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "query split")
+	}
+	if !split.enabled() {
+		return nil
+	}
+
+	v.lock.Lock()
+	part := v.artifact
+	files := append([]*TsFile{}, part.Files...)
+	begin, _ := time.Parse(time.RFC3339, part.Begin)
+	v.lock.Unlock()
+
+	if !split.ShouldSplit(files, begin, time.Now(), msg.TsFile) {
+		return nil
+	}
+
+	// Link the parts by the session, which is the UUID of the first part.
+	v.lock.Lock()
+	if part.Session == "" {
+		part.Session, part.Part = part.UUID, 1
+	}
+	v.lock.Unlock()
+
+	// Finish the current part in background, to be consumed while recording. Finish it right now
+	// if the queue is full, because the part should never be lost.
+	obj := &RecordPart{stream: v, artifact: part, msg: msg}
+	select {
+	case v.recordWorker.parts <- obj:
+	default:
+		logger.Wf(ctx, "finish part %v for queue is full", obj.String())
+		if err := obj.finish(ctx); err != nil {
+			return errors.Wrapf(err, "finish part %v", obj.String())
+		}
+	}
+
+	// Start a new part of session.
+	now := time.Now().Format(time.RFC3339)
+	v.lock.Lock()
+	v.UUID = uuid.NewString()
+	v.artifact = &M3u8VoDArtifact{
+		UUID: v.UUID, M3u8URL: v.M3u8URL, Processing: true, Update: now, Begin: now,
+		Session: part.Session, Part: part.Part + 1, Keep: part.Keep,
+	}
+	artifact := v.artifact
+	v.lock.Unlock()
+
+	if err := v.saveArtifact(ctx, artifact); err != nil {
+		return errors.Wrapf(err, "save artifact %v", artifact.String())
+	}
+	if err := v.saveObject(ctx); err != nil {
+		return errors.Wrapf(err, "save object %v", v.String())
+	}
+	if err := callbackWorker.OnRecordMessage(ctx, SrsActionOnRecordBegin, artifact.UUID, msg.Msg, nil); err != nil {
+		logger.Wf(ctx, "ignore part %v callback begin err %+v", artifact.String(), err)
+	}
+
+	logger.Tf(ctx, "record split ok, %v, session=%v, part=%v, uuid=%v, previous=%v, files=%v",
+		split.String(), artifact.Session, artifact.Part, artifact.UUID, part.UUID, len(files))
+	return nil
+}
+
+func (v *RecordWorker) handleSplit(ctx context.Context, handler *http.ServeMux) error {
+	ep := "/terraform/v1/hooks/record/split"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := func() error {
+			var token string
+			var split RecordSplit
+			if err := ParseBody(ctx, r.Body, &struct {
+				Token *string `json:"token"`
+				*RecordSplit
+			}{
+				Token: &token, RecordSplit: &split,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			if err := split.Validate(); err != nil {
+				return errors.Wrapf(err, "validate %v", split.String())
+			}
+
+			if b, err := json.Marshal(&split); err != nil {
+				return errors.Wrapf(err, "marshal %v", split.String())
+			} else if err := rdb.HSet(ctx, SRS_RECORD_PATTERNS, "split", string(b)).Err(); err != nil && err != redis.Nil {
+				return errors.Wrapf(err, "hset %v split %v", SRS_RECORD_PATTERNS, string(b))
+			}
+			v.updateSplit(&split)
+
+			ohttp.WriteData(ctx, w, r, nil)
+			logger.Tf(ctx, "record update split ok, %v, token=%vB", split.String(), len(token))
+			return nil
+		}(); err != nil {
+			ohttp.WriteError(ctx, w, r, err)
+		}
+	})
+
+	return nil
+}
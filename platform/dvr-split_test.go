@@ -0,0 +1,52 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRecordSplit_ShouldSplit(t *testing.T) {
+	files := []*TsFile{
+		{Duration: 10, Size: 4 * 1024 * 1024},
+		{Duration: 10, Size: 4 * 1024 * 1024},
+	}
+	next := &TsFile{Duration: 10, Size: 4 * 1024 * 1024}
+	begin := time.Date(2024, 1, 1, 9, 59, 0, 0, time.Local)
+	now := begin.Add(30 * time.Second)
+
+	if (&RecordSplit{}).ShouldSplit(files, begin, now, next) {
+		t.Errorf("should not split without policy")
+	}
+	if (&RecordSplit{Duration: 60}).ShouldSplit(nil, begin, now, next) {
+		t.Errorf("should not split for empty part")
+	}
+	if !(&RecordSplit{Duration: 25}).ShouldSplit(files, begin, now, next) {
+		t.Errorf("should split by duration")
+	}
+	if (&RecordSplit{Duration: 30}).ShouldSplit(files, begin, now, next) {
+		t.Errorf("should not split by duration")
+	}
+	if !(&RecordSplit{Size: 10}).ShouldSplit(files, begin, now, next) {
+		t.Errorf("should split by size")
+	}
+
+	// Split by hourly wall clock, the part begins at 09:59.
+	if (&RecordSplit{Clock: 60}).ShouldSplit(files, begin, now, next) {
+		t.Errorf("should not split in the same hour")
+	}
+	if !(&RecordSplit{Clock: 60}).ShouldSplit(files, begin, begin.Add(time.Minute), next) {
+		t.Errorf("should split at 10:00")
+	}
+	if !(&RecordSplit{Clock: 1440}).ShouldSplit(files, begin, begin.Add(15*time.Hour), next) {
+		t.Errorf("should split at midnight")
+	}
+
+	for _, split := range []*RecordSplit{{Duration: 10}, {Size: 1}, {Clock: 7}, {Clock: 2880}} {
+		if err := split.Validate(); err == nil {
+			t.Errorf("should fail %v", split.String())
+		}
+	}
+}
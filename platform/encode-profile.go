@@ -0,0 +1,714 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ossrs/go-oryx-lib/errors"
+	ohttp "github.com/ossrs/go-oryx-lib/http"
+	"github.com/ossrs/go-oryx-lib/logger"
+
+	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+)
+
+// The rate control mode of video encoder.
+const (
+	// Average bitrate, only set the target bitrate, which is the default.
+	EncodeRateControlABR = ""
+	// Constant bitrate, the min, max and target bitrate are the same.
+	EncodeRateControlCBR = "cbr"
+	// Variable bitrate, limited by the max bitrate and buffer size.
+	EncodeRateControlVBR = "vbr"
+	// Constant rate factor, by quality, optionally limited by the max bitrate.
+	EncodeRateControlCRF = "crf"
+)
+
+// EncodeProfile is a named encoding profile, shared by transcoding, forwarding, vLive and other tasks
+// which re-encode stream, referenced by ID.
+type EncodeProfile struct {
+	// The profile ID.
+	ID string `json:"id"`
+	// The profile name, for example, 720p-2mbps.
+	Name string `json:"name"`
+
+	// The video codec name, for example, libx264.
+	VideoCodec string `json:"vcodec"`
+	// The video profile, for example, baseline.
+	VideoProfile string `json:"vprofile,omitempty"`
+	// The video preset, for example, veryfast.
+	VideoPreset string `json:"vpreset,omitempty"`
+	// The video tune, for example, zerolatency.
+	VideoTune string `json:"vtune,omitempty"`
+	// The output size, keep the original if not set, or scale by aspect ratio if only one is set.
+	Width  int `json:"width,omitempty"`
+	Height int `json:"height,omitempty"`
+	// The frame rate, default to 25.
+	FPS int `json:"fps,omitempty"`
+	// The GOP in frames, default to 2s.
+	GOP int `json:"gop,omitempty"`
+	// The max number of B frames, 0 to disable B frame for WebRTC.
+	BFrames int `json:"bframes"`
+	// The rate control mode, empty(average bitrate), cbr, vbr or crf.
+	RateControl string `json:"rc,omitempty"`
+	// The video bitrate in kbps, not used for crf.
+	VideoBitrate int `json:"vbitrate,omitempty"`
+	// The max bitrate and buffer size in kbps, for vbr and crf.
+	MaxRate int `json:"maxrate,omitempty"`
+	BufSize int `json:"bufsize,omitempty"`
+	// The quality for crf, for example, 23.
+	CRF int `json:"crf,omitempty"`
+
+	// The audio codec name, for example, aac.
+	AudioCodec string `json:"acodec"`
+	// The audio bitrate in kbps.
+	AudioBitrate int `json:"abitrate"`
+	// The audio channels.
+	AudioChannels int `json:"achannels,omitempty"`
+	// The audio sample rate, for example, 44100.
+	AudioSampleRate int `json:"asamplerate,omitempty"`
+	// The integrated loudness target in LUFS, for example, -23 for EBU R128, 0 to disable.
+	Loudness float64 `json:"loudness,omitempty"`
+	// The max true peak in dBTP, for example, -1, default to -1.5.
+	TruePeak float64 `json:"truePeak,omitempty"`
+
+	// The create and update time.
+	CreatedAt string `json:"created_at,omitempty"`
+	UpdatedAt string `json:"updated_at,omitempty"`
+}
+
+func (v *EncodeProfile) String() string {
+	return fmt.Sprintf("id=%v, name=%v, vcodec=%v, vprofile=%v, vpreset=%v, vtune=%v, size=%vx%v, "+
+		"fps=%v, gop=%v, bframes=%v, rc=%v, vbitrate=%v, maxrate=%v, bufsize=%v, crf=%v, acodec=%v, "+
+		"abitrate=%v, achannels=%v, asamplerate=%v, loudness=%v, truePeak=%v",
+		v.ID, v.Name, v.VideoCodec, v.VideoProfile, v.VideoPreset, v.VideoTune, v.Width, v.Height,
+		v.FPS, v.GOP, v.BFrames, v.RateControl, v.VideoBitrate, v.MaxRate, v.BufSize, v.CRF, v.AudioCodec,
+		v.AudioBitrate, v.AudioChannels, v.AudioSampleRate, v.Loudness, v.TruePeak,
+	)
+}
+
+// Validate the settings of profile, not including the capabilities of FFmpeg.
+func (v *EncodeProfile) Validate() error {
+	if v.Name == "" {
+		return errors.New("no name")
+	}
+	if v.VideoCodec == "" {
+		return errors.New("no vcodec")
+	}
+	if v.AudioCodec == "" {
+		return errors.New("no acodec")
+	}
+
+	if v.Width < 0 || v.Width%2 != 0 || v.Width > 3840 {
+		return errors.Errorf("invalid width %v", v.Width)
+	}
+	if v.Height < 0 || v.Height%2 != 0 || v.Height > 2160 {
+		return errors.Errorf("invalid height %v", v.Height)
+	}
+	if v.FPS < 0 || v.FPS > 120 {
+		return errors.Errorf("invalid fps %v", v.FPS)
+	}
+	if v.GOP < 0 || v.GOP > 1200 {
+		return errors.Errorf("invalid gop %v", v.GOP)
+	}
+	if v.BFrames < 0 || v.BFrames > 16 {
+		return errors.Errorf("invalid bframes %v", v.BFrames)
+	}
+
+	switch v.RateControl {
+	case EncodeRateControlABR:
+		if v.VideoBitrate <= 0 {
+			return errors.Errorf("invalid vbitrate %v", v.VideoBitrate)
+		}
+	case EncodeRateControlCBR:
+		if v.VideoBitrate <= 0 {
+			return errors.Errorf("invalid vbitrate %v", v.VideoBitrate)
+		}
+	case EncodeRateControlVBR:
+		if v.VideoBitrate <= 0 || v.MaxRate < v.VideoBitrate {
+			return errors.Errorf("invalid vbitrate %v and maxrate %v", v.VideoBitrate, v.MaxRate)
+		}
+	case EncodeRateControlCRF:
+		if v.CRF <= 0 || v.CRF > 63 {
+			return errors.Errorf("invalid crf %v", v.CRF)
+		}
+	default:
+		return errors.Errorf("invalid rc %v", v.RateControl)
+	}
+	if v.MaxRate < 0 || v.BufSize < 0 {
+		return errors.Errorf("invalid maxrate %v or bufsize %v", v.MaxRate, v.BufSize)
+	}
+
+	if v.AudioBitrate <= 0 {
+		return errors.Errorf("invalid abitrate %v", v.AudioBitrate)
+	}
+	if v.AudioChannels < 0 || v.AudioChannels > 8 {
+		return errors.Errorf("invalid achannels %v", v.AudioChannels)
+	}
+	if v.AudioSampleRate != 0 && !slicesContains([]string{"8000", "16000", "22050", "24000", "32000", "44100", "48000"}, fmt.Sprintf("%v", v.AudioSampleRate)) {
+		return errors.Errorf("invalid asamplerate %v", v.AudioSampleRate)
+	}
+	if v.Loudness < -70 || (v.Loudness > -5 && v.Loudness != 0) {
+		return errors.Errorf("invalid loudness %v", v.Loudness)
+	}
+	if v.TruePeak < -9 || v.TruePeak > 0 {
+		return errors.Errorf("invalid truePeak %v", v.TruePeak)
+	}
+	return nil
+}
+
+// ValidateEncoders validate the codecs by the encoders of FFmpeg.
+func (v *EncodeProfile) ValidateEncoders(encoders map[string]string) error {
+	if encoders[v.VideoCodec] != "V" {
+		return errors.Errorf("no video encoder %v", v.VideoCodec)
+	}
+	if encoders[v.AudioCodec] != "A" {
+		return errors.Errorf("no audio encoder %v", v.AudioCodec)
+	}
+	return nil
+}
+
+func (v *EncodeProfile) fps() int {
+	if v.FPS <= 0 {
+		return 25
+	}
+	return v.FPS
+}
+
+func (v *EncodeProfile) gop() int {
+	if v.GOP <= 0 {
+		return v.fps() * 2
+	}
+	return v.GOP
+}
+
+// VideoFilter build the video filter to scale, empty if keep the original size.
+func (v *EncodeProfile) VideoFilter() string {
+	if v.Width <= 0 && v.Height <= 0 {
+		return ""
+	}
+
+	width, height := v.Width, v.Height
+	if width <= 0 {
+		width = -2
+	}
+	if height <= 0 {
+		height = -2
+	}
+	return fmt.Sprintf("scale=%v:%v", width, height)
+}
+
+// AudioFilter build the audio filter to normalize loudness, empty if disabled. Note that the loudnorm
+// upsamples to 192kHz, so it's always resampled to the sample rate of profile.
+func (v *EncodeProfile) AudioFilter() string {
+	if v.Loudness == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%v,aresample=%v", v.loudnormFilter(), v.sampleRate())
+}
+
+func (v *EncodeProfile) loudnormFilter() string {
+	truePeak := v.TruePeak
+	if truePeak == 0 {
+		truePeak = -1.5
+	}
+	return fmt.Sprintf("loudnorm=I=%v:TP=%v:LRA=11", v.Loudness, truePeak)
+}
+
+// The sample rate to resample the audio after filters, default to 48kHz.
+func (v *EncodeProfile) sampleRate() int {
+	if v.AudioSampleRate <= 0 {
+		return 48000
+	}
+	return v.AudioSampleRate
+}
+
+// VideoArgs build the video encoder arguments of FFmpeg, without filters.
+func (v *EncodeProfile) VideoArgs() []string {
+	args := []string{"-vcodec", v.VideoCodec}
+	if v.VideoProfile != "" {
+		args = append(args, "-profile:v", v.VideoProfile)
+	}
+	if v.VideoPreset != "" {
+		args = append(args, "-preset:v", v.VideoPreset)
+	}
+	if v.VideoTune != "" {
+		args = append(args, "-tune", v.VideoTune)
+	}
+
+	switch v.RateControl {
+	case EncodeRateControlCBR:
+		bitrate := fmt.Sprintf("%vk", v.VideoBitrate)
+		bufsize := v.BufSize
+		if bufsize <= 0 {
+			bufsize = v.VideoBitrate
+		}
+		args = append(args, "-b:v", bitrate, "-minrate", bitrate, "-maxrate", bitrate,
+			"-bufsize", fmt.Sprintf("%vk", bufsize),
+		)
+	case EncodeRateControlVBR:
+		bufsize := v.BufSize
+		if bufsize <= 0 {
+			bufsize = v.MaxRate * 2
+		}
+		args = append(args, "-b:v", fmt.Sprintf("%vk", v.VideoBitrate),
+			"-maxrate", fmt.Sprintf("%vk", v.MaxRate), "-bufsize", fmt.Sprintf("%vk", bufsize),
+		)
+	case EncodeRateControlCRF:
+		args = append(args, "-crf", fmt.Sprintf("%v", v.CRF))
+		if v.MaxRate > 0 {
+			bufsize := v.BufSize
+			if bufsize <= 0 {
+				bufsize = v.MaxRate * 2
+			}
+			args = append(args, "-maxrate", fmt.Sprintf("%vk", v.MaxRate), "-bufsize", fmt.Sprintf("%vk", bufsize))
+		}
+	default:
+		args = append(args, "-b:v", fmt.Sprintf("%vk", v.VideoBitrate))
+	}
+
+	return append(args,
+		"-r", fmt.Sprintf("%v", v.fps()), "-g", fmt.Sprintf("%v", v.gop()),
+		"-bf", fmt.Sprintf("%v", v.BFrames),
+	)
+}
+
+// AudioArgs build the audio encoder arguments of FFmpeg, without filters.
+func (v *EncodeProfile) AudioArgs() []string {
+	args := []string{"-acodec", v.AudioCodec, "-b:a", fmt.Sprintf("%vk", v.AudioBitrate)}
+	if v.AudioChannels > 0 {
+		args = append(args, "-ac", fmt.Sprintf("%v", v.AudioChannels))
+	}
+	if v.AudioSampleRate > 0 {
+		args = append(args, "-ar", fmt.Sprintf("%v", v.AudioSampleRate))
+	}
+	return args
+}
+
+// FFmpegArgs build the encoder arguments of FFmpeg, with the filters to scale and normalize loudness.
+// Note that the caller should not use filter_complex for the same stream.
+func (v *EncodeProfile) FFmpegArgs() []string {
+	var args []string
+	if filter := v.VideoFilter(); filter != "" {
+		args = append(args, "-vf", filter)
+	}
+	if filter := v.AudioFilter(); filter != "" {
+		args = append(args, "-af", filter)
+	}
+	args = append(args, v.VideoArgs()...)
+	return append(args, v.AudioArgs()...)
+}
+
+// Convert the loose encoder settings to profile, which is the same as before profile is introduced.
+func (v TranscodeEncoder) legacyProfile() *EncodeProfile {
+	return &EncodeProfile{
+		VideoCodec: v.VideoCodec, VideoProfile: v.VideoProfile, VideoPreset: v.VideoPreset,
+		// Low latency mode.
+		VideoTune: "zerolatency",
+		// Set gop to 2s, and disable B frame for WebRTC.
+		FPS: 25, GOP: 50, BFrames: 0,
+		VideoBitrate: v.VideoBitrate,
+		AudioCodec:   v.AudioCodec, AudioBitrate: v.AudioBitrate, AudioChannels: v.AudioChannels,
+	}
+}
+
+// ResolveProfile load the profile by ID if specified, or use the loose encoder settings.
+func (v TranscodeEncoder) ResolveProfile(ctx context.Context) (*EncodeProfile, error) {
+	if v.Profile == "" {
+		return v.legacyProfile(), nil
+	}
+
+	profile, err := LoadEncodeProfile(ctx, v.Profile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "load profile %v", v.Profile)
+	}
+	return profile, nil
+}
+
+// LoadEncodeProfile load the profile by ID.
+func LoadEncodeProfile(ctx context.Context, id string) (*EncodeProfile, error) {
+	b, err := rdb.HGet(ctx, SRS_ENCODE_PROFILE, id).Result()
+	if err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hget %v %v", SRS_ENCODE_PROFILE, id)
+	} else if b == "" {
+		return nil, errors.Errorf("no profile %v", id)
+	}
+
+	var profile EncodeProfile
+	if err := json.Unmarshal([]byte(b), &profile); err != nil {
+		return nil, errors.Wrapf(err, "unmarshal %v", b)
+	}
+	return &profile, nil
+}
+
+// queryEncodeProfileReferences query the forward, transcode, mosaic, vLive and record pipeline which
+// reference the profile, return the description of each reference.
+func queryEncodeProfileReferences(ctx context.Context, id string) ([]string, error) {
+	var refs []string
+	unmarshalAll := func(key string, fn func(field string, b []byte) error) error {
+		objs, err := rdb.HGetAll(ctx, key).Result()
+		if err != nil && err != redis.Nil {
+			return errors.Wrapf(err, "hgetall %v", key)
+		}
+		for field, obj := range objs {
+			if err := fn(field, []byte(obj)); err != nil {
+				return errors.Wrapf(err, "unmarshal %v %v", field, obj)
+			}
+		}
+		return nil
+	}
+
+	if err := unmarshalAll(SRS_FORWARD_CONFIG, func(field string, b []byte) error {
+		var config ForwardConfigure
+		if err := json.Unmarshal(b, &config); err != nil {
+			return err
+		}
+		if config.Profile == id {
+			refs = append(refs, fmt.Sprintf("forward %v", config.Platform))
+		}
+		return nil
+	}); err != nil {
+		return nil, errors.Wrapf(err, "forward")
+	}
+
+	if b, err := rdb.HGet(ctx, SRS_TRANSCODE_CONFIG, "global").Result(); err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hget %v global", SRS_TRANSCODE_CONFIG)
+	} else if b != "" {
+		var config TranscodeConfig
+		if err := json.Unmarshal([]byte(b), &config); err != nil {
+			return nil, errors.Wrapf(err, "unmarshal %v", b)
+		}
+		if config.Profile == id {
+			refs = append(refs, "transcode")
+		}
+	}
+
+	if rules, err := loadTranscodeRules(ctx); err != nil {
+		return nil, errors.Wrapf(err, "load transcode rules")
+	} else {
+		for _, rule := range rules.Rules {
+			if rule.Profile == id {
+				refs = append(refs, fmt.Sprintf("transcode rule %v", rule.ID))
+			}
+		}
+	}
+
+	if err := unmarshalAll(SRS_MOSAIC_CONFIG, func(field string, b []byte) error {
+		var config MosaicConfigure
+		if err := json.Unmarshal(b, &config); err != nil {
+			return err
+		}
+		if config.Profile == id {
+			refs = append(refs, fmt.Sprintf("mosaic %v", config.Platform))
+		}
+		return nil
+	}); err != nil {
+		return nil, errors.Wrapf(err, "mosaic")
+	}
+
+	if err := unmarshalAll(SRS_VLIVE_CONFIG, func(field string, b []byte) error {
+		var config VLiveConfigure
+		if err := json.Unmarshal(b, &config); err != nil {
+			return err
+		}
+		if config.Encode != nil && config.Encode.Profile == id {
+			refs = append(refs, fmt.Sprintf("vlive %v", config.Platform))
+		}
+		return nil
+	}); err != nil {
+		return nil, errors.Wrapf(err, "vlive")
+	}
+
+	if pipeline, err := loadRecordPipelineSteps(ctx); err != nil {
+		return nil, errors.Wrapf(err, "load record pipeline")
+	} else {
+		for index, step := range pipeline.Steps {
+			if step.Type == RecordPipelineStepTranscode && step.Profile == id {
+				refs = append(refs, fmt.Sprintf("record pipeline step %v", index))
+			}
+		}
+	}
+
+	return refs, nil
+}
+
+// ParseFFmpegEncoders parse the output of ffmpeg -encoders, return the map of encoder name to type, V
+// for video, A for audio and S for subtitle.
+func ParseFFmpegEncoders(output string) map[string]string {
+	encoders := make(map[string]string)
+
+	var started bool
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		// The encoders are listed after the line of " ------".
+		if !started {
+			started = strings.HasPrefix(fields[0], "------")
+			continue
+		}
+		if len(fields) < 2 {
+			continue
+		}
+
+		if flags := fields[0]; len(flags) == 6 && strings.Contains("VAS", flags[:1]) {
+			encoders[fields[1]] = flags[:1]
+		}
+	}
+	return encoders
+}
+
+// The encoders of FFmpeg, which never changes, so only query once.
+var ffmpegEncoders map[string]string
+var ffmpegEncodersLock sync.Mutex
+
+// FFmpegEncoders query the encoders by ffmpeg -encoders.
+func FFmpegEncoders(ctx context.Context) (map[string]string, error) {
+	ffmpegEncodersLock.Lock()
+	defer ffmpegEncodersLock.Unlock()
+
+	if ffmpegEncoders != nil {
+		return ffmpegEncoders, nil
+	}
+
+	toCtx, toCancelFunc := context.WithTimeout(ctx, 10*time.Second)
+	defer toCancelFunc()
+
+	b, err := exec.CommandContext(toCtx, "ffmpeg", "-hide_banner", "-encoders").Output()
+	if err != nil {
+		return nil, errors.Wrapf(err, "ffmpeg -encoders")
+	}
+
+	ffmpegEncoders = ParseFFmpegEncoders(string(b))
+	return ffmpegEncoders, nil
+}
+
+func handleEncodeProfileService(ctx context.Context, handler *http.ServeMux) error {
+	ep := "/terraform/v1/ffmpeg/profiles/query"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := func() error {
+			var token, id string
+			if err := ParseBody(ctx, r.Body, &struct {
+				Token *string `json:"token"`
+				ID    *string `json:"id"`
+			}{
+				Token: &token, ID: &id,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			if id != "" {
+				profile, err := LoadEncodeProfile(ctx, id)
+				if err != nil {
+					return errors.Wrapf(err, "load profile %v", id)
+				}
+
+				ohttp.WriteData(ctx, w, r, profile)
+				logger.Tf(ctx, "profile query ok, %v, token=%vB", profile.String(), len(token))
+				return nil
+			}
+
+			profiles := make([]*EncodeProfile, 0)
+			if objs, err := rdb.HGetAll(ctx, SRS_ENCODE_PROFILE).Result(); err != nil && err != redis.Nil {
+				return errors.Wrapf(err, "hgetall %v", SRS_ENCODE_PROFILE)
+			} else {
+				for k, obj := range objs {
+					var profile EncodeProfile
+					if err := json.Unmarshal([]byte(obj), &profile); err != nil {
+						return errors.Wrapf(err, "unmarshal %v %v", k, obj)
+					}
+					profiles = append(profiles, &profile)
+				}
+			}
+
+			sort.Slice(profiles, func(i, j int) bool {
+				return profiles[i].Name < profiles[j].Name
+			})
+
+			ohttp.WriteData(ctx, w, r, profiles)
+			logger.Tf(ctx, "profile query ok, profiles=%v, token=%vB", len(profiles), len(token))
+			return nil
+		}(); err != nil {
+			ohttp.WriteError(ctx, w, r, err)
+		}
+	})
+
+	// Create or update the profile, update if the ID is specified.
+	saveProfile := func(w http.ResponseWriter, r *http.Request, update bool) error {
+		var token string
+		var profile EncodeProfile
+		if err := ParseBody(ctx, r.Body, &struct {
+			Token *string `json:"token"`
+			*EncodeProfile
+		}{
+			Token: &token, EncodeProfile: &profile,
+		}); err != nil {
+			return errors.Wrapf(err, "parse body")
+		}
+
+		apiSecret := envApiSecret()
+		if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+			return errors.Wrapf(err, "authenticate")
+		}
+
+		if err := profile.Validate(); err != nil {
+			return errors.Wrapf(err, "validate %v", profile.String())
+		}
+
+		encoders, err := FFmpegEncoders(ctx)
+		if err != nil {
+			return errors.Wrapf(err, "query encoders")
+		}
+		if err := profile.ValidateEncoders(encoders); err != nil {
+			return errors.Wrapf(err, "validate encoders of %v", profile.String())
+		}
+
+		now := time.Now().Format(time.RFC3339)
+		if update {
+			if old, err := LoadEncodeProfile(ctx, profile.ID); err != nil {
+				return errors.Wrapf(err, "load profile %v", profile.ID)
+			} else {
+				profile.CreatedAt = old.CreatedAt
+			}
+		} else {
+			profile.ID, profile.CreatedAt = uuid.NewString(), now
+		}
+		profile.UpdatedAt = now
+
+		if b, err := json.Marshal(&profile); err != nil {
+			return errors.Wrapf(err, "marshal %v", profile.String())
+		} else if err := rdb.HSet(ctx, SRS_ENCODE_PROFILE, profile.ID, string(b)).Err(); err != nil && err != redis.Nil {
+			return errors.Wrapf(err, "hset %v %v %v", SRS_ENCODE_PROFILE, profile.ID, string(b))
+		}
+
+		ohttp.WriteData(ctx, w, r, &profile)
+		logger.Tf(ctx, "profile save ok, update=%v, %v, token=%vB", update, profile.String(), len(token))
+		return nil
+	}
+
+	ep = "/terraform/v1/ffmpeg/profiles/create"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := saveProfile(w, r, false); err != nil {
+			ohttp.WriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/terraform/v1/ffmpeg/profiles/update"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := saveProfile(w, r, true); err != nil {
+			ohttp.WriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/terraform/v1/ffmpeg/profiles/remove"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := func() error {
+			var token, id string
+			if err := ParseBody(ctx, r.Body, &struct {
+				Token *string `json:"token"`
+				ID    *string `json:"id"`
+			}{
+				Token: &token, ID: &id,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			if id == "" {
+				return errors.New("no id")
+			}
+
+			// The tasks which reference the profile will fail to start, so user should change them first.
+			if refs, err := queryEncodeProfileReferences(ctx, id); err != nil {
+				return errors.Wrapf(err, "query references of %v", id)
+			} else if len(refs) > 0 {
+				return errors.Errorf("profile %v is referenced by %v", id, strings.Join(refs, ", "))
+			}
+
+			if err := rdb.HDel(ctx, SRS_ENCODE_PROFILE, id).Err(); err != nil && err != redis.Nil {
+				return errors.Wrapf(err, "hdel %v %v", SRS_ENCODE_PROFILE, id)
+			}
+
+			ohttp.WriteData(ctx, w, r, nil)
+			logger.Tf(ctx, "profile remove ok, id=%v, token=%vB", id, len(token))
+			return nil
+		}(); err != nil {
+			ohttp.WriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/terraform/v1/ffmpeg/profiles/encoders"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := func() error {
+			var token string
+			if err := ParseBody(ctx, r.Body, &struct {
+				Token *string `json:"token"`
+			}{
+				Token: &token,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			encoders, err := FFmpegEncoders(ctx)
+			if err != nil {
+				return errors.Wrapf(err, "query encoders")
+			}
+
+			videos, audios := []string{}, []string{}
+			for name, kind := range encoders {
+				if kind == "V" {
+					videos = append(videos, name)
+				} else if kind == "A" {
+					audios = append(audios, name)
+				}
+			}
+			sort.Strings(videos)
+			sort.Strings(audios)
+
+			ohttp.WriteData(ctx, w, r, &struct {
+				Video []string `json:"video"`
+				Audio []string `json:"audio"`
+			}{
+				Video: videos, Audio: audios,
+			})
+			logger.Tf(ctx, "profile encoders ok, video=%v, audio=%v, token=%vB", len(videos), len(audios), len(token))
+			return nil
+		}(); err != nil {
+			ohttp.WriteError(ctx, w, r, err)
+		}
+	})
+
+	return nil
+}
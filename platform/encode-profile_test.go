@@ -0,0 +1,94 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEncodeProfile_LegacyArgs(t *testing.T) {
+	encoder := TranscodeEncoder{
+		VideoCodec: "libx264", VideoProfile: "main", VideoPreset: "veryfast", VideoBitrate: 1200,
+		AudioCodec: "aac", AudioBitrate: 64, AudioChannels: 2,
+	}
+
+	// Should be the same as before the profile is introduced.
+	args := strings.Join(encoder.FFmpegArgs(), " ")
+	expect := "-vcodec libx264 -profile:v main -preset:v veryfast -tune zerolatency -b:v 1200k -r 25 -g 50 -bf 0 -acodec aac -b:a 64k -ac 2"
+	if args != expect {
+		t.Errorf("invalid args %v, expect %v", args, expect)
+	}
+}
+
+func TestEncodeProfile_Args(t *testing.T) {
+	profile := &EncodeProfile{
+		Name: "720p", VideoCodec: "libx264", Height: 720, FPS: 30, BFrames: 2,
+		RateControl: EncodeRateControlVBR, VideoBitrate: 2000, MaxRate: 3000,
+		AudioCodec: "aac", AudioBitrate: 128, AudioSampleRate: 48000, Loudness: -23,
+	}
+	if err := profile.Validate(); err != nil {
+		t.Errorf("validate err %+v", err)
+	}
+
+	args := strings.Join(profile.FFmpegArgs(), " ")
+	expect := "-vf scale=-2:720 -af loudnorm=I=-23:TP=-1.5:LRA=11,aresample=48000 -vcodec libx264 -b:v 2000k -maxrate 3000k -bufsize 6000k -r 30 -g 60 -bf 2 -acodec aac -b:a 128k -ar 48000"
+	if args != expect {
+		t.Errorf("invalid args %v, expect %v", args, expect)
+	}
+
+	profile.RateControl, profile.CRF, profile.MaxRate = EncodeRateControlCRF, 23, 0
+	if args := strings.Join(profile.VideoArgs(), " "); !strings.Contains(args, "-crf 23 -r 30") {
+		t.Errorf("invalid crf args %v", args)
+	}
+
+	profile.RateControl = EncodeRateControlCBR
+	if args := strings.Join(profile.VideoArgs(), " "); !strings.Contains(args, "-b:v 2000k -minrate 2000k -maxrate 2000k -bufsize 2000k") {
+		t.Errorf("invalid cbr args %v", args)
+	}
+}
+
+func TestEncodeProfile_Validate(t *testing.T) {
+	for _, profile := range []*EncodeProfile{
+		{VideoCodec: "libx264", VideoBitrate: 1000, AudioCodec: "aac", AudioBitrate: 64},
+		{Name: "a", VideoCodec: "libx264", AudioCodec: "aac", AudioBitrate: 64},
+		{Name: "a", VideoCodec: "libx264", VideoBitrate: 1000, AudioCodec: "aac", AudioBitrate: 64, Width: 1281},
+		{Name: "a", VideoCodec: "libx264", VideoBitrate: 1000, AudioCodec: "aac", AudioBitrate: 64, RateControl: "vbr"},
+		{Name: "a", VideoCodec: "libx264", AudioCodec: "aac", AudioBitrate: 64, RateControl: "crf"},
+		{Name: "a", VideoCodec: "libx264", VideoBitrate: 1000, AudioCodec: "aac", AudioBitrate: 64, AudioSampleRate: 44000},
+		{Name: "a", VideoCodec: "libx264", VideoBitrate: 1000, AudioCodec: "aac", AudioBitrate: 64, Loudness: -2},
+	} {
+		if err := profile.Validate(); err == nil {
+			t.Errorf("should fail %v", profile.String())
+		}
+	}
+}
+
+func TestEncodeProfile_ParseEncoders(t *testing.T) {
+	output := strings.Join([]string{
+		"Encoders:",
+		" V..... = Video",
+		" A..... = Audio",
+		" ------",
+		" V....D libx264              libx264 H.264 / AVC / MPEG-4 AVC (codec h264)",
+		" V....D libx265              libx265 H.265 / HEVC (codec hevc)",
+		" A....D aac                  AAC (Advanced Audio Coding)",
+		" S..... webvtt               WebVTT subtitle",
+	}, "\n")
+
+	encoders := ParseFFmpegEncoders(output)
+	if len(encoders) != 4 || encoders["libx264"] != "V" || encoders["aac"] != "A" || encoders["webvtt"] != "S" {
+		t.Errorf("invalid encoders %v", encoders)
+	}
+
+	profile := &EncodeProfile{VideoCodec: "libx264", AudioCodec: "aac"}
+	if err := profile.ValidateEncoders(encoders); err != nil {
+		t.Errorf("validate err %+v", err)
+	}
+
+	profile.VideoCodec = "aac"
+	if err := profile.ValidateEncoders(encoders); err == nil {
+		t.Errorf("should fail for audio encoder as video")
+	}
+}
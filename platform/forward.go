@@ -89,6 +89,11 @@ func (v *ForwardWorker) Handle(ctx context.Context, handler *http.ServeMux) erro
 				if userConf.Server == "" && userConf.Secret == "" {
 					return errors.New("no secret")
 				}
+				if userConf.Profile != "" {
+					if _, err := LoadEncodeProfile(ctx, userConf.Profile); err != nil {
+						return errors.Wrapf(err, "load profile %v", userConf.Profile)
+					}
+				}
 			}
 
 			if action == "update" {
@@ -344,11 +349,13 @@ type ForwardConfigure struct {
 	Customed bool `json:"custom"`
 	// The label for this configure.
 	Label string `json:"label"`
+	// The ID of encode profile to re-encode the stream, or copy it if empty.
+	Profile string `json:"profile,omitempty"`
 }
 
 func (v *ForwardConfigure) String() string {
-	return fmt.Sprintf("platform=%v, server=%v, secret=%v, enabled=%v, customed=%v, label=%v",
-		v.Platform, v.Server, v.Secret, v.Enabled, v.Customed, v.Label,
+	return fmt.Sprintf("platform=%v, server=%v, secret=%v, enabled=%v, customed=%v, label=%v, profile=%v",
+		v.Platform, v.Server, v.Secret, v.Enabled, v.Customed, v.Label, v.Profile,
 	)
 }
 
@@ -359,6 +366,7 @@ func (v *ForwardConfigure) Update(u *ForwardConfigure) error {
 	v.Label = u.Label
 	v.Enabled = u.Enabled
 	v.Customed = u.Customed
+	v.Profile = u.Profile
 	return nil
 }
 
@@ -628,7 +636,13 @@ func (v *ForwardTask) doForward(ctx context.Context, input *SrsStream) error {
 	} else {
 		args = append(args, "-i", inputURL)
 	}
-	args = append(args, "-c", "copy")
+	if v.config.Profile == "" {
+		args = append(args, "-c", "copy")
+	} else if profile, err := LoadEncodeProfile(ctx, v.config.Profile); err != nil {
+		return errors.Wrapf(err, "load profile %v", v.config.Profile)
+	} else {
+		args = append(args, profile.FFmpegArgs()...)
+	}
 	// If RTMP use flv, if SRT use mpegts, otherwise do not set.
 	if strings.HasPrefix(outputURL, "rtmp://") || strings.HasPrefix(outputURL, "rtmps://") {
 		args = append(args, "-f", "flv")
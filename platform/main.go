@@ -258,6 +258,27 @@ func doMain(ctx context.Context) error {
 		return errors.Wrapf(err, "start forward worker")
 	}
 
+	// Create worker for resumable upload.
+	uploadWorker = NewUploadWorker()
+	defer uploadWorker.Close()
+	if err := uploadWorker.Start(ctx); err != nil {
+		return errors.Wrapf(err, "start upload worker")
+	}
+
+	// Create worker for youtube-dl download jobs.
+	ytdlWorker = NewYtdlWorker()
+	defer ytdlWorker.Close()
+	if err := ytdlWorker.Start(ctx); err != nil {
+		return errors.Wrapf(err, "start ytdl worker")
+	}
+
+	// Create worker for normalizing media to streaming-safe profile.
+	normalizeWorker = NewNormalizeWorker()
+	defer normalizeWorker.Close()
+	if err := normalizeWorker.Start(ctx); err != nil {
+		return errors.Wrapf(err, "start normalize worker")
+	}
+
 	// Create worker for vLive.
 	vLiveWorker = NewVLiveWorker()
 	defer vLiveWorker.Close()
@@ -272,6 +293,20 @@ func doMain(ctx context.Context) error {
 		return errors.Wrapf(err, "start IP camera worker")
 	}
 
+	// Create worker for mosaic.
+	mosaicWorker = NewMosaicWorker()
+	defer mosaicWorker.Close()
+	if err := mosaicWorker.Start(ctx); err != nil {
+		return errors.Wrapf(err, "start mosaic worker")
+	}
+
+	// Create worker for snapshot.
+	snapshotWorker = NewSnapshotWorker()
+	defer snapshotWorker.Close()
+	if err := snapshotWorker.Start(ctx); err != nil {
+		return errors.Wrapf(err, "start snapshot worker")
+	}
+
 	// Create worker for crontab.
 	crontabWorker = NewCrontabWorker()
 	defer crontabWorker.Close()
@@ -438,7 +473,8 @@ func initPlatform(ctx context.Context) error {
 		"containers/data/upload", "containers/data/vlive", "containers/data/signals",
 		"containers/data/lego", "containers/data/.well-known", "containers/data/config",
 		"containers/data/transcript", "containers/data/srs-s3-bucket", "containers/data/ai-talk",
-		"containers/data/dubbing", "containers/data/ocr",
+		"containers/data/dubbing", "containers/data/ocr", "containers/data/media",
+		"containers/data/snapshots",
 	} {
 		if _, err := os.Stat(dir); err != nil && os.IsNotExist(err) {
 			if err = os.MkdirAll(dir, os.ModeDir|os.FileMode(0755)); err != nil {
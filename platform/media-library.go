@@ -0,0 +1,541 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ossrs/go-oryx-lib/errors"
+	ohttp "github.com/ossrs/go-oryx-lib/http"
+	"github.com/ossrs/go-oryx-lib/logger"
+
+	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+)
+
+// To protect the reference count of media assets.
+var mediaLock sync.Mutex
+
+func handleMediaLibraryService(ctx context.Context, handler *http.ServeMux) error {
+	// Register an uploaded file to media library, the file is moved to dirMediaPath. If the same content
+	// already exists, the uploaded file is removed and the existing asset is returned.
+	ep := "/terraform/v1/media/create"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := func() error {
+			var token, target, name string
+			var tags []string
+			if err := ParseBody(ctx, r.Body, &struct {
+				Token  *string   `json:"token"`
+				Target *string   `json:"target"`
+				Name   *string   `json:"name"`
+				Tags   *[]string `json:"tags"`
+			}{
+				Token: &token, Target: &target, Name: &name, Tags: &tags,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			if target == "" {
+				return errors.New("no target")
+			}
+			if !strings.HasPrefix(target, dirUploadPath) {
+				return errors.Errorf("invalid target %v", target)
+			}
+			if _, err := os.Stat(target); err != nil {
+				return errors.Wrapf(err, "no file %v", target)
+			}
+
+			asset, dedup, err := CreateMediaAsset(ctx, target, ChooseNotEmpty(name, path.Base(target)), tags)
+			if err != nil {
+				return errors.Wrapf(err, "create media of %v", target)
+			}
+
+			ohttp.WriteData(ctx, w, r, &struct {
+				*MediaAsset
+				Dedup bool `json:"dedup"`
+			}{
+				MediaAsset: asset, Dedup: dedup,
+			})
+			logger.Tf(ctx, "media: Create ok, dedup=%v, %v, token=%vB", dedup, asset.String(), len(token))
+			return nil
+		}(); err != nil {
+			ohttp.WriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/terraform/v1/media/query"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := func() error {
+			var token, mediaUUID string
+			if err := ParseBody(ctx, r.Body, &struct {
+				Token *string `json:"token"`
+				UUID  *string `json:"uuid"`
+			}{
+				Token: &token, UUID: &mediaUUID,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			asset, err := loadMediaAsset(ctx, mediaUUID)
+			if err != nil {
+				return errors.Wrapf(err, "load media %v", mediaUUID)
+			}
+
+			ohttp.WriteData(ctx, w, r, asset)
+			logger.Tf(ctx, "media: Query ok, %v, token=%vB", asset.String(), len(token))
+			return nil
+		}(); err != nil {
+			ohttp.WriteError(ctx, w, r, err)
+		}
+	})
+
+	// Search assets by keyword of name, tags and kind, all assets if no condition.
+	ep = "/terraform/v1/media/search"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := func() error {
+			var token, keyword, kind string
+			var tags []string
+			if err := ParseBody(ctx, r.Body, &struct {
+				Token   *string   `json:"token"`
+				Keyword *string   `json:"keyword"`
+				Tags    *[]string `json:"tags"`
+				Kind    *string   `json:"kind"`
+			}{
+				Token: &token, Keyword: &keyword, Tags: &tags, Kind: &kind,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			if kind != "" && kind != "video" && kind != "audio" {
+				return errors.Errorf("invalid kind %v", kind)
+			}
+
+			objs, err := rdb.HGetAll(ctx, SRS_MEDIA_ASSET).Result()
+			if err != nil && err != redis.Nil {
+				return errors.Wrapf(err, "hgetall %v", SRS_MEDIA_ASSET)
+			}
+
+			assets := make([]*MediaAsset, 0)
+			for k, v := range objs {
+				var asset MediaAsset
+				if err = json.Unmarshal([]byte(v), &asset); err != nil {
+					return errors.Wrapf(err, "unmarshal %v %v", k, v)
+				}
+
+				if asset.Match(keyword, tags, kind) {
+					assets = append(assets, &asset)
+				}
+			}
+
+			// Sort by create time, the latest first.
+			sort.Slice(assets, func(i, j int) bool {
+				return assets[i].Created > assets[j].Created
+			})
+
+			ohttp.WriteData(ctx, w, r, assets)
+			logger.Tf(ctx, "media: Search ok, keyword=%v, tags=%v, kind=%v, assets=%v, token=%vB",
+				keyword, tags, kind, len(assets), len(token))
+			return nil
+		}(); err != nil {
+			ohttp.WriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/terraform/v1/media/update"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := func() error {
+			var token, mediaUUID, name string
+			var tags []string
+			if err := ParseBody(ctx, r.Body, &struct {
+				Token *string   `json:"token"`
+				UUID  *string   `json:"uuid"`
+				Name  *string   `json:"name"`
+				Tags  *[]string `json:"tags"`
+			}{
+				Token: &token, UUID: &mediaUUID, Name: &name, Tags: &tags,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			mediaLock.Lock()
+			defer mediaLock.Unlock()
+
+			asset, err := loadMediaAsset(ctx, mediaUUID)
+			if err != nil {
+				return errors.Wrapf(err, "load media %v", mediaUUID)
+			}
+
+			if name != "" {
+				asset.Name = name
+			}
+			asset.Tags = normalizeMediaTags(tags)
+			if err := asset.Save(ctx); err != nil {
+				return errors.Wrapf(err, "save %v", asset.String())
+			}
+
+			ohttp.WriteData(ctx, w, r, asset)
+			logger.Tf(ctx, "media: Update ok, %v, token=%vB", asset.String(), len(token))
+			return nil
+		}(); err != nil {
+			ohttp.WriteError(ctx, w, r, err)
+		}
+	})
+
+	// Remove the asset and file, fail if still in use.
+	ep = "/terraform/v1/media/remove"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := func() error {
+			var token, mediaUUID string
+			if err := ParseBody(ctx, r.Body, &struct {
+				Token *string `json:"token"`
+				UUID  *string `json:"uuid"`
+			}{
+				Token: &token, UUID: &mediaUUID,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			mediaLock.Lock()
+			defer mediaLock.Unlock()
+
+			asset, err := loadMediaAsset(ctx, mediaUUID)
+			if err != nil {
+				return errors.Wrapf(err, "load media %v", mediaUUID)
+			}
+
+			if len(asset.Refs) > 0 {
+				return errors.Errorf("media %v is used by %v", mediaUUID, asset.Refs)
+			}
+
+			if err := rdb.HDel(ctx, SRS_MEDIA_ASSET, asset.UUID).Err(); err != nil && err != redis.Nil {
+				return errors.Wrapf(err, "hdel %v %v", SRS_MEDIA_ASSET, asset.UUID)
+			}
+			if err := rdb.HDel(ctx, SRS_MEDIA_HASH, asset.Hash).Err(); err != nil && err != redis.Nil {
+				return errors.Wrapf(err, "hdel %v %v", SRS_MEDIA_HASH, asset.Hash)
+			}
+			if _, err := os.Stat(asset.Target); err == nil {
+				os.Remove(asset.Target)
+			}
+
+			ohttp.WriteData(ctx, w, r, nil)
+			logger.Tf(ctx, "media: Remove ok, %v, token=%vB", asset.String(), len(token))
+			return nil
+		}(); err != nil {
+			ohttp.WriteError(ctx, w, r, err)
+		}
+	})
+
+	return nil
+}
+
+// MediaAsset is a file in media library, which is registered once and shared by vLive, camera and dubbing.
+type MediaAsset struct {
+	// The asset UUID.
+	UUID string `json:"uuid"`
+	// The display name, generally the original file name.
+	Name string `json:"name"`
+	// The file in dirMediaPath.
+	Target string `json:"target"`
+	// The size in bytes.
+	Size int64 `json:"size"`
+	// The SHA256 of file content in hex, to dedup the files.
+	Hash string `json:"hash"`
+	// The tags for search.
+	Tags []string `json:"tags"`
+	// The file format by ffprobe.
+	Format *MediaFormat `json:"format"`
+	// The video information by ffprobe.
+	Video *FFprobeVideo `json:"video"`
+	// The audio information by ffprobe.
+	Audio *FFprobeAudio `json:"audio"`
+	// The owners which use the asset, for example, vlive:wx or dubbing:xxx, the asset is protected from
+	// deleting while in use.
+	Refs []string `json:"refs"`
+	// The create time.
+	Created string `json:"created"`
+	// The last update time.
+	Update string `json:"update"`
+}
+
+func (v *MediaAsset) String() string {
+	return fmt.Sprintf("uuid=%v, name=%v, target=%v, size=%v, hash=%v, tags=%v, refs=%v, format=(%v), video=(%v), audio=(%v)",
+		v.UUID, v.Name, v.Target, v.Size, v.Hash, v.Tags, v.Refs, v.Format, v.Video, v.Audio,
+	)
+}
+
+func (v *MediaAsset) Save(ctx context.Context) error {
+	v.Update = time.Now().Format(time.RFC3339)
+
+	if b, err := json.Marshal(v); err != nil {
+		return errors.Wrapf(err, "marshal %v", v.String())
+	} else if err = rdb.HSet(ctx, SRS_MEDIA_ASSET, v.UUID, string(b)).Err(); err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hset %v %v %v", SRS_MEDIA_ASSET, v.UUID, string(b))
+	}
+	return nil
+}
+
+// Match whether the asset matches the keyword of name or tags, all the tags, and the kind of video or
+// audio. Ignore the empty condition.
+func (v *MediaAsset) Match(keyword string, tags []string, kind string) bool {
+	if keyword = strings.ToLower(strings.TrimSpace(keyword)); keyword != "" {
+		matched := strings.Contains(strings.ToLower(v.Name), keyword)
+		for _, tag := range v.Tags {
+			matched = matched || strings.Contains(tag, keyword)
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	for _, tag := range normalizeMediaTags(tags) {
+		if !slicesContains(v.Tags, tag) {
+			return false
+		}
+	}
+
+	if kind == "video" && v.Video == nil {
+		return false
+	}
+	if kind == "audio" && (v.Video != nil || v.Audio == nil) {
+		return false
+	}
+	return true
+}
+
+// ToSource build the source for vLive, camera or dubbing.
+func (v *MediaAsset) ToSource() *FFprobeSource {
+	source := &FFprobeSource{
+		Name: v.Name, Path: v.Name, Size: uint64(v.Size), UUID: uuid.NewString(), Target: v.Target,
+		Type: FFprobeSourceTypeMedia, Media: v.UUID, Video: v.Video, Audio: v.Audio,
+	}
+	if v.Format != nil {
+		source.Format = &FFprobeFormat{
+			Starttime: v.Format.Starttime,
+			Duration:  strconv.FormatFloat(v.Format.Duration, 'f', -1, 64),
+			Bitrate:   fmt.Sprintf("%v", v.Format.Bitrate),
+			Streams:   v.Format.Streams, Score: v.Format.Score,
+			HasVideo: v.Format.HasVideo, HasAudio: v.Format.HasAudio,
+		}
+	}
+	return source
+}
+
+// Load the asset by UUID, error if not exists.
+func loadMediaAsset(ctx context.Context, mediaUUID string) (*MediaAsset, error) {
+	if mediaUUID == "" {
+		return nil, errors.New("no media uuid")
+	}
+
+	var asset MediaAsset
+	if b, err := rdb.HGet(ctx, SRS_MEDIA_ASSET, mediaUUID).Result(); err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hget %v %v", SRS_MEDIA_ASSET, mediaUUID)
+	} else if b == "" {
+		return nil, errors.Errorf("no media %v", mediaUUID)
+	} else if err = json.Unmarshal([]byte(b), &asset); err != nil {
+		return nil, errors.Wrapf(err, "unmarshal %v", b)
+	}
+	return &asset, nil
+}
+
+// CreateMediaAsset register the file to media library, and move it to dirMediaPath. Return the existing
+// asset with dedup=true if the content is the same, and remove the file.
+func CreateMediaAsset(ctx context.Context, target, name string, tags []string) (asset *MediaAsset, dedup bool, err error) {
+	hash, size, err := sha256File(target)
+	if err != nil {
+		return nil, false, errors.Wrapf(err, "hash %v", target)
+	}
+
+	mediaLock.Lock()
+	defer mediaLock.Unlock()
+
+	// Dedup by content hash, merge the tags.
+	if mediaUUID, err := rdb.HGet(ctx, SRS_MEDIA_HASH, hash).Result(); err != nil && err != redis.Nil {
+		return nil, false, errors.Wrapf(err, "hget %v %v", SRS_MEDIA_HASH, hash)
+	} else if mediaUUID != "" {
+		if asset, err = loadMediaAsset(ctx, mediaUUID); err != nil {
+			return nil, false, errors.Wrapf(err, "load media %v", mediaUUID)
+		}
+
+		asset.Tags = normalizeMediaTags(append(asset.Tags, tags...))
+		if err := asset.Save(ctx); err != nil {
+			return nil, false, errors.Wrapf(err, "save %v", asset.String())
+		}
+
+		os.Remove(target)
+		return asset, true, nil
+	}
+
+	toCtx, toCancelFunc := context.WithTimeout(ctx, 15*time.Second)
+	defer toCancelFunc()
+
+	format, video, audio, err := FFprobeFileFormat(toCtx, target)
+	if err != nil {
+		return nil, false, errors.Wrapf(err, "probe %v", target)
+	}
+
+	asset = &MediaAsset{
+		UUID: uuid.NewString(), Name: name, Size: size, Hash: hash, Tags: normalizeMediaTags(tags),
+		Format: format, Video: video, Audio: audio, Refs: []string{},
+		Created: time.Now().Format(time.RFC3339),
+	}
+	asset.Target = path.Join(dirMediaPath, fmt.Sprintf("%v%v", asset.UUID, path.Ext(target)))
+	if err := os.Rename(target, asset.Target); err != nil {
+		return nil, false, errors.Wrapf(err, "rename %v to %v", target, asset.Target)
+	}
+
+	if err := asset.Save(ctx); err != nil {
+		return nil, false, errors.Wrapf(err, "save %v", asset.String())
+	}
+	if err := rdb.HSet(ctx, SRS_MEDIA_HASH, hash, asset.UUID).Err(); err != nil && err != redis.Nil {
+		return nil, false, errors.Wrapf(err, "hset %v %v %v", SRS_MEDIA_HASH, hash, asset.UUID)
+	}
+
+	return asset, false, nil
+}
+
+// ResolveMediaSource build the source from media asset, for vLive, camera and dubbing to play the file
+// of asset directly.
+func ResolveMediaSource(ctx context.Context, mediaUUID string) (*FFprobeSource, error) {
+	asset, err := loadMediaAsset(ctx, mediaUUID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "load media %v", mediaUUID)
+	}
+
+	if _, err := os.Stat(asset.Target); err != nil {
+		return nil, errors.Wrapf(err, "no file %v of media %v", asset.Target, mediaUUID)
+	}
+	return asset.ToSource(), nil
+}
+
+// UpdateMediaRefs update the references of owner, for example, vlive:wx, from the old assets to the new
+// assets. The assets only in olds are released, while those only in news are referenced.
+func UpdateMediaRefs(ctx context.Context, owner string, olds, news []string) error {
+	mediaLock.Lock()
+	defer mediaLock.Unlock()
+
+	for _, mediaUUID := range news {
+		if slicesContains(olds, mediaUUID) {
+			continue
+		}
+
+		asset, err := loadMediaAsset(ctx, mediaUUID)
+		if err != nil {
+			return errors.Wrapf(err, "load media %v", mediaUUID)
+		}
+		if !slicesContains(asset.Refs, owner) {
+			asset.Refs = append(asset.Refs, owner)
+			if err := asset.Save(ctx); err != nil {
+				return errors.Wrapf(err, "save %v", asset.String())
+			}
+		}
+	}
+
+	for _, mediaUUID := range olds {
+		if slicesContains(news, mediaUUID) {
+			continue
+		}
+
+		// Ignore if asset not exists, because there is no file to protect.
+		asset, err := loadMediaAsset(ctx, mediaUUID)
+		if err != nil {
+			logger.Wf(ctx, "ignore unref media %v of %v, err %+v", mediaUUID, owner, err)
+			continue
+		}
+
+		refs := []string{}
+		for _, ref := range asset.Refs {
+			if ref != owner {
+				refs = append(refs, ref)
+			}
+		}
+		asset.Refs = refs
+		if err := asset.Save(ctx); err != nil {
+			return errors.Wrapf(err, "save %v", asset.String())
+		}
+	}
+
+	return nil
+}
+
+// The UUIDs of media assets in sources.
+func mediaUUIDsOf(sources []*FFprobeSource) []string {
+	var uuids []string
+	for _, source := range sources {
+		if source.Type == FFprobeSourceTypeMedia && source.Media != "" && !slicesContains(uuids, source.Media) {
+			uuids = append(uuids, source.Media)
+		}
+	}
+	return uuids
+}
+
+// Trim, lower and dedup the tags.
+func normalizeMediaTags(tags []string) []string {
+	normalized := []string{}
+	for _, tag := range tags {
+		if tag = strings.ToLower(strings.TrimSpace(tag)); tag != "" && !slicesContains(normalized, tag) {
+			normalized = append(normalized, tag)
+		}
+	}
+	return normalized
+}
+
+// Calculate the SHA256 of file in hex, and the size in bytes.
+func sha256File(filename string) (string, int64, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", 0, errors.Wrapf(err, "open %v", filename)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	nn, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, errors.Wrapf(err, "read %v", filename)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nn, nil
+}
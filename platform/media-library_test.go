@@ -0,0 +1,44 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMedia_AssetMatch(t *testing.T) {
+	asset := &MediaAsset{
+		Name: "Evening Show.mp4", Tags: normalizeMediaTags([]string{" News", "news", "Sport "}),
+		Video: &FFprobeVideo{CodecName: "h264"}, Audio: &FFprobeAudio{CodecName: "aac"},
+	}
+	if strings.Join(asset.Tags, ",") != "news,sport" {
+		t.Errorf("invalid tags %v", asset.Tags)
+	}
+
+	for _, e := range []struct {
+		keyword string
+		tags    []string
+		kind    string
+		expect  bool
+	}{
+		{expect: true},
+		{keyword: "evening", expect: true},
+		{keyword: "SPO", expect: true},
+		{keyword: "morning", expect: false},
+		{tags: []string{"News", "sport"}, expect: true},
+		{tags: []string{"news", "music"}, expect: false},
+		{kind: "video", expect: true},
+		{kind: "audio", expect: false},
+	} {
+		if actual := asset.Match(e.keyword, e.tags, e.kind); actual != e.expect {
+			t.Errorf("keyword=%v, tags=%v, kind=%v, expect %v, actual %v", e.keyword, e.tags, e.kind, e.expect, actual)
+		}
+	}
+
+	sources := []*FFprobeSource{
+		{Type: FFprobeSourceTypeMedia, Media: "a"}, {Type: FFprobeSourceTypeUpload},
+		{Type: FFprobeSourceTypeMedia, Media: "a"}, {Type: FFprobeSourceTypeMedia, Media: "b"},
+	}
+	if uuids := strings.Join(mediaUUIDsOf(sources), ","); uuids != "a,b" {
+		t.Errorf("invalid uuids %v", uuids)
+	}
+}
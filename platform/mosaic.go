@@ -0,0 +1,829 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/ossrs/go-oryx-lib/errors"
+	ohttp "github.com/ossrs/go-oryx-lib/http"
+	"github.com/ossrs/go-oryx-lib/logger"
+
+	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+)
+
+var mosaicWorker *MosaicWorker
+
+// MosaicWorker composes multiple IP camera streams or stream URLs to a grid, with labels, and publish
+// to a stream. The missing input is shown as a "no signal" tile, instead of failing the whole output.
+type MosaicWorker struct {
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	// The mosaic tasks, key is platform in string, value is *MosaicTask.
+	tasks sync.Map
+}
+
+func NewMosaicWorker() *MosaicWorker {
+	return &MosaicWorker{}
+}
+
+func (v *MosaicWorker) GetTask(platform string) *MosaicTask {
+	if task, loaded := v.tasks.Load(platform); loaded {
+		return task.(*MosaicTask)
+	}
+	return nil
+}
+
+func (v *MosaicWorker) Handle(ctx context.Context, handler *http.ServeMux) error {
+	ep := "/terraform/v1/ffmpeg/mosaic/query"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := func() error {
+			var token string
+			if err := ParseBody(ctx, r.Body, &struct {
+				Token *string `json:"token"`
+			}{
+				Token: &token,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			res := make([]map[string]interface{}, 0)
+			if configs, err := rdb.HGetAll(ctx, SRS_MOSAIC_CONFIG).Result(); err != nil && err != redis.Nil {
+				return errors.Wrapf(err, "hgetall %v", SRS_MOSAIC_CONFIG)
+			} else {
+				for k, v := range configs {
+					var config MosaicConfigure
+					if err = json.Unmarshal([]byte(v), &config); err != nil {
+						return errors.Wrapf(err, "unmarshal %v %v", k, v)
+					}
+
+					elem := map[string]interface{}{
+						"config": &config,
+					}
+					if task := mosaicWorker.GetTask(config.Platform); task != nil {
+						if pid, signals, frame, update := task.queryFrame(); pid > 0 {
+							elem["signals"] = signals
+							elem["frame"] = map[string]string{
+								"log":    frame,
+								"update": update,
+							}
+						}
+					}
+
+					res = append(res, elem)
+				}
+			}
+
+			sort.Slice(res, func(i, j int) bool {
+				return res[i]["config"].(*MosaicConfigure).Platform < res[j]["config"].(*MosaicConfigure).Platform
+			})
+
+			ohttp.WriteData(ctx, w, r, res)
+			logger.Tf(ctx, "Mosaic: Query ok, mosaics=%v", len(res))
+			return nil
+		}(); err != nil {
+			ohttp.WriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/terraform/v1/ffmpeg/mosaic/apply"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := func() error {
+			var token string
+			var conf MosaicConfigure
+			if err := ParseBody(ctx, r.Body, &struct {
+				Token *string `json:"token"`
+				*MosaicConfigure
+			}{
+				Token: &token, MosaicConfigure: &conf,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			if err := conf.Validate(ctx); err != nil {
+				return errors.Wrapf(err, "validate %v", conf.String())
+			}
+
+			if b, err := json.Marshal(&conf); err != nil {
+				return errors.Wrapf(err, "marshal %v", conf.String())
+			} else if err = rdb.HSet(ctx, SRS_MOSAIC_CONFIG, conf.Platform, string(b)).Err(); err != nil && err != redis.Nil {
+				return errors.Wrapf(err, "hset %v %v %v", SRS_MOSAIC_CONFIG, conf.Platform, string(b))
+			}
+
+			// Restart the mosaic if exists.
+			if task := mosaicWorker.GetTask(conf.Platform); task != nil {
+				if err := task.Restart(ctx); err != nil {
+					return errors.Wrapf(err, "restart task %v", conf.Platform)
+				}
+			}
+
+			ohttp.WriteData(ctx, w, r, &conf)
+			logger.Tf(ctx, "Mosaic: Apply ok, %v", conf.String())
+			return nil
+		}(); err != nil {
+			ohttp.WriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/terraform/v1/ffmpeg/mosaic/remove"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := func() error {
+			var token, platform string
+			if err := ParseBody(ctx, r.Body, &struct {
+				Token    *string `json:"token"`
+				Platform *string `json:"platform"`
+			}{
+				Token: &token, Platform: &platform,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			if err := rdb.HDel(ctx, SRS_MOSAIC_CONFIG, platform).Err(); err != nil && err != redis.Nil {
+				return errors.Wrapf(err, "hdel %v %v", SRS_MOSAIC_CONFIG, platform)
+			}
+
+			// Stop and remove the task.
+			if task := mosaicWorker.GetTask(platform); task != nil {
+				task.Stop()
+				mosaicWorker.tasks.Delete(platform)
+			}
+
+			ohttp.WriteData(ctx, w, r, nil)
+			logger.Tf(ctx, "Mosaic: Remove ok, platform=%v", platform)
+			return nil
+		}(); err != nil {
+			ohttp.WriteError(ctx, w, r, err)
+		}
+	})
+
+	return nil
+}
+
+func (v *MosaicWorker) Close() error {
+	if v.cancel != nil {
+		v.cancel()
+	}
+	v.wg.Wait()
+	return nil
+}
+
+func (v *MosaicWorker) Start(ctx context.Context) error {
+	wg := &v.wg
+
+	ctx, cancel := context.WithCancel(ctx)
+	v.cancel = cancel
+
+	ctx = logger.WithContext(ctx)
+	logger.Tf(ctx, "Mosaic: start a worker")
+
+	// Load tasks from redis and force to kill all.
+	if objs, err := rdb.HGetAll(ctx, SRS_MOSAIC_TASK).Result(); err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hgetall %v", SRS_MOSAIC_TASK)
+	} else if len(objs) > 0 {
+		for uuid, obj := range objs {
+			logger.Tf(ctx, "Load task %v object %v", uuid, obj)
+
+			var task MosaicTask
+			if err = json.Unmarshal([]byte(obj), &task); err != nil {
+				return errors.Wrapf(err, "unmarshal %v %v", uuid, obj)
+			}
+
+			if task.PID > 0 {
+				task.cleanup(ctx)
+			}
+		}
+
+		if err = rdb.Del(ctx, SRS_MOSAIC_TASK).Err(); err != nil && err != redis.Nil {
+			return errors.Wrapf(err, "del %v", SRS_MOSAIC_TASK)
+		}
+	}
+
+	// Load all configurations from redis, and create task for new mosaic.
+	loadTasks := func() error {
+		configItems, err := rdb.HGetAll(ctx, SRS_MOSAIC_CONFIG).Result()
+		if err != nil && err != redis.Nil {
+			return errors.Wrapf(err, "hgetall %v", SRS_MOSAIC_CONFIG)
+		}
+
+		for platform, configItem := range configItems {
+			var config MosaicConfigure
+			if err = json.Unmarshal([]byte(configItem), &config); err != nil {
+				return errors.Wrapf(err, "unmarshal %v %v", platform, configItem)
+			}
+
+			if _, loaded := v.tasks.Load(config.Platform); loaded {
+				continue
+			}
+
+			taskCtx, taskCancel := context.WithCancel(ctx)
+			task := &MosaicTask{
+				UUID: uuid.NewString(), Platform: config.Platform, config: &config, stop: taskCancel,
+			}
+			v.tasks.Store(config.Platform, task)
+			logger.Tf(ctx, "Mosaic: create platform=%v task is %v", platform, task.String())
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer taskCancel()
+
+				if err := task.Run(taskCtx); err != nil {
+					logger.Wf(ctx, "run task %v err %+v", task.String(), err)
+				}
+			}()
+		}
+
+		return nil
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		// When startup, we try to wait for the camera streams.
+		select {
+		case <-ctx.Done():
+		case <-time.After(3 * time.Second):
+		}
+		logger.Tf(ctx, "Mosaic: Start to run tasks")
+
+		for ctx.Err() == nil {
+			duration := 3 * time.Second
+			if err := loadTasks(); err != nil {
+				logger.Wf(ctx, "ignore err %+v", err)
+				duration = 10 * time.Second
+			}
+
+			select {
+			case <-ctx.Done():
+			case <-time.After(duration):
+			}
+		}
+	}()
+
+	return nil
+}
+
+// MosaicConfigure is the configure for mosaic.
+type MosaicConfigure struct {
+	// The platform name, for example, mosaic-xxx
+	Platform string `json:"platform"`
+	// The RTMP server url, for example, rtmp://localhost/live
+	Server string `json:"server"`
+	// The RTMP stream and secret, for example, mosaic?secret=xxx
+	Secret string `json:"secret"`
+	// Whether enabled.
+	Enabled bool `json:"enabled"`
+	// The label for this configure.
+	Label string `json:"label"`
+
+	// The layout, for example, 2x2, 3x3 or custom.
+	Layout string `json:"layout"`
+	// The size of output video, default to 1280x720.
+	Width  int `json:"width"`
+	Height int `json:"height"`
+	// The font file for labels, use the default font of FFmpeg if empty.
+	Font string `json:"font,omitempty"`
+	// The tiles, in order of grid from left to right and top to bottom.
+	Tiles []*MosaicTile `json:"tiles"`
+
+	// The encoder settings, same to transcoding.
+	TranscodeEncoder
+}
+
+func (v *MosaicConfigure) String() string {
+	return fmt.Sprintf("platform=%v, server=%v, secret=%v, enabled=%v, label=%v, layout=%v, size=%vx%v, tiles=%v, %v",
+		v.Platform, v.Server, v.Secret, v.Enabled, v.Label, v.Layout, v.Width, v.Height, len(v.Tiles),
+		v.TranscodeEncoder.String(),
+	)
+}
+
+// The layout of custom, each tile specifies the position and size.
+const MosaicLayoutCustom = "custom"
+
+// MosaicTile is a tile of mosaic, the source is an IP camera or a stream URL.
+type MosaicTile struct {
+	// The platform of IP camera, for example, camera-xxx, use the output stream of camera.
+	Camera string `json:"camera,omitempty"`
+	// Or the stream URL, for example, rtsp://192.168.1.100/stream1
+	URL string `json:"url,omitempty"`
+	// The label to draw on the tile.
+	Label string `json:"label,omitempty"`
+	// The position and size in pixels, only for custom layout.
+	X int `json:"x,omitempty"`
+	Y int `json:"y,omitempty"`
+	W int `json:"w,omitempty"`
+	H int `json:"h,omitempty"`
+}
+
+func (v *MosaicTile) String() string {
+	return fmt.Sprintf("camera=%v, url=%v, label=%v, rect=%v,%v,%vx%v", v.Camera, v.URL, v.Label, v.X, v.Y, v.W, v.H)
+}
+
+// MosaicRect is the position and size of tile.
+type MosaicRect struct {
+	X, Y, W, H int
+}
+
+func (v *MosaicConfigure) size() (int, int) {
+	if v.Width <= 0 || v.Height <= 0 {
+		return 1280, 720
+	}
+	return v.Width, v.Height
+}
+
+// Parse the grid layout, for example, 2x2 is 2 columns and 2 rows.
+func (v *MosaicConfigure) grid() (cols, rows int, err error) {
+	cs, rs, ok := strings.Cut(v.Layout, "x")
+	if !ok {
+		return 0, 0, errors.Errorf("invalid layout %v", v.Layout)
+	}
+	if cols, err = strconv.Atoi(cs); err != nil || cols <= 0 || cols > 4 {
+		return 0, 0, errors.Errorf("invalid columns of layout %v", v.Layout)
+	}
+	if rows, err = strconv.Atoi(rs); err != nil || rows <= 0 || rows > 4 {
+		return 0, 0, errors.Errorf("invalid rows of layout %v", v.Layout)
+	}
+	return cols, rows, nil
+}
+
+func (v *MosaicConfigure) Validate(ctx context.Context) error {
+	if v.Platform == "" || !strings.HasPrefix(v.Platform, "mosaic-") {
+		return errors.Errorf("invalid platform %v", v.Platform)
+	}
+	if v.Server == "" {
+		return errors.New("no server")
+	}
+	if len(v.Tiles) == 0 {
+		return errors.New("no tiles")
+	}
+	if width, height := v.size(); width%2 != 0 || height%2 != 0 || width > 3840 || height > 2160 {
+		return errors.Errorf("invalid size %vx%v", width, height)
+	}
+
+	if v.Layout != MosaicLayoutCustom {
+		if cols, rows, err := v.grid(); err != nil {
+			return errors.Wrapf(err, "parse layout")
+		} else if len(v.Tiles) > cols*rows {
+			return errors.Errorf("too many tiles %v for layout %v", len(v.Tiles), v.Layout)
+		}
+	}
+
+	width, height := v.size()
+	for _, tile := range v.Tiles {
+		if tile.Camera == "" && tile.URL == "" {
+			return errors.Errorf("no camera or url of tile %v", tile.String())
+		}
+		if tile.URL != "" && !strings.Contains(tile.URL, "://") {
+			return errors.Errorf("invalid url of tile %v", tile.String())
+		}
+		if v.Layout == MosaicLayoutCustom {
+			if tile.W <= 0 || tile.H <= 0 || tile.X < 0 || tile.Y < 0 || tile.X+tile.W > width || tile.Y+tile.H > height {
+				return errors.Errorf("invalid rect of tile %v", tile.String())
+			}
+		}
+	}
+
+	// Use the default encoder if not specified.
+	if v.VideoCodec == "" && v.Profile == "" {
+		v.TranscodeEncoder = TranscodeEncoder{
+			VideoCodec: "libx264", VideoProfile: "main", VideoPreset: "veryfast", VideoBitrate: 2000,
+			AudioCodec: "aac", AudioBitrate: 32, AudioChannels: 2,
+		}
+	}
+	if err := v.TranscodeEncoder.Validate(ctx); err != nil {
+		return errors.Wrapf(err, "encoder")
+	}
+
+	return nil
+}
+
+// Rects get the position and size of tiles, the size should be even for H.264.
+func (v *MosaicConfigure) Rects() []MosaicRect {
+	var rects []MosaicRect
+	if v.Layout == MosaicLayoutCustom {
+		for _, tile := range v.Tiles {
+			rects = append(rects, MosaicRect{X: tile.X, Y: tile.Y, W: tile.W / 2 * 2, H: tile.H / 2 * 2})
+		}
+		return rects
+	}
+
+	cols, rows, err := v.grid()
+	if err != nil {
+		return nil
+	}
+
+	width, height := v.size()
+	w, h := width/cols/2*2, height/rows/2*2
+	for i := range v.Tiles {
+		rects = append(rects, MosaicRect{X: (i % cols) * w, Y: (i / cols) * h, W: w, H: h})
+	}
+	return rects
+}
+
+// FFmpegArgs build the arguments of FFmpeg, the inputs are the URLs of tiles, empty for no signal.
+// Note that the output is not included, and the size of profile is ignored.
+func (v *MosaicConfigure) FFmpegArgs(inputs []string, profile *EncodeProfile) []string {
+	var args, filters []string
+	width, height := v.size()
+	rects := v.Rects()
+	fps := profile.fps()
+
+	// The base canvas and silent audio are inputs in realtime, to pace the output even if all tiles
+	// are missing. Always use a silent audio stream, because the mosaic is for monitoring.
+	args = append(args,
+		"-re", "-f", "lavfi", "-i", fmt.Sprintf("color=c=black:s=%vx%v:r=%v", width, height, fps),
+		"-re", "-f", "lavfi", "-i", "anullsrc=channel_layout=stereo:sample_rate=44100",
+	)
+
+	font := ""
+	if v.Font != "" {
+		font = fmt.Sprintf("fontfile=%v:", ffmpegFilterEscape(ffmpegOptionEscape(v.Font)))
+	}
+
+	last, index := "0:v", 2
+	for i, tile := range v.Tiles {
+		rect := rects[i]
+
+		// Generate a "no signal" tile, and overlay the scaled input on it if available. When the input
+		// drops, the overlay passes the "no signal" through, rather than freezing on the last frame.
+		filter := fmt.Sprintf("color=c=0x202020:s=%vx%v:r=%v,drawtext=%vtext='NO SIGNAL':fontsize=%v:fontcolor=gray:x=(w-tw)/2:y=(h-th)/2",
+			rect.W, rect.H, fps, font, mosaicFontSize(rect.H),
+		)
+		if inputs[i] != "" {
+			// For RTSP stream source, always use TCP transport.
+			if strings.HasPrefix(inputs[i], "rtsp://") {
+				args = append(args, "-rtsp_transport", "tcp")
+			}
+			args = append(args, "-i", inputs[i])
+
+			filters = append(filters, fmt.Sprintf("%v[nosignal%v]", filter, i), fmt.Sprintf(
+				"[%v:v]fps=%v,scale=%v:%v:force_original_aspect_ratio=decrease,pad=%v:%v:(ow-iw)/2:(oh-ih)/2,setsar=1[input%v]",
+				index, fps, rect.W, rect.H, rect.W, rect.H, i,
+			))
+			filter = fmt.Sprintf("[nosignal%v][input%v]overlay=eof_action=pass", i, i)
+			index++
+		}
+
+		if tile.Label != "" {
+			filter = fmt.Sprintf("%v,drawtext=%vtext=%v:expansion=none:fontsize=%v:fontcolor=white:box=1:boxcolor=black@0.5:boxborderw=4:x=8:y=8",
+				filter, font, ffmpegFilterEscape(ffmpegOptionEscape(tile.Label)), mosaicFontSize(rect.H)/2,
+			)
+		}
+		filters = append(filters, fmt.Sprintf("%v[tile%v]", filter, i))
+
+		filters = append(filters, fmt.Sprintf("[%v][tile%v]overlay=x=%v:y=%v[mosaic%v]", last, i, rect.X, rect.Y, i))
+		last = fmt.Sprintf("mosaic%v", i)
+	}
+
+	args = append(args, "-filter_complex", strings.Join(filters, ";"),
+		"-map", fmt.Sprintf("[%v]", last), "-map", "1:a",
+	)
+	args = append(args, profile.VideoArgs()...)
+	return append(args, profile.AudioArgs()...)
+}
+
+// The font size of "no signal", by the height of tile.
+func mosaicFontSize(height int) int {
+	if size := height / 8; size > 16 {
+		return size
+	}
+	return 16
+}
+
+// MosaicTask is a task for FFmpeg to compose the mosaic, with a configure.
+type MosaicTask struct {
+	// The ID for task.
+	UUID string `json:"uuid"`
+	// The platform for task.
+	Platform string `json:"platform"`
+	// The output url
+	Output string `json:"output"`
+
+	// FFmpeg pid.
+	PID int32 `json:"pid"`
+	// FFmpeg last frame.
+	frame string
+	// The last update time.
+	update *time.Time
+	// Whether each tile has signal.
+	signals []bool
+
+	// The context for current FFmpeg.
+	cancel context.CancelFunc
+	// To stop the task.
+	stop context.CancelFunc
+
+	// The configure for mosaic task.
+	config *MosaicConfigure
+
+	// To protect the fields.
+	lock sync.Mutex
+}
+
+func (v *MosaicTask) String() string {
+	return fmt.Sprintf("uuid=%v, platform=%v, output=%v, pid=%v, frame=%vB, signals=%v, config is %v",
+		v.UUID, v.Platform, v.Output, v.PID, len(v.frame), v.signals, v.config.String(),
+	)
+}
+
+func (v *MosaicTask) saveTask(ctx context.Context) error {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if b, err := json.Marshal(v); err != nil {
+		return errors.Wrapf(err, "marshal %v", v.String())
+	} else if err = rdb.HSet(ctx, SRS_MOSAIC_TASK, v.UUID, string(b)).Err(); err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hset %v %v %v", SRS_MOSAIC_TASK, v.UUID, string(b))
+	}
+
+	return nil
+}
+
+func (v *MosaicTask) cleanup(ctx context.Context) error {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if v.PID <= 0 {
+		return nil
+	}
+
+	logger.Wf(ctx, "kill task pid=%v", v.PID)
+	syscall.Kill(int(v.PID), syscall.SIGKILL)
+
+	v.PID = 0
+	v.cancel = nil
+
+	return nil
+}
+
+// Restart the FFmpeg with the new configure.
+func (v *MosaicTask) Restart(ctx context.Context) error {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if v.cancel != nil {
+		v.cancel()
+	}
+
+	// Reload config from redis, to a new object, or the removed fields are kept by the omitempty.
+	var config MosaicConfigure
+	if b, err := rdb.HGet(ctx, SRS_MOSAIC_CONFIG, v.Platform).Result(); err != nil {
+		return errors.Wrapf(err, "hget %v %v", SRS_MOSAIC_CONFIG, v.Platform)
+	} else if err = json.Unmarshal([]byte(b), &config); err != nil {
+		return errors.Wrapf(err, "unmarshal %v", b)
+	}
+	v.config = &config
+
+	return nil
+}
+
+// Stop the task, for the mosaic is removed.
+func (v *MosaicTask) Stop() {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if v.stop != nil {
+		v.stop()
+	}
+}
+
+func (v *MosaicTask) updateFrame(frame string) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	v.frame = frame
+
+	var now = time.Now()
+	v.update = &now
+}
+
+func (v *MosaicTask) queryFrame() (int32, []bool, string, string) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	update := ""
+	if v.update != nil {
+		update = v.update.Format(time.RFC3339)
+	}
+
+	return v.PID, append([]bool{}, v.signals...), v.frame, update
+}
+
+func (v *MosaicTask) Run(ctx context.Context) error {
+	ctx = logger.WithContext(ctx)
+	logger.Tf(ctx, "Mosaic: Run task %v", v.String())
+
+	for ctx.Err() == nil {
+		var err error
+		if config := v.queryConfig(); config.Enabled {
+			err = v.doMosaic(ctx, config)
+		}
+
+		duration := 300 * time.Millisecond
+		if err != nil {
+			logger.Wf(ctx, "ignore %v err %+v", v.String(), err)
+			duration = 3500 * time.Millisecond
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(duration):
+		}
+	}
+
+	// Remove the task, when the mosaic is removed.
+	if err := rdb.HDel(context.Background(), SRS_MOSAIC_TASK, v.UUID).Err(); err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hdel %v %v", SRS_MOSAIC_TASK, v.UUID)
+	}
+	return nil
+}
+
+// The config is replaced by restart, so get the current one before using it.
+func (v *MosaicTask) queryConfig() *MosaicConfigure {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	return v.config
+}
+
+// Resolve the URLs of tiles, empty if no signal.
+func (v *MosaicTask) resolveInputs(ctx context.Context, config *MosaicConfigure) []string {
+	inputs := make([]string, len(config.Tiles))
+
+	var wg sync.WaitGroup
+	for i, tile := range config.Tiles {
+		wg.Add(1)
+		go func(i int, tile *MosaicTile) {
+			defer wg.Done()
+
+			input := tile.URL
+			if tile.Camera != "" {
+				var conf CameraConfigure
+				if b, err := rdb.HGet(ctx, SRS_CAMERA_CONFIG, tile.Camera).Result(); err != nil || b == "" {
+					return
+				} else if err = json.Unmarshal([]byte(b), &conf); err != nil || !conf.Enabled {
+					return
+				}
+				input = conf.OutputURL()
+			}
+
+			if u, err := RebuildStreamURL(input); err != nil {
+				return
+			} else if err := probeCameraStream(ctx, u.String()); err != nil {
+				return
+			} else {
+				inputs[i] = u.String()
+			}
+		}(i, tile)
+	}
+	wg.Wait()
+
+	return inputs
+}
+
+func (v *MosaicTask) doMosaic(ctx context.Context, config *MosaicConfigure) error {
+	// Create context for current task.
+	parentCtx := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	v.cancel = cancel
+
+	// Probe the inputs, the missing input is shown as "no signal".
+	inputs := v.resolveInputs(ctx, config)
+	signals := make([]bool, len(inputs))
+	for i, input := range inputs {
+		signals[i] = input != ""
+	}
+	v.lock.Lock()
+	v.signals = signals
+	v.lock.Unlock()
+
+	// Build output URL, the same as the camera.
+	outputURL := (&CameraConfigure{Server: config.Server, Secret: config.Secret}).OutputURL()
+
+	// Create a heartbeat to poll and manage the status of FFmpeg process.
+	heartbeat := NewFFmpegHeartbeat(cancel)
+
+	// Start FFmpeg process.
+	profile, err := config.TranscodeEncoder.ResolveProfile(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "resolve profile")
+	}
+	args := config.FFmpegArgs(inputs, profile)
+	// If RTMP use flv, if SRT use mpegts, otherwise do not set.
+	if strings.HasPrefix(outputURL, "rtmp://") || strings.HasPrefix(outputURL, "rtmps://") {
+		args = append(args, "-f", "flv")
+	} else if strings.HasPrefix(outputURL, "srt://") {
+		args = append(args, "-pes_payload_size", "0", "-f", "mpegts")
+	}
+	args = append(args, outputURL)
+	// Create the command object.
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return errors.Wrapf(err, "pipe process")
+	}
+
+	if err := cmd.Start(); err != nil {
+		return errors.Wrapf(err, "execute ffmpeg %v", strings.Join(args, " "))
+	}
+
+	v.PID, v.Output = int32(cmd.Process.Pid), outputURL
+	defer func() {
+		// When canceled, we should still write to redis, so we must not use ctx(which is cancelled).
+		v.cleanup(parentCtx)
+		v.saveTask(parentCtx)
+	}()
+	logger.Tf(ctx, "Mosaic: Start, platform=%v, signals=%v, pid=%v", v.Platform, signals, v.PID)
+
+	if err := v.saveTask(ctx); err != nil {
+		return errors.Wrapf(err, "save task %v", v.String())
+	}
+
+	// Pull the latest log frame.
+	heartbeat.Polling(ctx, stderr)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case frame := <-heartbeat.FrameLogs:
+				v.updateFrame(frame)
+			}
+		}
+	}()
+
+	// Probe the missing inputs, restart FFmpeg when any input recovers.
+	go func() {
+		for ctx.Err() == nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(10 * time.Second):
+			}
+
+			for i, input := range v.resolveInputs(ctx, config) {
+				if ctx.Err() != nil {
+					return
+				}
+
+				// The lost tile is shown as "no signal" by FFmpeg, restart when it recovers.
+				if signals[i] && input == "" {
+					logger.Tf(ctx, "Mosaic: Tile %v lost, platform=%v", i, v.Platform)
+					v.lock.Lock()
+					signals[i] = false
+					v.lock.Unlock()
+				} else if !signals[i] && input != "" {
+					logger.Tf(ctx, "Mosaic: Tile %v recovered, restart platform=%v", i, v.Platform)
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+
+	// Process terminated, or user cancel the process.
+	select {
+	case <-parentCtx.Done():
+	case <-ctx.Done():
+	case <-heartbeat.PollingCtx.Done():
+	}
+	logger.Tf(ctx, "Mosaic: Cycle stopping, platform=%v, pid=%v", v.Platform, v.PID)
+
+	err = cmd.Wait()
+	logger.Tf(ctx, "Mosaic: Cycle done, platform=%v, pid=%v, err=%v", v.Platform, v.PID, err)
+
+	return err
+}
@@ -0,0 +1,84 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestMosaicRects(t *testing.T) {
+	conf := &MosaicConfigure{Layout: "2x2", Tiles: []*MosaicTile{{URL: "a"}, {URL: "b"}, {URL: "c"}}}
+	rects := conf.Rects()
+	if len(rects) != 3 {
+		t.Errorf("invalid rects %v", rects)
+	} else if rects[0] != (MosaicRect{0, 0, 640, 360}) || rects[1] != (MosaicRect{640, 0, 640, 360}) || rects[2] != (MosaicRect{0, 360, 640, 360}) {
+		t.Errorf("invalid rects %v", rects)
+	}
+
+	conf = &MosaicConfigure{Layout: "3x3", Width: 1920, Height: 1080, Tiles: []*MosaicTile{{URL: "a"}}}
+	if rects = conf.Rects(); rects[0] != (MosaicRect{0, 0, 640, 360}) {
+		t.Errorf("invalid rects %v", rects)
+	}
+
+	conf = &MosaicConfigure{Layout: MosaicLayoutCustom, Tiles: []*MosaicTile{{URL: "a", X: 10, Y: 20, W: 301, H: 201}}}
+	if rects = conf.Rects(); rects[0] != (MosaicRect{10, 20, 300, 200}) {
+		t.Errorf("invalid rects %v", rects)
+	}
+}
+
+func TestMosaicValidate(t *testing.T) {
+	conf := &MosaicConfigure{Platform: "mosaic-1", Server: "rtmp://localhost/live", Layout: "2x2",
+		Tiles: []*MosaicTile{{Camera: "camera-1"}, {URL: "rtsp://192.168.1.100/stream1"}},
+	}
+	if err := conf.Validate(context.Background()); err != nil {
+		t.Errorf("validate err %+v", err)
+	} else if conf.VideoCodec != "libx264" {
+		t.Errorf("invalid default encoder %v", conf.TranscodeEncoder.String())
+	}
+
+	conf.Layout = "1x1"
+	if err := conf.Validate(context.Background()); err == nil {
+		t.Errorf("should fail for too many tiles")
+	}
+
+	conf.Layout = MosaicLayoutCustom
+	if err := conf.Validate(context.Background()); err == nil {
+		t.Errorf("should fail for no rect")
+	}
+}
+
+func TestMosaicFFmpegArgs(t *testing.T) {
+	conf := &MosaicConfigure{Layout: "2x1", Tiles: []*MosaicTile{{URL: "a", Label: "Door"}, {URL: "b"}}}
+	args := strings.Join(conf.FFmpegArgs([]string{"rtsp://cam/1", ""}, conf.legacyProfile()), " ")
+
+	if !strings.Contains(args, "-rtsp_transport tcp -i rtsp://cam/1") {
+		t.Errorf("invalid input %v", args)
+	}
+	if !strings.HasPrefix(args, "-re -f lavfi -i color=c=black:s=1280x720:r=25 -re -f lavfi -i anullsrc") {
+		t.Errorf("invalid base input %v", args)
+	}
+	if strings.Count(args, "-i ") != 3 {
+		t.Errorf("missing tile should not be input %v", args)
+	}
+	if !strings.Contains(args, "[2:v]fps=25,scale=640:720") || !strings.Contains(args, "text=Door") {
+		t.Errorf("invalid tile %v", args)
+	}
+	if !strings.Contains(args, "[nosignal0][input0]overlay=eof_action=pass,drawtext=") {
+		t.Errorf("invalid fallback of tile %v", args)
+	}
+	if !strings.Contains(args, "text='NO SIGNAL'") || !strings.Contains(args, "[mosaic0][tile1]overlay=x=640:y=0[mosaic1]") {
+		t.Errorf("invalid no signal tile %v", args)
+	}
+	if !strings.Contains(args, "-map [mosaic1] -map 1:a") {
+		t.Errorf("invalid map %v", args)
+	}
+
+	profile := conf.legacyProfile()
+	profile.FPS = 30
+	if args = strings.Join(conf.FFmpegArgs([]string{"", ""}, profile), " "); !strings.Contains(args, "r=30") || strings.Contains(args, "r=25") {
+		t.Errorf("invalid fps %v", args)
+	}
+}
@@ -0,0 +1,689 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ossrs/go-oryx-lib/errors"
+	ohttp "github.com/ossrs/go-oryx-lib/http"
+	"github.com/ossrs/go-oryx-lib/logger"
+
+	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+)
+
+var normalizeWorker *NormalizeWorker
+
+// The status of normalize job.
+const (
+	NormalizeJobStatusPending  = "pending"
+	NormalizeJobStatusRunning  = "running"
+	NormalizeJobStatusDone     = "done"
+	NormalizeJobStatusFailed   = "failed"
+	NormalizeJobStatusCanceled = "canceled"
+)
+
+// NormalizeWorker transcodes the uploaded file or media asset to a streaming-safe profile, that is
+// H.264 without B frames, fixed frame rate and GOP, and AAC 44.1kHz stereo, because vLive copies the
+// stream which breaks on some platforms for HEVC, B frames or variable frame rate. Both the original
+// and normalized files are kept, user is able to choose one as source.
+type NormalizeWorker struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	// The cancel function of pending or running job, key is job UUID in string, value is
+	// context.CancelFunc.
+	jobs sync.Map
+	// Transcoding is expensive, so only run one job at a time, and others are pending.
+	slots chan struct{}
+}
+
+func NewNormalizeWorker() *NormalizeWorker {
+	return &NormalizeWorker{
+		slots: make(chan struct{}, 1),
+	}
+}
+
+func (v *NormalizeWorker) Handle(ctx context.Context, handler *http.ServeMux) error {
+	ep := "/terraform/v1/normalize/create"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := func() error {
+			var token, qTarget, qMedia, qProfile string
+			var qForce bool
+			if err := ParseBody(ctx, r.Body, &struct {
+				Token   *string `json:"token"`
+				Target  *string `json:"target"`
+				Media   *string `json:"media"`
+				Force   *bool   `json:"force"`
+				Profile *string `json:"profile"`
+			}{
+				Token: &token, Target: &qTarget, Media: &qMedia, Force: &qForce, Profile: &qProfile,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			job := NewNormalizeJob(func(job *NormalizeJob) {
+				job.Original, job.Media, job.Force, job.Profile = qTarget, qMedia, qForce, qProfile
+			})
+
+			if job.Profile != "" {
+				if _, err := LoadEncodeProfile(ctx, job.Profile); err != nil {
+					return errors.Wrapf(err, "load profile %v", job.Profile)
+				}
+			}
+
+			// For media asset, normalize the file of asset, and register the normalized file as a new asset.
+			if job.Media != "" {
+				asset, err := loadMediaAsset(ctx, job.Media)
+				if err != nil {
+					return errors.Wrapf(err, "load media %v", job.Media)
+				}
+				job.Original = asset.Target
+			} else if !strings.HasPrefix(job.Original, dirUploadPath) {
+				return errors.Errorf("invalid target %v", job.Original)
+			}
+
+			if _, err := os.Stat(job.Original); err != nil {
+				return errors.Wrapf(err, "no file %v", job.Original)
+			}
+
+			if err := v.Create(ctx, job); err != nil {
+				return errors.Wrapf(err, "create %v", job.String())
+			}
+
+			ohttp.WriteData(ctx, w, r, job)
+			logger.Tf(ctx, "normalize: Create job %v", job.String())
+			return nil
+		}(); err != nil {
+			ohttp.WriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/terraform/v1/normalize/query"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := func() error {
+			var token, qUUID string
+			if err := ParseBody(ctx, r.Body, &struct {
+				Token *string `json:"token"`
+				UUID  *string `json:"uuid"`
+			}{
+				Token: &token, UUID: &qUUID,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			// Query all jobs if no uuid.
+			if qUUID == "" {
+				jobs, err := loadNormalizeJobs(ctx)
+				if err != nil {
+					return errors.Wrapf(err, "load jobs")
+				}
+
+				ohttp.WriteData(ctx, w, r, jobs)
+				logger.Tf(ctx, "normalize: Query jobs ok, jobs=%v", len(jobs))
+				return nil
+			}
+
+			job, err := loadNormalizeJob(ctx, qUUID)
+			if err != nil {
+				return errors.Wrapf(err, "load job %v", qUUID)
+			}
+			if job == nil {
+				return errors.Errorf("no job %v", qUUID)
+			}
+
+			ohttp.WriteData(ctx, w, r, job)
+			logger.Tf(ctx, "normalize: Query job ok, %v", job.String())
+			return nil
+		}(); err != nil {
+			ohttp.WriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/terraform/v1/normalize/cancel"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := func() error {
+			var token, qUUID string
+			if err := ParseBody(ctx, r.Body, &struct {
+				Token *string `json:"token"`
+				UUID  *string `json:"uuid"`
+			}{
+				Token: &token, UUID: &qUUID,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			job, err := loadNormalizeJob(ctx, qUUID)
+			if err != nil {
+				return errors.Wrapf(err, "load job %v", qUUID)
+			}
+			if job == nil {
+				return errors.Errorf("no job %v", qUUID)
+			}
+
+			// For pending or running job, cancel the FFmpeg process, and the job will be updated when quit.
+			// For finished job, remove the job and the normalized file.
+			if !job.Finished() {
+				if cancel, ok := v.jobs.Load(job.UUID); ok {
+					cancel.(context.CancelFunc)()
+				} else {
+					job.Status, job.Error = NormalizeJobStatusCanceled, "canceled"
+					if err := job.Save(ctx); err != nil {
+						return errors.Wrapf(err, "save %v", job.String())
+					}
+				}
+			} else if err := job.Remove(ctx); err != nil {
+				return errors.Wrapf(err, "remove %v", job.String())
+			}
+
+			ohttp.WriteData(ctx, w, r, nil)
+			logger.Tf(ctx, "normalize: Cancel job ok, %v", job.String())
+			return nil
+		}(); err != nil {
+			ohttp.WriteError(ctx, w, r, err)
+		}
+	})
+
+	return nil
+}
+
+func (v *NormalizeWorker) Close() error {
+	if v.cancel != nil {
+		v.cancel()
+	}
+	v.wg.Wait()
+	return nil
+}
+
+func (v *NormalizeWorker) Start(ctx context.Context) error {
+	wg := &v.wg
+
+	ctx, cancel := context.WithCancel(ctx)
+	v.ctx, v.cancel = ctx, cancel
+
+	ctx = logger.WithContext(ctx)
+	logger.Tf(ctx, "normalize: start a worker")
+
+	// The pending and running jobs are interrupted by restarting, so mark them as failed.
+	if jobs, err := loadNormalizeJobs(ctx); err != nil {
+		return errors.Wrapf(err, "load jobs")
+	} else {
+		for _, job := range jobs {
+			if job.Finished() {
+				continue
+			}
+
+			job.cleanupFiles(ctx)
+			job.Status, job.Error = NormalizeJobStatusFailed, "interrupted by restart"
+			if err := job.Save(ctx); err != nil {
+				return errors.Wrapf(err, "save %v", job.String())
+			}
+			logger.Tf(ctx, "normalize: Interrupted %v", job.String())
+		}
+	}
+
+	// Cleanup the expired jobs.
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		for ctx.Err() == nil {
+			if err := v.cleanup(ctx); err != nil {
+				logger.Wf(ctx, "ignore normalize cleanup err %+v", err)
+			}
+
+			select {
+			case <-ctx.Done():
+			case <-time.After(60 * time.Second):
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (v *NormalizeWorker) cleanup(ctx context.Context) error {
+	jobs, err := loadNormalizeJobs(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "load jobs")
+	}
+
+	for _, job := range jobs {
+		if !job.Finished() || !job.Expired() {
+			continue
+		}
+
+		if err := job.Remove(ctx); err != nil {
+			return errors.Wrapf(err, "remove %v", job.String())
+		}
+		logger.Tf(ctx, "normalize: Cleanup expired %v", job.String())
+	}
+
+	return nil
+}
+
+// Create save the job and run it in background, when there is a free slot.
+func (v *NormalizeWorker) Create(ctx context.Context, job *NormalizeJob) error {
+	job.Status = NormalizeJobStatusPending
+	if err := job.Save(ctx); err != nil {
+		return errors.Wrapf(err, "save %v", job.String())
+	}
+
+	jobCtx, jobCancel := context.WithCancel(logger.WithContext(v.ctx))
+	v.jobs.Store(job.UUID, jobCancel)
+
+	v.wg.Add(1)
+	go func() {
+		defer v.wg.Done()
+		defer v.jobs.Delete(job.UUID)
+		defer jobCancel()
+
+		select {
+		case <-jobCtx.Done():
+		case v.slots <- struct{}{}:
+			defer func() {
+				<-v.slots
+			}()
+		}
+
+		if err := v.Run(jobCtx, job); err != nil {
+			logger.Wf(jobCtx, "normalize: Job %v err %+v", job.UUID, err)
+		}
+	}()
+	return nil
+}
+
+// Run the job until done, and update the status of job.
+func (v *NormalizeWorker) Run(ctx context.Context, job *NormalizeJob) (err error) {
+	defer func() {
+		if err == nil {
+			job.Status, job.Percent = NormalizeJobStatusDone, 100
+		} else {
+			job.cleanupFiles(ctx)
+			if ctx.Err() != nil {
+				job.Status, job.Error = NormalizeJobStatusCanceled, "canceled"
+			} else {
+				job.Status, job.Error = NormalizeJobStatusFailed, err.Error()
+			}
+		}
+
+		// Use the worker context to save the job, because the job context might be canceled.
+		if r0 := job.Save(logger.WithContext(v.ctx)); r0 != nil {
+			logger.Wf(ctx, "normalize: ignore save %v err %+v", job.String(), r0)
+		}
+	}()
+
+	if err := ctx.Err(); err != nil {
+		return errors.Wrapf(err, "canceled")
+	}
+
+	job.Status = NormalizeJobStatusRunning
+	if err := job.Save(ctx); err != nil {
+		return errors.Wrapf(err, "save %v", job.String())
+	}
+
+	// Probe the original file, to check whether it's compatible.
+	toCtx, toCancelFunc := context.WithTimeout(ctx, 15*time.Second)
+	defer toCancelFunc()
+
+	format, video, audio, err := FFprobeFileFormat(toCtx, job.Original)
+	if err != nil {
+		return errors.Wrapf(err, "probe %v", job.Original)
+	}
+
+	job.Reasons = NormalizeReasons(video, audio)
+	if len(job.Reasons) == 0 && !job.Force {
+		logger.Tf(ctx, "normalize: Compatible, ignore %v", job.String())
+		return nil
+	}
+
+	// Transcode by the profile, which might be changed after the job is created.
+	profile := NormalizeEncodeProfile()
+	if job.Profile != "" {
+		if profile, err = LoadEncodeProfile(ctx, job.Profile); err != nil {
+			return errors.Wrapf(err, "load profile %v", job.Profile)
+		}
+	}
+
+	// Transcode to the normalized file, and report the progress.
+	output := path.Join(dirUploadPath, fmt.Sprintf("%v.mp4", job.UUID))
+	args := []string{"-hide_banner", "-nostats", "-progress", "pipe:1", "-i", job.Original}
+	args = append(args, NormalizeFFmpegArgs(video, audio, profile)...)
+	args = append(args, "-y", output)
+
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return errors.Wrapf(err, "pipe process")
+	}
+
+	if err := cmd.Start(); err != nil {
+		return errors.Wrapf(err, "execute ffmpeg %v", strings.Join(args, " "))
+	}
+	logger.Tf(ctx, "normalize: Start ffmpeg pid=%v, %v", cmd.Process.Pid, job.String())
+
+	// Parse the progress of FFmpeg, and save the job at most once per second.
+	var lastSave time.Time
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		if percent, ok := ParseFFmpegProgress(scanner.Text(), format.Duration); ok {
+			job.Percent = percent
+		}
+
+		if time.Since(lastSave) > time.Second {
+			lastSave = time.Now()
+			if err := job.Save(ctx); err != nil {
+				logger.Wf(ctx, "normalize: ignore save %v err %+v", job.String(), err)
+			}
+		}
+	}
+
+	if err := cmd.Wait(); err != nil {
+		return errors.Wrapf(err, "run ffmpeg %v", strings.Join(args, " "))
+	}
+	job.Normalized = output
+
+	// For media asset, register the normalized file as a new asset, with the same tags.
+	if job.Media != "" {
+		asset, err := loadMediaAsset(ctx, job.Media)
+		if err != nil {
+			return errors.Wrapf(err, "load media %v", job.Media)
+		}
+
+		name := fmt.Sprintf("%v.normalized.mp4", strings.TrimSuffix(asset.Name, path.Ext(asset.Name)))
+		normalized, dedup, err := CreateMediaAsset(ctx, output, name, append(asset.Tags, "normalized"))
+		if err != nil {
+			return errors.Wrapf(err, "create media %v", output)
+		}
+		job.Normalized, job.NormalizedMedia = normalized.Target, normalized.UUID
+		logger.Tf(ctx, "normalize: Register media %v, dedup=%v", normalized.String(), dedup)
+	}
+
+	logger.Tf(ctx, "normalize: Job done %v", job.String())
+	return nil
+}
+
+// NormalizeJob is a background job to transcode a file to streaming-safe profile.
+type NormalizeJob struct {
+	// The job UUID, also the UUID of the normalized file.
+	UUID string `json:"uuid"`
+	// The original file, in dirUploadPath, or the file of media asset.
+	Original string `json:"original"`
+	// The original media asset UUID, if normalize a media asset.
+	Media string `json:"media,omitempty"`
+	// Whether transcode even if the file is compatible.
+	Force bool `json:"force,omitempty"`
+	// The ID of encode profile to transcode, use the default normalize profile if empty.
+	Profile string `json:"profile,omitempty"`
+
+	// The status of job, pending, running, done, failed or canceled.
+	Status string `json:"status"`
+	// The transcoding progress in percent.
+	Percent float64 `json:"percent"`
+	// The reasons why the original file is incompatible, empty if compatible.
+	Reasons []string `json:"reasons,omitempty"`
+	// The error message, for failed job.
+	Error string `json:"error,omitempty"`
+
+	// The normalized file, in dirUploadPath, or in dirMediaPath if normalize a media asset. It's
+	// empty if the original file is compatible, so user should use the original file.
+	Normalized string `json:"normalized,omitempty"`
+	// The normalized media asset UUID, if normalize a media asset.
+	NormalizedMedia string `json:"normalizedMedia,omitempty"`
+
+	// The create time.
+	Created string `json:"created"`
+	// The last update time.
+	Update string `json:"update"`
+	// The expire time, the job and normalized file in dirUploadPath will be removed after it.
+	Expires string `json:"expires"`
+}
+
+func NewNormalizeJob(opts ...func(*NormalizeJob)) *NormalizeJob {
+	v := &NormalizeJob{
+		UUID: uuid.NewString(),
+	}
+
+	// If the normalized file is not used for a long time, remove it.
+	duration := 24 * time.Hour
+	if envNodeEnv() == "development" {
+		duration = time.Duration(300) * time.Second
+	}
+
+	now := time.Now()
+	v.Created = now.Format(time.RFC3339)
+	v.Update = v.Created
+	v.Expires = now.Add(duration).Format(time.RFC3339)
+
+	for _, opt := range opts {
+		opt(v)
+	}
+	return v
+}
+
+func (v *NormalizeJob) String() string {
+	return fmt.Sprintf("uuid=%v, original=%v, media=%v, force=%v, profile=%v, status=%v, percent=%v, reasons=%v, normalized=%v, error=%v",
+		v.UUID, v.Original, v.Media, v.Force, v.Profile, v.Status, v.Percent, v.Reasons, v.Normalized, v.Error,
+	)
+}
+
+func (v *NormalizeJob) Finished() bool {
+	return v.Status != NormalizeJobStatusPending && v.Status != NormalizeJobStatusRunning
+}
+
+func (v *NormalizeJob) Expired() bool {
+	expires, err := time.Parse(time.RFC3339, v.Expires)
+	return err != nil || time.Now().After(expires)
+}
+
+func (v *NormalizeJob) Save(ctx context.Context) error {
+	v.Update = time.Now().Format(time.RFC3339)
+	if b, err := json.Marshal(v); err != nil {
+		return errors.Wrapf(err, "marshal %v", v.String())
+	} else if err = rdb.HSet(ctx, SRS_NORMALIZE_JOB, v.UUID, string(b)).Err(); err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hset %v %v %v", SRS_NORMALIZE_JOB, v.UUID, string(b))
+	}
+	return nil
+}
+
+// Remove the job and the normalized file in dirUploadPath. Note that the original file and the media
+// assets are never removed.
+func (v *NormalizeJob) Remove(ctx context.Context) error {
+	v.cleanupFiles(ctx)
+
+	if err := rdb.HDel(ctx, SRS_NORMALIZE_JOB, v.UUID).Err(); err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hdel %v %v", SRS_NORMALIZE_JOB, v.UUID)
+	}
+	return nil
+}
+
+func (v *NormalizeJob) cleanupFiles(ctx context.Context) {
+	output := path.Join(dirUploadPath, fmt.Sprintf("%v.mp4", v.UUID))
+	if _, err := os.Stat(output); err == nil {
+		os.Remove(output)
+		logger.Tf(ctx, "normalize: remove %v of job %v", output, v.UUID)
+	}
+}
+
+// Load the job by UUID, nil if not exists.
+func loadNormalizeJob(ctx context.Context, jobUUID string) (*NormalizeJob, error) {
+	var job NormalizeJob
+	if b, err := rdb.HGet(ctx, SRS_NORMALIZE_JOB, jobUUID).Result(); err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hget %v %v", SRS_NORMALIZE_JOB, jobUUID)
+	} else if b == "" {
+		return nil, nil
+	} else if err = json.Unmarshal([]byte(b), &job); err != nil {
+		return nil, errors.Wrapf(err, "unmarshal %v", b)
+	}
+	return &job, nil
+}
+
+// Load all jobs, sorted by create time.
+func loadNormalizeJobs(ctx context.Context) ([]*NormalizeJob, error) {
+	objs, err := rdb.HGetAll(ctx, SRS_NORMALIZE_JOB).Result()
+	if err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hgetall %v", SRS_NORMALIZE_JOB)
+	}
+
+	jobs := []*NormalizeJob{}
+	for jobUUID, obj := range objs {
+		var job NormalizeJob
+		if err := json.Unmarshal([]byte(obj), &job); err != nil {
+			return nil, errors.Wrapf(err, "unmarshal %v %v", jobUUID, obj)
+		}
+		jobs = append(jobs, &job)
+	}
+
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].Created < jobs[j].Created
+	})
+	return jobs, nil
+}
+
+// NormalizeReasons check whether the streams are compatible for copying to live stream, return the
+// reasons if not, or empty if compatible.
+func NormalizeReasons(video *FFprobeVideo, audio *FFprobeAudio) []string {
+	var reasons []string
+
+	if video != nil {
+		if video.CodecName != "h264" {
+			reasons = append(reasons, fmt.Sprintf("video codec %v", video.CodecName))
+		}
+		if video.HasBFrames > 0 {
+			reasons = append(reasons, fmt.Sprintf("b-frames %v", video.HasBFrames))
+		}
+		if video.PixFormat != "" && video.PixFormat != "yuv420p" && video.PixFormat != "yuvj420p" {
+			reasons = append(reasons, fmt.Sprintf("pixel format %v", video.PixFormat))
+		}
+
+		// Allow 1% difference of frame rate, for example, 30/1 and 2997/100 are both constant.
+		fps, avg := parseFrameRate(video.FrameRate), parseFrameRate(video.AvgFrameRate)
+		if fps > 0 && avg > 0 && math.Abs(fps-avg)/fps > 0.01 {
+			reasons = append(reasons, fmt.Sprintf("variable frame rate %v avg %v", video.FrameRate, video.AvgFrameRate))
+		}
+	}
+
+	if audio != nil {
+		if audio.CodecName != "aac" {
+			reasons = append(reasons, fmt.Sprintf("audio codec %v", audio.CodecName))
+		}
+		if audio.SampleRate != "44100" && audio.SampleRate != "48000" {
+			reasons = append(reasons, fmt.Sprintf("sample rate %v", audio.SampleRate))
+		}
+		if audio.Channels > 2 {
+			reasons = append(reasons, fmt.Sprintf("channels %v", audio.Channels))
+		}
+	}
+
+	return reasons
+}
+
+// Parse the frame rate in fraction, for example, 30000/1001, return 0 if invalid.
+func parseFrameRate(rate string) float64 {
+	num, den, ok := strings.Cut(rate, "/")
+	if !ok {
+		den = "1"
+	}
+
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil {
+		return 0
+	}
+	d, err := strconv.ParseFloat(den, 64)
+	if err != nil || d == 0 {
+		return 0
+	}
+	return n / d
+}
+
+// NormalizeEncodeProfile get the default profile to normalize, H.264 and AAC with constant frame rate
+// and gop of 2s, and without B frames for WebRTC.
+func NormalizeEncodeProfile() *EncodeProfile {
+	return &EncodeProfile{
+		ID: "normalize", Name: "normalize",
+		VideoCodec: "libx264", VideoProfile: "high", VideoPreset: "veryfast",
+		FPS: 25, GOP: 50, BFrames: 0, RateControl: EncodeRateControlCRF, CRF: 23,
+		AudioCodec: "aac", AudioBitrate: 128, AudioChannels: 2, AudioSampleRate: 44100,
+	}
+}
+
+// NormalizeFFmpegArgs build the FFmpeg arguments after the input, to transcode by the profile, with
+// constant frame rate and fixed GOP.
+func NormalizeFFmpegArgs(video *FFprobeVideo, audio *FFprobeAudio, profile *EncodeProfile) []string {
+	var args []string
+
+	if video != nil {
+		// H.264 requires even size, if not scaled by profile.
+		filter := profile.VideoFilter()
+		if filter == "" {
+			filter = "scale=trunc(iw/2)*2:trunc(ih/2)*2"
+		}
+		args = append(args, "-map", "0:v:0", "-vf", fmt.Sprintf("%v,setsar=1", filter), "-pix_fmt", "yuv420p")
+		args = append(args, profile.VideoArgs()...)
+		// Set fixed gop, never insert keyframe for scene change.
+		args = append(args, "-keyint_min", fmt.Sprintf("%v", profile.gop()), "-sc_threshold", "0")
+	}
+
+	if audio != nil {
+		args = append(args, "-map", "0:a:0")
+		if filter := profile.AudioFilter(); filter != "" {
+			args = append(args, "-af", filter)
+		}
+		args = append(args, profile.AudioArgs()...)
+	}
+
+	args = append(args, "-movflags", "+faststart", "-f", "mp4")
+	return args
+}
+
+// ParseFFmpegProgress parse the line of FFmpeg -progress, return the percent by out_time_us and the
+// duration in seconds.
+func ParseFFmpegProgress(line string, duration float64) (float64, bool) {
+	key, value, ok := strings.Cut(strings.TrimSpace(line), "=")
+	if !ok || key != "out_time_us" || duration <= 0 {
+		return 0, false
+	}
+
+	us, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || us < 0 {
+		return 0, false
+	}
+
+	percent := float64(us) / 1000000 / duration * 100
+	return math.Min(math.Round(percent*10)/10, 100), true
+}
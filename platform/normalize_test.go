@@ -0,0 +1,48 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNormalize_Reasons(t *testing.T) {
+	video := &FFprobeVideo{CodecName: "h264", PixFormat: "yuv420p", FrameRate: "30/1", AvgFrameRate: "2997/100"}
+	audio := &FFprobeAudio{CodecName: "aac", SampleRate: "44100", Channels: 2}
+	if reasons := NormalizeReasons(video, audio); len(reasons) != 0 {
+		t.Errorf("should be compatible, reasons=%v", reasons)
+	}
+
+	video = &FFprobeVideo{CodecName: "hevc", HasBFrames: 2, PixFormat: "yuv420p", FrameRate: "60/1", AvgFrameRate: "24/1"}
+	audio = &FFprobeAudio{CodecName: "opus", SampleRate: "22050", Channels: 6}
+	if reasons := NormalizeReasons(video, audio); len(reasons) != 6 {
+		t.Errorf("should be incompatible, reasons=%v", reasons)
+	}
+
+	profile := NormalizeEncodeProfile()
+	if err := profile.Validate(); err != nil {
+		t.Errorf("invalid profile %v err %+v", profile.String(), err)
+	}
+	if args := strings.Join(NormalizeFFmpegArgs(video, nil, profile), " "); !strings.Contains(args, "-vcodec libx264") ||
+		!strings.Contains(args, "-r 25 -g 50 -bf 0") || !strings.Contains(args, "-keyint_min 50") || strings.Contains(args, "-acodec") {
+		t.Errorf("invalid args %v", args)
+	}
+
+	// The normalize args follow the profile.
+	profile.FPS, profile.GOP, profile.Height = 30, 0, 720
+	if args := strings.Join(NormalizeFFmpegArgs(video, audio, profile), " "); !strings.Contains(args, "-vf scale=-2:720,setsar=1") ||
+		!strings.Contains(args, "-r 30 -g 60") || !strings.Contains(args, "-keyint_min 60") || !strings.Contains(args, "-acodec aac") {
+		t.Errorf("invalid args %v", args)
+	}
+}
+
+func TestNormalize_ParseFFmpegProgress(t *testing.T) {
+	if percent, ok := ParseFFmpegProgress("out_time_us=5000000", 20); !ok || percent != 25 {
+		t.Errorf("invalid percent %v, %v", percent, ok)
+	}
+	if percent, ok := ParseFFmpegProgress("out_time_us=30000000", 20); !ok || percent != 100 {
+		t.Errorf("invalid percent %v, %v", percent, ok)
+	}
+	if _, ok := ParseFFmpegProgress("frame=100", 20); ok {
+		t.Errorf("should ignore other keys")
+	}
+}
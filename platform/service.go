@@ -233,14 +233,50 @@ func handleHTTPService(ctx context.Context, handler *http.ServeMux) error {
 		return errors.Wrapf(err, "handle forward")
 	}
 
+	if err := uploadWorker.Handle(ctx, handler); err != nil {
+		return errors.Wrapf(err, "handle upload")
+	}
+
+	if err := ytdlWorker.Handle(ctx, handler); err != nil {
+		return errors.Wrapf(err, "handle ytdl")
+	}
+
+	if err := normalizeWorker.Handle(ctx, handler); err != nil {
+		return errors.Wrapf(err, "handle normalize")
+	}
+
+	if err := handleMediaLibraryService(ctx, handler); err != nil {
+		return errors.Wrapf(err, "handle media library")
+	}
+
 	if err := vLiveWorker.Handle(ctx, handler); err != nil {
 		return errors.Wrapf(err, "handle vLive")
 	}
 
+	if err := handleVLiveEPGService(ctx, handler); err != nil {
+		return errors.Wrapf(err, "handle vLive EPG")
+	}
+
 	if err := cameraWorker.Handle(ctx, handler); err != nil {
 		return errors.Wrapf(err, "handle IP camera")
 	}
 
+	if err := handleCameraONVIFService(ctx, handler); err != nil {
+		return errors.Wrapf(err, "handle IP camera onvif")
+	}
+
+	if err := mosaicWorker.Handle(ctx, handler); err != nil {
+		return errors.Wrapf(err, "handle mosaic")
+	}
+
+	if err := handleEncodeProfileService(ctx, handler); err != nil {
+		return errors.Wrapf(err, "handle encode profile")
+	}
+
+	if err := snapshotWorker.Handle(ctx, handler); err != nil {
+		return errors.Wrapf(err, "handle snapshot")
+	}
+
 	if err := handleHooksService(ctx, handler); err != nil {
 		return errors.Wrapf(err, "handle hooks")
 	}
@@ -310,7 +346,8 @@ func handleHTTPService(ctx context.Context, handler *http.ServeMux) error {
 
 	platformFileServer := http.FileServer(http.Dir(path.Join(conf.Pwd, "containers/www")))
 	wellKnownFileServer := http.FileServer(http.Dir(path.Join(conf.Pwd, "containers/data")))
-	hlsFileServer := http.FileServer(http.Dir(path.Join(conf.Pwd, "containers/objs/nginx/html")))
+	hlsDir := path.Join(conf.Pwd, "containers/objs/nginx/html")
+	hlsFileServer := http.FileServer(http.Dir(hlsDir))
 
 	ep = "/"
 	logger.Tf(ctx, "Handle %v", ep)
@@ -409,6 +446,19 @@ func handleHTTPService(ctx context.Context, handler *http.ServeMux) error {
 			hlsFileServer.ServeHTTP(w, r)
 			return
 		}
+		// The fMP4 playlist of CMAF HLS, generated by transcoding rather than SRS, so never proxy to SRS.
+		if TranscodeIsFMP4Playlist(hlsDir, r.URL.Path) {
+			w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%v", 1))
+			hlsFileServer.ServeHTTP(w, r)
+			return
+		}
+		// The fMP4 segments and init file of CMAF HLS, generated by transcoding.
+		if strings.HasSuffix(r.URL.Path, ".m4s") {
+			w.Header().Set("Content-Type", "video/iso.segment")
+			w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%v", 600))
+			hlsFileServer.ServeHTTP(w, r)
+			return
+		}
 
 		if strings.HasSuffix(r.URL.Path, ".flv") || strings.HasSuffix(r.URL.Path, ".m3u8") ||
 			strings.HasSuffix(r.URL.Path, ".ts") || strings.HasSuffix(r.URL.Path, ".aac") ||
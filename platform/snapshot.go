@@ -0,0 +1,632 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ossrs/go-oryx-lib/errors"
+	ohttp "github.com/ossrs/go-oryx-lib/http"
+	"github.com/ossrs/go-oryx-lib/logger"
+
+	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
+	"github.com/go-redis/redis/v8"
+)
+
+var snapshotWorker *SnapshotWorker
+
+// SnapshotWorker captures JPEG thumbnails periodically, for each active live stream and each running
+// IP camera, to use as dashboard previews and room posters. It keeps the latest image and a short
+// history for each source.
+type SnapshotWorker struct {
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	// To wakeup the worker when configure changed.
+	notify chan struct{}
+}
+
+func NewSnapshotWorker() *SnapshotWorker {
+	return &SnapshotWorker{notify: make(chan struct{}, 1)}
+}
+
+// SnapshotConfig is the global configure for snapshot.
+type SnapshotConfig struct {
+	// Whether enable the snapshot.
+	Enabled bool `json:"enabled"`
+	// The interval in seconds to capture, default to 10s.
+	Interval int `json:"interval,omitempty"`
+	// The width of image, default to 320, the height is scaled by aspect ratio if not set.
+	Width  int `json:"width,omitempty"`
+	Height int `json:"height,omitempty"`
+	// The number of images to keep for each source, including the latest one, default to 5.
+	History int `json:"history,omitempty"`
+	// Whether require authentication to get the image.
+	Auth bool `json:"auth"`
+}
+
+func (v *SnapshotConfig) String() string {
+	return fmt.Sprintf("enabled=%v, interval=%v, size=%vx%v, history=%v, auth=%v",
+		v.Enabled, v.Interval, v.Width, v.Height, v.History, v.Auth,
+	)
+}
+
+func (v *SnapshotConfig) Validate() error {
+	if v.Interval < 0 || (v.Interval > 0 && v.Interval < 3) || v.Interval > 3600 {
+		return errors.Errorf("invalid interval %v, should be in [3, 3600]", v.Interval)
+	}
+	if v.Width < 0 || v.Width > 1920 || v.Width%2 != 0 {
+		return errors.Errorf("invalid width %v", v.Width)
+	}
+	if v.Height < 0 || v.Height > 1080 || v.Height%2 != 0 {
+		return errors.Errorf("invalid height %v", v.Height)
+	}
+	if v.History < 0 || v.History > 60 {
+		return errors.Errorf("invalid history %v, should be in [1, 60]", v.History)
+	}
+	return nil
+}
+
+func (v *SnapshotConfig) interval() time.Duration {
+	if v.Interval <= 0 {
+		return 10 * time.Second
+	}
+	return time.Duration(v.Interval) * time.Second
+}
+
+func (v *SnapshotConfig) history() int {
+	if v.History <= 0 {
+		return 5
+	}
+	return v.History
+}
+
+// FFmpegArgs build the arguments to capture a frame of input to the output image.
+func (v *SnapshotConfig) FFmpegArgs(input, output string) []string {
+	width, height := v.Width, v.Height
+	if width <= 0 && height <= 0 {
+		width = 320
+	}
+	if width <= 0 {
+		width = -2
+	}
+	if height <= 0 {
+		height = -2
+	}
+
+	var args []string
+	// For RTSP stream source, always use TCP transport.
+	if strings.HasPrefix(input, "rtsp://") {
+		args = append(args, "-rtsp_transport", "tcp")
+	}
+	return append(args, "-i", input,
+		"-frames:v", "1", "-vf", fmt.Sprintf("scale=%v:%v", width, height), "-q:v", "5",
+		"-y", output,
+	)
+}
+
+func loadSnapshotConfig(ctx context.Context) (*SnapshotConfig, error) {
+	var config SnapshotConfig
+	if b, err := rdb.HGet(ctx, SRS_SNAPSHOT_CONFIG, "global").Result(); err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hget %v global", SRS_SNAPSHOT_CONFIG)
+	} else if len(b) > 0 {
+		if err := json.Unmarshal([]byte(b), &config); err != nil {
+			return nil, errors.Wrapf(err, "unmarshal %v", b)
+		}
+	}
+	return &config, nil
+}
+
+// SnapshotName filter the name of source, to use as the path of images. The name is the platform of
+// camera, or the app/stream of live stream, for example, live/livestream. Return empty string if invalid.
+func SnapshotName(name string) string {
+	segments := strings.Split(name, "/")
+	if len(segments) > 2 {
+		return ""
+	}
+
+	for _, segment := range segments {
+		if segment == "" || segment == "." || segment == ".." {
+			return ""
+		}
+		for _, c := range segment {
+			if (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && (c < '0' || c > '9') && c != '-' && c != '_' && c != '.' {
+				return ""
+			}
+		}
+	}
+	return name
+}
+
+// Load the names of sources, the directory of camera, or the directory of stream in app.
+func loadSnapshotSources() ([]string, error) {
+	entries, err := os.ReadDir(dirSnapshotPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "read dir %v", dirSnapshotPath)
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		names = append(names, entry.Name())
+
+		dir := path.Join(dirSnapshotPath, entry.Name())
+		subEntries, err := os.ReadDir(dir)
+		if err != nil {
+			return nil, errors.Wrapf(err, "read dir %v", dir)
+		}
+		for _, subEntry := range subEntries {
+			if subEntry.IsDir() {
+				names = append(names, path.Join(entry.Name(), subEntry.Name()))
+			}
+		}
+	}
+	return names, nil
+}
+
+// SnapshotImage is an image of source, the file name is the capture time in unix milliseconds.
+type SnapshotImage struct {
+	// The file path of image.
+	File string `json:"-"`
+	// The capture time.
+	Update time.Time `json:"update"`
+	// The size in bytes.
+	Size int64 `json:"size"`
+}
+
+// Load the images of source, the latest one is the first.
+func loadSnapshotImages(name string) ([]*SnapshotImage, error) {
+	dir := path.Join(dirSnapshotPath, name)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "read dir %v", dir)
+	}
+
+	var images []*SnapshotImage
+	for _, entry := range entries {
+		if entry.IsDir() || path.Ext(entry.Name()) != ".jpg" {
+			continue
+		}
+
+		ms, err := strconv.ParseInt(strings.TrimSuffix(entry.Name(), ".jpg"), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil || info.Size() == 0 {
+			continue
+		}
+
+		images = append(images, &SnapshotImage{
+			File: path.Join(dir, entry.Name()), Update: time.UnixMilli(ms), Size: info.Size(),
+		})
+	}
+
+	sort.Slice(images, func(i, j int) bool {
+		return images[i].Update.After(images[j].Update)
+	})
+	return images, nil
+}
+
+func (v *SnapshotWorker) Handle(ctx context.Context, handler *http.ServeMux) error {
+	ep := "/terraform/v1/snapshots/query"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := func() error {
+			var token string
+			if err := ParseBody(ctx, r.Body, &struct {
+				Token *string `json:"token"`
+			}{
+				Token: &token,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			config, err := loadSnapshotConfig(ctx)
+			if err != nil {
+				return errors.Wrapf(err, "load config")
+			}
+
+			type SnapshotSource struct {
+				// The platform of camera, or app/stream of live stream.
+				Name string `json:"name"`
+				// The images, the latest one is the first.
+				Images []*SnapshotImage `json:"images"`
+			}
+			sources := make([]*SnapshotSource, 0)
+
+			if names, err := loadSnapshotSources(); err != nil {
+				return errors.Wrapf(err, "load sources")
+			} else {
+				for _, name := range names {
+					images, err := loadSnapshotImages(name)
+					if err != nil {
+						return errors.Wrapf(err, "load images of %v", name)
+					}
+					if len(images) > 0 {
+						sources = append(sources, &SnapshotSource{Name: name, Images: images})
+					}
+				}
+			}
+
+			ohttp.WriteData(ctx, w, r, &struct {
+				Config  *SnapshotConfig   `json:"config"`
+				Sources []*SnapshotSource `json:"sources"`
+			}{
+				Config: config, Sources: sources,
+			})
+			logger.Tf(ctx, "snapshot query ok, %v, sources=%v, token=%vB", config.String(), len(sources), len(token))
+			return nil
+		}(); err != nil {
+			ohttp.WriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/terraform/v1/snapshots/apply"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := func() error {
+			var token string
+			var config SnapshotConfig
+			if err := ParseBody(ctx, r.Body, &struct {
+				Token *string `json:"token"`
+				*SnapshotConfig
+			}{
+				Token: &token, SnapshotConfig: &config,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			if err := config.Validate(); err != nil {
+				return errors.Wrapf(err, "validate %v", config.String())
+			}
+
+			if b, err := json.Marshal(&config); err != nil {
+				return errors.Wrapf(err, "marshal conf %v", config.String())
+			} else if err := rdb.HSet(ctx, SRS_SNAPSHOT_CONFIG, "global", string(b)).Err(); err != nil && err != redis.Nil {
+				return errors.Wrapf(err, "hset %v global %v", SRS_SNAPSHOT_CONFIG, string(b))
+			}
+
+			// Wakeup the worker to apply the configure.
+			select {
+			case v.notify <- struct{}{}:
+			default:
+			}
+
+			ohttp.WriteData(ctx, w, r, nil)
+			logger.Tf(ctx, "snapshot apply ok, %v, token=%vB", config.String(), len(token))
+			return nil
+		}(); err != nil {
+			ohttp.WriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/terraform/v1/snapshots/"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := func() error {
+			// Format is /terraform/v1/snapshots/:name.jpg?index=N&token=xxx, the name is the platform of
+			// camera, or app/stream of live stream, for example, /terraform/v1/snapshots/live/livestream.jpg
+			filename := r.URL.Path[len("/terraform/v1/snapshots/"):]
+			if path.Ext(filename) != ".jpg" {
+				return errors.Errorf("invalid image %v of %v", filename, r.URL.Path)
+			}
+
+			name := SnapshotName(strings.TrimSuffix(filename, ".jpg"))
+			if name == "" {
+				return errors.Errorf("invalid name %v of %v", filename, r.URL.Path)
+			}
+
+			config, err := loadSnapshotConfig(ctx)
+			if err != nil {
+				return errors.Wrapf(err, "load config")
+			}
+
+			// Optional authentication, by token in query or bearer in header.
+			if config.Auth {
+				apiSecret := envApiSecret()
+				if err := Authenticate(ctx, apiSecret, r.URL.Query().Get("token"), r.Header); err != nil {
+					return errors.Wrapf(err, "authenticate")
+				}
+			}
+
+			// The index of history, 0 is the latest one.
+			var index int
+			if q := r.URL.Query().Get("index"); q != "" {
+				if index, err = strconv.Atoi(q); err != nil || index < 0 {
+					return errors.Errorf("invalid index %v", q)
+				}
+			}
+
+			images, err := loadSnapshotImages(name)
+			if err != nil {
+				return errors.Wrapf(err, "load images of %v", name)
+			}
+			if index >= len(images) {
+				return errors.Errorf("no image %v index=%v, images=%v", name, index, len(images))
+			}
+
+			image := images[index]
+			if f, err := os.Open(image.File); err != nil {
+				return errors.Wrapf(err, "open file %v", image.File)
+			} else {
+				defer f.Close()
+				w.Header().Set("Content-Type", "image/jpeg")
+				w.Header().Set("Cache-Control", "no-cache")
+				w.Header().Set("Last-Modified", image.Update.UTC().Format(http.TimeFormat))
+				io.Copy(w, f)
+			}
+
+			logger.Tf(ctx, "snapshot image ok, name=%v, index=%v, file=%v", name, index, image.File)
+			return nil
+		}(); err != nil {
+			ohttp.WriteError(ctx, w, r, err)
+		}
+	})
+
+	return nil
+}
+
+func (v *SnapshotWorker) Close() error {
+	if v.cancel != nil {
+		v.cancel()
+	}
+	v.wg.Wait()
+	return nil
+}
+
+func (v *SnapshotWorker) Start(ctx context.Context) error {
+	wg := &v.wg
+
+	ctx, cancel := context.WithCancel(ctx)
+	v.cancel = cancel
+
+	ctx = logger.WithContext(ctx)
+	logger.Tf(ctx, "snapshot: start a worker")
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		for ctx.Err() == nil {
+			duration := 10 * time.Second
+			if config, err := loadSnapshotConfig(ctx); err != nil {
+				logger.Wf(ctx, "ignore err %+v", err)
+			} else if config.Enabled {
+				duration = config.interval()
+				if err := v.capture(ctx, config); err != nil {
+					logger.Wf(ctx, "ignore err %+v", err)
+				}
+			}
+
+			select {
+			case <-ctx.Done():
+			case <-v.notify:
+			case <-time.After(duration):
+			}
+		}
+	}()
+
+	// Cleanup the images of sources, which are not active for a long time.
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		for ctx.Err() == nil {
+			if err := v.cleanup(ctx); err != nil {
+				logger.Wf(ctx, "ignore err %+v", err)
+			}
+
+			select {
+			case <-ctx.Done():
+			case <-time.After(10 * time.Minute):
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Collect the sources to capture, the active live streams and the running IP cameras. Return the map
+// of name to the input URL.
+func (v *SnapshotWorker) sources(ctx context.Context) (map[string]string, error) {
+	sources := make(map[string]string)
+
+	// For IP camera, use the output stream, to avoid pulling the camera again. The output stream is also
+	// an active stream, which is captured as the camera only.
+	outputs := make(map[string]bool)
+	configs, err := rdb.HGetAll(ctx, SRS_CAMERA_CONFIG).Result()
+	if err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hgetall %v", SRS_CAMERA_CONFIG)
+	}
+	for platform, value := range configs {
+		var config CameraConfigure
+		if err := json.Unmarshal([]byte(value), &config); err != nil {
+			return nil, errors.Wrapf(err, "unmarshal %v %v", platform, value)
+		}
+
+		if !config.Enabled {
+			continue
+		}
+		if task := cameraWorker.GetTask(config.Platform); task == nil {
+			continue
+		} else if pid, _, _, _, _, _ := task.queryFrame(); pid <= 0 {
+			continue
+		}
+
+		if u, err := RebuildStreamURL(config.OutputURL()); err == nil {
+			outputs[u.Path] = true
+		}
+		if name := SnapshotName(config.Platform); name != "" {
+			sources[name] = config.OutputURL()
+		}
+	}
+
+	streams, err := rdb.HGetAll(ctx, SRS_STREAM_ACTIVE).Result()
+	if err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hgetall %v", SRS_STREAM_ACTIVE)
+	}
+	for _, value := range streams {
+		var stream SrsStream
+		if err := json.Unmarshal([]byte(value), &stream); err != nil {
+			return nil, errors.Wrapf(err, "unmarshal %v", value)
+		}
+
+		if outputs[fmt.Sprintf("/%v/%v", stream.App, stream.Stream)] {
+			continue
+		}
+		if name := SnapshotName(path.Join(stream.App, stream.Stream)); name != "" {
+			sources[name] = fmt.Sprintf("rtmp://localhost/%v/%v", stream.App, stream.Stream)
+		}
+	}
+
+	return sources, nil
+}
+
+// Capture the images of all sources, and remove the images exceed the history.
+func (v *SnapshotWorker) capture(ctx context.Context, config *SnapshotConfig) error {
+	sources, err := v.sources(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "collect sources")
+	}
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	// Limit the number of FFmpeg processes.
+	limits := make(chan struct{}, 4)
+	for name, input := range sources {
+		wg.Add(1)
+		go func(name, input string) {
+			defer wg.Done()
+
+			select {
+			case <-ctx.Done():
+				return
+			case limits <- struct{}{}:
+			}
+			defer func() {
+				<-limits
+			}()
+
+			if err := v.captureSource(ctx, config, name, input); err != nil {
+				logger.Wf(ctx, "snapshot: ignore capture %v of %v err %+v", name, input, err)
+			}
+		}(name, input)
+	}
+
+	return nil
+}
+
+func (v *SnapshotWorker) captureSource(ctx context.Context, config *SnapshotConfig, name, input string) error {
+	dir := path.Join(dirSnapshotPath, name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.Wrapf(err, "create dir %v", dir)
+	}
+
+	// Rebuild the stream url, because it may contain special characters.
+	if u, err := RebuildStreamURL(input); err != nil {
+		return errors.Wrapf(err, "rebuild %v", input)
+	} else {
+		input = u.String()
+	}
+
+	toCtx, toCancelFunc := context.WithTimeout(ctx, 15*time.Second)
+	defer toCancelFunc()
+
+	// Write to a temporary file, which is ignored by loadSnapshotImages, then rename to the image, to
+	// never serve a partial image.
+	output := path.Join(dir, fmt.Sprintf("%v.jpg", time.Now().UnixMilli()))
+	tmpOutput := fmt.Sprintf("%v.tmp.jpg", strings.TrimSuffix(output, ".jpg"))
+	args := config.FFmpegArgs(input, tmpOutput)
+	if err := exec.CommandContext(toCtx, "ffmpeg", args...).Run(); err != nil {
+		os.Remove(tmpOutput)
+		return errors.Wrapf(err, "capture %v", strings.Join(args, " "))
+	}
+	if err := os.Rename(tmpOutput, output); err != nil {
+		os.Remove(tmpOutput)
+		return errors.Wrapf(err, "rename %v to %v", tmpOutput, output)
+	}
+
+	// Remove the images exceed the history.
+	images, err := loadSnapshotImages(name)
+	if err != nil {
+		return errors.Wrapf(err, "load images of %v", name)
+	}
+	for i := config.history(); i < len(images); i++ {
+		if err := os.Remove(images[i].File); err != nil {
+			return errors.Wrapf(err, "remove %v", images[i].File)
+		}
+	}
+
+	return nil
+}
+
+// Remove the images of source which is not updated for a day.
+func (v *SnapshotWorker) cleanup(ctx context.Context) error {
+	names, err := loadSnapshotSources()
+	if err != nil {
+		return errors.Wrapf(err, "load sources")
+	}
+
+	// Cleanup the streams before the app, which is removed only when it's empty.
+	for i := len(names) - 1; i >= 0; i-- {
+		name := names[i]
+		images, err := loadSnapshotImages(name)
+		if err != nil {
+			return errors.Wrapf(err, "load images of %v", name)
+		}
+		if len(images) > 0 && time.Since(images[0].Update) < 24*time.Hour {
+			continue
+		}
+
+		for _, image := range images {
+			if err := os.Remove(image.File); err != nil {
+				return errors.Wrapf(err, "remove %v", image.File)
+			}
+		}
+
+		dir := path.Join(dirSnapshotPath, name)
+		if entries, err := os.ReadDir(dir); err != nil || len(entries) > 0 {
+			continue
+		}
+		if err := os.Remove(dir); err != nil {
+			return errors.Wrapf(err, "remove %v", dir)
+		}
+		logger.Tf(ctx, "snapshot: cleanup expired %v", dir)
+	}
+
+	return nil
+}
@@ -0,0 +1,47 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSnapshotName(t *testing.T) {
+	for _, name := range []string{"live/livestream", "camera-1234", "room_1.hd", "other/room_1.hd"} {
+		if SnapshotName(name) != name {
+			t.Errorf("should be valid %v", name)
+		}
+	}
+	for _, name := range []string{"", ".", "..", "../etc", "a/..", "a/b/c", "/a", "a/", "a b", "a?b"} {
+		if SnapshotName(name) != "" {
+			t.Errorf("should be invalid %v", name)
+		}
+	}
+}
+
+func TestSnapshotConfig(t *testing.T) {
+	conf := &SnapshotConfig{}
+	if err := conf.Validate(); err != nil {
+		t.Errorf("validate err %+v", err)
+	} else if conf.interval().Seconds() != 10 || conf.history() != 5 {
+		t.Errorf("invalid default %v", conf.String())
+	}
+
+	for _, conf := range []*SnapshotConfig{{Interval: 1}, {Width: 321}, {History: 61}, {Height: -2}} {
+		if err := conf.Validate(); err == nil {
+			t.Errorf("should fail %v", conf.String())
+		}
+	}
+
+	args := strings.Join(conf.FFmpegArgs("rtsp://cam/1", "snapshots/a/1.jpg"), " ")
+	if args != "-rtsp_transport tcp -i rtsp://cam/1 -frames:v 1 -vf scale=320:-2 -q:v 5 -y snapshots/a/1.jpg" {
+		t.Errorf("invalid args %v", args)
+	}
+
+	conf = &SnapshotConfig{Height: 180}
+	if args = strings.Join(conf.FFmpegArgs("rtmp://localhost/live/livestream", "1.jpg"), " "); !strings.Contains(args, "scale=-2:180") {
+		t.Errorf("invalid args %v", args)
+	}
+}
@@ -733,10 +733,12 @@ func handleOnHls(ctx context.Context, handler *http.ServeMux) error {
 			}
 			logger.Tf(ctx, "on_hls ok, %v", string(b))
 
-			// Handle TS file by Record task if enabled.
+			// Handle TS file by Record task if enabled, or the stream is recorded on demand.
 			if recordAll, err := rdb.HGet(ctx, SRS_RECORD_PATTERNS, "all").Result(); err != nil && err != redis.Nil {
 				return errors.Wrapf(err, "hget %v all", SRS_RECORD_PATTERNS)
-			} else if recordAll == "true" {
+			} else if manual, err := recordWorker.IsManual(ctx, msg.App, msg.Stream); err != nil {
+				return errors.Wrapf(err, "query manual %v", msg.String())
+			} else if recordAll == "true" || manual {
 				if err = recordWorker.OnHlsTsMessage(ctx, &msg); err != nil {
 					return errors.Wrapf(err, "feed %v", msg.String())
 				}
@@ -8,7 +8,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"net/url"
 	"os/exec"
 	"path"
 	"strings"
@@ -33,10 +32,15 @@ type TranscodeWorker struct {
 
 	// The global transcode task, only support one transcode task.
 	task *TranscodeTask
+
+	// The tasks of transcode rules, key is stream URL, value is *TranscodeTask.
+	streams sync.Map
+	// To wakeup the worker when rules changed.
+	notify chan struct{}
 }
 
 func NewTranscodeWorker() *TranscodeWorker {
-	v := &TranscodeWorker{}
+	v := &TranscodeWorker{notify: make(chan struct{}, 1)}
 	v.task = NewTranscodeTask()
 	v.task.transcodeWorker = v
 	return v
@@ -70,8 +74,54 @@ func (v *TranscodeWorker) Handle(ctx context.Context, handler *http.ServeMux) er
 				}
 			}
 
-			ohttp.WriteData(ctx, w, r, &config)
-			logger.Tf(ctx, "transcode query ok, %v, token=%vB", config, len(token))
+			type TaskItem struct {
+				// The task uuid.
+				UUID string `json:"uuid"`
+				// The rule ID, empty for the global task.
+				Rule string `json:"rule,omitempty"`
+				// The input stream URL.
+				InputStream string `json:"input"`
+				// The output stream URL.
+				OutputStream string `json:"output"`
+				// The FFmpeg pid.
+				PID int32 `json:"pid"`
+				// The HLS master playlist URL of task of rule, for ABR ladder.
+				Master string `json:"master,omitempty"`
+				// The FFmpeg log.
+				Frame struct {
+					// The FFmpeg log lines.
+					Log string `json:"log"`
+					// The last update time.
+					Update string `json:"update"`
+				} `json:"frame"`
+			}
+			tasks := []*TaskItem{}
+			for _, task := range append([]*TranscodeTask{v.task}, v.ruleTasks()...) {
+				pid, input, output, frame, update := task.queryFrame()
+				if task.Rule == "" && pid <= 0 {
+					continue
+				}
+
+				item := &TaskItem{UUID: task.UUID, Rule: task.Rule, InputStream: input, PID: pid}
+				if config := task.queryConfig(); task.Rule != "" && config.abrEnabled() {
+					item.Master = fmt.Sprintf("/terraform/v1/ffmpeg/transcode/abr.m3u8?task=%v", task.UUID)
+				}
+				if pid > 0 {
+					item.OutputStream = output
+					item.Frame.Log = frame
+					item.Frame.Update = update
+				}
+				tasks = append(tasks, item)
+			}
+
+			ohttp.WriteData(ctx, w, r, &struct {
+				*TranscodeConfig
+				// The running tasks, the global task and the tasks of rules.
+				Tasks []*TaskItem `json:"tasks"`
+			}{
+				TranscodeConfig: &config, Tasks: tasks,
+			})
+			logger.Tf(ctx, "transcode query ok, %v, tasks=%v, token=%vB", config, len(tasks), len(token))
 			return nil
 		}(); err != nil {
 			ohttp.WriteError(ctx, w, r, err)
@@ -99,6 +149,15 @@ func (v *TranscodeWorker) Handle(ctx context.Context, handler *http.ServeMux) er
 				return errors.Wrapf(err, "authenticate")
 			}
 
+			if err := config.validateRenditions(); err != nil {
+				return errors.Wrapf(err, "validate %v", config.String())
+			}
+			if config.Audio != nil {
+				if err := config.Audio.Validate(); err != nil {
+					return errors.Wrapf(err, "validate audio %v", config.Audio.String())
+				}
+			}
+
 			if b, err := json.Marshal(config); err != nil {
 				return errors.Wrapf(err, "marshal conf %v", config)
 			} else if err := rdb.HSet(ctx, SRS_TRANSCODE_CONFIG, "global", string(b)).Err(); err != nil && err != redis.Nil {
@@ -155,6 +214,8 @@ func (v *TranscodeWorker) Handle(ctx context.Context, handler *http.ServeMux) er
 				InputStream string `json:"input"`
 				// The output stream URL.
 				OutputStream string `json:"output"`
+				// The HLS master playlist URL, for ABR ladder.
+				Master string `json:"master,omitempty"`
 				// The FFmpeg log.
 				Frame struct {
 					// The FFmpeg log lines.
@@ -171,6 +232,9 @@ func (v *TranscodeWorker) Handle(ctx context.Context, handler *http.ServeMux) er
 				res.Frame.Log = frame
 				res.Frame.Update = update
 			}
+			if config.abrEnabled() {
+				res.Master = "/terraform/v1/ffmpeg/transcode/abr.m3u8"
+			}
 
 			ohttp.WriteData(ctx, w, r, &res)
 			logger.Tf(ctx, "transcode task ok, %v, pid=%v, input=%v, output=%v, frame=%v, update=%v, token=%vB",
@@ -181,6 +245,62 @@ func (v *TranscodeWorker) Handle(ctx context.Context, handler *http.ServeMux) er
 		}
 	})
 
+	// The master playlist of global task, or the task of rule by ?task=uuid
+	ep = "/terraform/v1/ffmpeg/transcode/abr.m3u8"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := func() error {
+			var config TranscodeConfig
+			if taskUUID := r.URL.Query().Get("task"); taskUUID != "" {
+				var task *TranscodeTask
+				for _, t := range v.ruleTasks() {
+					if t.UUID == taskUUID {
+						task = t
+					}
+				}
+				if task == nil {
+					return errors.Errorf("no task %v", taskUUID)
+				}
+				config = task.queryConfig()
+			} else if b, err := rdb.HGet(ctx, SRS_TRANSCODE_CONFIG, "global").Result(); err != nil && err != redis.Nil {
+				return errors.Wrapf(err, "hget %v global", SRS_TRANSCODE_CONFIG)
+			} else if len(b) > 0 {
+				if err := json.Unmarshal([]byte(b), &config); err != nil {
+					return errors.Wrapf(err, "unmarshal %v", b)
+				}
+			}
+
+			if !config.All || !config.abrEnabled() {
+				return errors.Errorf("no abr, %v", config.String())
+			}
+
+			variants, err := TranscodeMasterVariants(config.Server, config.Secret, config.Renditions)
+			if err != nil {
+				return errors.Wrapf(err, "build variants of %v", config.String())
+			}
+
+			contentType, m3u8Body, err := buildLiveM3u8ForVariants(ctx, variants, "", "")
+			if err != nil {
+				return errors.Wrapf(err, "build master m3u8 of %v", config.String())
+			}
+
+			w.Header().Set("Content-Type", contentType)
+			w.Write([]byte(m3u8Body))
+			logger.Tf(ctx, "transcode generate master m3u8 ok, variants=%v", len(variants))
+			return nil
+		}(); err != nil {
+			ohttp.WriteError(ctx, w, r, err)
+		}
+	})
+
+	if err := v.handleRules(ctx, handler); err != nil {
+		return errors.Wrapf(err, "handle rules")
+	}
+
+	if err := v.handleLoudness(ctx, handler); err != nil {
+		return errors.Wrapf(err, "handle loudness")
+	}
+
 	return nil
 }
 
@@ -245,12 +365,53 @@ func (v *TranscodeWorker) Start(ctx context.Context) error {
 		}
 	}()
 
+	// Start the tasks of transcode rules.
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		for ctx.Err() == nil {
+			duration := 3 * time.Second
+			if err := v.applyRules(ctx); err != nil {
+				logger.Wf(ctx, "ignore err %+v", err)
+				duration = 10 * time.Second
+			}
+
+			select {
+			case <-ctx.Done():
+			case <-v.notify:
+			case <-time.After(duration):
+			}
+		}
+	}()
+
 	return nil
 }
 
 type TranscodeConfig struct {
 	// Whether transcode all streams.
 	All bool `json:"all"`
+	// The encoder settings.
+	TranscodeEncoder
+	// The RTMP server url, for example, rtmp://localhost/live
+	Server string `json:"server"`
+	// The RTMP stream and secret, for example, livestream
+	Secret string `json:"secret"`
+	// The renditions of ABR ladder, each is published as a local stream, and the video bitrate of
+	// encoder is ignored. Transcode to one stream if empty.
+	Renditions []*TranscodeRendition `json:"renditions,omitempty"`
+	// The audio processing chain, optional.
+	Audio *TranscodeAudio `json:"audio,omitempty"`
+}
+
+func (v TranscodeConfig) String() string {
+	return fmt.Sprintf("all=%v, %v, server=%v, secret=%v, renditions=%v, audio=<%v>",
+		v.All, v.TranscodeEncoder.String(), v.Server, v.Secret, len(v.Renditions), v.Audio,
+	)
+}
+
+// TranscodeEncoder is the encoder settings, shared by transcoding and other tasks which re-encode stream.
+type TranscodeEncoder struct {
 	// The video codec name.
 	VideoCodec string `json:"vcodec"`
 	// The audio codec name.
@@ -265,22 +426,50 @@ type TranscodeConfig struct {
 	VideoPreset string `json:"vpreset"`
 	// The audio channels.
 	AudioChannels int `json:"achannels"`
-	// The RTMP server url, for example, rtmp://localhost/live
-	Server string `json:"server"`
-	// The RTMP stream and secret, for example, livestream
-	Secret string `json:"secret"`
+	// The ID of encode profile, the loose settings are ignored if specified.
+	Profile string `json:"profile,omitempty"`
 }
 
-func (v TranscodeConfig) String() string {
-	return fmt.Sprintf("all=%v, vcodec=%v, acodec=%v, vbitrate=%v, abitrate=%v, achannels=%v, vprofile=%v, vpreset=%v, server=%v, secret=%v",
-		v.All, v.VideoCodec, v.AudioCodec, v.VideoBitrate, v.AudioBitrate, v.AudioChannels, v.VideoProfile,
-		v.VideoPreset, v.Server, v.Secret,
+func (v TranscodeEncoder) String() string {
+	return fmt.Sprintf("vcodec=%v, acodec=%v, vbitrate=%v, abitrate=%v, achannels=%v, vprofile=%v, vpreset=%v, profile=%v",
+		v.VideoCodec, v.AudioCodec, v.VideoBitrate, v.AudioBitrate, v.AudioChannels, v.VideoProfile, v.VideoPreset, v.Profile,
 	)
 }
 
+// Validate the required encoder settings, or the profile which should exist.
+func (v TranscodeEncoder) Validate(ctx context.Context) error {
+	// The profile is resolved again when start the task, because it might be changed.
+	if v.Profile != "" {
+		if _, err := LoadEncodeProfile(ctx, v.Profile); err != nil {
+			return errors.Wrapf(err, "load profile %v", v.Profile)
+		}
+		return nil
+	}
+	if v.VideoCodec == "" {
+		return errors.New("no vcodec")
+	}
+	if v.AudioCodec == "" {
+		return errors.New("no acodec")
+	}
+	if v.VideoBitrate <= 0 {
+		return errors.Errorf("invalid vbitrate %v", v.VideoBitrate)
+	}
+	if v.AudioBitrate <= 0 {
+		return errors.Errorf("invalid abitrate %v", v.AudioBitrate)
+	}
+	return nil
+}
+
+// FFmpegArgs build the encoder arguments of FFmpeg, by the loose settings.
+func (v TranscodeEncoder) FFmpegArgs() []string {
+	return v.legacyProfile().FFmpegArgs()
+}
+
 type TranscodeTask struct {
 	// The ID for task.
 	UUID string `json:"uuid"`
+	// The rule ID, empty for the global task.
+	Rule string `json:"rule,omitempty"`
 
 	// The input url.
 	Input string `json:"input"`
@@ -298,9 +487,13 @@ type TranscodeTask struct {
 
 	// The context for current task.
 	cancel context.CancelFunc
+	// To stop the task of rule, when stream unpublished or rule changed.
+	stop context.CancelFunc
 
 	// The configure for transcode task.
 	config TranscodeConfig
+	// The fingerprint of configure, to detect the change of rule.
+	fingerprint string
 	// The transcode worker.
 	transcodeWorker *TranscodeWorker
 
@@ -313,8 +506,8 @@ func NewTranscodeTask() *TranscodeTask {
 }
 
 func (v *TranscodeTask) String() string {
-	return fmt.Sprintf("uuid=%v, pid=%v, config is %v",
-		v.UUID, v.PID, v.config.String(),
+	return fmt.Sprintf("uuid=%v, rule=%v, pid=%v, config is %v",
+		v.UUID, v.Rule, v.PID, v.config.String(),
 	)
 }
 
@@ -333,46 +526,37 @@ func (v *TranscodeTask) Run(ctx context.Context) error {
 	ctx = logger.WithContext(ctx)
 	logger.Tf(ctx, "transcode run task %v", v.String())
 
-	isSameStream := func(a, b string) bool {
-		ua, err := url.Parse(a)
-		if err != nil {
-			return false
-		}
-
-		ub, err := url.Parse(b)
-		if err != nil {
-			return false
-		}
-
-		if path.Clean(ua.Path) == path.Clean(ub.Path) {
-			return true
-		}
-
-		return false
-	}
-
 	// TODO: FIXME: Should select stream again when stream republished.
 	selectActiveStream := func() (*SrsStream, error) {
-		streams, err := rdb.HGetAll(ctx, SRS_STREAM_ACTIVE).Result()
+		items, err := rdb.HGetAll(ctx, SRS_STREAM_ACTIVE).Result()
 		if err != nil {
 			return nil, errors.Wrapf(err, "hgetall %v", SRS_STREAM_ACTIVE)
 		}
 
-		var best *SrsStream
-		for _, value := range streams {
+		var streams []*SrsStream
+		for _, value := range items {
 			var stream SrsStream
 			if err := json.Unmarshal([]byte(value), &stream); err != nil {
 				return nil, errors.Wrapf(err, "unmarshal %v", value)
 			}
+			streams = append(streams, &stream)
+		}
+
+		// Ignore the output streams of transcode itself, the renditions of ABR ladder, and the rules.
+		rules, err := loadTranscodeRules(ctx)
+		if err != nil {
+			return nil, errors.Wrapf(err, "load rules")
+		}
+		outputs := TranscodeOutputs(&v.config, rules, streams)
 
-			// Ignore the transcode stream itself.
-			if isSameStream(fmt.Sprintf("%v/%v", v.config.Server, v.config.Secret),
-				fmt.Sprintf("rtmp://%v/%v/%v", stream.Vhost, stream.App, stream.Stream)) {
+		var best *SrsStream
+		for _, stream := range streams {
+			if outputs[transcodeStreamPath(stream)] {
 				continue
 			}
 
 			if best == nil {
-				best = &stream
+				best = stream
 				continue
 			}
 
@@ -387,7 +571,7 @@ func (v *TranscodeTask) Run(ctx context.Context) error {
 			}
 
 			if bestUpdate.Before(streamUpdate) {
-				best = &stream
+				best = stream
 			}
 		}
 
@@ -456,6 +640,31 @@ func (v *TranscodeTask) Run(ctx context.Context) error {
 	return nil
 }
 
+// RunStream transcode the specified stream by the configure of rule, until stopped.
+func (v *TranscodeTask) RunStream(ctx context.Context, input *SrsStream) error {
+	ctx = logger.WithContext(ctx)
+	logger.Tf(ctx, "transcode run stream task %v", v.String())
+
+	for ctx.Err() == nil {
+		duration := 300 * time.Millisecond
+		if err := v.doTranscode(ctx, input); err != nil {
+			logger.Wf(ctx, "ignore %v err %+v", v.String(), err)
+			duration = 3500 * time.Millisecond
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(duration):
+		}
+	}
+
+	// Remove the task, when stopped.
+	if err := rdb.HDel(context.Background(), SRS_TRANSCODE_TASK, v.UUID).Err(); err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hdel %v %v", SRS_TRANSCODE_TASK, v.UUID)
+	}
+	return nil
+}
+
 func (v *TranscodeTask) doTranscode(ctx context.Context, input *SrsStream) error {
 	// Create context for current task.
 	parentCtx := ctx
@@ -476,6 +685,15 @@ func (v *TranscodeTask) doTranscode(ctx context.Context, input *SrsStream) error
 	// Create a heartbeat to poll and manage the status of FFmpeg process.
 	heartbeat := NewFFmpegHeartbeat(cancel)
 
+	// Measure the loudness of output, by the ebur128 logs of FFmpeg.
+	var loudness *LoudnessSession
+	if audio := v.config.Audio; audio != nil && audio.Monitor {
+		loudness = NewLoudnessSession(v.UUID, fmt.Sprintf("/%v/%v", input.App, input.Stream), audio.target())
+		heartbeat.FilterLogs = func(line string) bool {
+			return loudness.Update(ctx, line)
+		}
+	}
+
 	// Start FFmpeg process.
 	args := []string{}
 	args = append(args, "-re")
@@ -494,27 +712,39 @@ func (v *TranscodeTask) doTranscode(ctx context.Context, input *SrsStream) error
 	} else {
 		args = append(args, "-i", inputURL)
 	}
-	args = append(args,
-		"-vcodec", v.config.VideoCodec,
-		"-profile:v", v.config.VideoProfile,
-		"-preset:v", v.config.VideoPreset,
-		"-tune", "zerolatency", // Low latency mode.
-		"-b:v", fmt.Sprintf("%vk", v.config.VideoBitrate),
-		"-r", "25", "-g", "50", // Set gop to 2s.
-		"-bf", "0", // Disable B frame for WebRTC.
-		"-acodec", v.config.AudioCodec,
-		"-b:a", fmt.Sprintf("%vk", v.config.AudioBitrate),
-	)
-	if v.config.AudioChannels > 0 {
-		args = append(args, "-ac", fmt.Sprintf("%v", v.config.AudioChannels))
+	profile, err := v.config.TranscodeEncoder.ResolveProfile(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "resolve profile")
 	}
-	// If RTMP use flv, if SRT use mpegts, otherwise do not set.
-	if strings.HasPrefix(outputURL, "rtmp://") || strings.HasPrefix(outputURL, "rtmps://") {
-		args = append(args, "-f", "flv")
-	} else if strings.HasPrefix(outputURL, "srt://") {
-		args = append(args, "-pes_payload_size", "0", "-f", "mpegts")
+	// The fMP4 HLS of renditions is written to the directory of SRS HLS, served by the same handler.
+	hlsDir := path.Join(conf.Pwd, "containers/objs/nginx/html")
+	if v.config.abrEnabled() {
+		// Encode the renditions of ABR ladder from one decode.
+		if err := TranscodePrepareFMP4(hlsDir, outputURL, v.config.Renditions); err != nil {
+			return errors.Wrapf(err, "prepare fmp4")
+		}
+		abrArgs, err := TranscodeABRArgs(profile, v.config.Audio, v.config.Renditions, outputURL, hlsDir)
+		if err != nil {
+			return errors.Wrapf(err, "build abr args")
+		}
+		args = append(args, abrArgs...)
+	} else {
+		if filter := profile.VideoFilter(); filter != "" {
+			args = append(args, "-vf", filter)
+		}
+		if filter := TranscodeAudioFilter(profile, v.config.Audio, true); filter != "" {
+			args = append(args, "-af", filter)
+		}
+		args = append(args, profile.VideoArgs()...)
+		args = append(args, profile.AudioArgs()...)
+		// If RTMP use flv, if SRT use mpegts, otherwise do not set.
+		if strings.HasPrefix(outputURL, "rtmp://") || strings.HasPrefix(outputURL, "rtmps://") {
+			args = append(args, "-f", "flv")
+		} else if strings.HasPrefix(outputURL, "srt://") {
+			args = append(args, "-pes_payload_size", "0", "-f", "mpegts")
+		}
+		args = append(args, outputURL)
 	}
-	args = append(args, outputURL)
 	// Create the command object.
 	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
 
@@ -541,6 +771,16 @@ func (v *TranscodeTask) doTranscode(ctx context.Context, input *SrsStream) error
 		// When canceled, we should still write to redis, so we must not use ctx(which is cancelled).
 		v.cleanup(parentCtx)
 		v.saveTask(parentCtx)
+
+		if err := TranscodeCleanupFMP4(hlsDir, outputURL, v.config.Renditions); err != nil {
+			logger.Wf(ctx, "cleanup fmp4 of %v err %+v", outputURL, err)
+		}
+
+		if loudness != nil {
+			if err := loudness.Save(parentCtx); err != nil {
+				logger.Wf(ctx, "save loudness %v err %+v", loudness.String(), err)
+			}
+		}
 	}()
 	logger.Tf(ctx, "transcode start, stream=%v, pid=%v", input.StreamURL(), v.PID)
 
@@ -584,6 +824,12 @@ func (v *TranscodeTask) updateFrame(frame string) {
 	v.update = time.Now()
 }
 
+func (v *TranscodeTask) queryConfig() TranscodeConfig {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	return v.config
+}
+
 func (v *TranscodeTask) queryFrame() (int32, string, string, string, string) {
 	v.lock.Lock()
 	defer v.lock.Unlock()
@@ -0,0 +1,368 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/ossrs/go-oryx-lib/errors"
+)
+
+// The packaging of rendition.
+const (
+	// Publish as a local stream, and SRS generates the HLS in TS segments, which is the default.
+	TranscodePackagingStream = ""
+	// Generate the CMAF HLS in fMP4 segments by FFmpeg, required by HEVC and AV1.
+	TranscodePackagingFMP4 = "fmp4"
+)
+
+// TranscodeRendition is a rendition of ABR(Adaptive Bitrate) ladder, which is published as a local
+// stream, named by the output stream with the suffix of rendition name, for example, livestream_720p.
+// For fMP4 packaging, the HLS is written to the same path as SRS, for example, live/livestream_720p.m3u8
+type TranscodeRendition struct {
+	// The name of rendition, used as suffix of stream, for example, 720p.
+	Name string `json:"name"`
+	// The height of video, the width is scaled by aspect ratio if not set.
+	Width  int `json:"width,omitempty"`
+	Height int `json:"height,omitempty"`
+	// The video bitrate in kbps.
+	VideoBitrate int `json:"vbitrate,omitempty"`
+	// The audio bitrate in kbps.
+	AudioBitrate int `json:"abitrate"`
+	// Whether audio only rendition, without video.
+	AudioOnly bool `json:"audioOnly,omitempty"`
+	// The video codec to overwrite the profile, for example, libx265 or libsvtav1.
+	VideoCodec string `json:"vcodec,omitempty"`
+	// The packaging, empty(stream) or fmp4.
+	Packaging string `json:"packaging,omitempty"`
+}
+
+func (v *TranscodeRendition) String() string {
+	return fmt.Sprintf("name=%v, size=%vx%v, vbitrate=%v, abitrate=%v, audioOnly=%v, vcodec=%v, packaging=%v",
+		v.Name, v.Width, v.Height, v.VideoBitrate, v.AudioBitrate, v.AudioOnly, v.VideoCodec, v.Packaging,
+	)
+}
+
+func (v *TranscodeRendition) Validate() error {
+	if v.Name == "" || strings.IndexFunc(v.Name, func(c rune) bool {
+		return (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && (c < '0' || c > '9') && c != '-' && c != '_'
+	}) >= 0 {
+		return errors.Errorf("invalid name %v", v.Name)
+	}
+	if v.AudioBitrate <= 0 {
+		return errors.Errorf("invalid abitrate %v", v.AudioBitrate)
+	}
+	if v.Packaging != TranscodePackagingStream && v.Packaging != TranscodePackagingFMP4 {
+		return errors.Errorf("invalid packaging %v", v.Packaging)
+	}
+	if v.AudioOnly {
+		return nil
+	}
+
+	if strings.IndexFunc(v.VideoCodec, func(c rune) bool {
+		return (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '_'
+	}) >= 0 {
+		return errors.Errorf("invalid vcodec %v", v.VideoCodec)
+	}
+	// The FLV of SRS does not support HEVC or AV1, so we must package them in fMP4 by FFmpeg.
+	if vcodec := transcodeVideoCodec(v.VideoCodec); (vcodec == "hevc" || vcodec == "av1") && v.Packaging != TranscodePackagingFMP4 {
+		return errors.Errorf("vcodec %v requires fmp4 packaging", v.VideoCodec)
+	}
+
+	if v.Height <= 0 || v.Height%2 != 0 || v.Height > 2160 {
+		return errors.Errorf("invalid height %v", v.Height)
+	}
+	if v.Width < 0 || v.Width%2 != 0 || v.Width > 3840 {
+		return errors.Errorf("invalid width %v", v.Width)
+	}
+	if v.VideoBitrate <= 0 {
+		return errors.Errorf("invalid vbitrate %v", v.VideoBitrate)
+	}
+	return nil
+}
+
+// The codecs for HLS master playlist, only for HEVC and AV1, for player to ignore the unsupported
+// variants, use the level by height, for example, hvc1.1.6.L120.90 for 1080p.
+func (v *TranscodeRendition) codecs() string {
+	if v.AudioOnly {
+		return "mp4a.40.2"
+	}
+
+	switch transcodeVideoCodec(v.VideoCodec) {
+	case "hevc":
+		level := 150
+		if v.Height <= 720 {
+			level = 93
+		} else if v.Height <= 1080 {
+			level = 120
+		}
+		return fmt.Sprintf("hvc1.1.6.L%v.90,mp4a.40.2", level)
+	case "av1":
+		level := 12
+		if v.Height <= 720 {
+			level = 5
+		} else if v.Height <= 1080 {
+			level = 8
+		}
+		return fmt.Sprintf("av01.0.%02dM.08,mp4a.40.2", level)
+	}
+	return ""
+}
+
+// The bandwidth in bps, for HLS master playlist.
+func (v *TranscodeRendition) bandwidth() int64 {
+	if v.AudioOnly {
+		return int64(v.AudioBitrate) * 1000
+	}
+	return int64(v.VideoBitrate+v.AudioBitrate) * 1000
+}
+
+// Validate the renditions of ABR ladder, the name should be unique.
+func (v *TranscodeConfig) validateRenditions() error {
+	names := make(map[string]bool)
+	for _, rendition := range v.Renditions {
+		if err := rendition.Validate(); err != nil {
+			return errors.Wrapf(err, "validate rendition %v", rendition.String())
+		}
+		if names[rendition.Name] {
+			return errors.Errorf("duplicated rendition %v", rendition.Name)
+		}
+		names[rendition.Name] = true
+	}
+	return nil
+}
+
+// transcodeVideoCodec get the codec of encoder, for example, hevc for libx265, or av1 for libsvtav1.
+func transcodeVideoCodec(encoder string) string {
+	switch {
+	case strings.Contains(encoder, "265") || strings.Contains(encoder, "hevc"):
+		return "hevc"
+	case strings.Contains(encoder, "av1"):
+		return "av1"
+	case strings.Contains(encoder, "264") || strings.Contains(encoder, "h264"):
+		return "h264"
+	}
+	return encoder
+}
+
+func (v *TranscodeConfig) abrEnabled() bool {
+	return len(v.Renditions) > 0
+}
+
+// TranscodeRenditionURL build the output URL of rendition, by appending the name to stream, and keep
+// the query string, for example, rtmp://localhost/live/livestream_720p?secret=xxx
+func TranscodeRenditionURL(outputURL, name string) string {
+	if index := strings.Index(outputURL, "?"); index >= 0 {
+		return fmt.Sprintf("%v_%v%v", outputURL[:index], name, outputURL[index:])
+	}
+	return fmt.Sprintf("%v_%v", outputURL, name)
+}
+
+// TranscodeFMP4Path build the HLS path of fMP4 rendition, relative to the HLS directory, for example,
+// live/livestream_720p for rtmp://localhost/live/livestream?secret=xxx
+func TranscodeFMP4Path(outputURL, name string) (string, error) {
+	u, err := url.Parse(TranscodeRenditionURL(outputURL, name))
+	if err != nil {
+		return "", errors.Wrapf(err, "parse %v", outputURL)
+	}
+
+	p := strings.Trim(path.Clean(u.Path), "/")
+	if p == "" || p == "." || strings.HasPrefix(p, "..") {
+		return "", errors.Errorf("invalid path %v of %v", u.Path, outputURL)
+	}
+	return p, nil
+}
+
+// TranscodeFMP4Args build the FFmpeg arguments of CMAF HLS output, the segments and init file are in the
+// same directory of playlist, for example, live/livestream_720p-init.m4s and live/livestream_720p-0.m4s
+func TranscodeFMP4Args(hlsDir, hlsPath string) []string {
+	base := path.Base(hlsPath)
+	return []string{
+		"-f", "hls", "-hls_time", "2", "-hls_list_size", "10",
+		"-hls_flags", "delete_segments+independent_segments",
+		"-hls_segment_type", "fmp4", "-hls_fmp4_init_filename", fmt.Sprintf("%v-init.m4s", base),
+		"-hls_segment_filename", path.Join(hlsDir, fmt.Sprintf("%v-%%d.m4s", hlsPath)),
+		path.Join(hlsDir, fmt.Sprintf("%v.m3u8", hlsPath)),
+	}
+}
+
+// TranscodeIsFMP4Playlist whether the URL path is the playlist of fMP4 rendition in hlsDir, which is
+// generated by transcode rather than SRS, identified by the init file beside the playlist.
+func TranscodeIsFMP4Playlist(hlsDir, urlPath string) bool {
+	if !strings.HasSuffix(urlPath, ".m3u8") {
+		return false
+	}
+
+	initFile := fmt.Sprintf("%v-init.m4s", strings.TrimSuffix(path.Clean("/"+urlPath), ".m3u8"))
+	if _, err := os.Stat(path.Join(hlsDir, initFile)); err != nil {
+		return false
+	}
+	return true
+}
+
+// TranscodePrepareFMP4 create the directory of fMP4 renditions, because FFmpeg does not create it.
+func TranscodePrepareFMP4(hlsDir, outputURL string, renditions []*TranscodeRendition) error {
+	for _, rendition := range renditions {
+		if rendition.Packaging != TranscodePackagingFMP4 {
+			continue
+		}
+
+		hlsPath, err := TranscodeFMP4Path(outputURL, rendition.Name)
+		if err != nil {
+			return errors.Wrapf(err, "build path of %v", rendition.Name)
+		}
+
+		dir := path.Dir(path.Join(hlsDir, hlsPath))
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return errors.Wrapf(err, "mkdir %v", dir)
+		}
+	}
+	return nil
+}
+
+// TranscodeCleanupFMP4 remove the playlist and segments of fMP4 renditions, when transcode task done.
+func TranscodeCleanupFMP4(hlsDir, outputURL string, renditions []*TranscodeRendition) error {
+	for _, rendition := range renditions {
+		if rendition.Packaging != TranscodePackagingFMP4 {
+			continue
+		}
+
+		hlsPath, err := TranscodeFMP4Path(outputURL, rendition.Name)
+		if err != nil {
+			return errors.Wrapf(err, "build path of %v", rendition.Name)
+		}
+
+		files, err := filepath.Glob(path.Join(hlsDir, fmt.Sprintf("%v-*.m4s", hlsPath)))
+		if err != nil {
+			return errors.Wrapf(err, "glob %v", hlsPath)
+		}
+		files = append(files, path.Join(hlsDir, fmt.Sprintf("%v.m3u8", hlsPath)))
+
+		for _, file := range files {
+			if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+				return errors.Wrapf(err, "remove %v", file)
+			}
+		}
+	}
+	return nil
+}
+
+// TranscodeABRArgs build the FFmpeg arguments after input, to encode several renditions from one
+// decode, each rendition is published to its own output URL, or written as fMP4 HLS to hlsDir. The
+// size and bitrate of profile are overwritten by each rendition, and the audio processing chain is
+// applied to each rendition.
+func TranscodeABRArgs(profile *EncodeProfile, audio *TranscodeAudio, renditions []*TranscodeRendition, outputURL, hlsDir string) ([]string, error) {
+	var videos []*TranscodeRendition
+	for _, rendition := range renditions {
+		if !rendition.AudioOnly {
+			videos = append(videos, rendition)
+		}
+	}
+
+	var args []string
+	if len(videos) > 0 {
+		// Decode the video once, split and scale to each rendition.
+		filters := []string{fmt.Sprintf("[0:v]split=%v", len(videos))}
+		for i := range videos {
+			filters[0] += fmt.Sprintf("[v%v]", i)
+		}
+		for i, rendition := range videos {
+			width := rendition.Width
+			if width <= 0 {
+				width = -2
+			}
+			filters = append(filters, fmt.Sprintf("[v%v]scale=%v:%v[vout%v]", i, width, rendition.Height, i))
+		}
+		args = append(args, "-filter_complex", strings.Join(filters, ";"))
+	}
+
+	var index int
+	for i, rendition := range renditions {
+		// Limit the bitrate of each rendition, for player to switch.
+		p := *profile
+		p.RateControl, p.VideoBitrate, p.AudioBitrate = EncodeRateControlVBR, rendition.VideoBitrate, rendition.AudioBitrate
+		p.MaxRate, p.BufSize = rendition.VideoBitrate, rendition.VideoBitrate*2
+		// The profile, preset and tune are specified to the codec, so reset them for other codec.
+		if rendition.VideoCodec != "" && rendition.VideoCodec != p.VideoCodec {
+			p.VideoCodec, p.VideoProfile, p.VideoPreset, p.VideoTune = rendition.VideoCodec, "", "", ""
+		}
+
+		if rendition.AudioOnly {
+			args = append(args, "-map", "0:a", "-vn")
+		} else {
+			args = append(args, "-map", fmt.Sprintf("[vout%v]", index), "-map", "0:a?")
+			args = append(args, p.VideoArgs()...)
+			// Use hvc1 tag for HEVC in fMP4, which is required by Safari.
+			if transcodeVideoCodec(p.VideoCodec) == "hevc" {
+				args = append(args, "-tag:v", "hvc1")
+			}
+			index++
+		}
+
+		// Only measure the loudness of the first rendition, all renditions are the same.
+		if filter := TranscodeAudioFilter(&p, audio, i == 0); filter != "" {
+			args = append(args, "-af", filter)
+		}
+		args = append(args, p.AudioArgs()...)
+
+		if rendition.Packaging == TranscodePackagingFMP4 {
+			hlsPath, err := TranscodeFMP4Path(outputURL, rendition.Name)
+			if err != nil {
+				return nil, errors.Wrapf(err, "build path of %v", rendition.Name)
+			}
+			args = append(args, TranscodeFMP4Args(hlsDir, hlsPath)...)
+			continue
+		}
+
+		output := TranscodeRenditionURL(outputURL, rendition.Name)
+		// If RTMP use flv, if SRT use mpegts, otherwise do not set.
+		if strings.HasPrefix(output, "rtmp://") || strings.HasPrefix(output, "rtmps://") {
+			args = append(args, "-f", "flv")
+		} else if strings.HasPrefix(output, "srt://") {
+			args = append(args, "-pes_payload_size", "0", "-f", "mpegts")
+		}
+		args = append(args, output)
+	}
+
+	return args, nil
+}
+
+// TranscodeMasterVariants build the variants of HLS master playlist, the HLS of each rendition is
+// served at /app/stream_name.m3u8, by SRS for local stream, or by HLS file server for fMP4.
+func TranscodeMasterVariants(server, secret string, renditions []*TranscodeRendition) ([]*M3u8Variant, error) {
+	u, err := url.Parse(server)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse %v", server)
+	}
+
+	app := strings.Trim(u.Path, "/")
+	stream := secret
+	if index := strings.Index(stream, "?"); index >= 0 {
+		stream = stream[:index]
+	}
+	// The secret may include the app, for example, live/livestream
+	streamPath := strings.Trim(path.Join(app, stream), "/")
+	if streamPath == "" {
+		return nil, errors.Errorf("no stream of server=%v, secret=%v", server, secret)
+	}
+
+	var variants []*M3u8Variant
+	for _, rendition := range renditions {
+		variant := &M3u8Variant{
+			Bandwidth: rendition.bandwidth(),
+			URI:       fmt.Sprintf("/%v_%v.m3u8", streamPath, rendition.Name),
+		}
+		variant.Codecs = rendition.codecs()
+		if !rendition.AudioOnly && rendition.Width > 0 {
+			variant.Resolution = fmt.Sprintf("%vx%v", rendition.Width, rendition.Height)
+		}
+		variants = append(variants, variant)
+	}
+	return variants, nil
+}
@@ -0,0 +1,190 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestTranscodeABR_RenditionURL(t *testing.T) {
+	if v := TranscodeRenditionURL("rtmp://localhost/live/livestream", "720p"); v != "rtmp://localhost/live/livestream_720p" {
+		t.Errorf("invalid url %v", v)
+	}
+	if v := TranscodeRenditionURL("rtmp://localhost/live/livestream?secret=xxx", "720p"); v != "rtmp://localhost/live/livestream_720p?secret=xxx" {
+		t.Errorf("invalid url %v", v)
+	}
+}
+
+func TestTranscodeABR_Validate(t *testing.T) {
+	conf := &TranscodeConfig{Renditions: []*TranscodeRendition{
+		{Name: "720p", Height: 720, VideoBitrate: 2000, AudioBitrate: 64},
+		{Name: "audio", AudioOnly: true, AudioBitrate: 64},
+	}}
+	if err := conf.validateRenditions(); err != nil {
+		t.Errorf("validate err %+v", err)
+	}
+
+	conf.Renditions = append(conf.Renditions, &TranscodeRendition{Name: "720p", Height: 720, VideoBitrate: 1000, AudioBitrate: 64})
+	if err := conf.validateRenditions(); err == nil {
+		t.Errorf("should fail for duplicated name")
+	}
+
+	for _, r := range []*TranscodeRendition{
+		{Name: "a/b", Height: 720, VideoBitrate: 2000, AudioBitrate: 64},
+		{Name: "720p", Height: 721, VideoBitrate: 2000, AudioBitrate: 64},
+		{Name: "720p", Height: 720, AudioBitrate: 64},
+		{Name: "audio", AudioOnly: true},
+	} {
+		if err := r.Validate(); err == nil {
+			t.Errorf("should fail %v", r.String())
+		}
+	}
+}
+
+func TestTranscodeABR_FFmpegArgs(t *testing.T) {
+	encoder := TranscodeEncoder{VideoCodec: "libx264", AudioCodec: "aac", AudioChannels: 2}
+	renditions := []*TranscodeRendition{
+		{Name: "1080p", Width: 1920, Height: 1080, VideoBitrate: 4000, AudioBitrate: 128},
+		{Name: "480p", Height: 480, VideoBitrate: 800, AudioBitrate: 64},
+		{Name: "audio", AudioOnly: true, AudioBitrate: 64},
+	}
+	abrArgs, err := TranscodeABRArgs(encoder.legacyProfile(), nil, renditions, "rtmp://localhost/live/livestream", "/data/html")
+	if err != nil {
+		t.Errorf("build args err %+v", err)
+	}
+	args := strings.Join(abrArgs, " ")
+
+	if !strings.Contains(args, "-filter_complex [0:v]split=2[v0][v1];[v0]scale=1920:1080[vout0];[v1]scale=-2:480[vout1]") {
+		t.Errorf("invalid filter %v", args)
+	}
+	if !strings.Contains(args, "-map [vout1] -map 0:a? -vcodec libx264") || !strings.Contains(args, "-b:v 800k") {
+		t.Errorf("invalid video rendition %v", args)
+	}
+	if !strings.Contains(args, "-map 0:a -vn -acodec aac -b:a 64k -ac 2 -f flv rtmp://localhost/live/livestream_audio") {
+		t.Errorf("invalid audio rendition %v", args)
+	}
+	if strings.Count(args, "-f flv") != 3 {
+		t.Errorf("invalid outputs %v", args)
+	}
+}
+
+func TestTranscodeABR_MasterPlaylist(t *testing.T) {
+	renditions := []*TranscodeRendition{
+		{Name: "720p", Width: 1280, Height: 720, VideoBitrate: 2000, AudioBitrate: 64},
+		{Name: "audio", AudioOnly: true, AudioBitrate: 64},
+	}
+	variants, err := TranscodeMasterVariants("rtmp://localhost/live", "livestream?secret=xxx", renditions)
+	if err != nil {
+		t.Errorf("build variants err %+v", err)
+		return
+	}
+
+	_, body, err := buildLiveM3u8ForVariants(context.Background(), variants, "", "")
+	if err != nil {
+		t.Errorf("build m3u8 err %+v", err)
+	}
+	expect := strings.Join([]string{
+		"#EXTM3U",
+		"#EXT-X-STREAM-INF:BANDWIDTH=2064000,RESOLUTION=1280x720",
+		"/live/livestream_720p.m3u8",
+		`#EXT-X-STREAM-INF:BANDWIDTH=64000,CODECS="mp4a.40.2"`,
+		"/live/livestream_audio.m3u8",
+	}, "\n")
+	if body != expect {
+		t.Errorf("invalid m3u8 %v", body)
+	}
+
+	// Should keep the same output of closed caption.
+	_, body, _ = buildLiveM3u8ForVariantCC(context.Background(), 1000, "en", "/stream.m3u8", "subtitles.m3u8")
+	expect = strings.Join([]string{
+		"#EXTM3U",
+		`#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID="subs",NAME="Subtitle-EN",LANGUAGE="en",DEFAULT=YES,AUTOSELECT=YES,FORCED=NO,URI="subtitles.m3u8"`,
+		`#EXT-X-STREAM-INF:BANDWIDTH=1000,SUBTITLES="subs"`,
+		"/stream.m3u8",
+	}, "\n")
+	if body != expect {
+		t.Errorf("invalid m3u8 %v", body)
+	}
+}
+
+func TestTranscodeABR_FMP4(t *testing.T) {
+	for _, r := range []*TranscodeRendition{
+		{Name: "720p", Height: 720, VideoBitrate: 2000, AudioBitrate: 64, VideoCodec: "libx265"},
+		{Name: "720p", Height: 720, VideoBitrate: 2000, AudioBitrate: 64, VideoCodec: "libsvtav1", Packaging: "ts"},
+		{Name: "720p", Height: 720, VideoBitrate: 2000, AudioBitrate: 64, VideoCodec: "lib x265", Packaging: "fmp4"},
+	} {
+		if err := r.Validate(); err == nil {
+			t.Errorf("should fail %v", r.String())
+		}
+	}
+
+	encoder := TranscodeEncoder{VideoCodec: "libx264", VideoProfile: "main", VideoPreset: "veryfast", AudioCodec: "aac"}
+	renditions := []*TranscodeRendition{
+		{Name: "720p", Width: 1280, Height: 720, VideoBitrate: 2000, AudioBitrate: 64},
+		{Name: "720p-hevc", Width: 1280, Height: 720, VideoBitrate: 1200, AudioBitrate: 64, VideoCodec: "libx265", Packaging: TranscodePackagingFMP4},
+		{Name: "1080p-av1", Width: 1920, Height: 1080, VideoBitrate: 2000, AudioBitrate: 64, VideoCodec: "libsvtav1", Packaging: TranscodePackagingFMP4},
+	}
+	conf := &TranscodeConfig{Renditions: renditions}
+	if err := conf.validateRenditions(); err != nil {
+		t.Errorf("validate err %+v", err)
+	}
+
+	abrArgs, err := TranscodeABRArgs(encoder.legacyProfile(), nil, renditions, "rtmp://localhost/live/livestream?secret=xxx", "/data/html")
+	if err != nil {
+		t.Errorf("build args err %+v", err)
+	}
+	args := strings.Join(abrArgs, " ")
+	if !strings.Contains(args, "-f flv rtmp://localhost/live/livestream_720p?secret=xxx") {
+		t.Errorf("invalid h264 rendition %v", args)
+	}
+	if !strings.Contains(args, "-map [vout1] -map 0:a? -vcodec libx265 -b:v 1200k") || !strings.Contains(args, "-tag:v hvc1") {
+		t.Errorf("invalid hevc rendition %v", args)
+	}
+	if strings.Contains(args, "-vcodec libx265 -profile:v main") {
+		t.Errorf("should reset the profile of hevc %v", args)
+	}
+	expect := "-f hls -hls_time 2 -hls_list_size 10 -hls_flags delete_segments+independent_segments " +
+		"-hls_segment_type fmp4 -hls_fmp4_init_filename livestream_1080p-av1-init.m4s " +
+		"-hls_segment_filename /data/html/live/livestream_1080p-av1-%d.m4s /data/html/live/livestream_1080p-av1.m3u8"
+	if !strings.HasSuffix(args, expect) {
+		t.Errorf("invalid av1 rendition %v", args)
+	}
+
+	variants, err := TranscodeMasterVariants("rtmp://localhost/live", "livestream?secret=xxx", renditions)
+	if err != nil {
+		t.Errorf("build variants err %+v", err)
+		return
+	}
+	if v := variants[1]; v.URI != "/live/livestream_720p-hevc.m3u8" || v.Codecs != "hvc1.1.6.L93.90,mp4a.40.2" {
+		t.Errorf("invalid hevc variant %v %v", v.URI, v.Codecs)
+	}
+	if v := variants[2]; v.Codecs != "av01.0.08M.08,mp4a.40.2" {
+		t.Errorf("invalid av1 variant %v", v.Codecs)
+	}
+}
+
+func TestTranscodeABR_IsFMP4Playlist(t *testing.T) {
+	hlsDir := t.TempDir()
+	if err := os.MkdirAll(path.Join(hlsDir, "live"), 0755); err != nil {
+		t.Errorf("mkdir err %+v", err)
+		return
+	}
+	if err := os.WriteFile(path.Join(hlsDir, "live/livestream_720p-init.m4s"), nil, 0644); err != nil {
+		t.Errorf("write err %+v", err)
+		return
+	}
+
+	if !TranscodeIsFMP4Playlist(hlsDir, "/live/livestream_720p.m3u8") {
+		t.Errorf("should be fmp4 playlist")
+	}
+	for _, p := range []string{"/live/livestream.m3u8", "/live/livestream_720p-init.m4s", "/../live/livestream_720p.ts"} {
+		if TranscodeIsFMP4Playlist(hlsDir, p) {
+			t.Errorf("%v should not be fmp4 playlist", p)
+		}
+	}
+}
@@ -0,0 +1,444 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ossrs/go-oryx-lib/errors"
+	ohttp "github.com/ossrs/go-oryx-lib/http"
+	"github.com/ossrs/go-oryx-lib/logger"
+
+	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+)
+
+// The channel remap of audio processing.
+const (
+	// Keep the original channels.
+	TranscodeAudioChannelsKeep = ""
+	// Downmix to mono.
+	TranscodeAudioChannelsMono = "mono"
+	// Upmix or downmix to stereo.
+	TranscodeAudioChannelsStereo = "stereo"
+	// Use the left channel for both channels, for example, only the left mic is connected.
+	TranscodeAudioChannelsLeft = "left"
+	// Use the right channel for both channels.
+	TranscodeAudioChannelsRight = "right"
+	// Swap the left and right channels.
+	TranscodeAudioChannelsSwap = "swap"
+)
+
+// The max number of loudness sessions to keep.
+const maxLoudnessSessions = 100
+
+// TranscodeLoudnorm is the EBU R128 loudness normalization, by the loudnorm filter of FFmpeg.
+type TranscodeLoudnorm struct {
+	// The integrated loudness target in LUFS, default to -23 for EBU R128.
+	Integrated float64 `json:"i,omitempty"`
+	// The max true peak in dBTP, default to -1.5.
+	TruePeak float64 `json:"tp,omitempty"`
+	// The loudness range target in LU, default to 11.
+	Range float64 `json:"lra,omitempty"`
+}
+
+// TranscodeCompressor is the dynamic range compressor, by the acompressor filter of FFmpeg.
+type TranscodeCompressor struct {
+	// The threshold in dB, default to -18.
+	Threshold float64 `json:"threshold,omitempty"`
+	// The ratio to reduce the signal above threshold, default to 3.
+	Ratio float64 `json:"ratio,omitempty"`
+	// The attack and release in ms, default to 20 and 250.
+	Attack  float64 `json:"attack,omitempty"`
+	Release float64 `json:"release,omitempty"`
+	// The makeup gain in dB, default to 0.
+	Makeup float64 `json:"makeup,omitempty"`
+}
+
+// TranscodeLimiter is the peak limiter, by the alimiter filter of FFmpeg.
+type TranscodeLimiter struct {
+	// The max level in dBFS, default to -1.
+	Limit float64 `json:"limit,omitempty"`
+}
+
+// TranscodeAudio is the audio processing chain of transcoding, all stages are optional and applied
+// in order of channel remap, compressor, loudnorm, limiter and resample.
+type TranscodeAudio struct {
+	// The channel remap, empty(keep), mono, stereo, left, right or swap.
+	Channels string `json:"channels,omitempty"`
+	// The compressor, disabled if not set.
+	Compressor *TranscodeCompressor `json:"compressor,omitempty"`
+	// The loudness normalization, overwrite the loudness of encode profile if set.
+	Loudnorm *TranscodeLoudnorm `json:"loudnorm,omitempty"`
+	// The limiter, disabled if not set.
+	Limiter *TranscodeLimiter `json:"limiter,omitempty"`
+	// The output sample rate, for example, 48000, keep the original if not set.
+	SampleRate int `json:"sampleRate,omitempty"`
+	// Whether measure the loudness of output, and save the integrated LUFS of each stream session.
+	Monitor bool `json:"monitor,omitempty"`
+}
+
+func (v *TranscodeAudio) String() string {
+	return fmt.Sprintf("channels=%v, compressor=%v, loudnorm=%v, limiter=%v, sampleRate=%v, monitor=%v",
+		v.Channels, v.Compressor != nil, v.Loudnorm != nil, v.Limiter != nil, v.SampleRate, v.Monitor,
+	)
+}
+
+func (v *TranscodeAudio) Validate() error {
+	switch v.Channels {
+	case TranscodeAudioChannelsKeep, TranscodeAudioChannelsMono, TranscodeAudioChannelsStereo,
+		TranscodeAudioChannelsLeft, TranscodeAudioChannelsRight, TranscodeAudioChannelsSwap:
+	default:
+		return errors.Errorf("invalid channels %v", v.Channels)
+	}
+
+	if c := v.Compressor; c != nil {
+		if c.Threshold < -60 || c.Threshold > 0 {
+			return errors.Errorf("invalid compressor threshold %v", c.Threshold)
+		}
+		if c.Ratio != 0 && (c.Ratio < 1 || c.Ratio > 20) {
+			return errors.Errorf("invalid compressor ratio %v", c.Ratio)
+		}
+		if c.Attack < 0 || c.Attack > 2000 || c.Release < 0 || c.Release > 9000 {
+			return errors.Errorf("invalid compressor attack %v or release %v", c.Attack, c.Release)
+		}
+		if c.Makeup < 0 || c.Makeup > 36 {
+			return errors.Errorf("invalid compressor makeup %v", c.Makeup)
+		}
+	}
+
+	if l := v.Loudnorm; l != nil {
+		if l.Integrated != 0 && (l.Integrated < -70 || l.Integrated > -5) {
+			return errors.Errorf("invalid loudnorm i %v", l.Integrated)
+		}
+		if l.TruePeak < -9 || l.TruePeak > 0 {
+			return errors.Errorf("invalid loudnorm tp %v", l.TruePeak)
+		}
+		if l.Range != 0 && (l.Range < 1 || l.Range > 50) {
+			return errors.Errorf("invalid loudnorm lra %v", l.Range)
+		}
+	}
+
+	if l := v.Limiter; l != nil && (l.Limit < -30 || l.Limit > 0) {
+		return errors.Errorf("invalid limiter %v", l.Limit)
+	}
+
+	switch v.SampleRate {
+	case 0, 8000, 16000, 22050, 32000, 44100, 48000:
+	default:
+		return errors.Errorf("invalid sample rate %v", v.SampleRate)
+	}
+	return nil
+}
+
+// target is the integrated loudness target in LUFS, 0 if no loudnorm.
+func (v *TranscodeAudio) target() float64 {
+	if v.Loudnorm == nil {
+		return 0
+	}
+	if v.Loudnorm.Integrated == 0 {
+		return -23
+	}
+	return v.Loudnorm.Integrated
+}
+
+// Filters build the filters of audio processing chain, without the monitor.
+func (v *TranscodeAudio) Filters() []string {
+	var filters []string
+
+	// Convert to stereo before pan, because the c1 doesn't exist for mono input.
+	switch v.Channels {
+	case TranscodeAudioChannelsMono:
+		filters = append(filters, "aformat=channel_layouts=stereo", "pan=mono|c0=0.5*c0+0.5*c1")
+	case TranscodeAudioChannelsStereo:
+		filters = append(filters, "aformat=channel_layouts=stereo")
+	case TranscodeAudioChannelsLeft:
+		filters = append(filters, "aformat=channel_layouts=stereo", "pan=stereo|c0=c0|c1=c0")
+	case TranscodeAudioChannelsRight:
+		filters = append(filters, "aformat=channel_layouts=stereo", "pan=stereo|c0=c1|c1=c1")
+	case TranscodeAudioChannelsSwap:
+		filters = append(filters, "aformat=channel_layouts=stereo", "pan=stereo|c0=c1|c1=c0")
+	}
+
+	if c := v.Compressor; c != nil {
+		threshold, ratio, attack, release := c.Threshold, c.Ratio, c.Attack, c.Release
+		if threshold == 0 {
+			threshold = -18
+		}
+		if ratio == 0 {
+			ratio = 3
+		}
+		if attack == 0 {
+			attack = 20
+		}
+		if release == 0 {
+			release = 250
+		}
+		filter := fmt.Sprintf("acompressor=threshold=%vdB:ratio=%v:attack=%v:release=%v",
+			threshold, ratio, attack, release,
+		)
+		if c.Makeup > 0 {
+			filter += fmt.Sprintf(":makeup=%vdB", c.Makeup)
+		}
+		filters = append(filters, filter)
+	}
+
+	if l := v.Loudnorm; l != nil {
+		truePeak, lra := l.TruePeak, l.Range
+		if truePeak == 0 {
+			truePeak = -1.5
+		}
+		if lra == 0 {
+			lra = 11
+		}
+		filters = append(filters, fmt.Sprintf("loudnorm=I=%v:TP=%v:LRA=%v", v.target(), truePeak, lra))
+	}
+
+	if l := v.Limiter; l != nil {
+		limit := l.Limit
+		if limit == 0 {
+			limit = -1
+		}
+		filters = append(filters, fmt.Sprintf("alimiter=limit=%vdB", limit))
+	}
+
+	// The loudnorm upsamples to 192kHz, so we must resample it for encoder.
+	if sampleRate := v.SampleRate; sampleRate > 0 || v.Loudnorm != nil {
+		if sampleRate == 0 {
+			sampleRate = 48000
+		}
+		filters = append(filters, fmt.Sprintf("aresample=%v", sampleRate))
+	}
+
+	return filters
+}
+
+// TranscodeAudioFilter build the audio filter of transcoding, by the audio processing chain, or the
+// loudness of profile if no loudnorm in chain. Append the ebur128 to measure the loudness if monitor.
+func TranscodeAudioFilter(profile *EncodeProfile, audio *TranscodeAudio, monitor bool) string {
+	if audio == nil {
+		return profile.AudioFilter()
+	}
+
+	filters := audio.Filters()
+	if audio.Loudnorm == nil && profile.Loudness != 0 {
+		filters = append([]string{profile.loudnormFilter()}, filters...)
+		// Resample after loudnorm, if not resampled by the chain.
+		if audio.SampleRate == 0 {
+			filters = append(filters, fmt.Sprintf("aresample=%v", profile.sampleRate()))
+		}
+	}
+	if monitor && audio.Monitor {
+		filters = append(filters, "ebur128=framelog=info")
+	}
+	return strings.Join(filters, ",")
+}
+
+var ebur128LogRegex = regexp.MustCompile(`M:\s*(\S+)\s+S:\s*(\S+)\s+I:\s*(\S+)\s+LUFS\s+LRA:\s*(\S+)\s+LU`)
+
+// ParseEbur128Log parse the momentary, short-term, integrated loudness and loudness range from the
+// frame log of ebur128 filter, use the last one if there are multiple lines, for example:
+//
+//	[Parsed_ebur128_0 @ 0x5581] t: 9.1 TARGET:-23 LUFS M: -22.8 S: -23.1 I: -23.0 LUFS LRA: 2.1 LU
+func ParseEbur128Log(line string) (m, s, i, lra float64, err error) {
+	matches := ebur128LogRegex.FindAllStringSubmatch(line, -1)
+	if len(matches) == 0 {
+		err = errors.Errorf("parse %v failed", line)
+		return
+	}
+
+	match := matches[len(matches)-1]
+	var values []float64
+	for _, value := range match[1:] {
+		fv, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return 0, 0, 0, 0, errors.Wrapf(err, "parse %v of %v", value, line)
+		}
+		// Ignore the -inf for silence, which is not allowed by JSON.
+		if math.IsInf(fv, 0) || math.IsNaN(fv) {
+			fv = -120
+		}
+		values = append(values, fv)
+	}
+	m, s, i, lra = values[0], values[1], values[2], values[3]
+	return
+}
+
+// LoudnessSession is the loudness measurement of a stream session of transcoding.
+type LoudnessSession struct {
+	// The session ID, a stream session is from the start to the end of a FFmpeg process.
+	ID string `json:"id"`
+	// The UUID of transcode task.
+	Task string `json:"task"`
+	// The input stream URL, for example, /live/livestream
+	Stream string `json:"stream"`
+	// The integrated loudness target in LUFS, 0 if no loudnorm.
+	Target float64 `json:"target,omitempty"`
+	// The integrated loudness in LUFS of the whole session.
+	Integrated float64 `json:"integrated"`
+	// The momentary(400ms) and short-term(3s) loudness in LUFS.
+	Momentary float64 `json:"momentary"`
+	ShortTerm float64 `json:"shortTerm"`
+	// The loudness range in LU.
+	Range float64 `json:"lra"`
+	// The start and update time.
+	StartedAt string `json:"started_at"`
+	UpdatedAt string `json:"updated_at"`
+
+	// The last time saved to redis.
+	saved time.Time
+	// To protect the fields.
+	lock sync.Mutex
+}
+
+func NewLoudnessSession(task, stream string, target float64) *LoudnessSession {
+	return &LoudnessSession{
+		ID: uuid.NewString(), Task: task, Stream: stream, Target: target,
+		StartedAt: time.Now().Format(time.RFC3339),
+	}
+}
+
+func (v *LoudnessSession) String() string {
+	return fmt.Sprintf("id=%v, task=%v, stream=%v, target=%v, i=%v, m=%v, s=%v, lra=%v",
+		v.ID, v.Task, v.Stream, v.Target, v.Integrated, v.Momentary, v.ShortTerm, v.Range,
+	)
+}
+
+// Update the loudness by the FFmpeg log, return false if not the log of ebur128.
+func (v *LoudnessSession) Update(ctx context.Context, line string) bool {
+	if !strings.Contains(line, "ebur128") {
+		return false
+	}
+
+	m, s, i, lra, err := ParseEbur128Log(line)
+	if err != nil {
+		return true
+	}
+
+	v.lock.Lock()
+	v.Momentary, v.ShortTerm, v.Integrated, v.Range = m, s, i, lra
+	v.UpdatedAt = time.Now().Format(time.RFC3339)
+	shouldSave := time.Since(v.saved) > 10*time.Second
+	if shouldSave {
+		v.saved = time.Now()
+	}
+	v.lock.Unlock()
+
+	if shouldSave {
+		if err := v.Save(ctx); err != nil {
+			logger.Wf(ctx, "save loudness %v err %+v", v.String(), err)
+		}
+	}
+	return true
+}
+
+// Save the session to redis, and remove the oldest sessions.
+func (v *LoudnessSession) Save(ctx context.Context) error {
+	v.lock.Lock()
+	b, err := json.Marshal(v)
+	v.lock.Unlock()
+	if err != nil {
+		return errors.Wrapf(err, "marshal %v", v.String())
+	}
+
+	if err := rdb.HSet(ctx, SRS_TRANSCODE_LOUDNESS, v.ID, string(b)).Err(); err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hset %v %v %v", SRS_TRANSCODE_LOUDNESS, v.ID, string(b))
+	}
+
+	sessions, err := loadLoudnessSessions(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "load sessions")
+	}
+	for i := maxLoudnessSessions; i < len(sessions); i++ {
+		if err := rdb.HDel(ctx, SRS_TRANSCODE_LOUDNESS, sessions[i].ID).Err(); err != nil && err != redis.Nil {
+			return errors.Wrapf(err, "hdel %v %v", SRS_TRANSCODE_LOUDNESS, sessions[i].ID)
+		}
+	}
+	return nil
+}
+
+// loadLoudnessSessions load the sessions, the latest is the first.
+func loadLoudnessSessions(ctx context.Context) ([]*LoudnessSession, error) {
+	objs, err := rdb.HGetAll(ctx, SRS_TRANSCODE_LOUDNESS).Result()
+	if err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hgetall %v", SRS_TRANSCODE_LOUDNESS)
+	}
+
+	sessions := make([]*LoudnessSession, 0)
+	for id, obj := range objs {
+		var session LoudnessSession
+		if err := json.Unmarshal([]byte(obj), &session); err != nil {
+			return nil, errors.Wrapf(err, "unmarshal %v %v", id, obj)
+		}
+		sessions = append(sessions, &session)
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].StartedAt > sessions[j].StartedAt
+	})
+	return sessions, nil
+}
+
+func (v *TranscodeWorker) handleLoudness(ctx context.Context, handler *http.ServeMux) error {
+	ep := "/terraform/v1/ffmpeg/transcode/loudness/query"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := func() error {
+			var token, stream string
+			if err := ParseBody(ctx, r.Body, &struct {
+				Token  *string `json:"token"`
+				Stream *string `json:"stream"`
+			}{
+				Token: &token, Stream: &stream,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			sessions, err := loadLoudnessSessions(ctx)
+			if err != nil {
+				return errors.Wrapf(err, "load sessions")
+			}
+
+			// Filter by the stream URL, for example, /live/livestream
+			if stream != "" {
+				matched := make([]*LoudnessSession, 0)
+				for _, session := range sessions {
+					if session.Stream == stream {
+						matched = append(matched, session)
+					}
+				}
+				sessions = matched
+			}
+
+			ohttp.WriteData(ctx, w, r, &struct {
+				Sessions []*LoudnessSession `json:"sessions"`
+			}{
+				Sessions: sessions,
+			})
+			logger.Tf(ctx, "transcode loudness query ok, stream=%v, sessions=%v, token=%vB",
+				stream, len(sessions), len(token))
+			return nil
+		}(); err != nil {
+			ohttp.WriteError(ctx, w, r, err)
+		}
+	})
+
+	return nil
+}
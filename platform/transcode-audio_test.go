@@ -0,0 +1,78 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTranscodeAudio_Filter(t *testing.T) {
+	audio := &TranscodeAudio{
+		Channels: TranscodeAudioChannelsLeft, Compressor: &TranscodeCompressor{},
+		Loudnorm: &TranscodeLoudnorm{Integrated: -16}, Limiter: &TranscodeLimiter{}, Monitor: true,
+	}
+	if err := audio.Validate(); err != nil {
+		t.Errorf("validate err %+v", err)
+	}
+
+	profile := &EncodeProfile{AudioCodec: "aac", AudioBitrate: 64, Loudness: -23}
+	filter := TranscodeAudioFilter(profile, audio, true)
+	expect := strings.Join([]string{
+		"aformat=channel_layouts=stereo",
+		"pan=stereo|c0=c0|c1=c0",
+		"acompressor=threshold=-18dB:ratio=3:attack=20:release=250",
+		"loudnorm=I=-16:TP=-1.5:LRA=11",
+		"alimiter=limit=-1dB",
+		"aresample=48000",
+		"ebur128=framelog=info",
+	}, ",")
+	if filter != expect {
+		t.Errorf("invalid filter %v, expect %v", filter, expect)
+	}
+
+	// Should use the loudness of profile, if no loudnorm in chain.
+	audio = &TranscodeAudio{SampleRate: 44100, Monitor: true}
+	if filter := TranscodeAudioFilter(profile, audio, false); filter != "loudnorm=I=-23:TP=-1.5:LRA=11,aresample=44100" {
+		t.Errorf("invalid filter %v", filter)
+	}
+	if filter := TranscodeAudioFilter(profile, nil, true); filter != "loudnorm=I=-23:TP=-1.5:LRA=11,aresample=48000" {
+		t.Errorf("invalid filter %v", filter)
+	}
+	audio = &TranscodeAudio{Limiter: &TranscodeLimiter{}}
+	if filter := TranscodeAudioFilter(profile, audio, false); filter != "loudnorm=I=-23:TP=-1.5:LRA=11,alimiter=limit=-1dB,aresample=48000" {
+		t.Errorf("invalid filter %v", filter)
+	}
+
+	for _, audio := range []*TranscodeAudio{
+		{Channels: "5.1"},
+		{SampleRate: 96000},
+		{Loudnorm: &TranscodeLoudnorm{Integrated: -2}},
+		{Compressor: &TranscodeCompressor{Ratio: 0.5}},
+		{Limiter: &TranscodeLimiter{Limit: 1}},
+	} {
+		if err := audio.Validate(); err == nil {
+			t.Errorf("should fail %v", audio.String())
+		}
+	}
+}
+
+func TestTranscodeAudio_ParseEbur128(t *testing.T) {
+	line := "[Parsed_ebur128_5 @ 0x5581] t: 9.0 TARGET:-23 LUFS M: -22.9 S: -23.5 I: -24.0 LUFS LRA: 1.9 LU " +
+		"[Parsed_ebur128_5 @ 0x5581] t: 9.1 TARGET:-23 LUFS M: -22.8 S: -23.1 I: -23.0 LUFS LRA: 2.1 LU"
+	m, s, i, lra, err := ParseEbur128Log(line)
+	if err != nil {
+		t.Errorf("parse err %+v", err)
+	}
+	if m != -22.8 || s != -23.1 || i != -23.0 || lra != 2.1 {
+		t.Errorf("invalid m=%v, s=%v, i=%v, lra=%v", m, s, i, lra)
+	}
+
+	if _, _, i, _, err := ParseEbur128Log("t: 0.1 TARGET:-23 LUFS M: -inf S: -inf I: -70.0 LUFS LRA: 0.0 LU"); err != nil || i != -70 {
+		t.Errorf("parse silence err %+v, i=%v", err, i)
+	}
+	if _, _, _, _, err := ParseEbur128Log("frame=1 fps=0.0 q=0.0 size=0kB time=00:00:00.00 speed=0x"); err == nil {
+		t.Errorf("should fail for cycle log")
+	}
+}
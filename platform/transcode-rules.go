@@ -0,0 +1,450 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/ossrs/go-oryx-lib/errors"
+	ohttp "github.com/ossrs/go-oryx-lib/http"
+	"github.com/ossrs/go-oryx-lib/logger"
+
+	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+)
+
+// TranscodeRule match streams by app/stream glob or live room, and transcode each matched stream by a
+// dedicated task, instead of the global task which only transcode the latest stream.
+type TranscodeRule struct {
+	// The rule ID.
+	ID string `json:"id"`
+	// Whether enabled.
+	Enabled bool `json:"enabled"`
+	// The glob to match app/stream, for example, live/* or live/camera-*
+	Match string `json:"match,omitempty"`
+	// Or the UUID of live room, to match the stream of room.
+	Room string `json:"room,omitempty"`
+	// The RTMP server url, for example, rtmp://localhost/live
+	Server string `json:"server"`
+	// The RTMP stream and secret, the {app} and {stream} is replaced by the input stream, for example,
+	// {stream}_hd?secret=xxx
+	Secret string `json:"secret"`
+	// The encoder settings.
+	TranscodeEncoder
+	// The renditions of ABR ladder, optional.
+	Renditions []*TranscodeRendition `json:"renditions,omitempty"`
+	// The audio processing chain, optional.
+	Audio *TranscodeAudio `json:"audio,omitempty"`
+}
+
+func (v *TranscodeRule) String() string {
+	return fmt.Sprintf("id=%v, enabled=%v, match=%v, room=%v, server=%v, secret=%v, %v, renditions=%v",
+		v.ID, v.Enabled, v.Match, v.Room, v.Server, v.Secret, v.TranscodeEncoder.String(), len(v.Renditions),
+	)
+}
+
+func (v *TranscodeRule) Validate(ctx context.Context) error {
+	if v.Match == "" && v.Room == "" {
+		return errors.New("no match or room")
+	}
+	if v.Match != "" && v.Room != "" {
+		return errors.Errorf("both match %v and room %v", v.Match, v.Room)
+	}
+	if v.Match != "" {
+		if _, err := path.Match(v.Match, "live/livestream"); err != nil {
+			return errors.Wrapf(err, "invalid match %v", v.Match)
+		}
+		// Each matched stream should be transcoded to different stream.
+		if strings.ContainsAny(v.Match, "*?[") && !strings.Contains(v.Secret, "{stream}") {
+			return errors.Errorf("secret %v should contain {stream} for glob %v", v.Secret, v.Match)
+		}
+	}
+
+	if v.Server == "" || v.Secret == "" {
+		return errors.Errorf("no server %v or secret %v", v.Server, v.Secret)
+	}
+	if err := v.TranscodeEncoder.Validate(ctx); err != nil {
+		return errors.Wrapf(err, "encoder")
+	}
+
+	config := TranscodeConfig{Renditions: v.Renditions}
+	if err := config.validateRenditions(); err != nil {
+		return errors.Wrapf(err, "renditions")
+	}
+	if v.Audio != nil {
+		if err := v.Audio.Validate(); err != nil {
+			return errors.Wrapf(err, "audio")
+		}
+	}
+	return nil
+}
+
+// Matches whether the rule matches the stream, the room is the stream name of the live room.
+func (v *TranscodeRule) Matches(stream *SrsStream, room string) bool {
+	if !v.Enabled {
+		return false
+	}
+	if v.Room != "" {
+		return room != "" && stream.Stream == room
+	}
+
+	matched, err := path.Match(v.Match, fmt.Sprintf("%v/%v", stream.App, stream.Stream))
+	return err == nil && matched
+}
+
+// Config build the transcode config for the stream.
+func (v *TranscodeRule) Config(stream *SrsStream) TranscodeConfig {
+	secret := strings.ReplaceAll(v.Secret, "{app}", stream.App)
+	secret = strings.ReplaceAll(secret, "{stream}", stream.Stream)
+
+	return TranscodeConfig{
+		All: true, TranscodeEncoder: v.TranscodeEncoder, Server: v.Server, Secret: secret,
+		Renditions: v.Renditions, Audio: v.Audio,
+	}
+}
+
+// The paths of output streams, for example, /live/livestream_hd, to ignore the transcoded streams.
+func (v *TranscodeConfig) outputPaths() []string {
+	outputURL := fmt.Sprintf("%v/%v", strings.TrimSuffix(v.Server, "/"), strings.TrimPrefix(v.Secret, "/"))
+
+	var urls []string
+	if v.abrEnabled() {
+		for _, rendition := range v.Renditions {
+			urls = append(urls, TranscodeRenditionURL(outputURL, rendition.Name))
+		}
+	} else {
+		urls = append(urls, outputURL)
+	}
+
+	var paths []string
+	for _, u := range urls {
+		if pu, err := url.Parse(u); err == nil {
+			paths = append(paths, path.Clean(pu.Path))
+		}
+	}
+	return paths
+}
+
+// TranscodeOutputs get the paths of output streams of the global config and all rules, which should
+// never be transcoded again, or the same stream might be transcoded twice or recursively.
+func TranscodeOutputs(global *TranscodeConfig, rules *TranscodeRules, streams []*SrsStream) map[string]bool {
+	outputs := make(map[string]bool)
+	if global != nil && global.All {
+		for _, p := range global.outputPaths() {
+			outputs[p] = true
+		}
+	}
+
+	for _, stream := range streams {
+		for _, rule := range rules.Rules {
+			config := rule.Config(stream)
+			for _, p := range config.outputPaths() {
+				outputs[p] = true
+			}
+		}
+	}
+	return outputs
+}
+
+// transcodeStreamPath get the path of stream, to match the paths of outputs.
+func transcodeStreamPath(stream *SrsStream) string {
+	return path.Clean(fmt.Sprintf("/%v/%v", stream.App, stream.Stream))
+}
+
+// TranscodeRules is the rules to transcode streams, with a concurrency limit.
+type TranscodeRules struct {
+	// The max number of transcode tasks, default to 2.
+	Limit int `json:"limit"`
+	// The rules, the first matched rule is used for a stream.
+	Rules []*TranscodeRule `json:"rules"`
+}
+
+func (v *TranscodeRules) String() string {
+	return fmt.Sprintf("limit=%v, rules=%v", v.Limit, len(v.Rules))
+}
+
+func (v *TranscodeRules) Validate(ctx context.Context) error {
+	if v.Limit < 0 || v.Limit > 32 {
+		return errors.Errorf("invalid limit %v", v.Limit)
+	}
+
+	ids := make(map[string]bool)
+	for _, rule := range v.Rules {
+		if rule.ID == "" {
+			rule.ID = uuid.NewString()
+		}
+		if ids[rule.ID] {
+			return errors.Errorf("duplicated rule %v", rule.ID)
+		}
+		ids[rule.ID] = true
+
+		if err := rule.Validate(ctx); err != nil {
+			return errors.Wrapf(err, "validate rule %v", rule.String())
+		}
+	}
+	return nil
+}
+
+func (v *TranscodeRules) limit() int {
+	if v.Limit <= 0 {
+		return 2
+	}
+	return v.Limit
+}
+
+func loadTranscodeConfig(ctx context.Context) (*TranscodeConfig, error) {
+	var config TranscodeConfig
+	if b, err := rdb.HGet(ctx, SRS_TRANSCODE_CONFIG, "global").Result(); err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hget %v global", SRS_TRANSCODE_CONFIG)
+	} else if len(b) > 0 {
+		if err := json.Unmarshal([]byte(b), &config); err != nil {
+			return nil, errors.Wrapf(err, "unmarshal %v", b)
+		}
+	}
+	return &config, nil
+}
+
+func loadTranscodeRules(ctx context.Context) (*TranscodeRules, error) {
+	rules := &TranscodeRules{Rules: []*TranscodeRule{}}
+	if b, err := rdb.HGet(ctx, SRS_TRANSCODE_CONFIG, "rules").Result(); err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hget %v rules", SRS_TRANSCODE_CONFIG)
+	} else if len(b) > 0 {
+		if err := json.Unmarshal([]byte(b), rules); err != nil {
+			return nil, errors.Wrapf(err, "unmarshal %v", b)
+		}
+	}
+	return rules, nil
+}
+
+func (v *TranscodeWorker) handleRules(ctx context.Context, handler *http.ServeMux) error {
+	ep := "/terraform/v1/ffmpeg/transcode/rules/query"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := func() error {
+			var token string
+			if err := ParseBody(ctx, r.Body, &struct {
+				Token *string `json:"token"`
+			}{
+				Token: &token,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			rules, err := loadTranscodeRules(ctx)
+			if err != nil {
+				return errors.Wrapf(err, "load rules")
+			}
+
+			ohttp.WriteData(ctx, w, r, rules)
+			logger.Tf(ctx, "transcode rules query ok, %v, token=%vB", rules.String(), len(token))
+			return nil
+		}(); err != nil {
+			ohttp.WriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/terraform/v1/ffmpeg/transcode/rules/apply"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := func() error {
+			var token string
+			var rules TranscodeRules
+			if err := ParseBody(ctx, r.Body, &struct {
+				Token *string `json:"token"`
+				*TranscodeRules
+			}{
+				Token: &token, TranscodeRules: &rules,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			if err := rules.Validate(ctx); err != nil {
+				return errors.Wrapf(err, "validate %v", rules.String())
+			}
+
+			if b, err := json.Marshal(&rules); err != nil {
+				return errors.Wrapf(err, "marshal %v", rules.String())
+			} else if err := rdb.HSet(ctx, SRS_TRANSCODE_CONFIG, "rules", string(b)).Err(); err != nil && err != redis.Nil {
+				return errors.Wrapf(err, "hset %v rules %v", SRS_TRANSCODE_CONFIG, string(b))
+			}
+
+			// Wakeup the worker to apply the rules.
+			select {
+			case v.notify <- struct{}{}:
+			default:
+			}
+
+			ohttp.WriteData(ctx, w, r, &rules)
+			logger.Tf(ctx, "transcode rules apply ok, %v, token=%vB", rules.String(), len(token))
+			return nil
+		}(); err != nil {
+			ohttp.WriteError(ctx, w, r, err)
+		}
+	})
+
+	return nil
+}
+
+// Get the tasks of rules, sorted by input stream.
+func (v *TranscodeWorker) ruleTasks() []*TranscodeTask {
+	var tasks []*TranscodeTask
+	v.streams.Range(func(key, value interface{}) bool {
+		tasks = append(tasks, value.(*TranscodeTask))
+		return true
+	})
+
+	sort.Slice(tasks, func(i, j int) bool {
+		return tasks[i].inputStreamURL < tasks[j].inputStreamURL
+	})
+	return tasks
+}
+
+// Apply the rules to active streams, start task for new matched stream, and stop task for stream which
+// is unpublished or the rule is changed.
+func (v *TranscodeWorker) applyRules(ctx context.Context) error {
+	rules, err := loadTranscodeRules(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "load rules")
+	}
+
+	global, err := loadTranscodeConfig(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "load global")
+	}
+
+	items, err := rdb.HGetAll(ctx, SRS_STREAM_ACTIVE).Result()
+	if err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hgetall %v", SRS_STREAM_ACTIVE)
+	}
+
+	var streams []*SrsStream
+	for _, item := range items {
+		var stream SrsStream
+		if err := json.Unmarshal([]byte(item), &stream); err != nil {
+			return errors.Wrapf(err, "unmarshal %v", item)
+		}
+		streams = append(streams, &stream)
+	}
+	sort.Slice(streams, func(i, j int) bool {
+		return streams[i].StreamURL() < streams[j].StreamURL()
+	})
+
+	// Load the stream name of live rooms.
+	rooms := make(map[string]string)
+	for _, rule := range rules.Rules {
+		if rule.Room == "" {
+			continue
+		}
+		if b, err := rdb.HGet(ctx, SRS_LIVE_ROOM, rule.Room).Result(); err != nil && err != redis.Nil {
+			return errors.Wrapf(err, "hget %v %v", SRS_LIVE_ROOM, rule.Room)
+		} else if len(b) > 0 {
+			var room SrsLiveRoom
+			if err := json.Unmarshal([]byte(b), &room); err != nil {
+				return errors.Wrapf(err, "unmarshal %v", b)
+			}
+			rooms[rule.Room] = room.StreamName
+		}
+	}
+
+	// The output streams of global and all rules, which should never be transcoded again.
+	outputs := TranscodeOutputs(global, rules, streams)
+
+	// Match the stream to the first rule.
+	type matchedStream struct {
+		stream      *SrsStream
+		config      TranscodeConfig
+		rule        string
+		fingerprint string
+	}
+	var matches []*matchedStream
+	for _, stream := range streams {
+		if outputs[transcodeStreamPath(stream)] {
+			continue
+		}
+
+		for _, rule := range rules.Rules {
+			if !rule.Matches(stream, rooms[rule.Room]) {
+				continue
+			}
+
+			config := rule.Config(stream)
+			b, _ := json.Marshal(&config)
+			matches = append(matches, &matchedStream{
+				stream: stream, config: config, rule: rule.ID, fingerprint: string(b),
+			})
+			break
+		}
+	}
+
+	// Stop the task which is not matched, or the rule is changed.
+	v.streams.Range(func(key, value interface{}) bool {
+		task := value.(*TranscodeTask)
+
+		var found bool
+		for _, m := range matches {
+			if m.stream.StreamURL() == key.(string) && m.rule == task.Rule && m.fingerprint == task.fingerprint {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			logger.Tf(ctx, "transcode: stop rule task %v", task.String())
+			task.stop()
+			v.streams.Delete(key)
+		}
+		return true
+	})
+
+	// Start task for new matched stream, if not exceed the limit.
+	for _, m := range matches {
+		streamURL := m.stream.StreamURL()
+		if _, loaded := v.streams.Load(streamURL); loaded {
+			continue
+		}
+
+		if running := len(v.ruleTasks()); running >= rules.limit() {
+			logger.Wf(ctx, "transcode: ignore stream %v of rule %v, running=%v, limit=%v",
+				streamURL, m.rule, running, rules.limit())
+			continue
+		}
+
+		taskCtx, taskCancel := context.WithCancel(ctx)
+		task := NewTranscodeTask()
+		task.Rule, task.config, task.fingerprint = m.rule, m.config, m.fingerprint
+		task.inputStreamURL, task.stop, task.transcodeWorker = streamURL, taskCancel, v
+		v.streams.Store(streamURL, task)
+		logger.Tf(ctx, "transcode: start rule task %v", task.String())
+
+		v.wg.Add(1)
+		go func(stream *SrsStream) {
+			defer v.wg.Done()
+			defer taskCancel()
+
+			if err := task.RunStream(taskCtx, stream); err != nil {
+				logger.Wf(ctx, "run task %v err %+v", task.String(), err)
+			}
+		}(m.stream)
+	}
+
+	return nil
+}
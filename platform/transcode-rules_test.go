@@ -0,0 +1,95 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestTranscodeRules_Matches(t *testing.T) {
+	rule := &TranscodeRule{Enabled: true, Match: "live/camera-*"}
+	if !rule.Matches(&SrsStream{App: "live", Stream: "camera-1"}, "") {
+		t.Errorf("should match")
+	}
+	if rule.Matches(&SrsStream{App: "live", Stream: "livestream"}, "") {
+		t.Errorf("should not match")
+	}
+
+	rule = &TranscodeRule{Enabled: true, Room: "room-uuid"}
+	if !rule.Matches(&SrsStream{App: "live", Stream: "abc"}, "abc") {
+		t.Errorf("should match room")
+	}
+	if rule.Matches(&SrsStream{App: "live", Stream: "abc"}, "") {
+		t.Errorf("should not match removed room")
+	}
+
+	rule.Enabled = false
+	if rule.Matches(&SrsStream{App: "live", Stream: "abc"}, "abc") {
+		t.Errorf("should not match disabled rule")
+	}
+}
+
+func TestTranscodeRules_Config(t *testing.T) {
+	rule := &TranscodeRule{Enabled: true, Match: "live/*", Server: "rtmp://localhost/live", Secret: "{stream}_hd?secret=xxx"}
+	config := rule.Config(&SrsStream{App: "live", Stream: "livestream"})
+	if config.Secret != "livestream_hd?secret=xxx" || !config.All {
+		t.Errorf("invalid config %v", config.String())
+	}
+	if paths := config.outputPaths(); strings.Join(paths, ",") != "/live/livestream_hd" {
+		t.Errorf("invalid paths %v", paths)
+	}
+
+	config.Renditions = []*TranscodeRendition{{Name: "720p"}, {Name: "audio"}}
+	if paths := config.outputPaths(); strings.Join(paths, ",") != "/live/livestream_hd_720p,/live/livestream_hd_audio" {
+		t.Errorf("invalid paths %v", paths)
+	}
+}
+
+func TestTranscodeRules_Validate(t *testing.T) {
+	encoder := TranscodeEncoder{VideoCodec: "libx264", AudioCodec: "aac", VideoBitrate: 1000, AudioBitrate: 64}
+	rules := &TranscodeRules{Rules: []*TranscodeRule{
+		{Match: "live/*", Server: "rtmp://localhost/live", Secret: "{stream}_hd", TranscodeEncoder: encoder},
+	}}
+	if err := rules.Validate(context.Background()); err != nil {
+		t.Errorf("validate err %+v", err)
+	} else if rules.Rules[0].ID == "" || rules.limit() != 2 {
+		t.Errorf("invalid default %v", rules.String())
+	}
+
+	rules.Rules[0].Secret = "hd"
+	if err := rules.Validate(context.Background()); err == nil {
+		t.Errorf("should fail for glob without {stream}")
+	}
+
+	rules.Rules[0].Secret, rules.Rules[0].Room = "{stream}_hd", "room-uuid"
+	if err := rules.Validate(context.Background()); err == nil {
+		t.Errorf("should fail for both match and room")
+	}
+}
+
+func TestTranscodeRules_TranscodeOutputs(t *testing.T) {
+	global := &TranscodeConfig{All: true, Server: "rtmp://localhost/live", Secret: "global"}
+	rules := &TranscodeRules{Rules: []*TranscodeRule{
+		{Enabled: true, Match: "live/*", Server: "rtmp://localhost/live", Secret: "{stream}_hd"},
+	}}
+	streams := []*SrsStream{{App: "live", Stream: "livestream"}, {App: "live", Stream: "global"}}
+
+	outputs := TranscodeOutputs(global, rules, streams)
+	for _, stream := range []*SrsStream{{App: "live", Stream: "global"}, {App: "live", Stream: "livestream_hd"}, {App: "live", Stream: "global_hd"}} {
+		if !outputs[transcodeStreamPath(stream)] {
+			t.Errorf("stream %v should be output of %v", transcodeStreamPath(stream), outputs)
+		}
+	}
+	if outputs[transcodeStreamPath(streams[0])] {
+		t.Errorf("stream %v should not be output", transcodeStreamPath(streams[0]))
+	}
+
+	// The global config is ignored if disabled.
+	global.All = false
+	if outputs = TranscodeOutputs(global, rules, streams[:1]); outputs["/live/global"] || !outputs["/live/livestream_hd"] {
+		t.Errorf("invalid outputs %v", outputs)
+	}
+}
@@ -0,0 +1,545 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ossrs/go-oryx-lib/errors"
+	ohttp "github.com/ossrs/go-oryx-lib/http"
+	"github.com/ossrs/go-oryx-lib/logger"
+
+	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+)
+
+var uploadWorker *UploadWorker
+
+// The tus protocol version, see https://tus.io/protocols/resumable-upload
+const tusVersion = "1.0.0"
+
+// UploadWorker is the resumable upload service, compatible with tus protocol, shared by vLive, dubbing
+// and AI talk. The uploaded file is in dirUploadPath, the same as the single request upload.
+type UploadWorker struct {
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	// The lock for each upload, key is upload UUID in string, value is *sync.Mutex.
+	locks sync.Map
+}
+
+func NewUploadWorker() *UploadWorker {
+	return &UploadWorker{}
+}
+
+func (v *UploadWorker) Handle(ctx context.Context, handler *http.ServeMux) error {
+	// The tus endpoint, for example:
+	//		POST /terraform/v1/uploads/ to create an upload.
+	//		HEAD /terraform/v1/uploads/:uuid to query the offset.
+	//		PATCH /terraform/v1/uploads/:uuid to upload a chunk at offset.
+	//		DELETE /terraform/v1/uploads/:uuid to terminate the upload.
+	//		GET /terraform/v1/uploads/:uuid to query the upload in JSON, for the target file.
+	// Note that the bearer token in Authorization header is preferred, and the token in query is also supported.
+	// For room users of AI talk, use the room and roomToken in query, and the upload is bound to the room.
+	ep := "/terraform/v1/uploads/"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := func(ctx context.Context) error {
+			w.Header().Set("Tus-Resumable", tusVersion)
+
+			// Allow client to discover the server configuration without authentication.
+			if r.Method == http.MethodOptions {
+				w.Header().Set("Tus-Version", tusVersion)
+				w.Header().Set("Tus-Extension", "creation,expiration,checksum,termination")
+				w.Header().Set("Tus-Checksum-Algorithm", "md5,sha1,sha256")
+				w.WriteHeader(http.StatusNoContent)
+				return nil
+			}
+
+			owner, err := authenticateUpload(ctx, r)
+			if err != nil {
+				return newUploadError(http.StatusUnauthorized, "authenticate, %v", err)
+			}
+
+			uploadUUID := r.URL.Path[len("/terraform/v1/uploads/"):]
+			if r.Method == http.MethodPost {
+				if uploadUUID != "" {
+					return newUploadError(http.StatusMethodNotAllowed, "create with uuid %v", uploadUUID)
+				}
+				return v.handleCreate(ctx, w, r, owner)
+			}
+
+			if uploadUUID == "" || strings.Contains(uploadUUID, "/") {
+				return newUploadError(http.StatusNotFound, "invalid uuid %v", uploadUUID)
+			}
+
+			// Serialize the requests of the same upload.
+			lock, _ := v.locks.LoadOrStore(uploadUUID, &sync.Mutex{})
+			lock.(*sync.Mutex).Lock()
+			defer lock.(*sync.Mutex).Unlock()
+
+			upload, err := loadUploadObject(ctx, uploadUUID)
+			if err != nil {
+				return errors.Wrapf(err, "load upload %v", uploadUUID)
+			}
+			if upload == nil || upload.Expired() {
+				return newUploadError(http.StatusNotFound, "no upload %v", uploadUUID)
+			}
+			// The room user is only allowed to access the upload of room, while API secret allows all.
+			if owner != "" && upload.Owner != owner {
+				return newUploadError(http.StatusNotFound, "no upload %v of %v", uploadUUID, owner)
+			}
+
+			switch r.Method {
+			case http.MethodHead:
+				upload.WriteHeader(w)
+				w.Header().Set("Cache-Control", "no-store")
+				w.WriteHeader(http.StatusOK)
+				return nil
+			case http.MethodGet:
+				ohttp.WriteData(ctx, w, r, upload)
+				return nil
+			case http.MethodPatch:
+				return v.handlePatch(ctx, w, r, upload)
+			case http.MethodDelete:
+				if err := upload.Remove(ctx); err != nil {
+					return errors.Wrapf(err, "remove %v", upload.String())
+				}
+				v.locks.Delete(uploadUUID)
+				w.WriteHeader(http.StatusNoContent)
+				logger.Tf(ctx, "upload: Terminate %v", upload.String())
+				return nil
+			}
+
+			return newUploadError(http.StatusMethodNotAllowed, "invalid method %v", r.Method)
+		}(logger.WithContext(ctx)); err != nil {
+			if ue, ok := errors.Cause(err).(*UploadError); ok {
+				err = &UploadError{error: err, status: ue.status}
+			}
+			ohttp.WriteError(ctx, w, r, err)
+		}
+	})
+
+	return nil
+}
+
+// Create an upload, by Upload-Length and Upload-Metadata with filename.
+func (v *UploadWorker) handleCreate(ctx context.Context, w http.ResponseWriter, r *http.Request, owner string) error {
+	size, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || size <= 0 {
+		return newUploadError(http.StatusBadRequest, "invalid Upload-Length %v", r.Header.Get("Upload-Length"))
+	}
+
+	metadata, err := ParseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		return newUploadError(http.StatusBadRequest, "invalid Upload-Metadata, %v", err)
+	}
+
+	filename := metadata["filename"]
+	if filename == "" {
+		return newUploadError(http.StatusBadRequest, "no filename in Upload-Metadata")
+	}
+
+	upload := NewUploadObject(func(upload *UploadObject) {
+		upload.Name, upload.Size, upload.Owner = path.Base(filename), size, owner
+		upload.Target = path.Join(dirUploadPath, fmt.Sprintf("%v%v", upload.UUID, path.Ext(upload.Name)))
+	})
+
+	// Create an empty part file, to append chunks.
+	if f, err := os.Create(upload.partFile()); err != nil {
+		return errors.Wrapf(err, "create %v", upload.partFile())
+	} else {
+		f.Close()
+	}
+
+	if err := upload.Save(ctx); err != nil {
+		return errors.Wrapf(err, "save %v", upload.String())
+	}
+
+	upload.WriteHeader(w)
+	w.Header().Set("Location", fmt.Sprintf("/terraform/v1/uploads/%v", upload.UUID))
+	w.WriteHeader(http.StatusCreated)
+	logger.Tf(ctx, "upload: Create %v", upload.String())
+	return nil
+}
+
+// Write the chunk at Upload-Offset, verify by Upload-Checksum if specified.
+func (v *UploadWorker) handlePatch(ctx context.Context, w http.ResponseWriter, r *http.Request, upload *UploadObject) error {
+	if ct := r.Header.Get("Content-Type"); ct != "application/offset+octet-stream" {
+		return newUploadError(http.StatusUnsupportedMediaType, "invalid Content-Type %v", ct)
+	}
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		return newUploadError(http.StatusBadRequest, "invalid Upload-Offset %v", r.Header.Get("Upload-Offset"))
+	}
+	if offset != upload.Offset {
+		return newUploadError(http.StatusConflict, "offset %v mismatch %v", offset, upload.Offset)
+	}
+	if upload.Done() {
+		return newUploadError(http.StatusConflict, "upload %v is done", upload.UUID)
+	}
+
+	var checksum hash.Hash
+	var expectChecksum []byte
+	if header := r.Header.Get("Upload-Checksum"); header != "" {
+		if checksum, expectChecksum, err = ParseTusChecksum(header); err != nil {
+			return newUploadError(http.StatusBadRequest, "invalid Upload-Checksum %v, %v", header, err)
+		}
+	}
+
+	f, err := os.OpenFile(upload.partFile(), os.O_WRONLY, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "open %v", upload.partFile())
+	}
+	defer f.Close()
+
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return errors.Wrapf(err, "seek %v to %v", upload.partFile(), offset)
+	}
+
+	// Never write more than the size of upload.
+	var writer io.Writer = f
+	if checksum != nil {
+		writer = io.MultiWriter(f, checksum)
+	}
+	nn, err := io.Copy(writer, io.LimitReader(r.Body, upload.Size-offset))
+
+	// Drop the chunk if checksum mismatch, client should retry it.
+	if err == nil && checksum != nil && string(checksum.Sum(nil)) != string(expectChecksum) {
+		if err := f.Truncate(offset); err != nil {
+			return errors.Wrapf(err, "truncate %v to %v", upload.partFile(), offset)
+		}
+		return newUploadError(460, "checksum mismatch, offset=%v, size=%v", offset, nn)
+	}
+
+	// Keep the written bytes when client disconnected, to resume from the offset. However, for checksum
+	// we're unable to verify the partial chunk, so drop it.
+	if err != nil && checksum != nil {
+		f.Truncate(offset)
+		nn = 0
+	}
+
+	upload.Offset += nn
+	upload.Update = time.Now().Format(time.RFC3339)
+	if upload.Done() {
+		if err := os.Rename(upload.partFile(), upload.Target); err != nil {
+			return errors.Wrapf(err, "rename %v to %v", upload.partFile(), upload.Target)
+		}
+		logger.Tf(ctx, "upload: Done %v", upload.String())
+	}
+
+	if r0 := upload.Save(ctx); r0 != nil {
+		return errors.Wrapf(r0, "save %v", upload.String())
+	}
+	if err != nil {
+		return errors.Wrapf(err, "copy body of %v", upload.String())
+	}
+
+	upload.WriteHeader(w)
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (v *UploadWorker) Close() error {
+	if v.cancel != nil {
+		v.cancel()
+	}
+	v.wg.Wait()
+	return nil
+}
+
+func (v *UploadWorker) Start(ctx context.Context) error {
+	wg := &v.wg
+
+	ctx, cancel := context.WithCancel(ctx)
+	v.cancel = cancel
+
+	ctx = logger.WithContext(ctx)
+	logger.Tf(ctx, "upload: start a worker")
+
+	// Cleanup the expired uploads.
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		for ctx.Err() == nil {
+			if err := v.cleanup(ctx); err != nil {
+				logger.Wf(ctx, "ignore upload cleanup err %+v", err)
+			}
+
+			select {
+			case <-ctx.Done():
+			case <-time.After(60 * time.Second):
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (v *UploadWorker) cleanup(ctx context.Context) error {
+	objs, err := rdb.HGetAll(ctx, SRS_UPLOAD_TASK).Result()
+	if err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hgetall %v", SRS_UPLOAD_TASK)
+	}
+
+	for uploadUUID, obj := range objs {
+		var upload UploadObject
+		if err := json.Unmarshal([]byte(obj), &upload); err != nil {
+			return errors.Wrapf(err, "unmarshal %v %v", uploadUUID, obj)
+		}
+
+		if !upload.Expired() {
+			continue
+		}
+
+		if err := upload.Remove(ctx); err != nil {
+			return errors.Wrapf(err, "remove %v", upload.String())
+		}
+		v.locks.Delete(uploadUUID)
+		logger.Tf(ctx, "upload: Cleanup expired %v", upload.String())
+	}
+
+	return nil
+}
+
+// UploadObject is a resumable upload.
+type UploadObject struct {
+	// The upload UUID.
+	UUID string `json:"uuid"`
+	// The file name.
+	Name string `json:"name"`
+	// The total size in bytes.
+	Size int64 `json:"size"`
+	// The received size in bytes.
+	Offset int64 `json:"offset"`
+	// The target file, in dirUploadPath, only available when done.
+	Target string `json:"target"`
+	// The create time.
+	Created string `json:"created"`
+	// The last update time.
+	Update string `json:"update"`
+	// The expire time, the upload and file will be removed after it.
+	Expires string `json:"expires"`
+	// The room UUID which creates the upload by room token, empty if created by API secret.
+	Owner string `json:"owner,omitempty"`
+}
+
+func NewUploadObject(opts ...func(*UploadObject)) *UploadObject {
+	v := &UploadObject{
+		UUID: uuid.NewString(),
+	}
+
+	// The upload might take a long time for large file, so the expire time is longer.
+	duration := 24 * time.Hour
+	if envNodeEnv() == "development" {
+		duration = time.Duration(300) * time.Second
+	}
+
+	now := time.Now()
+	v.Created = now.Format(time.RFC3339)
+	v.Update = v.Created
+	v.Expires = now.Add(duration).Format(time.RFC3339)
+
+	for _, opt := range opts {
+		opt(v)
+	}
+	return v
+}
+
+func (v *UploadObject) String() string {
+	return fmt.Sprintf("uuid=%v, name=%v, size=%v, offset=%v, target=%v, created=%v, expires=%v, owner=%v",
+		v.UUID, v.Name, v.Size, v.Offset, v.Target, v.Created, v.Expires, v.Owner,
+	)
+}
+
+// The temporary file to write chunks, renamed to target when done.
+func (v *UploadObject) partFile() string {
+	return fmt.Sprintf("%v.part", v.Target)
+}
+
+func (v *UploadObject) Done() bool {
+	return v.Offset >= v.Size
+}
+
+func (v *UploadObject) Expired() bool {
+	expires, err := time.Parse(time.RFC3339, v.Expires)
+	return err != nil || time.Now().After(expires)
+}
+
+// WriteHeader write the tus headers of upload.
+func (v *UploadObject) WriteHeader(w http.ResponseWriter) {
+	w.Header().Set("Upload-Offset", fmt.Sprintf("%v", v.Offset))
+	w.Header().Set("Upload-Length", fmt.Sprintf("%v", v.Size))
+	if expires, err := time.Parse(time.RFC3339, v.Expires); err == nil {
+		w.Header().Set("Upload-Expires", expires.UTC().Format(http.TimeFormat))
+	}
+}
+
+func (v *UploadObject) Save(ctx context.Context) error {
+	if b, err := json.Marshal(v); err != nil {
+		return errors.Wrapf(err, "marshal %v", v.String())
+	} else if err = rdb.HSet(ctx, SRS_UPLOAD_TASK, v.UUID, string(b)).Err(); err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hset %v %v %v", SRS_UPLOAD_TASK, v.UUID, string(b))
+	}
+	return nil
+}
+
+// Remove the upload and files. Note that the target file might be moved by user, for example, vLive
+// moves it to dirVLivePath, which is not affected.
+func (v *UploadObject) Remove(ctx context.Context) error {
+	for _, file := range []string{v.partFile(), v.Target} {
+		if _, err := os.Stat(file); err == nil {
+			os.Remove(file)
+		}
+	}
+
+	if err := rdb.HDel(ctx, SRS_UPLOAD_TASK, v.UUID).Err(); err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hdel %v %v", SRS_UPLOAD_TASK, v.UUID)
+	}
+	return nil
+}
+
+// Load the upload by UUID, nil if not exists.
+func loadUploadObject(ctx context.Context, uploadUUID string) (*UploadObject, error) {
+	var upload UploadObject
+	if b, err := rdb.HGet(ctx, SRS_UPLOAD_TASK, uploadUUID).Result(); err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hget %v %v", SRS_UPLOAD_TASK, uploadUUID)
+	} else if b == "" {
+		return nil, nil
+	} else if err = json.Unmarshal([]byte(b), &upload); err != nil {
+		return nil, errors.Wrapf(err, "unmarshal %v", b)
+	}
+	return &upload, nil
+}
+
+// authenticateUpload authenticate by API secret, or by room token for room users, return the owner which
+// is the room UUID, or empty for API secret.
+func authenticateUpload(ctx context.Context, r *http.Request) (string, error) {
+	q := r.URL.Query()
+	if roomUUID, roomToken := q.Get("room"), q.Get("roomToken"); roomToken != "" {
+		var room SrsLiveRoom
+		if b, err := rdb.HGet(ctx, SRS_LIVE_ROOM, roomUUID).Result(); err != nil && err != redis.Nil {
+			return "", errors.Wrapf(err, "hget %v %v", SRS_LIVE_ROOM, roomUUID)
+		} else if b == "" {
+			return "", errors.Errorf("live room %v not exists", roomUUID)
+		} else if err = json.Unmarshal([]byte(b), &room); err != nil {
+			return "", errors.Wrapf(err, "unmarshal %v %v", roomUUID, b)
+		}
+
+		if room.RoomToken != roomToken {
+			return "", errors.Errorf("invalid room token %v", roomToken)
+		}
+		return room.UUID, nil
+	}
+
+	apiSecret := envApiSecret()
+	if err := Authenticate(ctx, apiSecret, q.Get("token"), r.Header); err != nil {
+		return "", errors.Wrapf(err, "authenticate")
+	}
+	return "", nil
+}
+
+// QueryUploadTarget query the target file of a completed upload, for other services to use the file. The
+// owner is the room UUID for room users, who are only allowed to use the upload of room, or empty for API
+// secret, which only uses the upload created by API secret.
+func QueryUploadTarget(ctx context.Context, uploadUUID, owner string) (string, error) {
+	upload, err := loadUploadObject(ctx, uploadUUID)
+	if err != nil {
+		return "", errors.Wrapf(err, "load upload %v", uploadUUID)
+	}
+	if upload == nil || upload.Expired() || upload.Owner != owner {
+		return "", errors.Errorf("no upload %v of owner %v", uploadUUID, owner)
+	}
+	if !upload.Done() {
+		return "", errors.Errorf("upload %v not done, offset=%v, size=%v", uploadUUID, upload.Offset, upload.Size)
+	}
+	return upload.Target, nil
+}
+
+// UploadError is the error with HTTP status, for tus client to handle the error.
+type UploadError struct {
+	error
+	status int
+}
+
+func newUploadError(status int, format string, a ...interface{}) error {
+	return &UploadError{error: errors.Errorf(format, a...), status: status}
+}
+
+func (v *UploadError) Status() int {
+	return v.status
+}
+
+// ParseTusMetadata parse the Upload-Metadata header, which is key and base64 value pairs, for example:
+//
+//	filename d29ybGRfZG9taW5hdGlvbl9wbGFuLnBkZg==,is_confidential
+func ParseTusMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		kv := strings.Fields(pair)
+		if len(kv) == 0 {
+			continue
+		}
+		if len(kv) > 2 {
+			return nil, errors.Errorf("invalid pair %v", pair)
+		}
+
+		var value string
+		if len(kv) == 2 {
+			if b, err := base64.StdEncoding.DecodeString(kv[1]); err != nil {
+				return nil, errors.Wrapf(err, "decode %v", kv[1])
+			} else {
+				value = string(b)
+			}
+		}
+		metadata[kv[0]] = value
+	}
+	return metadata, nil
+}
+
+// ParseTusChecksum parse the Upload-Checksum header, which is algorithm and base64 checksum, for example:
+//
+//	sha1 Kq5sNclPz7QV2+lfQIuc6R7oRu0=
+func ParseTusChecksum(header string) (hash.Hash, []byte, error) {
+	kv := strings.Fields(header)
+	if len(kv) != 2 {
+		return nil, nil, errors.Errorf("invalid checksum %v", header)
+	}
+
+	var h hash.Hash
+	switch kv[0] {
+	case "md5":
+		h = md5.New()
+	case "sha1":
+		h = sha1.New()
+	case "sha256":
+		h = sha256.New()
+	default:
+		return nil, nil, errors.Errorf("invalid algorithm %v", kv[0])
+	}
+
+	expect, err := base64.StdEncoding.DecodeString(kv[1])
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "decode %v", kv[1])
+	}
+	return h, expect, nil
+}
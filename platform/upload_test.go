@@ -0,0 +1,32 @@
+package main
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+func TestUpload_ParseTusHeaders(t *testing.T) {
+	metadata, err := ParseTusMetadata("filename " + base64.StdEncoding.EncodeToString([]byte("show.mp4")) + ",is_confidential")
+	if err != nil {
+		t.Errorf("parse metadata err %+v", err)
+	} else if metadata["filename"] != "show.mp4" {
+		t.Errorf("invalid filename %v", metadata["filename"])
+	} else if v, ok := metadata["is_confidential"]; !ok || v != "" {
+		t.Errorf("invalid is_confidential %v", metadata)
+	}
+
+	if _, err := ParseTusMetadata("filename !!!"); err == nil {
+		t.Errorf("should fail for invalid base64")
+	}
+
+	h, expect, err := ParseTusChecksum("sha1 Kq5sNclPz7QV2+lfQIuc6R7oRu0=")
+	if err != nil {
+		t.Errorf("parse checksum err %+v", err)
+	} else if h.Write([]byte("hello world")); string(h.Sum(nil)) != string(expect) {
+		t.Errorf("checksum mismatch")
+	}
+
+	if _, _, err := ParseTusChecksum("crc32 AAAA"); err == nil {
+		t.Errorf("should fail for invalid algorithm")
+	}
+}
@@ -32,6 +32,7 @@ import (
 	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
 	"github.com/go-redis/redis/v8"
 	"github.com/golang-jwt/jwt/v4"
+	"github.com/google/uuid"
 )
 
 // Versions is latest and stable version from Oryx API.
@@ -263,6 +264,9 @@ const (
 	SRS_RECORD_PATTERNS      = "SRS_RECORD_PATTERNS"
 	SRS_RECORD_M3U8_WORKING  = "SRS_RECORD_M3U8_WORKING"
 	SRS_RECORD_M3U8_ARTIFACT = "SRS_RECORD_M3U8_ARTIFACT"
+	SRS_RECORD_MANUAL        = "SRS_RECORD_MANUAL"
+	SRS_RECORD_CLIP          = "SRS_RECORD_CLIP"
+	SRS_RECORD_PIPELINE      = "SRS_RECORD_PIPELINE"
 	// For cloud storage.
 	SRS_DVR_PATTERNS      = "SRS_DVR_PATTERNS"
 	SRS_DVR_M3U8_WORKING  = "SRS_DVR_M3U8_WORKING"
@@ -279,12 +283,31 @@ const (
 	// For virtual live channel/stream.
 	SRS_VLIVE_CONFIG = "SRS_VLIVE_CONFIG"
 	SRS_VLIVE_TASK   = "SRS_VLIVE_TASK"
+	SRS_VLIVE_EPG    = "SRS_VLIVE_EPG"
+	// For resumable upload, shared by vLive, dubbing and AI talk.
+	SRS_UPLOAD_TASK = "SRS_UPLOAD_TASK"
+	// For async download jobs by youtube-dl.
+	SRS_YTDL_JOB = "SRS_YTDL_JOB"
+	// For normalizing the media to streaming-safe profile.
+	SRS_NORMALIZE_JOB = "SRS_NORMALIZE_JOB"
+	// For media library, the assets and the index of content hash.
+	SRS_MEDIA_ASSET = "SRS_MEDIA_ASSET"
+	SRS_MEDIA_HASH  = "SRS_MEDIA_HASH"
 	// For IP camera live channel/stream.
 	SRS_CAMERA_CONFIG = "SRS_CAMERA_CONFIG"
 	SRS_CAMERA_TASK   = "SRS_CAMERA_TASK"
+	// For multi-camera mosaic.
+	SRS_MOSAIC_CONFIG = "SRS_MOSAIC_CONFIG"
+	SRS_MOSAIC_TASK   = "SRS_MOSAIC_TASK"
+	// For named encoding profiles.
+	SRS_ENCODE_PROFILE = "SRS_ENCODE_PROFILE"
+	// For snapshot thumbnails of streams and cameras.
+	SRS_SNAPSHOT_CONFIG = "SRS_SNAPSHOT_CONFIG"
 	// For transcoding.
 	SRS_TRANSCODE_CONFIG = "SRS_TRANSCODE_CONFIG"
 	SRS_TRANSCODE_TASK   = "SRS_TRANSCODE_TASK"
+	// For loudness monitor of transcoding.
+	SRS_TRANSCODE_LOUDNESS = "SRS_TRANSCODE_LOUDNESS"
 	// For transcription.
 	SRS_TRANSCRIPT_CONFIG = "SRS_TRANSCRIPT_CONFIG"
 	SRS_TRANSCRIPT_TASK   = "SRS_TRANSCRIPT_TASK"
@@ -348,11 +371,95 @@ const FFprobeSourceTypeFile FFprobeSourceType = "file"
 const FFprobeSourceTypeYTDL FFprobeSourceType = "ytdl"
 const FFprobeSourceTypeStream FFprobeSourceType = "stream"
 
+// The source type of artifacts, which reference the UUID of record, DVR or VoD artifact.
+const FFprobeSourceTypeRecord FFprobeSourceType = "record"
+const FFprobeSourceTypeDVR FFprobeSourceType = "dvr"
+const FFprobeSourceTypeVoD FFprobeSourceType = "vod"
+
+// The source type of media library, which references the UUID of media asset.
+const FFprobeSourceTypeMedia FFprobeSourceType = "media"
+
+// IsArtifact whether the source is an artifact, which is played directly without copying.
+func (v FFprobeSourceType) IsArtifact() bool {
+	return v == FFprobeSourceTypeRecord || v == FFprobeSourceTypeDVR || v == FFprobeSourceTypeVoD
+}
+
+// IsShared whether the file of source is owned by others, like artifact and media asset, so we should
+// never move or remove the file.
+func (v FFprobeSourceType) IsShared() bool {
+	return v.IsArtifact() || v == FFprobeSourceTypeMedia
+}
+
+// ResolveArtifactTarget resolve the target to play for the artifact. For local record, use the MP4 file
+// like record/:uuid/index.mp4, while for DVR and VoD, use the HLS of artifact served by platform.
+func ResolveArtifactTarget(ctx context.Context, sourceType FFprobeSourceType, artifactUUID string) (string, error) {
+	key, target, err := ArtifactTarget(sourceType, artifactUUID)
+	if err != nil {
+		return "", errors.Wrapf(err, "artifact target")
+	}
+
+	var artifact M3u8VoDArtifact
+	if b, err := rdb.HGet(ctx, key, artifactUUID).Result(); err != nil && err != redis.Nil {
+		return "", errors.Wrapf(err, "hget %v %v", key, artifactUUID)
+	} else if b == "" {
+		return "", errors.Errorf("no artifact %v of %v", artifactUUID, sourceType)
+	} else if err = json.Unmarshal([]byte(b), &artifact); err != nil {
+		return "", errors.Wrapf(err, "unmarshal %v", b)
+	}
+
+	if artifact.Processing {
+		return "", errors.Errorf("artifact %v of %v is processing", artifactUUID, sourceType)
+	}
+
+	if sourceType == FFprobeSourceTypeRecord {
+		if _, err := os.Stat(target); err != nil {
+			return "", errors.Wrapf(err, "no mp4 file %v", target)
+		}
+	}
+	return target, nil
+}
+
+// ArtifactTarget get the redis key of artifact and the target to play, without checking the artifact.
+// The UUID should be valid, because it's used in the file path.
+func ArtifactTarget(sourceType FFprobeSourceType, artifactUUID string) (key, target string, err error) {
+	if artifactUUID == "" {
+		return "", "", errors.New("no artifact")
+	}
+	if _, err := uuid.Parse(artifactUUID); err != nil {
+		return "", "", errors.Wrapf(err, "invalid artifact %v", artifactUUID)
+	}
+
+	if sourceType == FFprobeSourceTypeRecord {
+		return SRS_RECORD_M3U8_ARTIFACT, path.Join("record", artifactUUID, "index.mp4"), nil
+	}
+
+	var prefix string
+	if sourceType == FFprobeSourceTypeDVR {
+		key, prefix = SRS_DVR_M3U8_ARTIFACT, "/terraform/v1/hooks/dvr/hls"
+	} else if sourceType == FFprobeSourceTypeVoD {
+		key, prefix = SRS_VOD_M3U8_ARTIFACT, "/terraform/v1/hooks/vod/hls"
+	} else {
+		return "", "", errors.Errorf("invalid artifact type %v", sourceType)
+	}
+
+	addr := envPlatformListen()
+	if strings.HasPrefix(addr, ":") {
+		addr = addr[1:]
+	}
+	return key, fmt.Sprintf("http://localhost:%v%v/%v.m3u8", addr, prefix, artifactUUID), nil
+}
+
 // For vLive upload directory.
 var dirUploadPath = path.Join(".", "upload")
 var dirVLivePath = path.Join(".", "vlive")
 var dirDubbingPath = path.Join(".", "dub")
 
+// For media library directory.
+var dirMediaPath = path.Join(".", "media")
+
+// For snapshot thumbnails directory, each source has a sub directory.
+var dirSnapshotPath = path.Join(".", "snapshots")
+
 // For Oryx to use the files.
 const serverDataDirectory = "/data"
 
@@ -1071,18 +1178,48 @@ func buildLiveM3u8ForLocal(
 	return
 }
 
-// buildLiveM3u8ForVariantCC go generate variant m3u8 with CC(Closed Caption).
-func buildLiveM3u8ForVariantCC(
-	ctx context.Context, bitrate int64, lang, stream, subtitles string,
+// M3u8Variant is a variant stream of HLS master playlist.
+type M3u8Variant struct {
+	// The peak bitrate in bps.
+	Bandwidth int64
+	// The resolution, for example, 1280x720, optional.
+	Resolution string
+	// The codecs, for example, mp4a.40.2 for audio only, optional.
+	Codecs string
+	// The URI of variant playlist.
+	URI string
+}
+
+// buildLiveM3u8ForVariants go generate master m3u8 with variants, and CC(Closed Caption) if subtitles
+// is not empty.
+func buildLiveM3u8ForVariants(
+	ctx context.Context, variants []*M3u8Variant, lang, subtitles string,
 ) (contentType, m3u8Body string, err error) {
-	m3u8 := []string{
-		"#EXTM3U",
-		fmt.Sprintf(
+	if len(variants) == 0 {
+		err = errors.Errorf("no variants")
+		return
+	}
+
+	m3u8 := []string{"#EXTM3U"}
+	if subtitles != "" {
+		m3u8 = append(m3u8, fmt.Sprintf(
 			`#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID="subs",NAME="Subtitle-%v",LANGUAGE="%v",DEFAULT=YES,AUTOSELECT=YES,FORCED=NO,URI="%v"`,
 			strings.ToUpper(lang), lang, subtitles,
-		),
-		fmt.Sprintf(`#EXT-X-STREAM-INF:BANDWIDTH=%v,SUBTITLES="subs"`, bitrate),
-		stream,
+		))
+	}
+
+	for _, variant := range variants {
+		info := fmt.Sprintf(`#EXT-X-STREAM-INF:BANDWIDTH=%v`, variant.Bandwidth)
+		if variant.Resolution != "" {
+			info += fmt.Sprintf(`,RESOLUTION=%v`, variant.Resolution)
+		}
+		if variant.Codecs != "" {
+			info += fmt.Sprintf(`,CODECS="%v"`, variant.Codecs)
+		}
+		if subtitles != "" {
+			info += `,SUBTITLES="subs"`
+		}
+		m3u8 = append(m3u8, info, variant.URI)
 	}
 
 	contentType = "application/vnd.apple.mpegurl"
@@ -1090,6 +1227,13 @@ func buildLiveM3u8ForVariantCC(
 	return
 }
 
+// buildLiveM3u8ForVariantCC go generate variant m3u8 with CC(Closed Caption).
+func buildLiveM3u8ForVariantCC(
+	ctx context.Context, bitrate int64, lang, stream, subtitles string,
+) (contentType, m3u8Body string, err error) {
+	return buildLiveM3u8ForVariants(ctx, []*M3u8Variant{{Bandwidth: bitrate, URI: stream}}, lang, subtitles)
+}
+
 // slicesContains is a function to check whether elem in arr.
 func slicesContains(arr []string, elem string) bool {
 	for _, e := range arr {
@@ -1158,6 +1302,19 @@ type M3u8VoDArtifact struct {
 	// The ts files of this m3u8.
 	Files []*TsFile `json:"files"`
 
+	// For local record only.
+	// Whether protected from the retention policy.
+	Keep bool `json:"keep,omitempty"`
+	// The begin time of record.
+	Begin string `json:"begin,omitempty"`
+	// The session of parts when split, which is the UUID of the first part, and the part number from 1.
+	Session string `json:"session,omitempty"`
+	Part    int    `json:"part,omitempty"`
+	// The source of clip, for example, record/:uuid, dvr/:uuid, vod/:uuid or stream/live/livestream.
+	Clip string `json:"clip,omitempty"`
+	// The visual preview of record, such as poster, thumbnails and animation.
+	Preview *RecordPreview `json:"preview,omitempty"`
+
 	// For DVR only.
 	// The COS bucket name.
 	Bucket string `json:"bucket"`
@@ -1562,6 +1719,12 @@ type FFprobeVideo struct {
 	PixFormat string `json:"pix_fmt"`
 	// The level of video.
 	Level int32 `json:"level"`
+	// The number of B frames, 0 means no B frame.
+	HasBFrames int32 `json:"has_b_frames"`
+	// The real base frame rate, for example, 25/1 or 30000/1001.
+	FrameRate string `json:"r_frame_rate"`
+	// The average frame rate, differs from r_frame_rate for variable frame rate.
+	AvgFrameRate string `json:"avg_frame_rate"`
 	// The bitrate in bps.
 	Bitrate string `json:"bit_rate"`
 	// The start time in seconds.
@@ -1626,11 +1789,17 @@ type FFprobeSource struct {
 	Video *FFprobeVideo `json:"video"`
 	// The audio information by ffprobe.
 	Audio *FFprobeAudio `json:"audio"`
+	// The repeat count to play the file in vLive playlist, 0 or 1 means play once.
+	Repeat int `json:"repeat,omitempty"`
+	// The UUID of record, DVR or VoD artifact, for artifact source only.
+	Artifact string `json:"artifact,omitempty"`
+	// The UUID of media asset, for media source only.
+	Media string `json:"media,omitempty"`
 }
 
 func (v *FFprobeSource) String() string {
-	return fmt.Sprintf("name=%v, path=%v, size=%v, uuid=%v, target=%v, format=(%v), video=(%v), audio=(%v)",
-		v.Name, v.Path, v.Size, v.UUID, v.Target, v.Format, v.Video, v.Audio,
+	return fmt.Sprintf("name=%v, path=%v, size=%v, uuid=%v, target=%v, type=%v, artifact=%v, media=%v, repeat=%v, format=(%v), video=(%v), audio=(%v)",
+		v.Name, v.Path, v.Size, v.UUID, v.Target, v.Type, v.Artifact, v.Media, v.Repeat, v.Format, v.Video, v.Audio,
 	)
 }
 
@@ -1650,6 +1819,8 @@ type FFmpegHeartbeat struct {
 	// Whether exit normally, the log is like:
 	//		Exiting normally, received signal 2.
 	exitingNormally bool
+	// Whether FFmpeg is stalled and killed by heartbeat, for not update or abnormal speed.
+	stalled bool
 	// Successful parsed log count.
 	parsedCount uint64
 	// FFmpeg's standard cycle logs every 1 second. Additional logs, such as FFmpeg error logs, are stored
@@ -1685,6 +1856,8 @@ type FFmpegHeartbeat struct {
 	MaxStreamDuration time.Duration
 	// The abnormal slow speed, such as 0.5x.
 	AbnormalFastSpeed float64
+	// To handle the logs of filters like ebur128, which are not stored as extra logs if handled.
+	FilterLogs func(line string) bool
 }
 
 // NewFFmpegHeartbeat create a new FFmpeg heartbeat manager, with cancelFFmpeg to cancel the FFmpeg
@@ -1754,6 +1927,7 @@ func (v *FFmpegHeartbeat) Polling(ctx context.Context, stderr io.Reader) {
 
 			if v.update.Add(10 * time.Second).Before(time.Now()) {
 				logger.Wf(ctx, "FFmpeg: not update for %v, restart it", time.Since(v.update))
+				v.stalled = true
 				v.cancelFFmpeg()
 				return
 			}
@@ -1778,9 +1952,17 @@ func (v *FFmpegHeartbeat) Polling(ctx context.Context, stderr io.Reader) {
 			v.exitingNormally = true
 		}
 
+		// Handle the logs of filters, which might be very many.
+		var filtered bool
+		if v.FilterLogs != nil {
+			filtered = v.FilterLogs(line)
+		}
+
 		// Handle the extra logs.
 		if !strings.Contains(line, "size=") && !strings.Contains(line, "time=") {
-			v.extraLogs = append(v.extraLogs, line)
+			if !filtered {
+				v.extraLogs = append(v.extraLogs, line)
+			}
 			return
 		}
 		if strings.Contains(line, "time=N/A") || strings.Contains(line, "speed=N/A") {
@@ -1832,6 +2014,7 @@ func (v *FFmpegHeartbeat) Polling(ctx context.Context, stderr io.Reader) {
 			if mv := RestartFFmpegCountAbnormalSpeed; v.veryFastSpeedCount > mv || v.verySlowSpeedCount > mv || exitForTimeout {
 				logger.Wf(ctx, "FFmpeg: abnormal speed=%v, fast=%v, slow=%v, mv=%v, timeout=%v,%v, restart it",
 					speed, v.veryFastSpeedCount, v.verySlowSpeedCount, mv, exitForTimeout, v.MaxStreamDuration)
+				v.stalled = !exitForTimeout
 				v.cancelFFmpeg()
 				return
 			}
@@ -58,3 +58,62 @@ func TestUtils_ParseFFmpegLogs(t *testing.T) {
 		}
 	}
 }
+
+func TestUtils_FFprobeSourceType(t *testing.T) {
+	for _, e := range []struct {
+		sourceType FFprobeSourceType
+		artifact   bool
+		shared     bool
+	}{
+		{FFprobeSourceTypeRecord, true, true},
+		{FFprobeSourceTypeDVR, true, true},
+		{FFprobeSourceTypeVoD, true, true},
+		{FFprobeSourceTypeMedia, false, true},
+		{FFprobeSourceTypeUpload, false, false},
+		{FFprobeSourceTypeStream, false, false},
+	} {
+		if v := e.sourceType.IsArtifact(); v != e.artifact {
+			t.Errorf("type %v artifact got %v, expect %v", e.sourceType, v, e.artifact)
+		}
+		if v := e.sourceType.IsShared(); v != e.shared {
+			t.Errorf("type %v shared got %v, expect %v", e.sourceType, v, e.shared)
+		}
+	}
+}
+
+func TestUtils_ArtifactTarget(t *testing.T) {
+	t.Setenv("PLATFORM_LISTEN", ":2024")
+
+	const artifactUUID = "3a6b8c1e-5f2d-4e7a-9b0c-1d2e3f4a5b6c"
+	for _, e := range []struct {
+		sourceType FFprobeSourceType
+		key        string
+		target     string
+	}{
+		{FFprobeSourceTypeRecord, SRS_RECORD_M3U8_ARTIFACT, "record/" + artifactUUID + "/index.mp4"},
+		{FFprobeSourceTypeDVR, SRS_DVR_M3U8_ARTIFACT, "http://localhost:2024/terraform/v1/hooks/dvr/hls/" + artifactUUID + ".m3u8"},
+		{FFprobeSourceTypeVoD, SRS_VOD_M3U8_ARTIFACT, "http://localhost:2024/terraform/v1/hooks/vod/hls/" + artifactUUID + ".m3u8"},
+	} {
+		if key, target, err := ArtifactTarget(e.sourceType, artifactUUID); err != nil {
+			t.Errorf("type %v err %+v", e.sourceType, err)
+		} else if key != e.key || target != e.target {
+			t.Errorf("type %v got %v %v, expect %v %v", e.sourceType, key, target, e.key, e.target)
+		}
+	}
+
+	for _, e := range []struct {
+		sourceType FFprobeSourceType
+		uuid       string
+	}{
+		{FFprobeSourceTypeRecord, ""},
+		{FFprobeSourceTypeRecord, "../../etc/passwd"},
+		{FFprobeSourceTypeDVR, "livestream"},
+		{FFprobeSourceTypeVoD, artifactUUID + "/index"},
+		{FFprobeSourceTypeMedia, artifactUUID},
+		{FFprobeSourceTypeUpload, artifactUUID},
+	} {
+		if _, _, err := ArtifactTarget(e.sourceType, e.uuid); err == nil {
+			t.Errorf("type %v uuid %v should fail", e.sourceType, e.uuid)
+		}
+	}
+}
@@ -0,0 +1,304 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/ossrs/go-oryx-lib/errors"
+)
+
+// VLiveEncode is the re-encode mode of vLive, to overlay logo, ticker and clock on the video.
+type VLiveEncode struct {
+	// Whether re-encode the stream, or copy it.
+	Enabled bool `json:"enabled"`
+	// The encoder settings, same to transcoding.
+	TranscodeEncoder
+	// The font file for ticker and clock, use the default font of FFmpeg if empty.
+	Font string `json:"font,omitempty"`
+	// The watermark image.
+	Logo *VLiveLogo `json:"logo,omitempty"`
+	// The scrolling text, which can be updated without restarting.
+	Ticker *VLiveTicker `json:"ticker,omitempty"`
+	// The wall clock.
+	Clock *VLiveClock `json:"clock,omitempty"`
+}
+
+func (v *VLiveEncode) String() string {
+	return fmt.Sprintf("enabled=%v, %v, font=%v, logo=<%v>, ticker=<%v>, clock=<%v>",
+		v.Enabled, v.TranscodeEncoder.String(), v.Font, v.Logo, v.Ticker, v.Clock,
+	)
+}
+
+// The position of overlay.
+const (
+	VLivePositionTopLeft     = "top-left"
+	VLivePositionTopRight    = "top-right"
+	VLivePositionBottomLeft  = "bottom-left"
+	VLivePositionBottomRight = "bottom-right"
+)
+
+// VLiveLogo is the watermark image overlay.
+type VLiveLogo struct {
+	// The image file, for example, vlive/vlive-xxx.logo.png
+	File string `json:"file"`
+	// The position, top-left, top-right, bottom-left or bottom-right. Default to top-right.
+	Position string `json:"position"`
+	// The opacity in [0, 1], 1 means fully opaque, 0 means not set and also fully opaque.
+	Opacity float64 `json:"opacity"`
+	// The margin in pixels to the border.
+	Margin int `json:"margin"`
+	// The width in pixels to scale the image, 0 to keep the size.
+	Width int `json:"width"`
+}
+
+func (v *VLiveLogo) String() string {
+	return fmt.Sprintf("file=%v, position=%v, opacity=%v, margin=%v, width=%v",
+		v.File, v.Position, v.Opacity, v.Margin, v.Width,
+	)
+}
+
+// VLiveTicker is the scrolling text overlay.
+type VLiveTicker struct {
+	// The text to scroll.
+	Text string `json:"text"`
+	// The position, top or bottom. Default to bottom.
+	Position string `json:"position"`
+	// The speed in pixels per second.
+	Speed int `json:"speed"`
+	// The font size, default to 32.
+	FontSize int `json:"fontSize"`
+	// The font color, default to white.
+	FontColor string `json:"fontColor"`
+}
+
+func (v *VLiveTicker) String() string {
+	return fmt.Sprintf("text=%vB, position=%v, speed=%v, size=%v, color=%v",
+		len(v.Text), v.Position, v.Speed, v.FontSize, v.FontColor,
+	)
+}
+
+// VLiveClock is the wall clock overlay.
+type VLiveClock struct {
+	// The strftime format, default to %Y-%m-%d %H:%M:%S
+	Format string `json:"format"`
+	// The position, top-left, top-right, bottom-left or bottom-right. Default to top-left.
+	Position string `json:"position"`
+	// The font size, default to 32.
+	FontSize int `json:"fontSize"`
+	// The font color, default to white.
+	FontColor string `json:"fontColor"`
+}
+
+func (v *VLiveClock) String() string {
+	return fmt.Sprintf("format=%v, position=%v, size=%v, color=%v",
+		v.Format, v.Position, v.FontSize, v.FontColor,
+	)
+}
+
+// Validate the encode settings, only when enabled.
+func (v *VLiveEncode) Validate(ctx context.Context) error {
+	if !v.Enabled {
+		return nil
+	}
+
+	if err := v.TranscodeEncoder.Validate(ctx); err != nil {
+		return errors.Wrapf(err, "encoder")
+	}
+
+	allowedPositions := []string{"", VLivePositionTopLeft, VLivePositionTopRight, VLivePositionBottomLeft, VLivePositionBottomRight}
+	if logo := v.Logo; logo != nil {
+		if !strings.HasPrefix(logo.File, dirUploadPath) && !strings.HasPrefix(logo.File, dirVLivePath) {
+			return errors.Errorf("invalid logo file %v", logo.File)
+		}
+		if _, err := os.Stat(logo.File); err != nil {
+			return errors.Wrapf(err, "no logo file %v", logo.File)
+		}
+		if !slicesContains(allowedPositions, logo.Position) {
+			return errors.Errorf("invalid logo position %v", logo.Position)
+		}
+		if logo.Opacity < 0 || logo.Opacity > 1 {
+			return errors.Errorf("invalid logo opacity %v", logo.Opacity)
+		}
+	}
+
+	if ticker := v.Ticker; ticker != nil {
+		if !slicesContains([]string{"", "top", "bottom"}, ticker.Position) {
+			return errors.Errorf("invalid ticker position %v", ticker.Position)
+		}
+	}
+
+	if clock := v.Clock; clock != nil {
+		if !slicesContains(allowedPositions, clock.Position) {
+			return errors.Errorf("invalid clock position %v", clock.Position)
+		}
+	}
+
+	return nil
+}
+
+// FFmpegArgs build the arguments after the input, to overlay and re-encode the stream by the profile.
+// Note that the logo is the second input, so the caller should put the args after the first input.
+func (v *VLiveEncode) FFmpegArgs(tickerFile string, profile *EncodeProfile) []string {
+	var args, filters []string
+	last := "0:v"
+
+	if logo := v.Logo; logo != nil {
+		args = append(args, "-i", logo.File)
+
+		filter := "format=rgba"
+		if logo.Width > 0 {
+			filter = fmt.Sprintf("scale=%v:-1,%v", logo.Width, filter)
+		}
+		if logo.Opacity > 0 && logo.Opacity < 1 {
+			filter = fmt.Sprintf("%v,colorchannelmixer=aa=%v", filter, logo.Opacity)
+		}
+
+		x, y := vLiveOverlayPosition(logo.Position, VLivePositionTopRight, logo.Margin, false)
+		filters = append(filters, fmt.Sprintf("[1:v]%v[logo]", filter))
+		filters = append(filters, fmt.Sprintf("[%v][logo]overlay=x=%v:y=%v[logoed]", last, x, y))
+		last = "logoed"
+	}
+
+	if ticker := v.Ticker; ticker != nil {
+		speed := ticker.Speed
+		if speed <= 0 {
+			speed = 100
+		}
+
+		y := "h-th-20"
+		if ticker.Position == "top" {
+			y = "20"
+		}
+
+		// Reload the text file for each frame, so the ticker could be updated without restarting.
+		filters = append(filters, fmt.Sprintf(
+			"[%v]drawtext=%vtextfile=%v:reload=1:%v:box=1:boxcolor=black@0.5:boxborderw=8:x=w-mod(t*%v\\,w+tw):y=%v[ticker]",
+			last, v.fontOption(), ffmpegFilterEscape(ffmpegOptionEscape(tickerFile)),
+			vLiveTextStyle(ticker.FontSize, ticker.FontColor), speed, y,
+		))
+		last = "ticker"
+	}
+
+	if clock := v.Clock; clock != nil {
+		// The default format of localtime is %Y-%m-%d %H:%M:%S
+		text := "%{localtime}"
+		if clock.Format != "" {
+			text = fmt.Sprintf("%%{localtime:%v}", ffmpegExpansionEscape(clock.Format))
+		}
+
+		x, y := vLiveOverlayPosition(clock.Position, VLivePositionTopLeft, 20, true)
+		filters = append(filters, fmt.Sprintf(
+			"[%v]drawtext=%vtext=%v:%v:box=1:boxcolor=black@0.5:boxborderw=8:x=%v:y=%v[clock]",
+			last, v.fontOption(), ffmpegFilterEscape(ffmpegOptionEscape(text)),
+			vLiveTextStyle(clock.FontSize, clock.FontColor), x, y,
+		))
+		last = "clock"
+	}
+
+	if len(filters) == 0 {
+		return append(args, profile.FFmpegArgs()...)
+	}
+
+	// Scale the video in the same filter graph, because -vf is not allowed for the overlaid stream.
+	if filter := profile.VideoFilter(); filter != "" {
+		filters = append(filters, fmt.Sprintf("[%v]%v[scaled]", last, filter))
+		last = "scaled"
+	}
+	args = append(args, "-filter_complex", strings.Join(filters, ";"), "-map", fmt.Sprintf("[%v]", last), "-map", "0:a?")
+
+	if filter := profile.AudioFilter(); filter != "" {
+		args = append(args, "-af", filter)
+	}
+	args = append(args, profile.VideoArgs()...)
+	return append(args, profile.AudioArgs()...)
+}
+
+func (v *VLiveEncode) fontOption() string {
+	if v.Font == "" {
+		return ""
+	}
+	return fmt.Sprintf("fontfile=%v:", ffmpegFilterEscape(ffmpegOptionEscape(v.Font)))
+}
+
+// Build the x and y expression of overlay. For drawtext, the size of video is w and h, and the size of
+// text is tw and th, while for overlay, they are W, H, w and h.
+func vLiveOverlayPosition(position, defaultPosition string, margin int, drawtext bool) (string, string) {
+	if position == "" {
+		position = defaultPosition
+	}
+
+	right, bottom := "W-w", "H-h"
+	if drawtext {
+		right, bottom = "w-tw", "h-th"
+	}
+
+	x, y := fmt.Sprintf("%v", margin), fmt.Sprintf("%v", margin)
+	if position == VLivePositionTopRight || position == VLivePositionBottomRight {
+		x = fmt.Sprintf("%v-%v", right, margin)
+	}
+	if position == VLivePositionBottomLeft || position == VLivePositionBottomRight {
+		y = fmt.Sprintf("%v-%v", bottom, margin)
+	}
+	return x, y
+}
+
+func vLiveTextStyle(size int, color string) string {
+	if size <= 0 {
+		size = 32
+	}
+	if color == "" {
+		color = "white"
+	}
+	return fmt.Sprintf("fontsize=%v:fontcolor=%v", size, ffmpegFilterEscape(ffmpegOptionEscape(color)))
+}
+
+// The ticker text file of vLive, which is reloaded by FFmpeg for each frame.
+func vLiveTickerFile(platform string) string {
+	return path.Join(dirVLivePath, fmt.Sprintf("%v.ticker.txt", platform))
+}
+
+// Write the ticker text to file. Write to a temporary file and rename it, because FFmpeg might read
+// the file at any time.
+func writeVLiveTicker(platform, text string) error {
+	tickerFile := vLiveTickerFile(platform)
+	tmpFile := fmt.Sprintf("%v.tmp", tickerFile)
+	if err := os.WriteFile(tmpFile, []byte(text), 0644); err != nil {
+		return errors.Wrapf(err, "write %v", tmpFile)
+	}
+	if err := os.Rename(tmpFile, tickerFile); err != nil {
+		return errors.Wrapf(err, "rename %v to %v", tmpFile, tickerFile)
+	}
+	return nil
+}
+
+// Escape the arguments of drawtext text expansion, for example, the format of %{localtime:format}
+func ffmpegExpansionEscape(s string) string {
+	return ffmpegEscape(s, "\\':}")
+}
+
+// Escape the value of filter option, see https://ffmpeg.org/ffmpeg-filters.html#Notes-on-filtergraph-escaping
+func ffmpegOptionEscape(s string) string {
+	return ffmpegEscape(s, "\\':")
+}
+
+// Escape the value for filtergraph description.
+func ffmpegFilterEscape(s string) string {
+	return ffmpegEscape(s, "\\'[],;")
+}
+
+func ffmpegEscape(s, special string) string {
+	var sb strings.Builder
+	for _, c := range s {
+		if strings.ContainsRune(special, c) {
+			sb.WriteRune('\\')
+		}
+		sb.WriteRune(c)
+	}
+	return sb.String()
+}
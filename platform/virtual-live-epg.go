@@ -0,0 +1,568 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/ossrs/go-oryx-lib/errors"
+	ohttp "github.com/ossrs/go-oryx-lib/http"
+	"github.com/ossrs/go-oryx-lib/logger"
+
+	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+)
+
+func handleVLiveEPGService(ctx context.Context, handler *http.ServeMux) error {
+	ep := "/terraform/v1/ffmpeg/vlive/epg/query"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := func() error {
+			var token, platform string
+			if err := ParseBody(ctx, r.Body, &struct {
+				Token    *string `json:"token"`
+				Platform *string `json:"platform"`
+			}{
+				Token: &token, Platform: &platform,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			if platform == "" {
+				return errors.New("no platform")
+			}
+
+			epg, err := loadVLiveEPG(ctx, platform)
+			if err != nil {
+				return errors.Wrapf(err, "load epg of %v", platform)
+			}
+
+			ohttp.WriteData(ctx, w, r, epg)
+			logger.Tf(ctx, "vLive: Query epg ok, %v, token=%vB", epg.String(), len(token))
+			return nil
+		}(); err != nil {
+			ohttp.WriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/terraform/v1/ffmpeg/vlive/epg/apply"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := func() error {
+			var token, platform string
+			var enabled bool
+			var filler []string
+			if err := ParseBody(ctx, r.Body, &struct {
+				Token    *string   `json:"token"`
+				Platform *string   `json:"platform"`
+				Enabled  *bool     `json:"enabled"`
+				Filler   *[]string `json:"filler"`
+			}{
+				Token: &token, Platform: &platform, Enabled: &enabled, Filler: &filler,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			if platform == "" {
+				return errors.New("no platform")
+			}
+
+			config, err := loadVLiveConfigure(ctx, platform)
+			if err != nil {
+				return errors.Wrapf(err, "load config of %v", platform)
+			}
+			for _, f := range filler {
+				if vLiveFindFile(config.Files, f) == nil {
+					return errors.Errorf("no filler file %v in %v", f, platform)
+				}
+			}
+
+			epg, err := loadVLiveEPG(ctx, platform)
+			if err != nil {
+				return errors.Wrapf(err, "load epg of %v", platform)
+			}
+
+			epg.Enabled, epg.Filler = enabled, filler
+			if err := epg.Save(ctx); err != nil {
+				return errors.Wrapf(err, "save epg %v", epg.String())
+			}
+			notifyVLiveEPG(platform)
+
+			ohttp.WriteData(ctx, w, r, nil)
+			logger.Tf(ctx, "vLive: Apply epg ok, %v, token=%vB", epg.String(), len(token))
+			return nil
+		}(); err != nil {
+			ohttp.WriteError(ctx, w, r, err)
+		}
+	})
+
+	// Create or update a slot of EPG, create if no uuid.
+	updateSlot := func(w http.ResponseWriter, r *http.Request, create bool) error {
+		var token, platform string
+		var slot VLiveEPGSlot
+		if err := ParseBody(ctx, r.Body, &struct {
+			Token    *string `json:"token"`
+			Platform *string `json:"platform"`
+			*VLiveEPGSlot
+		}{
+			Token: &token, Platform: &platform, VLiveEPGSlot: &slot,
+		}); err != nil {
+			return errors.Wrapf(err, "parse body")
+		}
+
+		apiSecret := envApiSecret()
+		if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+			return errors.Wrapf(err, "authenticate")
+		}
+
+		if platform == "" {
+			return errors.New("no platform")
+		}
+		if create {
+			slot.UUID = uuid.NewString()
+		} else if slot.UUID == "" {
+			return errors.New("no uuid")
+		}
+
+		config, err := loadVLiveConfigure(ctx, platform)
+		if err != nil {
+			return errors.Wrapf(err, "load config of %v", platform)
+		}
+		if len(slot.Files) == 0 {
+			return errors.New("no files")
+		}
+		for _, f := range slot.Files {
+			if vLiveFindFile(config.Files, f) == nil {
+				return errors.Errorf("no file %v in %v", f, platform)
+			}
+		}
+
+		epg, err := loadVLiveEPG(ctx, platform)
+		if err != nil {
+			return errors.Wrapf(err, "load epg of %v", platform)
+		}
+
+		if create {
+			epg.Slots = append(epg.Slots, &slot)
+		} else {
+			var found bool
+			for i, s := range epg.Slots {
+				if s.UUID == slot.UUID {
+					epg.Slots[i], found = &slot, true
+					break
+				}
+			}
+			if !found {
+				return errors.Errorf("no slot %v in %v", slot.UUID, platform)
+			}
+		}
+
+		if err := epg.Validate(); err != nil {
+			return errors.Wrapf(err, "validate %v", slot.String())
+		}
+		if err := epg.Save(ctx); err != nil {
+			return errors.Wrapf(err, "save epg %v", epg.String())
+		}
+		notifyVLiveEPG(platform)
+
+		ohttp.WriteData(ctx, w, r, &slot)
+		logger.Tf(ctx, "vLive: Update epg slot ok, create=%v, platform=%v, slot=%v, token=%vB",
+			create, platform, slot.String(), len(token))
+		return nil
+	}
+
+	ep = "/terraform/v1/ffmpeg/vlive/epg/create"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := updateSlot(w, r, true); err != nil {
+			ohttp.WriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/terraform/v1/ffmpeg/vlive/epg/update"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := updateSlot(w, r, false); err != nil {
+			ohttp.WriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/terraform/v1/ffmpeg/vlive/epg/remove"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := func() error {
+			var token, platform, slotUUID string
+			if err := ParseBody(ctx, r.Body, &struct {
+				Token    *string `json:"token"`
+				Platform *string `json:"platform"`
+				UUID     *string `json:"uuid"`
+			}{
+				Token: &token, Platform: &platform, UUID: &slotUUID,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			if platform == "" {
+				return errors.New("no platform")
+			}
+			if slotUUID == "" {
+				return errors.New("no uuid")
+			}
+
+			epg, err := loadVLiveEPG(ctx, platform)
+			if err != nil {
+				return errors.Wrapf(err, "load epg of %v", platform)
+			}
+
+			var slots []*VLiveEPGSlot
+			for _, s := range epg.Slots {
+				if s.UUID != slotUUID {
+					slots = append(slots, s)
+				}
+			}
+			if len(slots) == len(epg.Slots) {
+				return errors.Errorf("no slot %v in %v", slotUUID, platform)
+			}
+
+			epg.Slots = slots
+			if err := epg.Save(ctx); err != nil {
+				return errors.Wrapf(err, "save epg %v", epg.String())
+			}
+			notifyVLiveEPG(platform)
+
+			ohttp.WriteData(ctx, w, r, nil)
+			logger.Tf(ctx, "vLive: Remove epg slot ok, platform=%v, uuid=%v, token=%vB", platform, slotUUID, len(token))
+			return nil
+		}(); err != nil {
+			ohttp.WriteError(ctx, w, r, err)
+		}
+	})
+
+	// Export the EPG by GET, for EPG consumers like IPTV players, for example:
+	//		/terraform/v1/ffmpeg/vlive/epg/export?platform=vlive-xxx&format=xmltv&token=xxx
+	// Note that the bearer token in Authorization header is also supported.
+	ep = "/terraform/v1/ffmpeg/vlive/epg/export"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := func() error {
+			q := r.URL.Query()
+			token, platform, format := q.Get("token"), q.Get("platform"), q.Get("format")
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			if platform == "" {
+				return errors.New("no platform")
+			}
+			if format == "" {
+				format = "xmltv"
+			}
+			if format != "xmltv" && format != "json" {
+				return errors.Errorf("invalid format %v", format)
+			}
+
+			config, err := loadVLiveConfigure(ctx, platform)
+			if err != nil {
+				return errors.Wrapf(err, "load config of %v", platform)
+			}
+
+			epg, err := loadVLiveEPG(ctx, platform)
+			if err != nil {
+				return errors.Wrapf(err, "load epg of %v", platform)
+			}
+
+			var contentType string
+			var b []byte
+			if format == "xmltv" {
+				contentType = "application/xml"
+				if b, err = epg.ToXMLTV(ChooseNotEmpty(config.Label, platform)); err != nil {
+					return errors.Wrapf(err, "xmltv %v", epg.String())
+				}
+			} else {
+				contentType = "application/json"
+				if b, err = json.Marshal(epg); err != nil {
+					return errors.Wrapf(err, "marshal %v", epg.String())
+				}
+			}
+
+			w.Header().Set("Content-Type", contentType)
+			w.Write(b)
+			logger.Tf(ctx, "vLive: Export epg ok, format=%v, %v, size=%vB", format, epg.String(), len(b))
+			return nil
+		}(); err != nil {
+			ohttp.WriteError(ctx, w, r, err)
+		}
+	})
+
+	return nil
+}
+
+// Load the vLive configure of platform, error if not exists.
+func loadVLiveConfigure(ctx context.Context, platform string) (*VLiveConfigure, error) {
+	var config VLiveConfigure
+	if b, err := rdb.HGet(ctx, SRS_VLIVE_CONFIG, platform).Result(); err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hget %v %v", SRS_VLIVE_CONFIG, platform)
+	} else if b == "" {
+		return nil, errors.Errorf("vLive %v not exists", platform)
+	} else if err = json.Unmarshal([]byte(b), &config); err != nil {
+		return nil, errors.Wrapf(err, "unmarshal %v", b)
+	}
+	return &config, nil
+}
+
+// Load the EPG of platform, return an empty EPG if not exists.
+func loadVLiveEPG(ctx context.Context, platform string) (*VLiveEPG, error) {
+	epg := &VLiveEPG{Platform: platform}
+	if b, err := rdb.HGet(ctx, SRS_VLIVE_EPG, platform).Result(); err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hget %v %v", SRS_VLIVE_EPG, platform)
+	} else if b != "" {
+		if err = json.Unmarshal([]byte(b), epg); err != nil {
+			return nil, errors.Wrapf(err, "unmarshal %v", b)
+		}
+	}
+	return epg, nil
+}
+
+// Signal the vLive task of platform to reload the EPG, if the task is running.
+func notifyVLiveEPG(platform string) {
+	if vLiveWorker == nil {
+		return
+	}
+	if task := vLiveWorker.GetTask(platform); task != nil {
+		task.NotifyEPG()
+	}
+}
+
+// Find the file by UUID in files, nil if not found.
+func vLiveFindFile(files []*FFprobeSource, fileUUID string) *FFprobeSource {
+	for _, file := range files {
+		if file.UUID == fileUUID {
+			return file
+		}
+	}
+	return nil
+}
+
+// VLiveEPGFiller is the source key of EPG when no slot is active, to play the filler files.
+const VLiveEPGFiller = "filler"
+
+// VLiveEPG is the EPG(Electronic Program Guide) of a vLive channel, which schedules the files by time
+// slots. When no slot is active, play the filler files, or all files of channel if no filler.
+type VLiveEPG struct {
+	// The platform of vLive channel.
+	Platform string `json:"platform"`
+	// Whether enable the EPG.
+	Enabled bool `json:"enabled"`
+	// The filler file UUIDs for gaps between slots.
+	Filler []string `json:"filler"`
+	// The time slots, sorted by start time.
+	Slots []*VLiveEPGSlot `json:"slots"`
+	// The last update time.
+	Update string `json:"update"`
+}
+
+func (v *VLiveEPG) String() string {
+	return fmt.Sprintf("platform=%v, enabled=%v, filler=%v, slots=%v, update=%v",
+		v.Platform, v.Enabled, len(v.Filler), len(v.Slots), v.Update,
+	)
+}
+
+func (v *VLiveEPG) Save(ctx context.Context) error {
+	v.Update = time.Now().Format(time.RFC3339)
+
+	if b, err := json.Marshal(v); err != nil {
+		return errors.Wrapf(err, "marshal %v", v.String())
+	} else if err = rdb.HSet(ctx, SRS_VLIVE_EPG, v.Platform, string(b)).Err(); err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hset %v %v %v", SRS_VLIVE_EPG, v.Platform, string(b))
+	}
+	return nil
+}
+
+// Validate the slots, and sort by start time. The slots should never overlap.
+func (v *VLiveEPG) Validate() error {
+	allowedModes := []VLivePlayMode{"", VLivePlayModeLoop, VLivePlayModeSequential, VLivePlayModeShuffle}
+	for _, slot := range v.Slots {
+		if !vLivePlayModeValid(allowedModes, slot.PlayMode) {
+			return errors.Errorf("slot %v invalid playMode=%v", slot.UUID, slot.PlayMode)
+		}
+		if start, end, err := slot.Range(); err != nil {
+			return errors.Wrapf(err, "slot %v", slot.UUID)
+		} else if !start.Before(end) {
+			return errors.Errorf("slot %v start %v should before end %v", slot.UUID, slot.Start, slot.End)
+		}
+	}
+
+	sort.Slice(v.Slots, func(i, j int) bool {
+		si, _, _ := v.Slots[i].Range()
+		sj, _, _ := v.Slots[j].Range()
+		return si.Before(sj)
+	})
+
+	for i := 1; i < len(v.Slots); i++ {
+		prev, slot := v.Slots[i-1], v.Slots[i]
+		_, prevEnd, _ := prev.Range()
+		start, _, _ := slot.Range()
+		if start.Before(prevEnd) {
+			return errors.Errorf("slot %v overlaps with %v", slot.UUID, prev.UUID)
+		}
+	}
+
+	return nil
+}
+
+// Active returns the active slot at now, or nil if in gap, which should play the filler.
+func (v *VLiveEPG) Active(now time.Time) *VLiveEPGSlot {
+	for _, slot := range v.Slots {
+		if start, end, err := slot.Range(); err == nil && !now.Before(start) && now.Before(end) {
+			return slot
+		}
+	}
+	return nil
+}
+
+// NextBoundary returns the nearest start or end of slots after now, or zero time if no more boundary.
+func (v *VLiveEPG) NextBoundary(now time.Time) time.Time {
+	var next time.Time
+	for _, slot := range v.Slots {
+		start, end, err := slot.Range()
+		if err != nil {
+			continue
+		}
+		for _, t := range []time.Time{start, end} {
+			if t.After(now) && (next.IsZero() || t.Before(next)) {
+				next = t
+			}
+		}
+	}
+	return next
+}
+
+// Source returns the source key and the files and mode to play at now. The key is the slot UUID, or
+// VLiveEPGFiller if in gap. The files are selected from the files of channel.
+func (v *VLiveEPG) Source(now time.Time, files []*FFprobeSource, mode VLivePlayMode) (string, []*FFprobeSource, VLivePlayMode) {
+	pick := func(uuids []string) []*FFprobeSource {
+		var picked []*FFprobeSource
+		for _, fileUUID := range uuids {
+			if file := vLiveFindFile(files, fileUUID); file != nil {
+				picked = append(picked, file)
+			}
+		}
+		return picked
+	}
+
+	if slot := v.Active(now); slot != nil {
+		if picked := pick(slot.Files); len(picked) > 0 {
+			return slot.UUID, picked, slot.PlayMode
+		}
+	}
+
+	if picked := pick(v.Filler); len(picked) > 0 {
+		return VLiveEPGFiller, picked, VLivePlayModeLoop
+	}
+	return VLiveEPGFiller, files, mode
+}
+
+// ToXMLTV export the EPG in XMLTV format, see https://wiki.xmltv.org/index.php/XMLTVFormat
+func (v *VLiveEPG) ToXMLTV(channelName string) ([]byte, error) {
+	type xmltvProgramme struct {
+		Start   string `xml:"start,attr"`
+		Stop    string `xml:"stop,attr"`
+		Channel string `xml:"channel,attr"`
+		Title   string `xml:"title"`
+		Desc    string `xml:"desc,omitempty"`
+	}
+	type xmltvChannel struct {
+		ID          string `xml:"id,attr"`
+		DisplayName string `xml:"display-name"`
+	}
+	tv := struct {
+		XMLName    xml.Name          `xml:"tv"`
+		Generator  string            `xml:"generator-info-name,attr"`
+		Channel    xmltvChannel      `xml:"channel"`
+		Programmes []*xmltvProgramme `xml:"programme"`
+	}{
+		Generator: fmt.Sprintf("Oryx/%v", version),
+		Channel:   xmltvChannel{ID: v.Platform, DisplayName: channelName},
+	}
+
+	const xmltvTime = "20060102150405 -0700"
+	for _, slot := range v.Slots {
+		start, end, err := slot.Range()
+		if err != nil {
+			return nil, errors.Wrapf(err, "slot %v", slot.UUID)
+		}
+
+		tv.Programmes = append(tv.Programmes, &xmltvProgramme{
+			Start: start.Format(xmltvTime), Stop: end.Format(xmltvTime), Channel: v.Platform,
+			Title: slot.Title, Desc: slot.Description,
+		})
+	}
+
+	b, err := xml.MarshalIndent(&tv, "", "  ")
+	if err != nil {
+		return nil, errors.Wrapf(err, "marshal xmltv")
+	}
+	return append([]byte(xml.Header), b...), nil
+}
+
+// VLiveEPGSlot is a time slot of EPG, to play the files in the time range.
+type VLiveEPGSlot struct {
+	// The slot UUID.
+	UUID string `json:"uuid"`
+	// The program title.
+	Title string `json:"title"`
+	// The program description.
+	Description string `json:"desc"`
+	// The start time in RFC3339, for example, 2024-01-01T20:00:00+08:00
+	Start string `json:"start"`
+	// The end time in RFC3339, for example, 2024-01-01T21:00:00+08:00
+	End string `json:"end"`
+	// The file UUIDs of vLive channel to play.
+	Files []string `json:"files"`
+	// The play mode of files, default to loop until the end of slot.
+	PlayMode VLivePlayMode `json:"playMode"`
+}
+
+func (v *VLiveEPGSlot) String() string {
+	return fmt.Sprintf("uuid=%v, title=%v, start=%v, end=%v, files=%v, mode=%v",
+		v.UUID, v.Title, v.Start, v.End, len(v.Files), v.PlayMode,
+	)
+}
+
+// Range parse the start and end time of slot.
+func (v *VLiveEPGSlot) Range() (start, end time.Time, err error) {
+	if start, err = time.Parse(time.RFC3339, v.Start); err != nil {
+		err = errors.Wrapf(err, "parse start %v", v.Start)
+		return
+	}
+	if end, err = time.Parse(time.RFC3339, v.End); err != nil {
+		err = errors.Wrapf(err, "parse end %v", v.End)
+		return
+	}
+	return
+}
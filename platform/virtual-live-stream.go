@@ -8,7 +8,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"io/fs"
+	"math"
+	"math/rand"
 	"net/http"
 	"os"
 	"os/exec"
@@ -98,6 +99,17 @@ func (v *VLiveWorker) Handle(ctx context.Context, handler *http.ServeMux) error
 				if len(userConf.Files) == 0 {
 					return errors.New("no files")
 				}
+
+				allowedModes := []VLivePlayMode{"", VLivePlayModeLoop, VLivePlayModeSequential, VLivePlayModeShuffle}
+				if !vLivePlayModeValid(allowedModes, userConf.PlayMode) {
+					return errors.Errorf("invalid playMode=%v", userConf.PlayMode)
+				}
+
+				if userConf.Encode != nil {
+					if err := userConf.Encode.Validate(ctx); err != nil {
+						return errors.Wrapf(err, "invalid encode")
+					}
+				}
 			}
 
 			if action == "update" {
@@ -110,6 +122,12 @@ func (v *VLiveWorker) Handle(ctx context.Context, handler *http.ServeMux) error
 							return errors.Wrapf(err, "unmarshal %v", config)
 						}
 					}
+					// The files might be changed, so update the references of media assets.
+					owner := fmt.Sprintf("vlive:%v", userConf.Platform)
+					if err = UpdateMediaRefs(ctx, owner, mediaUUIDsOf(targetConf.Files), mediaUUIDsOf(userConf.Files)); err != nil {
+						return errors.Wrapf(err, "update media refs of %v", owner)
+					}
+
 					if err = targetConf.Update(&userConf); err != nil {
 						return errors.Wrapf(err, "update %v with %v", targetConf.String(), userConf.String())
 					} else if newB, err := json.Marshal(&targetConf); err != nil {
@@ -192,6 +210,13 @@ func (v *VLiveWorker) Handle(ctx context.Context, handler *http.ServeMux) error
 						"custom":   config.Customed,
 						"label":    config.Label,
 						"files":    config.Files,
+						"playMode": config.PlayMode,
+					}
+
+					if task := vLiveWorker.GetTask(config.Platform); task != nil {
+						if current := task.queryPlaylist(); current != nil {
+							elem["current"] = current
+						}
 					}
 
 					if pid > 0 {
@@ -220,6 +245,116 @@ func (v *VLiveWorker) Handle(ctx context.Context, handler *http.ServeMux) error
 		}
 	})
 
+	ep = "/terraform/v1/ffmpeg/vlive/playlist"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := func() error {
+			var token, platform, action, fileUUID string
+			if err := ParseBody(ctx, r.Body, &struct {
+				Token    *string `json:"token"`
+				Platform *string `json:"platform"`
+				Action   *string `json:"action"`
+				UUID     *string `json:"uuid"`
+			}{
+				Token: &token, Platform: &platform, Action: &action, UUID: &fileUUID,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			allowedActions := []string{"next", "jump"}
+			if !slicesContains(allowedActions, action) {
+				return errors.Errorf("invalid action=%v", action)
+			}
+			if platform == "" {
+				return errors.New("no platform")
+			}
+			if action == "jump" && fileUUID == "" {
+				return errors.New("no uuid")
+			}
+
+			task := vLiveWorker.GetTask(platform)
+			if task == nil {
+				return errors.Errorf("no task for platform=%v", platform)
+			}
+
+			if action == "next" {
+				if err := task.Skip(ctx); err != nil {
+					return errors.Wrapf(err, "skip %v", platform)
+				}
+			} else {
+				if err := task.Jump(ctx, fileUUID); err != nil {
+					return errors.Wrapf(err, "jump %v to %v", platform, fileUUID)
+				}
+			}
+
+			ohttp.WriteData(ctx, w, r, nil)
+			logger.Tf(ctx, "vLive: Playlist %v ok, platform=%v, uuid=%v, token=%vB", action, platform, fileUUID, len(token))
+			return nil
+		}(); err != nil {
+			ohttp.WriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/terraform/v1/ffmpeg/vlive/ticker"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := func() error {
+			var token, platform, text string
+			if err := ParseBody(ctx, r.Body, &struct {
+				Token    *string `json:"token"`
+				Platform *string `json:"platform"`
+				Text     *string `json:"text"`
+			}{
+				Token: &token, Platform: &platform, Text: &text,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			if platform == "" {
+				return errors.New("no platform")
+			}
+
+			// Save the text to config, to restore it when restart.
+			config, err := loadVLiveConfigure(ctx, platform)
+			if err != nil {
+				return errors.Wrapf(err, "load config of %v", platform)
+			}
+			if !config.encodeEnabled() || config.Encode.Ticker == nil {
+				return errors.Errorf("no ticker for platform=%v", platform)
+			}
+
+			config.Encode.Ticker.Text = text
+			if b, err := json.Marshal(config); err != nil {
+				return errors.Wrapf(err, "marshal %v", config.String())
+			} else if err = rdb.HSet(ctx, SRS_VLIVE_CONFIG, platform, string(b)).Err(); err != nil && err != redis.Nil {
+				return errors.Wrapf(err, "hset %v %v %v", SRS_VLIVE_CONFIG, platform, string(b))
+			}
+
+			// Update the ticker of running task, without restarting.
+			if task := vLiveWorker.GetTask(platform); task != nil {
+				if err := task.UpdateTicker(ctx, text); err != nil {
+					return errors.Wrapf(err, "update ticker of %v", platform)
+				}
+			}
+
+			ohttp.WriteData(ctx, w, r, nil)
+			logger.Tf(ctx, "vLive: Update ticker ok, platform=%v, text=%vB, token=%vB", platform, len(text), len(token))
+			return nil
+		}(); err != nil {
+			ohttp.WriteError(ctx, w, r, err)
+		}
+	})
+
 	streamUrlHandler := func(w http.ResponseWriter, r *http.Request) {
 		if err := func() error {
 			var token string
@@ -310,91 +445,17 @@ func (v *VLiveWorker) Handle(ctx context.Context, handler *http.ServeMux) error
 				return errors.Errorf("invalid url %v", qFile)
 			}
 
-			// If upload directory is symlink, eval it.
-			targetDir := dirUploadPath
-			if info, err := os.Lstat(targetDir); err == nil && info.Mode()&os.ModeSymlink != 0 {
-				if realPath, err := filepath.EvalSymlinks(targetDir); err != nil {
-					return errors.Wrapf(err, "eval symlink %v", targetDir)
-				} else {
-					targetDir = realPath
-				}
-			}
-
-			// The prefix for target files.
-			targetUUID := uuid.NewString()
-
-			// Cleanup all temporary files created by youtube-dl.
-			requestDone, requestDoneCancel := context.WithCancel(context.Background())
-			defer requestDoneCancel()
-			go func() {
-				// If the temporary file still exists for a long time, remove it
-				duration := 2 * time.Hour
-				if envNodeEnv() == "development" {
-					duration = time.Duration(30) * time.Second
-				}
-
-				select {
-				case <-ctx.Done():
-					logger.Tf(ctx, "ytdl: do cleanup immediately when quit")
-				case <-requestDone.Done():
-					time.Sleep(duration)
-				}
-
-				filepath.WalkDir(targetDir, func(p string, info fs.DirEntry, err error) error {
-					if err != nil {
-						return errors.Wrapf(err, "walk %v", p)
-					}
-
-					if !info.IsDir() && strings.HasPrefix(info.Name(), targetUUID) {
-						tempFile := path.Join(dirUploadPath, info.Name())
-						if _, err := os.Stat(tempFile); err == nil {
-							os.Remove(tempFile)
-							logger.Wf(ctx, "remove %v, duration=%v", tempFile, duration)
-						}
-					}
-
-					return nil
-				})
-			}()
-
-			// Use youtube-dl to download the file.
-			ytdlOutput := path.Join(targetDir, targetUUID)
-			args := []string{
-				"--output", ytdlOutput,
-			}
-			if proxy := envYtdlProxy(); proxy != "" {
-				args = append(args, "--proxy", proxy)
-			}
-			args = append(args, qFile)
-			if err := exec.CommandContext(ctx, "youtube-dl", args...).Run(); err != nil {
-				return errors.Wrapf(err, "run youtube-dl %v", args)
-			}
-
-			// Find out the downloaded target file.
-			var targetFile string
-			if err := filepath.WalkDir(targetDir, func(p string, info fs.DirEntry, err error) error {
-				if err != nil {
-					return errors.Wrapf(err, "walk %v", p)
-				}
-
-				if !info.IsDir() && strings.HasPrefix(info.Name(), targetUUID) {
-					targetFile = path.Join(dirUploadPath, info.Name())
-					return filepath.SkipDir
-				}
-
-				return nil
-			}); err != nil {
-				return errors.Wrapf(err, "walk %v", targetDir)
-			}
-
-			if targetFile == "" {
-				return errors.Errorf("no target file %v", targetUUID)
+			// Download the file in this request, the file is removed if not used when the job expired. Note
+			// that it's better to use the async API /terraform/v1/ytdl/create to run it in background.
+			job := NewYtdlJob(func(job *YtdlJob) {
+				job.URL = qFile
+			})
+			if err := job.Validate(); err != nil {
+				return errors.Wrapf(err, "validate %v", job.String())
 			}
 
-			// Get the file information.
-			targetFileInfo, err := os.Lstat(targetFile)
-			if err != nil {
-				return errors.Wrapf(err, "lstat %v", targetFile)
+			if err := ytdlWorker.Run(ctx, job); err != nil {
+				return errors.Wrapf(err, "run %v", job.String())
 			}
 
 			ohttp.WriteData(ctx, w, r, &struct {
@@ -403,12 +464,12 @@ func (v *VLiveWorker) Handle(ctx context.Context, handler *http.ServeMux) error
 				Target string `json:"target"`
 				Size   int    `json:"size"`
 			}{
-				Name:   targetFileInfo.Name(),
-				UUID:   targetUUID,
-				Target: targetFile,
-				Size:   int(targetFileInfo.Size()),
+				Name:   job.Name,
+				UUID:   job.UUID,
+				Target: job.Target,
+				Size:   int(job.Size),
 			})
-			logger.Tf(ctx, "vLive: Got vlive ytdl file target=%v, size=%v", targetFileInfo.Name(), targetFileInfo.Size())
+			logger.Tf(ctx, "vLive: Got vlive ytdl file target=%v, size=%v", job.Name, job.Size)
 			return nil
 		}(); err != nil {
 			ohttp.WriteError(ctx, w, r, err)
@@ -614,8 +675,16 @@ func (v *VLiveWorker) Handle(ctx context.Context, handler *http.ServeMux) error
 				UUID string `json:"uuid"`
 				// The target file name.
 				Target string `json:"target"`
+				// The UUID of resumable upload, for large file.
+				Upload string `json:"upload"`
 				// The source type.
 				Type FFprobeSourceType `json:"type"`
+				// The repeat count in playlist.
+				Repeat int `json:"repeat"`
+				// The artifact UUID, for record, DVR or VoD source.
+				Artifact string `json:"artifact"`
+				// The media asset UUID, for media source.
+				Media string `json:"media"`
 			}
 
 			var token, platform string
@@ -639,10 +708,21 @@ func (v *VLiveWorker) Handle(ctx context.Context, handler *http.ServeMux) error
 				return errors.New("no files")
 			}
 
+			// Use the file of resumable upload, which is completed by tus protocol.
+			for _, f := range files {
+				if f.Upload != "" {
+					if target, err := QueryUploadTarget(ctx, f.Upload, ""); err != nil {
+						return errors.Wrapf(err, "query upload %v", f.Upload)
+					} else {
+						f.Target = target
+					}
+				}
+			}
+
 			// Always cleanup the files in upload.
 			var tempFiles []string
 			for _, f := range files {
-				if f.Type != FFprobeSourceTypeStream {
+				if f.Type != FFprobeSourceTypeStream && !f.Type.IsShared() {
 					tempFiles = append(tempFiles, f.Target)
 				}
 			}
@@ -657,10 +737,28 @@ func (v *VLiveWorker) Handle(ctx context.Context, handler *http.ServeMux) error
 
 			// Check files.
 			for _, f := range files {
+				// For artifact, play the record or HLS directly, without copying.
+				if f.Type.IsArtifact() {
+					if target, err := ResolveArtifactTarget(ctx, f.Type, f.Artifact); err != nil {
+						return errors.Wrapf(err, "resolve %v %v", f.Type, f.Artifact)
+					} else {
+						f.Target = target
+					}
+				}
+
+				// For media asset, play the file of media library directly.
+				if f.Type == FFprobeSourceTypeMedia {
+					if source, err := ResolveMediaSource(ctx, f.Media); err != nil {
+						return errors.Wrapf(err, "resolve media %v", f.Media)
+					} else {
+						f.Target = source.Target
+					}
+				}
+
 				if f.Target == "" {
 					return errors.New("no target")
 				}
-				if f.Type != FFprobeSourceTypeStream {
+				if f.Type != FFprobeSourceTypeStream && !f.Type.IsShared() {
 					if _, err := os.Stat(f.Target); err != nil {
 						return errors.Wrapf(err, "no file %v", f.Target)
 					}
@@ -786,10 +884,11 @@ func (v *VLiveWorker) Handle(ctx context.Context, handler *http.ServeMux) error
 				parsedFile := &FFprobeSource{
 					Name: file.Name, Path: file.Path, Size: uint64(file.Size), UUID: file.UUID,
 					Target: file.Target,
-					Type:   file.Type,
+					Type:   file.Type, Repeat: file.Repeat, Artifact: file.Artifact,
+					Media:  file.Media,
 					Format: &format.Format, Video: matchVideo, Audio: matchAudio,
 				}
-				if file.Type != FFprobeSourceTypeStream {
+				if file.Type != FFprobeSourceTypeStream && !file.Type.IsShared() {
 					parsedFile.Target = path.Join(dirVLivePath, fmt.Sprintf("%v%v", file.UUID, path.Ext(file.Target)))
 					if err = os.Rename(file.Target, parsedFile.Target); err != nil {
 						return errors.Wrapf(err, "rename %v to %v", file.Target, parsedFile.Target)
@@ -812,14 +911,20 @@ func (v *VLiveWorker) Handle(ctx context.Context, handler *http.ServeMux) error
 					}
 				}
 
-				// Remove old files.
+				// Remove old files, but never remove the shared files like artifacts and media assets.
 				for _, f := range confObj.Files {
-					if f.Type != FFprobeSourceTypeStream {
+					if f.Type != FFprobeSourceTypeStream && !f.Type.IsShared() {
 						if _, err := os.Stat(f.Target); err == nil {
 							os.Remove(f.Target)
 						}
 					}
 				}
+
+				// Reference the media assets, to protect them from deleting.
+				owner := fmt.Sprintf("vlive:%v", platform)
+				if err := UpdateMediaRefs(ctx, owner, mediaUUIDsOf(confObj.Files), mediaUUIDsOf(parsedFiles)); err != nil {
+					return errors.Wrapf(err, "update media refs of %v", owner)
+				}
 				confObj.Files = parsedFiles
 
 				if b, err := json.Marshal(&confObj); err != nil {
@@ -909,9 +1014,10 @@ func (v *VLiveWorker) Start(ctx context.Context) error {
 
 			var task *VLiveTask
 			if tv, loaded := v.tasks.LoadOrStore(config.Platform, &VLiveTask{
-				UUID:     uuid.NewString(),
-				Platform: config.Platform,
-				config:   &config,
+				UUID:      uuid.NewString(),
+				Platform:  config.Platform,
+				config:    &config,
+				epgNotify: make(chan struct{}, 1),
 			}); loaded {
 				// Ignore if exists.
 				continue
@@ -986,11 +1092,17 @@ type VLiveConfigure struct {
 
 	// The input files for vLive.
 	Files []*FFprobeSource `json:"files"`
+	// The play mode of files, sequential, shuffle or loop. Default to loop.
+	PlayMode VLivePlayMode `json:"playMode"`
+	// Whether keep one output connection across items of playlist.
+	Gapless bool `json:"gapless"`
+	// The re-encode mode with overlays, copy the stream if not enabled.
+	Encode *VLiveEncode `json:"encode,omitempty"`
 }
 
 func (v VLiveConfigure) String() string {
-	return fmt.Sprintf("platform=%v, server=%v, secret=%v, enabled=%v, customed=%v, label=%v, files=%v",
-		v.Platform, v.Server, v.Secret, v.Enabled, v.Customed, v.Label, v.Files,
+	return fmt.Sprintf("platform=%v, server=%v, secret=%v, enabled=%v, customed=%v, label=%v, files=%v, mode=%v, gapless=%v, encode=<%v>",
+		v.Platform, v.Server, v.Secret, v.Enabled, v.Customed, v.Label, v.Files, v.PlayMode, v.Gapless, v.Encode,
 	)
 }
 
@@ -1002,9 +1114,17 @@ func (v *VLiveConfigure) Update(u *VLiveConfigure) error {
 	v.Enabled = u.Enabled
 	v.Customed = u.Customed
 	v.Files = append([]*FFprobeSource{}, u.Files...)
+	v.PlayMode = u.PlayMode
+	v.Gapless = u.Gapless
+	v.Encode = u.Encode
 	return nil
 }
 
+// Whether re-encode the stream with overlays.
+func (v *VLiveConfigure) encodeEnabled() bool {
+	return v.Encode != nil && v.Encode.Enabled
+}
+
 // VLiveTask is a task for FFmpeg to vLive stream, with a configure.
 type VLiveTask struct {
 	// The ID for task.
@@ -1032,9 +1152,21 @@ type VLiveTask struct {
 
 	// The context for current task.
 	cancel context.CancelFunc
+	// The context for current playing item, only for gapless mode.
+	cancelItem context.CancelFunc
 
 	// The configure for vLive task.
 	config *VLiveConfigure
+	// The playlist to select the input file, rebuilt when config changed.
+	playlist *VLivePlaylist
+	// The EPG of channel, reloaded by the EPG watcher.
+	epg *VLiveEPG
+	// The source key of EPG for current playlist, the slot UUID or filler.
+	epgSource string
+	// Whether the current item is stopped by EPG switching, reset when playlist is rebuilt.
+	epgSwitched bool
+	// Signal the EPG watcher to reload the EPG, when EPG is changed by user.
+	epgNotify chan struct{}
 	// The vLive worker.
 	vLiveWorker *VLiveWorker
 
@@ -1093,9 +1225,175 @@ func (v *VLiveTask) Restart(ctx context.Context) error {
 		return errors.Wrapf(err, "unmarshal %v", b)
 	}
 
+	// Rebuild the playlist, because files or mode might be changed.
+	v.playlist = nil
+
+	return nil
+}
+
+// Skip the current playing item, and play the next item of playlist.
+func (v *VLiveTask) Skip(ctx context.Context) error {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if v.playlist == nil {
+		return errors.New("no playlist")
+	}
+	v.playlist.Skip()
+	v.stopCurrentItem()
+	logger.Tf(ctx, "vLive: Skip platform=%v to next item", v.Platform)
+
+	return nil
+}
+
+// Jump to the item of playlist by file UUID, stop the current playing item.
+func (v *VLiveTask) Jump(ctx context.Context, fileUUID string) error {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if v.playlist == nil {
+		return errors.New("no playlist")
+	}
+	if err := v.playlist.Jump(fileUUID); err != nil {
+		return errors.Wrapf(err, "jump to %v", fileUUID)
+	}
+	v.stopCurrentItem()
+	logger.Tf(ctx, "vLive: Jump platform=%v to file=%v", v.Platform, fileUUID)
+
+	return nil
+}
+
+// Stop the current playing item, only stop the feeder for gapless mode, to keep the output connection.
+// Note that the caller should hold the lock.
+func (v *VLiveTask) stopCurrentItem() {
+	if v.config.Gapless {
+		if v.cancelItem != nil {
+			v.cancelItem()
+		}
+	} else if v.cancel != nil {
+		v.cancel()
+	}
+}
+
+// Write the ticker text to file, because FFmpeg reads the text from it.
+func (v *VLiveTask) prepareTicker() error {
+	if v.config.Encode.Ticker == nil {
+		return nil
+	}
+	return writeVLiveTicker(v.Platform, v.config.Encode.Ticker.Text)
+}
+
+// Update the ticker text, which is reloaded by FFmpeg without restarting.
+func (v *VLiveTask) UpdateTicker(ctx context.Context, text string) error {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if !v.config.encodeEnabled() || v.config.Encode.Ticker == nil {
+		return errors.Errorf("no ticker for platform=%v", v.Platform)
+	}
+
+	v.config.Encode.Ticker.Text = text
+	if err := writeVLiveTicker(v.Platform, text); err != nil {
+		return errors.Wrapf(err, "write ticker")
+	}
+
+	logger.Tf(ctx, "vLive: Update ticker platform=%v, text=%vB", v.Platform, len(text))
 	return nil
 }
 
+// Whether the current item is interrupted by skip, jump or EPG switching.
+func (v *VLiveTask) interrupted() bool {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	return v.epgSwitched || (v.playlist != nil && v.playlist.interrupted)
+}
+
+// NotifyEPG signals the EPG watcher to reload the EPG, never blocks.
+func (v *VLiveTask) NotifyEPG() {
+	select {
+	case v.epgNotify <- struct{}{}:
+	default:
+	}
+}
+
+// The duration to wait for next EPG refresh, until the next slot boundary, but at most one minute.
+func (v *VLiveTask) epgRefreshInterval(now time.Time) time.Duration {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	interval := 60 * time.Second
+	if v.epg == nil || !v.epg.Enabled {
+		return interval
+	}
+
+	if next := v.epg.NextBoundary(now); !next.IsZero() && next.Sub(now) < interval {
+		interval = next.Sub(now)
+	}
+	if interval < 100*time.Millisecond {
+		interval = 100 * time.Millisecond
+	}
+	return interval
+}
+
+// Reload the EPG, and switch to the new source if the active slot changed.
+func (v *VLiveTask) refreshEPG(ctx context.Context) error {
+	epg, err := loadVLiveEPG(ctx, v.Platform)
+	if err != nil {
+		return errors.Wrapf(err, "load epg of %v", v.Platform)
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	v.epg = epg
+	if v.playlist == nil {
+		return nil
+	}
+
+	source := v.selectEPGSource()
+	if source == v.epgSource {
+		return nil
+	}
+
+	logger.Tf(ctx, "vLive: EPG switch platform=%v from %v to %v", v.Platform, v.epgSource, source)
+	v.playlist, v.epgSwitched = nil, true
+	v.stopCurrentItem()
+	return nil
+}
+
+// Select the source key of EPG at now, empty if EPG disabled. Note that the caller should hold the lock.
+func (v *VLiveTask) selectEPGSource() string {
+	if v.epg == nil || !v.epg.Enabled {
+		return ""
+	}
+
+	source, _, _ := v.epg.Source(time.Now(), v.config.Files, v.config.PlayMode)
+	return source
+}
+
+// Query the current playing item of playlist, nil if not playing.
+func (v *VLiveTask) queryPlaylist() map[string]interface{} {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if v.playlist == nil {
+		return nil
+	}
+
+	index, file := v.playlist.Current()
+	if file == nil {
+		return nil
+	}
+
+	return map[string]interface{}{
+		"uuid":   file.UUID,
+		"name":   file.Name,
+		"index":  index,
+		"repeat": file.Repeat,
+	}
+}
+
 func (v *VLiveTask) updateFrame(frame string) {
 	v.lock.Lock()
 	defer v.lock.Unlock()
@@ -1142,39 +1440,49 @@ func (v *VLiveTask) Run(ctx context.Context) error {
 	ctx = logger.WithContext(ctx)
 	logger.Tf(ctx, "vLive: Run task %v", v.String())
 
-	selectInputFile := func() *FFprobeSource {
-		v.lock.Lock()
-		defer v.lock.Unlock()
-
-		if len(v.config.Files) == 0 {
-			return nil
-		}
-
-		file := v.config.Files[0]
-		logger.Tf(ctx, "vLive: Use file=%v as input for platform=%v", file.UUID, v.Platform)
-		return file
-	}
-
 	pfn := func(ctx context.Context) error {
 		// Ignore when not enabled.
 		if !v.config.Enabled {
 			return nil
 		}
 
-		// Use a active stream as input.
-		input := selectInputFile()
+		// Keep the output connection and feed each item of playlist.
+		if v.config.Gapless {
+			if err := v.doGaplessVirtualLiveStream(ctx); err != nil {
+				return errors.Wrapf(err, "do gapless vLive")
+			}
+			return nil
+		}
+
+		// Use the next file of playlist as input.
+		input, loops := v.selectInputFile(ctx)
 		if input == nil {
 			return nil
 		}
 
-		// Start vLive task.
-		if err := v.doVirtualLiveStream(ctx, input); err != nil {
+		// Start vLive task. Ignore the error if user skip to other item.
+		if err := v.doVirtualLiveStream(ctx, input, loops); err != nil && !v.interrupted() {
 			return errors.Wrapf(err, "do vLive")
 		}
 
 		return nil
 	}
 
+	// Watch the EPG, to switch the source by time slots.
+	go func() {
+		for ctx.Err() == nil {
+			if err := v.refreshEPG(ctx); err != nil {
+				logger.Wf(ctx, "ignore vLive epg err %+v", err)
+			}
+
+			select {
+			case <-ctx.Done():
+			case <-v.epgNotify:
+			case <-time.After(v.epgRefreshInterval(time.Now())):
+			}
+		}
+	}()
+
 	for ctx.Err() == nil {
 		if err := pfn(ctx); err != nil {
 			logger.Wf(ctx, "ignore %v err %+v", v.String(), err)
@@ -1195,7 +1503,37 @@ func (v *VLiveTask) Run(ctx context.Context) error {
 	return nil
 }
 
-func (v *VLiveTask) doVirtualLiveStream(ctx context.Context, input *FFprobeSource) error {
+// Select the next file of playlist as input, return the file and the -stream_loop for FFmpeg.
+func (v *VLiveTask) selectInputFile(ctx context.Context) (*FFprobeSource, int) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if len(v.config.Files) == 0 {
+		return nil, 0
+	}
+
+	if v.playlist == nil {
+		files, mode := v.config.Files, v.config.PlayMode
+		if v.epg != nil && v.epg.Enabled {
+			v.epgSource, files, mode = v.epg.Source(time.Now(), files, mode)
+		} else {
+			v.epgSource = ""
+		}
+		v.playlist, v.epgSwitched = NewVLivePlaylist(mode, files), false
+	}
+
+	file := v.playlist.Next()
+	if file == nil {
+		return nil, 0
+	}
+
+	loops := v.playlist.StreamLoop(file)
+	logger.Tf(ctx, "vLive: Use file=%v as input for platform=%v, mode=%v, loops=%v",
+		file.UUID, v.Platform, v.playlist.mode, loops)
+	return file, loops
+}
+
+func (v *VLiveTask) doVirtualLiveStream(ctx context.Context, input *FFprobeSource, loops int) error {
 	// Create context for current task.
 	parentCtx := ctx
 	ctx, cancel := context.WithCancel(ctx)
@@ -1220,8 +1558,10 @@ func (v *VLiveTask) doVirtualLiveStream(ctx context.Context, input *FFprobeSourc
 
 	// Start FFmpeg process.
 	args := []string{}
-	if input.Type == FFprobeSourceTypeFile || input.Type == FFprobeSourceTypeUpload || input.Type == FFprobeSourceTypeYTDL {
-		args = append(args, "-stream_loop", "-1")
+	if input.Type == FFprobeSourceTypeFile || input.Type == FFprobeSourceTypeUpload || input.Type == FFprobeSourceTypeYTDL || input.Type.IsShared() {
+		if loops != 0 {
+			args = append(args, "-stream_loop", fmt.Sprintf("%v", loops))
+		}
 		args = append(args, "-re")
 	}
 	// For RTSP stream source, always use TCP transport.
@@ -1239,7 +1579,18 @@ func (v *VLiveTask) doVirtualLiveStream(ctx context.Context, input *FFprobeSourc
 	} else {
 		args = append(args, "-i", input.Target)
 	}
-	args = append(args, "-c", "copy")
+	if v.config.encodeEnabled() {
+		if err := v.prepareTicker(); err != nil {
+			return errors.Wrapf(err, "prepare ticker")
+		}
+		profile, err := v.config.Encode.ResolveProfile(ctx)
+		if err != nil {
+			return errors.Wrapf(err, "resolve profile")
+		}
+		args = append(args, v.config.Encode.FFmpegArgs(vLiveTickerFile(v.Platform), profile)...)
+	} else {
+		args = append(args, "-c", "copy")
+	}
 	// If RTMP use flv, if SRT use mpegts, otherwise do not set.
 	if strings.HasPrefix(outputURL, "rtmp://") || strings.HasPrefix(outputURL, "rtmps://") {
 		args = append(args, "-f", "flv")
@@ -1315,3 +1666,481 @@ func (v *VLiveTask) doVirtualLiveStream(ctx context.Context, input *FFprobeSourc
 
 	return err
 }
+
+// The gapless vLive uses a persistent FFmpeg to publish the output stream, which reads MPEG-TS from stdin,
+// and starts a feeder FFmpeg for each item of playlist, which writes MPEG-TS to stdin of the output FFmpeg.
+// So the output connection is kept across items, and the timestamp of each item is shifted to be continuous.
+func (v *VLiveTask) doGaplessVirtualLiveStream(ctx context.Context) error {
+	// Select the first item before starting the output FFmpeg, to avoid publishing an empty stream when
+	// there is no item to play, for example, the sequential playlist is finished.
+	input, loops := v.selectInputFile(ctx)
+	if input == nil {
+		return nil
+	}
+
+	// Create context for current task.
+	parentCtx := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	v.cancel = cancel
+
+	// Build input URL.
+	host := "localhost"
+
+	// Build output URL.
+	outputServer := strings.ReplaceAll(v.config.Server, "localhost", host)
+	if !strings.HasSuffix(outputServer, "/") && !strings.HasPrefix(v.config.Secret, "/") && v.config.Secret != "" {
+		outputServer += "/"
+	}
+	outputURL := fmt.Sprintf("%v%v", outputServer, v.config.Secret)
+
+	// All items are normalized to the same profile, to make the output stream continuous.
+	profile := NewVLiveOutputProfile(v.config.Files)
+
+	// Create a heartbeat to poll and manage the status of FFmpeg process.
+	heartbeat := NewFFmpegHeartbeat(cancel)
+	v.starttime, v.firstReadyTime = &heartbeat.starttime, nil
+	defer func() {
+		v.starttime = nil
+	}()
+
+	// Start the output FFmpeg process, which reads MPEG-TS from stdin.
+	args := []string{"-fflags", "+genpts", "-f", "mpegts", "-i", "pipe:0"}
+	if v.config.encodeEnabled() {
+		if err := v.prepareTicker(); err != nil {
+			return errors.Wrapf(err, "prepare ticker")
+		}
+		profile, err := v.config.Encode.ResolveProfile(ctx)
+		if err != nil {
+			return errors.Wrapf(err, "resolve profile")
+		}
+		args = append(args, v.config.Encode.FFmpegArgs(vLiveTickerFile(v.Platform), profile)...)
+	} else {
+		args = append(args, "-c", "copy")
+	}
+	// If RTMP use flv, if SRT use mpegts, otherwise do not set.
+	if strings.HasPrefix(outputURL, "rtmp://") || strings.HasPrefix(outputURL, "rtmps://") {
+		args = append(args, "-f", "flv")
+	} else if strings.HasPrefix(outputURL, "srt://") {
+		args = append(args, "-pes_payload_size", "0", "-f", "mpegts")
+	}
+	args = append(args, outputURL)
+	// Create the command object.
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return errors.Wrapf(err, "pipe stdin")
+	}
+	defer stdin.Close()
+
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return errors.Wrapf(err, "pipe process")
+	}
+
+	if err := cmd.Start(); err != nil {
+		return errors.Wrapf(err, "execute ffmpeg %v", strings.Join(args, " "))
+	}
+
+	v.PID = int32(cmd.Process.Pid)
+	v.Output = outputURL
+	defer func() {
+		// If we got a PID, sleep for a while, to avoid too fast restart.
+		if v.PID > 0 {
+			select {
+			case <-ctx.Done():
+			case <-time.After(1 * time.Second):
+			}
+		}
+
+		// When canceled, we should still write to redis, so we must not use ctx(which is cancelled).
+		v.cleanup(parentCtx)
+		v.saveTask(parentCtx)
+	}()
+	logger.Tf(ctx, "vLive: Start gapless, platform=%v, profile=%v, pid=%v", v.Platform, profile.String(), v.PID)
+
+	if err := v.saveTask(ctx); err != nil {
+		return errors.Wrapf(err, "save task %v", v.String())
+	}
+
+	// Pull the latest log frame.
+	heartbeat.Polling(ctx, stderr)
+	go func() {
+		select {
+		case <-ctx.Done():
+			return
+		case <-heartbeat.firstReadyCtx.Done():
+			v.firstReadyTime = &heartbeat.firstReadyTime
+		}
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case frame := <-heartbeat.FrameLogs:
+				v.updateFrame(frame)
+			}
+		}
+	}()
+
+	// Feed the items of playlist one by one, quit when output FFmpeg terminated.
+	go func() {
+		defer cancel()
+
+		starttime := time.Now()
+		for ctx.Err() == nil {
+			// The first item is selected before starting the output FFmpeg.
+			if input == nil {
+				input, loops = v.selectInputFile(ctx)
+			}
+			if input == nil {
+				logger.Tf(ctx, "vLive: No more item for platform=%v", v.Platform)
+				return
+			}
+
+			// The feeder runs in realtime by -re, so we use the elapsed time as timestamp offset.
+			offset := time.Since(starttime)
+			if err := v.doGaplessItem(ctx, stdin, profile, input, loops, offset); err != nil && !v.interrupted() {
+				logger.Wf(ctx, "vLive: Ignore item %v err %+v", input.UUID, err)
+
+				select {
+				case <-ctx.Done():
+				case <-time.After(1 * time.Second):
+				}
+			}
+			input = nil
+		}
+	}()
+
+	// Process terminated, or user cancel the process.
+	select {
+	case <-parentCtx.Done():
+	case <-ctx.Done():
+	case <-heartbeat.PollingCtx.Done():
+	}
+	logger.Tf(ctx, "vLive: Gapless stopping, platform=%v, pid=%v", v.Platform, v.PID)
+
+	err = cmd.Wait()
+	logger.Tf(ctx, "vLive: Gapless done, platform=%v, pid=%v, err=%v", v.Platform, v.PID, err)
+
+	return err
+}
+
+// Start a feeder FFmpeg to write the input as MPEG-TS to w, with timestamp shifted by offset.
+func (v *VLiveTask) doGaplessItem(
+	ctx context.Context, w io.Writer, profile *VLiveOutputProfile, input *FFprobeSource, loops int,
+	offset time.Duration,
+) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	args := []string{}
+	if input.Type != FFprobeSourceTypeStream {
+		if loops != 0 {
+			args = append(args, "-stream_loop", fmt.Sprintf("%v", loops))
+		}
+	}
+	args = append(args, "-re")
+	// For RTSP stream source, always use TCP transport.
+	if strings.HasPrefix(input.Target, "rtsp://") {
+		args = append(args, "-rtsp_transport", "tcp")
+	}
+	// Rebuild the stream url, because it may contain special characters.
+	if strings.Contains(input.Target, "://") {
+		if u, err := RebuildStreamURL(input.Target); err != nil {
+			return errors.Wrapf(err, "rebuild %v", input.Target)
+		} else {
+			args = append(args, "-i", u.String())
+		}
+	} else {
+		args = append(args, "-i", input.Target)
+	}
+	args = append(args, profile.FeederArgs(input)...)
+	args = append(args, "-output_ts_offset", fmt.Sprintf("%.3f", offset.Seconds()), "-f", "mpegts", "pipe:1")
+
+	// Never close the w, which is the stdin of output FFmpeg.
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+	cmd.Stdout = w
+
+	if err := cmd.Start(); err != nil {
+		return errors.Wrapf(err, "execute ffmpeg %v", strings.Join(args, " "))
+	}
+
+	func() {
+		v.lock.Lock()
+		defer v.lock.Unlock()
+		v.Input, v.inputUUID, v.cancelItem = input.Target, input.UUID, cancel
+	}()
+	defer func() {
+		v.lock.Lock()
+		defer v.lock.Unlock()
+		v.cancelItem = nil
+	}()
+	logger.Tf(ctx, "vLive: Feed platform=%v, input=%v, offset=%v, match=%v, pid=%v",
+		v.Platform, input.Target, offset, profile.Match(input), cmd.Process.Pid)
+
+	if err := cmd.Wait(); err != nil {
+		return errors.Wrapf(err, "feed %v", input.Target)
+	}
+	return nil
+}
+
+// VLiveOutputProfile is the output profile of gapless vLive, all items are normalized to this profile,
+// because the codec parameters should not change for the same output stream.
+type VLiveOutputProfile struct {
+	// The video width and height, use the first video file.
+	Width  int32 `json:"width"`
+	Height int32 `json:"height"`
+	// The video frame rate, profile and pixel format, use the first video file if it's H.264, because
+	// the SPS should not change in the output, or players fail.
+	FrameRate    string `json:"frame_rate"`
+	VideoProfile string `json:"profile"`
+	PixFormat    string `json:"pix_fmt"`
+	// The audio sample rate and channels, use the first audio file.
+	SampleRate string `json:"sample_rate"`
+	Channels   int32  `json:"channels"`
+}
+
+func NewVLiveOutputProfile(files []*FFprobeSource) *VLiveOutputProfile {
+	v := &VLiveOutputProfile{
+		Width: 1280, Height: 720, FrameRate: "25/1", VideoProfile: "High", PixFormat: "yuv420p",
+		SampleRate: "44100", Channels: 2,
+	}
+
+	for _, file := range files {
+		if video := file.Video; video != nil && video.Width > 0 && video.Height > 0 {
+			v.Width, v.Height = video.Width, video.Height
+			if video.CodecName == "h264" && vLiveX264Profile(video.Profile) != "" && video.PixFormat != "" &&
+				parseFrameRate(video.FrameRate) > 0 {
+				v.FrameRate, v.VideoProfile, v.PixFormat = video.FrameRate, video.Profile, video.PixFormat
+			}
+			break
+		}
+	}
+
+	for _, file := range files {
+		if file.Audio != nil && file.Audio.SampleRate != "" && file.Audio.Channels > 0 {
+			v.SampleRate, v.Channels = file.Audio.SampleRate, file.Audio.Channels
+			break
+		}
+	}
+
+	return v
+}
+
+func (v *VLiveOutputProfile) String() string {
+	return fmt.Sprintf("width=%v, height=%v, fps=%v, profile=%v, pix_fmt=%v, rate=%v, channels=%v",
+		v.Width, v.Height, v.FrameRate, v.VideoProfile, v.PixFormat, v.SampleRate, v.Channels,
+	)
+}
+
+// Get the profile of x264 encoder by the profile of ffprobe, empty if not supported.
+func vLiveX264Profile(profile string) string {
+	switch profile {
+	case "Constrained Baseline":
+		return "baseline"
+	case "Main":
+		return "main"
+	case "High":
+		return "high"
+	}
+	return ""
+}
+
+// Whether the video of file matches the profile, so it's able to copy.
+func (v *VLiveOutputProfile) matchVideo(file *FFprobeSource) bool {
+	video := file.Video
+	return video != nil && video.CodecName == "h264" && video.Width == v.Width && video.Height == v.Height &&
+		video.FrameRate == v.FrameRate && video.Profile == v.VideoProfile && video.PixFormat == v.PixFormat
+}
+
+// Whether the audio of file matches the profile, so it's able to copy.
+func (v *VLiveOutputProfile) matchAudio(file *FFprobeSource) bool {
+	audio := file.Audio
+	return audio != nil && audio.CodecName == "aac" && audio.SampleRate == v.SampleRate && audio.Channels == v.Channels
+}
+
+// Match whether the file matches the profile, or it should be normalized by transcoding.
+func (v *VLiveOutputProfile) Match(file *FFprobeSource) bool {
+	return v.matchVideo(file) && v.matchAudio(file)
+}
+
+// FeederArgs build the FFmpeg arguments after the input, to normalize the file to this profile. Note
+// that the first input must be the file, and we generate the missing stream by lavfi.
+func (v *VLiveOutputProfile) FeederArgs(file *FFprobeSource) []string {
+	var args []string
+
+	// Generate a black video or silent audio stream if missing, as input 1.
+	videoInput, audioInput := "0:v:0", "0:a:0"
+	if file.Video == nil {
+		args = append(args, "-f", "lavfi", "-i", fmt.Sprintf("color=c=black:s=%vx%v:r=%v", v.Width, v.Height, v.FrameRate))
+		videoInput = "1:v"
+	} else if file.Audio == nil {
+		layout := "stereo"
+		if v.Channels == 1 {
+			layout = "mono"
+		}
+		args = append(args, "-f", "lavfi", "-i", fmt.Sprintf("anullsrc=channel_layout=%v:sample_rate=%v",
+			layout, v.SampleRate,
+		))
+		audioInput = "1:a"
+	}
+	args = append(args, "-map", videoInput, "-map", audioInput)
+	if file.Video == nil || file.Audio == nil {
+		args = append(args, "-shortest")
+	}
+
+	if v.matchVideo(file) {
+		args = append(args, "-c:v", "copy")
+	} else {
+		// Set gop to 2s, and encode by the same profile, to keep the SPS of output.
+		gop := int(math.Round(parseFrameRate(v.FrameRate) * 2))
+		args = append(args,
+			"-c:v", "libx264", "-profile:v", vLiveX264Profile(v.VideoProfile), "-preset:v", "veryfast",
+			"-vf", fmt.Sprintf("scale=%v:%v,setsar=1", v.Width, v.Height), "-pix_fmt", v.PixFormat,
+			"-r", v.FrameRate, "-g", fmt.Sprintf("%v", gop),
+			"-bf", "0", // Disable B frame for WebRTC.
+		)
+	}
+
+	if v.matchAudio(file) {
+		args = append(args, "-c:a", "copy")
+	} else {
+		args = append(args,
+			"-c:a", "aac", "-ar", v.SampleRate, "-ac", fmt.Sprintf("%v", v.Channels), "-b:a", "128k",
+		)
+	}
+
+	return args
+}
+
+// VLivePlayMode is the mode to play the files of vLive playlist.
+type VLivePlayMode string
+
+// Play the files in order, and repeat the list forever.
+const VLivePlayModeLoop VLivePlayMode = "loop"
+
+// Play the files in order only once, stop after the last file.
+const VLivePlayModeSequential VLivePlayMode = "sequential"
+
+// Play the files in random order, and reshuffle for each round.
+const VLivePlayModeShuffle VLivePlayMode = "shuffle"
+
+func vLivePlayModeValid(modes []VLivePlayMode, mode VLivePlayMode) bool {
+	for _, m := range modes {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// VLivePlaylist selects the file to play from files of vLive, by the play mode. Note that it's not
+// thread safe, the VLiveTask should protect it by lock.
+type VLivePlaylist struct {
+	// The play mode.
+	mode VLivePlayMode
+	// The files of playlist.
+	files []*FFprobeSource
+	// The play order, each element is the index of files.
+	order []int
+	// The position in order of current item, -1 if not started.
+	cursor int
+	// The position in order to jump to, -1 if no jump.
+	pending int
+	// Whether all files are played, only for sequential mode.
+	finished bool
+	// Whether the current item is interrupted by skip or jump.
+	interrupted bool
+}
+
+func NewVLivePlaylist(mode VLivePlayMode, files []*FFprobeSource) *VLivePlaylist {
+	if mode == "" {
+		mode = VLivePlayModeLoop
+	}
+
+	v := &VLivePlaylist{
+		mode: mode, files: append([]*FFprobeSource{}, files...), cursor: -1, pending: -1,
+	}
+	for index := range v.files {
+		v.order = append(v.order, index)
+	}
+	if v.mode == VLivePlayModeShuffle {
+		v.shuffle()
+	}
+	return v
+}
+
+func (v *VLivePlaylist) shuffle() {
+	rand.Shuffle(len(v.order), func(i, j int) {
+		v.order[i], v.order[j] = v.order[j], v.order[i]
+	})
+}
+
+// Next moves to the next item to play, return nil if no more items.
+func (v *VLivePlaylist) Next() *FFprobeSource {
+	if len(v.files) == 0 {
+		return nil
+	}
+
+	v.interrupted = false
+	if v.pending >= 0 {
+		v.cursor, v.pending, v.finished = v.pending, -1, false
+	} else if !v.finished {
+		v.cursor++
+	}
+
+	if v.cursor >= len(v.order) {
+		if v.mode == VLivePlayModeSequential {
+			v.cursor, v.finished = len(v.order)-1, true
+		} else {
+			v.cursor = 0
+			if v.mode == VLivePlayModeShuffle {
+				v.shuffle()
+			}
+		}
+	}
+
+	if v.finished {
+		return nil
+	}
+	return v.files[v.order[v.cursor]]
+}
+
+// Current returns the index in files and the current playing file, or nil if not playing.
+func (v *VLivePlaylist) Current() (int, *FFprobeSource) {
+	if v.cursor < 0 || v.finished || len(v.files) == 0 {
+		return -1, nil
+	}
+
+	index := v.order[v.cursor]
+	return index, v.files[index]
+}
+
+// Skip the current item, the next item will be selected by Next.
+func (v *VLivePlaylist) Skip() {
+	v.interrupted = true
+}
+
+// Jump to the file by UUID, which will be selected by Next.
+func (v *VLivePlaylist) Jump(fileUUID string) error {
+	for pos, index := range v.order {
+		if v.files[index].UUID == fileUUID {
+			v.pending, v.interrupted = pos, true
+			return nil
+		}
+	}
+	return errors.Errorf("no file %v", fileUUID)
+}
+
+// StreamLoop returns the -stream_loop of FFmpeg for the file. Because FFmpeg is restarted for each
+// item, we loop the file by FFmpeg if there is only one file in loop mode, to avoid reconnecting.
+func (v *VLivePlaylist) StreamLoop(file *FFprobeSource) int {
+	if len(v.files) == 1 && v.mode != VLivePlayModeSequential {
+		return -1
+	}
+	if file.Repeat > 1 {
+		return file.Repeat - 1
+	}
+	return 0
+}
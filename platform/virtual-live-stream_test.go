@@ -0,0 +1,247 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVLive_PlaylistModes(t *testing.T) {
+	files := []*FFprobeSource{{UUID: "a"}, {UUID: "b"}, {UUID: "c"}}
+
+	for _, e := range []struct {
+		mode   VLivePlayMode
+		expect []string
+	}{
+		{mode: "", expect: []string{"a", "b", "c", "a", "b"}},
+		{mode: VLivePlayModeLoop, expect: []string{"a", "b", "c", "a", "b"}},
+		{mode: VLivePlayModeSequential, expect: []string{"a", "b", "c", "", ""}},
+	} {
+		playlist := NewVLivePlaylist(e.mode, files)
+		for index, expect := range e.expect {
+			var actual string
+			if file := playlist.Next(); file != nil {
+				actual = file.UUID
+			}
+			if actual != expect {
+				t.Errorf("mode=%v, #%v expect %v, actual %v", e.mode, index, expect, actual)
+			}
+		}
+	}
+}
+
+func TestVLive_PlaylistShuffle(t *testing.T) {
+	files := []*FFprobeSource{{UUID: "a"}, {UUID: "b"}, {UUID: "c"}}
+	playlist := NewVLivePlaylist(VLivePlayModeShuffle, files)
+
+	// Each round should play every file exactly once.
+	for round := 0; round < 3; round++ {
+		played := make(map[string]bool)
+		for range files {
+			played[playlist.Next().UUID] = true
+		}
+		if len(played) != len(files) {
+			t.Errorf("round=%v expect %v files, actual %v", round, len(files), played)
+		}
+	}
+}
+
+func TestVLive_PlaylistJump(t *testing.T) {
+	files := []*FFprobeSource{{UUID: "a"}, {UUID: "b"}, {UUID: "c", Repeat: 3}}
+	playlist := NewVLivePlaylist(VLivePlayModeSequential, files)
+
+	if file := playlist.Next(); file.UUID != "a" {
+		t.Errorf("expect a, actual %v", file.UUID)
+	}
+	if err := playlist.Jump("c"); err != nil {
+		t.Errorf("jump err %+v", err)
+	}
+	if !playlist.interrupted {
+		t.Errorf("should be interrupted")
+	}
+	if file := playlist.Next(); file.UUID != "c" {
+		t.Errorf("expect c, actual %v", file.UUID)
+	} else if loops := playlist.StreamLoop(file); loops != 2 {
+		t.Errorf("expect loops 2, actual %v", loops)
+	}
+	if index, file := playlist.Current(); index != 2 || file.UUID != "c" {
+		t.Errorf("expect current 2, actual %v", index)
+	}
+	if file := playlist.Next(); file != nil {
+		t.Errorf("expect finished, actual %v", file.UUID)
+	}
+
+	// Jump to a finished playlist should restart from that file.
+	if err := playlist.Jump("b"); err != nil {
+		t.Errorf("jump err %+v", err)
+	}
+	if file := playlist.Next(); file == nil || file.UUID != "b" {
+		t.Errorf("expect b, actual %v", file)
+	}
+	if err := playlist.Jump("x"); err == nil {
+		t.Errorf("should fail for no file")
+	}
+
+	// Only one file in loop mode, loop by FFmpeg.
+	single := NewVLivePlaylist(VLivePlayModeLoop, files[:1])
+	if loops := single.StreamLoop(single.Next()); loops != -1 {
+		t.Errorf("expect loops -1, actual %v", loops)
+	}
+}
+
+func TestVLive_OutputProfile(t *testing.T) {
+	matched := &FFprobeSource{
+		Video: &FFprobeVideo{CodecName: "h264", Profile: "Main", Width: 1920, Height: 1080, PixFormat: "yuv420p", FrameRate: "30/1"},
+		Audio: &FFprobeAudio{CodecName: "aac", SampleRate: "48000", Channels: 2},
+	}
+	fps := &FFprobeSource{
+		Video: &FFprobeVideo{CodecName: "h264", Profile: "Main", Width: 1920, Height: 1080, PixFormat: "yuv420p", FrameRate: "25/1"},
+		Audio: &FFprobeAudio{CodecName: "aac", SampleRate: "48000", Channels: 2},
+	}
+	pixfmt := &FFprobeSource{
+		Video: &FFprobeVideo{CodecName: "h264", Profile: "High", Width: 1920, Height: 1080, PixFormat: "yuv420p", FrameRate: "30/1"},
+		Audio: &FFprobeAudio{CodecName: "aac", SampleRate: "48000", Channels: 2},
+	}
+	hevc := &FFprobeSource{
+		Video: &FFprobeVideo{CodecName: "hevc", Width: 1920, Height: 1080},
+		Audio: &FFprobeAudio{CodecName: "aac", SampleRate: "48000", Channels: 2},
+	}
+	silent := &FFprobeSource{
+		Video: &FFprobeVideo{CodecName: "h264", Profile: "Main", Width: 1920, Height: 1080, PixFormat: "yuv420p", FrameRate: "30/1"},
+	}
+
+	profile := NewVLiveOutputProfile([]*FFprobeSource{silent, matched, hevc})
+	if profile.Width != 1920 || profile.Height != 1080 || profile.SampleRate != "48000" || profile.Channels != 2 ||
+		profile.FrameRate != "30/1" || profile.VideoProfile != "Main" || profile.PixFormat != "yuv420p" {
+		t.Errorf("invalid profile %v", profile.String())
+	}
+
+	if !profile.Match(matched) {
+		t.Errorf("should match %v", matched)
+	}
+	if args := strings.Join(profile.FeederArgs(matched), " "); args != "-map 0:v:0 -map 0:a:0 -c:v copy -c:a copy" {
+		t.Errorf("invalid args %v", args)
+	}
+
+	// Should re-encode by the profile, if the frame rate or profile differs.
+	for _, file := range []*FFprobeSource{fps, pixfmt} {
+		if profile.Match(file) {
+			t.Errorf("should not match %v", file.Video)
+		}
+		if args := strings.Join(profile.FeederArgs(file), " "); !strings.Contains(args, "-c:v libx264 -profile:v main") ||
+			!strings.Contains(args, "-pix_fmt yuv420p -r 30/1 -g 60") || !strings.Contains(args, "-c:a copy") {
+			t.Errorf("invalid args %v", args)
+		}
+	}
+
+	if profile.Match(hevc) {
+		t.Errorf("should not match %v", hevc)
+	}
+	if args := strings.Join(profile.FeederArgs(hevc), " "); !strings.Contains(args, "-c:v libx264") || !strings.Contains(args, "-c:a copy") {
+		t.Errorf("invalid args %v", args)
+	}
+
+	if profile.Match(silent) {
+		t.Errorf("should not match %v", silent)
+	}
+	if args := strings.Join(profile.FeederArgs(silent), " "); !strings.Contains(args, "anullsrc=channel_layout=stereo:sample_rate=48000") ||
+		!strings.Contains(args, "-map 1:a") || !strings.Contains(args, "-c:v copy") || !strings.Contains(args, "-shortest") {
+		t.Errorf("invalid args %v", args)
+	}
+
+	if defaults := NewVLiveOutputProfile(nil); defaults.Width != 1280 || defaults.Height != 720 || defaults.FrameRate != "25/1" {
+		t.Errorf("invalid default profile %v", defaults.String())
+	}
+}
+
+func TestVLive_EPGSlots(t *testing.T) {
+	files := []*FFprobeSource{{UUID: "a"}, {UUID: "b"}, {UUID: "c"}}
+	epg := &VLiveEPG{Platform: "vlive-x", Enabled: true, Filler: []string{"c"}, Slots: []*VLiveEPGSlot{
+		{UUID: "s2", Title: "News", Start: "2024-01-01T21:00:00Z", End: "2024-01-01T22:00:00Z", Files: []string{"b"}},
+		{UUID: "s1", Title: "Movie", Start: "2024-01-01T20:00:00Z", End: "2024-01-01T21:00:00Z", Files: []string{"a"}},
+	}}
+
+	if err := epg.Validate(); err != nil {
+		t.Errorf("validate err %+v", err)
+	} else if epg.Slots[0].UUID != "s1" {
+		t.Errorf("expect sorted, actual %v", epg.Slots[0].UUID)
+	}
+
+	for _, e := range []struct {
+		now    string
+		source string
+		file   string
+	}{
+		{now: "2024-01-01T19:59:59Z", source: VLiveEPGFiller, file: "c"},
+		{now: "2024-01-01T20:00:00Z", source: "s1", file: "a"},
+		{now: "2024-01-01T21:00:00Z", source: "s2", file: "b"},
+		{now: "2024-01-01T22:00:00Z", source: VLiveEPGFiller, file: "c"},
+	} {
+		now, _ := time.Parse(time.RFC3339, e.now)
+		if source, picked, _ := epg.Source(now, files, VLivePlayModeLoop); source != e.source || len(picked) != 1 || picked[0].UUID != e.file {
+			t.Errorf("now=%v expect %v %v, actual %v %v", e.now, e.source, e.file, source, picked)
+		}
+	}
+
+	for _, e := range []struct {
+		now  string
+		next string
+	}{
+		{now: "2024-01-01T19:00:00Z", next: "2024-01-01T20:00:00Z"},
+		{now: "2024-01-01T20:00:00Z", next: "2024-01-01T21:00:00Z"},
+		{now: "2024-01-01T21:30:00Z", next: "2024-01-01T22:00:00Z"},
+		{now: "2024-01-01T22:00:00Z", next: ""},
+	} {
+		now, _ := time.Parse(time.RFC3339, e.now)
+		if next := epg.NextBoundary(now); (e.next == "" && !next.IsZero()) || (e.next != "" && next.Format(time.RFC3339) != e.next) {
+			t.Errorf("now=%v expect next %v, actual %v", e.now, e.next, next)
+		}
+	}
+
+	if b, err := epg.ToXMLTV("Movies"); err != nil {
+		t.Errorf("xmltv err %+v", err)
+	} else if xmltv := string(b); !strings.Contains(xmltv, `<programme start="20240101200000 +0000" stop="20240101210000 +0000" channel="vlive-x">`) ||
+		!strings.Contains(xmltv, "<display-name>Movies</display-name>") {
+		t.Errorf("invalid xmltv %v", xmltv)
+	}
+
+	epg.Slots = append(epg.Slots, &VLiveEPGSlot{UUID: "s3", Start: "2024-01-01T21:30:00Z", End: "2024-01-01T23:00:00Z"})
+	if err := epg.Validate(); err == nil {
+		t.Errorf("should fail for overlap")
+	}
+
+	epg.Slots = []*VLiveEPGSlot{{UUID: "s4", Start: "2024-01-02T20:00:00Z", End: "2024-01-02T21:00:00Z", PlayMode: "random"}}
+	if err := epg.Validate(); err == nil {
+		t.Errorf("should fail for play mode")
+	}
+}
+
+func TestVLive_EncodeOverlays(t *testing.T) {
+	encode := &VLiveEncode{
+		Enabled: true,
+		TranscodeEncoder: TranscodeEncoder{
+			VideoCodec: "libx264", AudioCodec: "aac", VideoBitrate: 1200, AudioBitrate: 64,
+			VideoProfile: "main", VideoPreset: "veryfast",
+		},
+		Logo:   &VLiveLogo{File: "vlive/logo.png", Position: VLivePositionBottomRight, Opacity: 0.8, Margin: 10},
+		Ticker: &VLiveTicker{Text: "Hello", Speed: 50},
+		Clock:  &VLiveClock{Format: "%H:%M:%S"},
+	}
+
+	args := strings.Join(encode.FFmpegArgs("vlive/wx.ticker.txt", encode.legacyProfile()), " ")
+	for _, expect := range []string{
+		"-i vlive/logo.png -filter_complex [1:v]format=rgba,colorchannelmixer=aa=0.8[logo];",
+		"[0:v][logo]overlay=x=W-w-10:y=H-h-10[logoed];",
+		"[logoed]drawtext=textfile=vlive/wx.ticker.txt:reload=1:fontsize=32:fontcolor=white:box=1:boxcolor=black@0.5:boxborderw=8:x=w-mod(t*50\\,w+tw):y=h-th-20[ticker];",
+		`[ticker]drawtext=text=%{localtime\\:%H\\\\\\:%M\\\\\\:%S}:`,
+		"-map [clock] -map 0:a? -vcodec libx264 -profile:v main -preset:v veryfast",
+	} {
+		if !strings.Contains(args, expect) {
+			t.Errorf("expect %v in %v", expect, args)
+		}
+	}
+
+	if args := strings.Join((&VLiveEncode{TranscodeEncoder: encode.TranscodeEncoder}).FFmpegArgs("", encode.legacyProfile()), " "); strings.Contains(args, "-filter_complex") {
+		t.Errorf("should not filter for %v", args)
+	}
+}
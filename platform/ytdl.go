@@ -0,0 +1,656 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ossrs/go-oryx-lib/errors"
+	ohttp "github.com/ossrs/go-oryx-lib/http"
+	"github.com/ossrs/go-oryx-lib/logger"
+
+	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+)
+
+var ytdlWorker *YtdlWorker
+
+// The status of youtube-dl job.
+const (
+	YtdlJobStatusRunning  = "running"
+	YtdlJobStatusDone     = "done"
+	YtdlJobStatusFailed   = "failed"
+	YtdlJobStatusCanceled = "canceled"
+)
+
+// YtdlWorker downloads the remote URL by youtube-dl in background, for vLive and dubbing to use the
+// file as source. The job is stored in redis, so user is able to query the progress after refreshing
+// the page.
+type YtdlWorker struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	// The cancel function of running job, key is job UUID in string, value is context.CancelFunc.
+	jobs sync.Map
+}
+
+func NewYtdlWorker() *YtdlWorker {
+	return &YtdlWorker{}
+}
+
+func (v *YtdlWorker) Handle(ctx context.Context, handler *http.ServeMux) error {
+	ep := "/terraform/v1/ytdl/create"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := func() error {
+			var token, qURL, qFormat string
+			var qResolution int
+			var qMedia bool
+			var qTags []string
+			if err := ParseBody(ctx, r.Body, &struct {
+				Token      *string   `json:"token"`
+				URL        *string   `json:"url"`
+				Format     *string   `json:"format"`
+				Resolution *int      `json:"resolution"`
+				Media      *bool     `json:"media"`
+				Tags       *[]string `json:"tags"`
+			}{
+				Token: &token, URL: &qURL, Format: &qFormat, Resolution: &qResolution,
+				Media: &qMedia, Tags: &qTags,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			job := NewYtdlJob(func(job *YtdlJob) {
+				job.URL, job.Format, job.Resolution = qURL, qFormat, qResolution
+				job.Media, job.Tags = qMedia, qTags
+			})
+			if err := job.Validate(); err != nil {
+				return errors.Wrapf(err, "validate %v", job.String())
+			}
+
+			if err := v.Create(ctx, job); err != nil {
+				return errors.Wrapf(err, "create %v", job.String())
+			}
+
+			ohttp.WriteData(ctx, w, r, job)
+			logger.Tf(ctx, "ytdl: Create job %v", job.String())
+			return nil
+		}(); err != nil {
+			ohttp.WriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/terraform/v1/ytdl/query"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := func() error {
+			var token, qUUID string
+			if err := ParseBody(ctx, r.Body, &struct {
+				Token *string `json:"token"`
+				UUID  *string `json:"uuid"`
+			}{
+				Token: &token, UUID: &qUUID,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			// Query all jobs if no uuid, for user to restore the jobs after refreshing the page.
+			if qUUID == "" {
+				jobs, err := loadYtdlJobs(ctx)
+				if err != nil {
+					return errors.Wrapf(err, "load jobs")
+				}
+
+				ohttp.WriteData(ctx, w, r, jobs)
+				logger.Tf(ctx, "ytdl: Query jobs ok, jobs=%v", len(jobs))
+				return nil
+			}
+
+			job, err := loadYtdlJob(ctx, qUUID)
+			if err != nil {
+				return errors.Wrapf(err, "load job %v", qUUID)
+			}
+			if job == nil {
+				return errors.Errorf("no job %v", qUUID)
+			}
+
+			ohttp.WriteData(ctx, w, r, job)
+			logger.Tf(ctx, "ytdl: Query job ok, %v", job.String())
+			return nil
+		}(); err != nil {
+			ohttp.WriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/terraform/v1/ytdl/cancel"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := func() error {
+			var token, qUUID string
+			if err := ParseBody(ctx, r.Body, &struct {
+				Token *string `json:"token"`
+				UUID  *string `json:"uuid"`
+			}{
+				Token: &token, UUID: &qUUID,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			job, err := loadYtdlJob(ctx, qUUID)
+			if err != nil {
+				return errors.Wrapf(err, "load job %v", qUUID)
+			}
+			if job == nil {
+				return errors.Errorf("no job %v", qUUID)
+			}
+
+			// For running job, cancel the youtube-dl process, and the job will be updated when quit. For
+			// finished job, remove the job and the file.
+			if job.Status == YtdlJobStatusRunning {
+				if cancel, ok := v.jobs.Load(job.UUID); ok {
+					cancel.(context.CancelFunc)()
+				} else {
+					job.Status, job.Error = YtdlJobStatusCanceled, "canceled"
+					if err := job.Save(ctx); err != nil {
+						return errors.Wrapf(err, "save %v", job.String())
+					}
+				}
+			} else if err := job.Remove(ctx); err != nil {
+				return errors.Wrapf(err, "remove %v", job.String())
+			}
+
+			ohttp.WriteData(ctx, w, r, nil)
+			logger.Tf(ctx, "ytdl: Cancel job ok, %v", job.String())
+			return nil
+		}(); err != nil {
+			ohttp.WriteError(ctx, w, r, err)
+		}
+	})
+
+	return nil
+}
+
+func (v *YtdlWorker) Close() error {
+	if v.cancel != nil {
+		v.cancel()
+	}
+	v.wg.Wait()
+	return nil
+}
+
+func (v *YtdlWorker) Start(ctx context.Context) error {
+	wg := &v.wg
+
+	ctx, cancel := context.WithCancel(ctx)
+	v.ctx, v.cancel = ctx, cancel
+
+	ctx = logger.WithContext(ctx)
+	logger.Tf(ctx, "ytdl: start a worker")
+
+	// The running jobs are interrupted by restarting, so mark them as failed.
+	if jobs, err := loadYtdlJobs(ctx); err != nil {
+		return errors.Wrapf(err, "load jobs")
+	} else {
+		for _, job := range jobs {
+			if job.Status != YtdlJobStatusRunning {
+				continue
+			}
+
+			job.cleanupFiles(ctx)
+			job.Status, job.Error = YtdlJobStatusFailed, "interrupted by restart"
+			if err := job.Save(ctx); err != nil {
+				return errors.Wrapf(err, "save %v", job.String())
+			}
+			logger.Tf(ctx, "ytdl: Interrupted %v", job.String())
+		}
+	}
+
+	// Cleanup the expired jobs.
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		for ctx.Err() == nil {
+			if err := v.cleanup(ctx); err != nil {
+				logger.Wf(ctx, "ignore ytdl cleanup err %+v", err)
+			}
+
+			select {
+			case <-ctx.Done():
+			case <-time.After(60 * time.Second):
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (v *YtdlWorker) cleanup(ctx context.Context) error {
+	jobs, err := loadYtdlJobs(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "load jobs")
+	}
+
+	for _, job := range jobs {
+		if job.Status == YtdlJobStatusRunning || !job.Expired() {
+			continue
+		}
+
+		if err := job.Remove(ctx); err != nil {
+			return errors.Wrapf(err, "remove %v", job.String())
+		}
+		logger.Tf(ctx, "ytdl: Cleanup expired %v", job.String())
+	}
+
+	return nil
+}
+
+// Create save the job and start it in background, which is not affected by the HTTP request.
+func (v *YtdlWorker) Create(ctx context.Context, job *YtdlJob) error {
+	job.Status = YtdlJobStatusRunning
+	if err := job.Save(ctx); err != nil {
+		return errors.Wrapf(err, "save %v", job.String())
+	}
+
+	jobCtx, jobCancel := context.WithCancel(logger.WithContext(v.ctx))
+	v.jobs.Store(job.UUID, jobCancel)
+
+	v.wg.Add(1)
+	go func() {
+		defer v.wg.Done()
+		defer v.jobs.Delete(job.UUID)
+		defer jobCancel()
+
+		if err := v.Run(jobCtx, job); err != nil {
+			logger.Wf(jobCtx, "ytdl: Job %v err %+v", job.UUID, err)
+		}
+	}()
+	return nil
+}
+
+// Run the job until done, and update the status of job. It's also used by the deprecated API, which
+// downloads the file in the HTTP request.
+func (v *YtdlWorker) Run(ctx context.Context, job *YtdlJob) (err error) {
+	job.Status = YtdlJobStatusRunning
+	defer func() {
+		if err == nil {
+			job.Status, job.Percent, job.ETA = YtdlJobStatusDone, 100, ""
+		} else {
+			job.cleanupFiles(ctx)
+			if ctx.Err() != nil {
+				job.Status, job.Error = YtdlJobStatusCanceled, "canceled"
+			} else {
+				job.Status, job.Error = YtdlJobStatusFailed, err.Error()
+			}
+		}
+
+		// Use the worker context to save the job, because the job context might be canceled.
+		if r0 := job.Save(logger.WithContext(v.ctx)); r0 != nil {
+			logger.Wf(ctx, "ytdl: ignore save %v err %+v", job.String(), r0)
+		}
+	}()
+
+	// If upload directory is symlink, eval it.
+	targetDir := dirUploadPath
+	if info, err := os.Lstat(targetDir); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		if realPath, err := filepath.EvalSymlinks(targetDir); err != nil {
+			return errors.Wrapf(err, "eval symlink %v", targetDir)
+		} else {
+			targetDir = realPath
+		}
+	}
+
+	// Use youtube-dl to download the file, print the progress in new line to parse it.
+	args := []string{
+		"--newline", "--no-playlist",
+		"--output", path.Join(targetDir, fmt.Sprintf("%v.%%(ext)s", job.UUID)),
+	}
+	if format := job.FormatSelector(); format != "" {
+		args = append(args, "--format", format, "--merge-output-format", "mp4")
+	}
+	if proxy := envYtdlProxy(); proxy != "" {
+		args = append(args, "--proxy", proxy)
+	}
+	args = append(args, job.URL)
+
+	cmd := exec.CommandContext(ctx, "youtube-dl", args...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return errors.Wrapf(err, "pipe process")
+	}
+
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+
+	if err := cmd.Start(); err != nil {
+		return errors.Wrapf(err, "run youtube-dl %v", args)
+	}
+	logger.Tf(ctx, "ytdl: Start youtube-dl pid=%v, %v", cmd.Process.Pid, job.String())
+
+	// Parse the progress, and save the job at most once per second.
+	var lastSave time.Time
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		progress := ParseYtdlProgress(scanner.Text())
+		if progress == nil {
+			continue
+		}
+
+		job.Percent, job.Total, job.Speed, job.ETA = progress.Percent, progress.Total, progress.Speed, progress.ETA
+		if time.Since(lastSave) > time.Second {
+			lastSave = time.Now()
+			if err := job.Save(ctx); err != nil {
+				logger.Wf(ctx, "ytdl: ignore save %v err %+v", job.String(), err)
+			}
+		}
+	}
+
+	if err := cmd.Wait(); err != nil {
+		return errors.Wrapf(err, "run youtube-dl %v, %v", args, strings.TrimSpace(stderr.String()))
+	}
+
+	// Find out the downloaded target file.
+	var targetFile string
+	if err := filepath.WalkDir(targetDir, func(p string, info fs.DirEntry, err error) error {
+		if err != nil {
+			return errors.Wrapf(err, "walk %v", p)
+		}
+
+		if !info.IsDir() && strings.HasPrefix(info.Name(), job.UUID) && !isYtdlTempFile(info.Name()) {
+			targetFile = path.Join(dirUploadPath, info.Name())
+			return filepath.SkipDir
+		}
+
+		return nil
+	}); err != nil {
+		return errors.Wrapf(err, "walk %v", targetDir)
+	}
+
+	if targetFile == "" {
+		return errors.Errorf("no target file %v", job.UUID)
+	}
+
+	// Get the file information.
+	targetFileInfo, err := os.Stat(targetFile)
+	if err != nil {
+		return errors.Wrapf(err, "stat %v", targetFile)
+	}
+	job.Name, job.Target, job.Size = targetFileInfo.Name(), targetFile, targetFileInfo.Size()
+
+	// Register to media library, the target file is moved to media directory.
+	if job.Media {
+		asset, dedup, err := CreateMediaAsset(ctx, targetFile, job.Name, job.Tags)
+		if err != nil {
+			return errors.Wrapf(err, "create media %v", targetFile)
+		}
+		job.Target, job.MediaUUID = asset.Target, asset.UUID
+		logger.Tf(ctx, "ytdl: Register media %v, dedup=%v", asset.String(), dedup)
+	}
+
+	logger.Tf(ctx, "ytdl: Job done %v", job.String())
+	return nil
+}
+
+// YtdlJob is a background job to download the remote URL by youtube-dl.
+type YtdlJob struct {
+	// The job UUID, also the prefix of the downloaded file.
+	UUID string `json:"uuid"`
+	// The remote URL to download.
+	URL string `json:"url"`
+	// The format selector of youtube-dl, for example, bestvideo+bestaudio. Use the default if empty.
+	Format string `json:"format,omitempty"`
+	// The max height of video, for example, 720. Ignored if format is specified.
+	Resolution int `json:"resolution,omitempty"`
+	// Whether register the file to media library.
+	Media bool `json:"media,omitempty"`
+	// The tags of media asset.
+	Tags []string `json:"tags,omitempty"`
+
+	// The status of job, running, done, failed or canceled.
+	Status string `json:"status"`
+	// The download progress in percent.
+	Percent float64 `json:"percent"`
+	// The total size, for example, 10.00MiB, reported by youtube-dl.
+	Total string `json:"total,omitempty"`
+	// The download speed, for example, 1.00MiB/s, reported by youtube-dl.
+	Speed string `json:"speed,omitempty"`
+	// The estimated time to finish, for example, 00:05.
+	ETA string `json:"eta,omitempty"`
+	// The error message, for failed job.
+	Error string `json:"error,omitempty"`
+
+	// The downloaded file name.
+	Name string `json:"name,omitempty"`
+	// The target file, in dirUploadPath, or in dirMediaPath if registered to media library. It's
+	// used as ytdl source by vLive and dubbing.
+	Target string `json:"target,omitempty"`
+	// The file size in bytes.
+	Size int64 `json:"size,omitempty"`
+	// The media asset UUID, if registered to media library.
+	MediaUUID string `json:"mediaUUID,omitempty"`
+
+	// The create time.
+	Created string `json:"created"`
+	// The last update time.
+	Update string `json:"update"`
+	// The expire time, the job and file will be removed after it.
+	Expires string `json:"expires"`
+}
+
+func NewYtdlJob(opts ...func(*YtdlJob)) *YtdlJob {
+	v := &YtdlJob{
+		UUID: uuid.NewString(),
+	}
+
+	// If the downloaded file is not used for a long time, remove it.
+	duration := 24 * time.Hour
+	if envNodeEnv() == "development" {
+		duration = time.Duration(300) * time.Second
+	}
+
+	now := time.Now()
+	v.Created = now.Format(time.RFC3339)
+	v.Update = v.Created
+	v.Expires = now.Add(duration).Format(time.RFC3339)
+
+	for _, opt := range opts {
+		opt(v)
+	}
+	return v
+}
+
+func (v *YtdlJob) String() string {
+	return fmt.Sprintf("uuid=%v, url=%v, format=%v, resolution=%v, media=%v, status=%v, percent=%v, eta=%v, target=%v, error=%v",
+		v.UUID, v.URL, v.Format, v.Resolution, v.Media, v.Status, v.Percent, v.ETA, v.Target, v.Error,
+	)
+}
+
+func (v *YtdlJob) Validate() error {
+	if !strings.HasPrefix(v.URL, "http://") && !strings.HasPrefix(v.URL, "https://") {
+		return errors.Errorf("invalid url %v", v.URL)
+	}
+	if v.Format != "" && !ytdlFormatRegex.MatchString(v.Format) {
+		return errors.Errorf("invalid format %v", v.Format)
+	}
+	if v.Resolution < 0 {
+		return errors.Errorf("invalid resolution %v", v.Resolution)
+	}
+	return nil
+}
+
+// The format selector only allows the characters of youtube-dl format syntax.
+var ytdlFormatRegex = regexp.MustCompile(`^[\w\-+/\[\]<>=!*?.,:^$~ ]+$`)
+
+// FormatSelector build the format of youtube-dl, by the format or resolution.
+func (v *YtdlJob) FormatSelector() string {
+	if v.Format != "" {
+		return v.Format
+	}
+	if v.Resolution > 0 {
+		return fmt.Sprintf("bestvideo[height<=%v]+bestaudio/best[height<=%v]", v.Resolution, v.Resolution)
+	}
+	return ""
+}
+
+func (v *YtdlJob) Expired() bool {
+	expires, err := time.Parse(time.RFC3339, v.Expires)
+	return err != nil || time.Now().After(expires)
+}
+
+func (v *YtdlJob) Save(ctx context.Context) error {
+	v.Update = time.Now().Format(time.RFC3339)
+	if b, err := json.Marshal(v); err != nil {
+		return errors.Wrapf(err, "marshal %v", v.String())
+	} else if err = rdb.HSet(ctx, SRS_YTDL_JOB, v.UUID, string(b)).Err(); err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hset %v %v %v", SRS_YTDL_JOB, v.UUID, string(b))
+	}
+	return nil
+}
+
+// Remove the job and files. Note that the target file might be moved by user, for example, vLive
+// moves it to dirVLivePath, and the file in media library is not removed.
+func (v *YtdlJob) Remove(ctx context.Context) error {
+	v.cleanupFiles(ctx)
+
+	if err := rdb.HDel(ctx, SRS_YTDL_JOB, v.UUID).Err(); err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hdel %v %v", SRS_YTDL_JOB, v.UUID)
+	}
+	return nil
+}
+
+// Remove all files created by youtube-dl, including the temporary files, in dirUploadPath.
+func (v *YtdlJob) cleanupFiles(ctx context.Context) {
+	// The upload directory is a symlink, and WalkDir never follows the root symlink.
+	uploadDir := dirUploadPath
+	if realPath, err := filepath.EvalSymlinks(uploadDir); err != nil {
+		logger.Wf(ctx, "ytdl: ignore eval symlink %v err %+v", uploadDir, err)
+		return
+	} else {
+		uploadDir = realPath
+	}
+
+	filepath.WalkDir(uploadDir, func(p string, info fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+
+		if !info.IsDir() && strings.HasPrefix(info.Name(), v.UUID) {
+			if _, err := os.Stat(p); err == nil {
+				os.Remove(p)
+				logger.Tf(ctx, "ytdl: remove %v of job %v", p, v.UUID)
+			}
+		}
+
+		return nil
+	})
+}
+
+// Load the job by UUID, nil if not exists.
+func loadYtdlJob(ctx context.Context, jobUUID string) (*YtdlJob, error) {
+	var job YtdlJob
+	if b, err := rdb.HGet(ctx, SRS_YTDL_JOB, jobUUID).Result(); err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hget %v %v", SRS_YTDL_JOB, jobUUID)
+	} else if b == "" {
+		return nil, nil
+	} else if err = json.Unmarshal([]byte(b), &job); err != nil {
+		return nil, errors.Wrapf(err, "unmarshal %v", b)
+	}
+	return &job, nil
+}
+
+// Load all jobs, sorted by create time.
+func loadYtdlJobs(ctx context.Context) ([]*YtdlJob, error) {
+	objs, err := rdb.HGetAll(ctx, SRS_YTDL_JOB).Result()
+	if err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hgetall %v", SRS_YTDL_JOB)
+	}
+
+	jobs := []*YtdlJob{}
+	for jobUUID, obj := range objs {
+		var job YtdlJob
+		if err := json.Unmarshal([]byte(obj), &job); err != nil {
+			return nil, errors.Wrapf(err, "unmarshal %v %v", jobUUID, obj)
+		}
+		jobs = append(jobs, &job)
+	}
+
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].Created < jobs[j].Created
+	})
+	return jobs, nil
+}
+
+// Whether the file is temporary file of youtube-dl, for example, xxx.mp4.part, xxx.f137.mp4 or
+// xxx.mp4.ytdl, which is not the final file.
+func isYtdlTempFile(name string) bool {
+	if strings.HasSuffix(name, ".part") || strings.HasSuffix(name, ".ytdl") || strings.HasSuffix(name, ".temp.mp4") {
+		return true
+	}
+	return ytdlFragmentRegex.MatchString(name)
+}
+
+var ytdlFragmentRegex = regexp.MustCompile(`\.f\d+\.\w+$`)
+
+// YtdlProgress is the progress of youtube-dl download.
+type YtdlProgress struct {
+	Percent float64
+	Total   string
+	Speed   string
+	ETA     string
+}
+
+var ytdlProgressRegex = regexp.MustCompile(`^\[download\]\s+([\d.]+)%\s+of\s+~?\s*(\S+)(?:\s+at\s+(\S+))?(?:\s+ETA\s+(\S+))?`)
+
+// ParseYtdlProgress parse the progress line of youtube-dl with --newline, for example:
+//
+//	[download]  45.3% of 10.00MiB at  1.00MiB/s ETA 00:05
+//	[download] 100% of 10.00MiB in 00:03
+//
+// Return nil if not a progress line.
+func ParseYtdlProgress(line string) *YtdlProgress {
+	matches := ytdlProgressRegex.FindStringSubmatch(strings.TrimSpace(line))
+	if matches == nil {
+		return nil
+	}
+
+	percent, err := strconv.ParseFloat(matches[1], 64)
+	if err != nil {
+		return nil
+	}
+
+	return &YtdlProgress{Percent: percent, Total: matches[2], Speed: matches[3], ETA: matches[4]}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestYtdl_ParseProgress(t *testing.T) {
+	if p := ParseYtdlProgress("[download]  45.3% of 10.00MiB at  1.00MiB/s ETA 00:05"); p == nil {
+		t.Errorf("should parse progress")
+	} else if p.Percent != 45.3 || p.Total != "10.00MiB" || p.Speed != "1.00MiB/s" || p.ETA != "00:05" {
+		t.Errorf("invalid progress %v", p)
+	}
+
+	if p := ParseYtdlProgress("[download] 100% of ~10.00MiB in 00:03"); p == nil {
+		t.Errorf("should parse progress")
+	} else if p.Percent != 100 || p.Total != "10.00MiB" || p.ETA != "" {
+		t.Errorf("invalid progress %v", p)
+	}
+
+	if p := ParseYtdlProgress("[download] Destination: xxx.mp4"); p != nil {
+		t.Errorf("should not parse %v", p)
+	}
+}
+
+func TestYtdl_FormatSelector(t *testing.T) {
+	if v := (&YtdlJob{Resolution: 720}).FormatSelector(); v != "bestvideo[height<=720]+bestaudio/best[height<=720]" {
+		t.Errorf("invalid format %v", v)
+	}
+	if v := (&YtdlJob{Format: "best", Resolution: 720}).FormatSelector(); v != "best" {
+		t.Errorf("invalid format %v", v)
+	}
+
+	if err := (&YtdlJob{URL: "https://youtu.be/xxx", Format: "best; rm -rf"}).Validate(); err == nil {
+		t.Errorf("should fail for invalid format")
+	}
+	if isYtdlTempFile("xxx.mp4") || !isYtdlTempFile("xxx.f137.mp4") || !isYtdlTempFile("xxx.mp4.part") {
+		t.Errorf("invalid temp file check")
+	}
+}
+
+func TestYtdl_CleanupFilesSymlink(t *testing.T) {
+	dir := t.TempDir()
+	realDir := path.Join(dir, "data")
+	if err := os.MkdirAll(realDir, 0755); err != nil {
+		t.Errorf("mkdir err %+v", err)
+		return
+	}
+
+	// The upload directory is a symlink to the data directory.
+	uploadDir := path.Join(dir, "upload")
+	if err := os.Symlink(realDir, uploadDir); err != nil {
+		t.Errorf("symlink err %+v", err)
+		return
+	}
+
+	jobFile, otherFile := path.Join(realDir, "job-uuid.mp4.part"), path.Join(realDir, "other.mp4")
+	for _, f := range []string{jobFile, otherFile} {
+		if err := os.WriteFile(f, []byte("data"), 0644); err != nil {
+			t.Errorf("write err %+v", err)
+			return
+		}
+	}
+
+	previous := dirUploadPath
+	dirUploadPath = uploadDir
+	defer func() {
+		dirUploadPath = previous
+	}()
+
+	(&YtdlJob{UUID: "job-uuid"}).cleanupFiles(context.Background())
+	if _, err := os.Stat(jobFile); err == nil {
+		t.Errorf("should remove %v", jobFile)
+	}
+	if _, err := os.Stat(otherFile); err != nil {
+		t.Errorf("should keep %v", otherFile)
+	}
+}